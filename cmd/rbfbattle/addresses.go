@@ -1,23 +1,114 @@
 package main
 
 import (
+	"crypto/sha256"
 	"encoding/csv"
+	"encoding/hex"
 	"fmt"
-	"log"
+	"log/slog"
 	"os"
 	"strings"
+	"sync"
+
+	"github.com/btcsuite/btcd/btcec/v2"
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/btcutil/hdkeychain"
+	"github.com/btcsuite/btcd/txscript"
 )
 
 type PrivateKey struct {
 	PrivateKeyHex string
 }
 
-// Map to store our addresses and private keys
-var ourAddresses = make(map[string]string) // address -> private key (WIF)
+// Map to store the output scripts we watch and their private keys. Outputs are matched on
+// their raw script, without encoding an address, so scripts without one like pay-to-pubkey
+// are watched too.
+var (
+	ourScripts   = make(map[string]string) // scriptPubKey -> private key (hex)
+	ourScriptsMu sync.RWMutex
+)
+
+// watchedScriptKey returns the private key of a watched output script
+func watchedScriptKey(script []byte) (string, bool) {
+	ourScriptsMu.RLock()
+	defer ourScriptsMu.RUnlock()
+
+	key, ok := ourScripts[string(script)]
+	return key, ok
+}
+
+// watchScript starts watching an output script we have the private key for
+func watchScript(script []byte, privateKey string) {
+	ourScriptsMu.Lock()
+	ourScripts[string(script)] = privateKey
+	ourScriptsMu.Unlock()
+}
+
+// unwatchScript stops watching an output script
+func unwatchScript(script []byte) {
+	ourScriptsMu.Lock()
+	delete(ourScripts, string(script))
+	ourScriptsMu.Unlock()
+}
+
+// watchedKey returns the private key of a watched address
+func watchedKey(address string) (string, bool) {
+	script, err := addressScript(address)
+	if err != nil {
+		return "", false
+	}
+	return watchedScriptKey(script)
+}
+
+// watchAddress starts watching the output script of an address we have the private key for
+func watchAddress(address, privateKey string) error {
+	script, err := addressScript(address)
+	if err != nil {
+		return err
+	}
+	watchScript(script, privateKey)
+	return nil
+}
+
+// unwatchAddress stops watching the output script of an address
+func unwatchAddress(address string) {
+	if script, err := addressScript(address); err == nil {
+		unwatchScript(script)
+	}
+}
+
+// addressScript returns the output script paying to an address
+func addressScript(address string) ([]byte, error) {
+	decoded, err := btcutil.DecodeAddress(address, network)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding address %s: %v", address, err)
+	}
+	return txscript.PayToAddrScript(decoded)
+}
+
+// payToPubKeyScripts returns the pay-to-pubkey output scripts of a private key, with the
+// compressed and the uncompressed public key. They have no address, so only the key finds them.
+func payToPubKeyScripts(privateKey string) ([][]byte, error) {
+	keyBytes, err := hex.DecodeString(privateKey)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding private key: %v", err)
+	}
+	_, pubKey := btcec.PrivKeyFromBytes(keyBytes)
+
+	var scripts [][]byte
+	for _, serialized := range [][]byte{pubKey.SerializeCompressed(), pubKey.SerializeUncompressed()} {
+		script, err := txscript.NewScriptBuilder().AddData(serialized).AddOp(txscript.OP_CHECKSIG).Script()
+		if err != nil {
+			return nil, err
+		}
+		scripts = append(scripts, script)
+	}
+	return scripts, nil
+}
 
 // loadAddressesAndKeys loads our addresses and private keys from the CSV file
 func loadAddressesAndKeys(filename string) error {
-	log.Printf("Loading addresses and keys from %s", filename)
+	slog.Info("Loading addresses and keys", "file", filename)
 	// Open the CSV file
 	file, err := os.Open(filename)
 	if err != nil {
@@ -46,9 +137,10 @@ func loadAddressesAndKeys(filename string) error {
 	}
 
 	// Process each record
+	var skipped int
 	for _, record := range records {
 		if len(record) < 2 {
-			log.Printf("Warning: Skipping invalid record: %v", record)
+			slog.Warn("Skipping invalid record", "record", record)
 			continue
 		}
 
@@ -61,13 +153,189 @@ func loadAddressesAndKeys(filename string) error {
 		p2tr := record[5]
 
 		// Add to our map
-		ourAddresses[p2pkh] = wif
-		ourAddresses[p2pkhCompressed] = wif
-		ourAddresses[p2sh] = wif
-		ourAddresses[p2wpkh] = wif
-		ourAddresses[p2tr] = wif
+		for _, address := range []string{p2pkh, p2pkhCompressed, p2sh, p2wpkh, p2tr} {
+			if err := watchAddress(address, wif); err != nil {
+				skipped++
+			}
+		}
+
+		scripts, err := payToPubKeyScripts(wif)
+		if err != nil {
+			slog.Warn("Skipping invalid private key", "err", err)
+			continue
+		}
+		for _, script := range scripts {
+			watchScript(script, wif)
+		}
+	}
+	if skipped > 0 {
+		slog.Warn("Skipped addresses that are not for the network", "count", skipped, "network", network.Name)
 	}
 
-	log.Printf("Loaded %d addresses from %s", len(ourAddresses), filename)
+	ourScriptsMu.RLock()
+	count := len(ourScripts)
+	ourScriptsMu.RUnlock()
+
+	slog.Info("Loaded scripts", "count", count, "file", filename)
 	return nil
 }
+
+// maxDescriptorRange is the most addresses of a ranged descriptor we watch
+const maxDescriptorRange = 100_000
+
+// watchedDescriptor is a descriptor added at runtime. Only its public form is kept.
+type watchedDescriptor struct {
+	public    string
+	addresses []string
+}
+
+var (
+	// watchedDescriptors are the descriptors added at runtime by descriptorID
+	watchedDescriptors   = make(map[string]*watchedDescriptor)
+	watchedDescriptorsMu sync.Mutex
+)
+
+// watchDescriptor starts watching the addresses of a descriptor over a WIF private key, or
+// the first count addresses of a descriptor over an extended private key ending with /*.
+// It returns the ID of the descriptor and the number of addresses.
+func watchDescriptor(descriptor string, count uint32) (string, int, error) {
+	if count == 0 || count > maxDescriptorRange {
+		return "", 0, fmt.Errorf("range must be between 1 and %d", maxDescriptorRange)
+	}
+
+	keys, err := descriptorKeys(descriptor, count)
+	if err != nil {
+		return "", 0, err
+	}
+	public, err := publicDescriptor(descriptor)
+	if err != nil {
+		return "", 0, err
+	}
+	id := descriptorID(descriptor)
+
+	watchedDescriptorsMu.Lock()
+	defer watchedDescriptorsMu.Unlock()
+
+	if _, ok := watchedDescriptors[id]; ok {
+		return "", 0, fmt.Errorf("descriptor is already watched")
+	}
+
+	addresses := make([]string, 0, len(keys))
+	for address, key := range keys {
+		if err := watchAddress(address, key); err != nil {
+			slog.Warn("Skipping address of descriptor", "err", err)
+			continue
+		}
+		addresses = append(addresses, address)
+	}
+	watchedDescriptors[id] = &watchedDescriptor{public: public, addresses: addresses}
+
+	slog.Info("Watching descriptor", "id", id, "addresses", len(addresses))
+	return id, len(addresses), nil
+}
+
+// unwatchDescriptor stops watching the addresses of a descriptor added with watchDescriptor
+func unwatchDescriptor(id string) bool {
+	watchedDescriptorsMu.Lock()
+	defer watchedDescriptorsMu.Unlock()
+
+	watched, ok := watchedDescriptors[id]
+	if !ok {
+		return false
+	}
+	for _, address := range watched.addresses {
+		unwatchAddress(address)
+	}
+	delete(watchedDescriptors, id)
+
+	slog.Info("Stopped watching descriptor", "id", id, "addresses", len(watched.addresses))
+	return true
+}
+
+// descriptorID identifies a private key descriptor without revealing it
+func descriptorID(descriptor string) string {
+	descriptor, _, _ = strings.Cut(strings.TrimSpace(descriptor), "#")
+	hash := sha256.Sum256([]byte(descriptor))
+	return hex.EncodeToString(hash[:8])
+}
+
+// publicDescriptor returns a private key descriptor with the public key in place of the
+// private one, keeping the key origin and path. The checksum is dropped as it no longer matches.
+func publicDescriptor(descriptor string) (string, error) {
+	descriptor, _, _ = strings.Cut(strings.TrimSpace(descriptor), "#")
+	_, inner, err := splitDescriptor(descriptor)
+	if err != nil {
+		return "", err
+	}
+
+	private, _, _ := strings.Cut(inner, "/")
+	var public string
+	if private == inner {
+		wif, err := btcutil.DecodeWIF(private)
+		if err != nil {
+			return "", fmt.Errorf("error parsing WIF private key: %v", err)
+		}
+		public = hex.EncodeToString(wif.SerializePubKey())
+	} else {
+		key, err := hdkeychain.NewKeyFromString(private)
+		if err != nil {
+			return "", fmt.Errorf("error parsing extended key: %v", err)
+		}
+		neutered, err := key.Neuter()
+		if err != nil {
+			return "", err
+		}
+		public = neutered.String()
+	}
+
+	return strings.Replace(descriptor, private, public, 1), nil
+}
+
+// descriptorKeys returns the addresses of a private key descriptor with their hex private keys
+func descriptorKeys(descriptor string, count uint32) (map[string]string, error) {
+	scriptType, inner, err := splitDescriptor(descriptor)
+	if err != nil {
+		return nil, err
+	}
+
+	var keys []*btcec.PrivateKey
+	if !strings.Contains(inner, "/") {
+		wif, err := btcutil.DecodeWIF(inner)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing WIF private key: %v", err)
+		}
+		if !wif.IsForNet(network) {
+			return nil, fmt.Errorf("private key is not for %s", network.Name)
+		}
+		keys = append(keys, wif.PrivKey)
+	} else {
+		desc, err := parseExtendedDescriptor(descriptor)
+		if err != nil {
+			return nil, err
+		}
+		if !desc.key.IsPrivate() {
+			return nil, fmt.Errorf("watched descriptor must use an extended private key")
+		}
+		for i := uint32(0); i < count; i++ {
+			child, err := desc.deriveKey(i)
+			if err != nil {
+				return nil, err
+			}
+			key, err := child.ECPrivKey()
+			if err != nil {
+				return nil, err
+			}
+			keys = append(keys, key)
+		}
+	}
+
+	addresses := make(map[string]string, len(keys))
+	for _, key := range keys {
+		address, err := addressForPubKey(scriptType, key.PubKey())
+		if err != nil {
+			return nil, err
+		}
+		addresses[address.EncodeAddress()] = hex.EncodeToString(key.Serialize())
+	}
+	return addresses, nil
+}
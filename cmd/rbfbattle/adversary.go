@@ -0,0 +1,376 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log/slog"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/btcsuite/btcd/btcec/v2"
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/rpcclient"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+)
+
+// AdversaryConfig scripts how a counterpart answers our spends of a contested utxo
+type AdversaryConfig struct {
+	Name string
+
+	// A bid pays FeeMultiplier times our fee rate plus FeeRateIncrement sat/vbyte,
+	// and never less than the replacement rules require.
+	FeeMultiplier    float64
+	FeeRateIncrement float64
+
+	// ExtraInput adds the counterpart's own coins so the fee can exceed the utxo value
+	// without the output turning into dust
+	ExtraInput bool
+
+	// BurnAfter burns the utxo to OP_RETURN from this round on. 0 never burns up front.
+	BurnAfter int
+	// BurnWhenBeaten burns the utxo instead of giving up when a bid can't be afforded
+	BurnWhenBeaten bool
+
+	// MaxFeeRatio caps the fee at this fraction of the utxo value. 0 means no cap.
+	MaxFeeRatio float64
+	// MaxRounds gives up after answering this many times. 0 means no limit.
+	MaxRounds int
+	// Delay is the reaction time before answering
+	Delay time.Duration
+}
+
+// simpleBumper bumps with one input and one output and gives up when the output would be dust
+func simpleBumper() AdversaryConfig {
+	return AdversaryConfig{
+		Name:             "simple",
+		FeeMultiplier:    1.1,
+		FeeRateIncrement: 1,
+		MaxFeeRatio:      1,
+	}
+}
+
+// inputBumper adds a second input so it can spend the full utxo value on fees
+func inputBumper() AdversaryConfig {
+	return AdversaryConfig{
+		Name:             "input",
+		FeeMultiplier:    1.1,
+		FeeRateIncrement: 1,
+		ExtraInput:       true,
+		MaxFeeRatio:      1,
+	}
+}
+
+// burner spends the full utxo value on fees with an OP_RETURN output as soon as it's contested
+func burner() AdversaryConfig {
+	return AdversaryConfig{
+		Name:        "burner",
+		BurnAfter:   1,
+		MaxFeeRatio: 1,
+	}
+}
+
+// parseAdversaryConfig parses "simple", "input", "burner" or a custom adversary such as
+// "custom:multiplier=1.5,increment=2,input,burn=3,beaten,maxfee=0.5,rounds=10,delay=200ms"
+func parseAdversaryConfig(spec string) (AdversaryConfig, error) {
+	switch spec {
+	case "simple":
+		return simpleBumper(), nil
+	case "input":
+		return inputBumper(), nil
+	case "burner":
+		return burner(), nil
+	}
+
+	options, ok := strings.CutPrefix(spec, "custom:")
+	if !ok {
+		return AdversaryConfig{}, fmt.Errorf("unknown adversary %s", spec)
+	}
+
+	config := simpleBumper()
+	config.Name = spec
+
+	for _, option := range strings.Split(options, ",") {
+		key, value, _ := strings.Cut(strings.TrimSpace(option), "=")
+
+		var err error
+		switch key {
+		case "multiplier":
+			config.FeeMultiplier, err = strconv.ParseFloat(value, 64)
+		case "increment":
+			config.FeeRateIncrement, err = strconv.ParseFloat(value, 64)
+		case "input":
+			config.ExtraInput = true
+		case "burn":
+			config.BurnAfter, err = strconv.Atoi(value)
+		case "beaten":
+			config.BurnWhenBeaten = true
+		case "maxfee":
+			config.MaxFeeRatio, err = strconv.ParseFloat(value, 64)
+		case "rounds":
+			config.MaxRounds, err = strconv.Atoi(value)
+		case "delay":
+			config.Delay, err = time.ParseDuration(value)
+		default:
+			return AdversaryConfig{}, fmt.Errorf("unknown adversary option %s", key)
+		}
+		if err != nil {
+			return AdversaryConfig{}, fmt.Errorf("invalid adversary option %s: %v", option, err)
+		}
+	}
+
+	return config, nil
+}
+
+// Coin is an output a counterpart holds the key for
+type Coin struct {
+	OutPoint wire.OutPoint
+	Output   *wire.TxOut
+	Key      *btcec.PrivateKey
+}
+
+// Adversary is a counterpart bot fighting over a utxo it holds the key for
+type Adversary struct {
+	AdversaryConfig
+
+	coin   Coin
+	extra  []Coin
+	payTo  []byte
+	burnTo []byte
+
+	mu     sync.Mutex
+	rounds int
+	sent   map[chainhash.Hash]bool
+}
+
+// newAdversary creates a counterpart fighting over coin, sweeping it to payTo.
+// Extra coins are only spent by adversaries adding inputs.
+func newAdversary(config AdversaryConfig, coin Coin, extra []Coin, payTo []byte) *Adversary {
+	burnTo, _ := txscript.NullDataScript([]byte("burned by " + config.Name))
+
+	return &Adversary{
+		AdversaryConfig: config,
+		coin:            coin,
+		extra:           extra,
+		payTo:           payTo,
+		burnTo:          burnTo,
+		sent:            make(map[chainhash.Hash]bool),
+	}
+}
+
+// Sent checks if a transaction is one of the adversary's
+func (a *Adversary) Sent(txHash chainhash.Hash) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.sent[txHash]
+}
+
+// Respond returns the answer to our spend paying fee, or nil when the adversary gives up
+func (a *Adversary) Respond(ours *wire.MsgTx, fee btcutil.Amount) (*wire.MsgTx, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.MaxRounds > 0 && a.rounds >= a.MaxRounds {
+		return nil, nil
+	}
+	a.rounds++
+
+	var tx *wire.MsgTx
+	var err error
+	if a.BurnAfter > 0 && a.rounds >= a.BurnAfter {
+		tx, err = a.burn(ours, fee)
+	} else {
+		tx, err = a.bid(ours, fee)
+		if err == nil && tx == nil && a.BurnWhenBeaten {
+			tx, err = a.burn(ours, fee)
+		}
+	}
+
+	if tx != nil {
+		a.sent[tx.TxHash()] = true
+	}
+	return tx, err
+}
+
+// bid outbids ours, or returns nil if it can't be afforded
+func (a *Adversary) bid(ours *wire.MsgTx, fee btcutil.Amount) (*wire.MsgTx, error) {
+	coins := []Coin{a.coin}
+	if a.ExtraInput {
+		coins = append(coins, a.extra...)
+	}
+
+	var available btcutil.Amount
+	for _, coin := range coins {
+		available += btcutil.Amount(coin.Output.Value)
+	}
+
+	// Sign once to learn the size. Signatures may vary by a byte.
+	tx, err := a.sweep(coins, wire.NewTxOut(int64(available-fee), a.payTo))
+	if err != nil {
+		return nil, err
+	}
+	vsize := float64(txVirtualSize(tx) + 1)
+
+	feeRate := float64(fee) / float64(txVirtualSize(ours))
+	bidFee := btcutil.Amount(math.Ceil(max(
+		float64(fee)+incrementalRelayFeeRate*vsize,
+		(feeRate*a.FeeMultiplier+a.FeeRateIncrement)*vsize,
+	)))
+
+	if !a.affordable(bidFee) || available-bidFee < dustThreshold(a.payTo) {
+		return nil, nil
+	}
+
+	return a.sweep(coins, wire.NewTxOut(int64(available-bidFee), a.payTo))
+}
+
+// burn spends the whole utxo on fees, or returns nil if that doesn't outbid ours
+func (a *Adversary) burn(ours *wire.MsgTx, fee btcutil.Amount) (*wire.MsgTx, error) {
+	tx, err := a.sweep([]Coin{a.coin}, wire.NewTxOut(0, a.burnTo))
+	if err != nil {
+		return nil, err
+	}
+
+	burnFee := btcutil.Amount(a.coin.Output.Value)
+	minFee := fee + btcutil.Amount(math.Ceil(incrementalRelayFeeRate*float64(txVirtualSize(tx))))
+	if !a.affordable(burnFee) || burnFee < minFee {
+		return nil, nil
+	}
+	return tx, nil
+}
+
+func (a *Adversary) affordable(fee btcutil.Amount) bool {
+	return a.MaxFeeRatio == 0 || float64(fee) <= a.MaxFeeRatio*float64(a.coin.Output.Value)
+}
+
+// sweep builds and signs a transaction spending coins to a single output
+func (a *Adversary) sweep(coins []Coin, output *wire.TxOut) (*wire.MsgTx, error) {
+	tx := wire.NewMsgTx(2)
+	for _, coin := range coins {
+		tx.AddTxIn(wire.NewTxIn(&coin.OutPoint, nil, nil))
+	}
+	tx.AddTxOut(output)
+
+	if err := signCoins(tx, coins); err != nil {
+		return nil, err
+	}
+	return tx, nil
+}
+
+// signCoins signs the P2PKH, P2WPKH and P2TR inputs of tx spending coins, in order
+func signCoins(tx *wire.MsgTx, coins []Coin) error {
+	prevOuts := txscript.NewMultiPrevOutFetcher(nil)
+	for _, coin := range coins {
+		prevOuts.AddPrevOut(coin.OutPoint, coin.Output)
+	}
+	sigHashes := txscript.NewTxSigHashes(tx, prevOuts)
+
+	for i, coin := range coins {
+		script := coin.Output.PkScript
+
+		switch txscript.GetScriptClass(script) {
+		case txscript.PubKeyHashTy:
+			sigScript, err := txscript.SignatureScript(tx, i, script, txscript.SigHashAll, coin.Key, true)
+			if err != nil {
+				return err
+			}
+			tx.TxIn[i].SignatureScript = sigScript
+		case txscript.WitnessV0PubKeyHashTy:
+			witness, err := txscript.WitnessSignature(tx, sigHashes, i, coin.Output.Value, script, txscript.SigHashAll, coin.Key, true)
+			if err != nil {
+				return err
+			}
+			tx.TxIn[i].Witness = witness
+		case txscript.WitnessV1TaprootTy:
+			witness, err := txscript.TaprootWitnessSignature(tx, sigHashes, i, coin.Output.Value, script, txscript.SigHashDefault, coin.Key)
+			if err != nil {
+				return err
+			}
+			tx.TxIn[i].Witness = witness
+		default:
+			return fmt.Errorf("unsupported script %x", script)
+		}
+	}
+
+	return nil
+}
+
+// Run answers spends of the contested utxo published as rawtx on the ZMQ endpoint until stop is closed
+func (a *Adversary) Run(client *rpcclient.Client, endpoint string, stop <-chan struct{}) error {
+	subscriber, err := newZMQSubscriber(endpoint)
+	if err != nil {
+		return fmt.Errorf("error connecting to %s: %v", endpoint, err)
+	}
+	defer subscriber.Close()
+
+	if err := subscriber.Subscribe("rawtx"); err != nil {
+		return err
+	}
+	subscriber.SetRecvTimeout(100 * time.Millisecond)
+
+	for {
+		select {
+		case <-stop:
+			return nil
+		default:
+		}
+
+		msgs, err := subscriber.Recv()
+		if err != nil || len(msgs) < 2 {
+			continue
+		}
+
+		tx := wire.NewMsgTx(2)
+		if err := tx.Deserialize(bytes.NewReader(msgs[1])); err != nil {
+			continue
+		}
+		if !msgTxSpends(tx, a.coin.OutPoint) || a.Sent(tx.TxHash()) {
+			continue
+		}
+
+		a.answer(client, tx)
+	}
+}
+
+// answer responds to our spend if it's still in the mempool
+func (a *Adversary) answer(client *rpcclient.Client, ours *wire.MsgTx) {
+	time.Sleep(a.Delay)
+
+	txHash := ours.TxHash()
+	entry, err := client.GetMempoolEntry(txHash.String())
+	if err != nil {
+		// Already replaced or confirmed
+		return
+	}
+	fee, _ := btcutil.NewAmount(entry.Fees.Base)
+
+	tx, err := a.Respond(ours, fee)
+	if err != nil {
+		slog.Error("Adversary failed to answer", "adversary", a.Name, "txid", txHash, "err", err)
+		return
+	}
+	if tx == nil {
+		slog.Debug("Adversary gives up", "adversary", a.Name, "txid", txHash)
+		return
+	}
+
+	if _, err := client.SendRawTransaction(tx, true); err != nil {
+		slog.Debug("Adversary answer was rejected", "adversary", a.Name, "txid", txHash, "err", err)
+		return
+	}
+	slog.Debug("Adversary answered", "adversary", a.Name, "txid", txHash, "answer", tx.TxHash())
+}
+
+// msgTxSpends checks if tx spends outpoint
+func msgTxSpends(tx *wire.MsgTx, outpoint wire.OutPoint) bool {
+	for _, txIn := range tx.TxIn {
+		if txIn.PreviousOutPoint == outpoint {
+			return true
+		}
+	}
+	return false
+}
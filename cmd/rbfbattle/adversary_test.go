@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/btcec/v2"
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+)
+
+// contest lets an adversary fight the bot over a new watched utxo and returns the spend that confirmed
+func contest(t *testing.T, b *battle, config AdversaryConfig) *wire.MsgTx {
+	t.Helper()
+
+	key, script := b.watch(t)
+	funding := b.send(t, script, 100_000)
+	coin := Coin{OutPoint: wire.OutPoint{Hash: funding.TxHash(), Index: 0}, Output: funding.TxOut[0], Key: key}
+
+	extraKey, _ := btcec.NewPrivateKey()
+	extraScript := p2wpkhScript(extraKey)
+	extra := Coin{OutPoint: b.node.Fund(extraScript, 200_000), Output: wire.NewTxOut(200_000, extraScript), Key: extraKey}
+
+	payToKey, _ := btcec.NewPrivateKey()
+	adversary := newAdversary(config, coin, []Coin{extra}, p2wpkhScript(payToKey))
+
+	client, err := b.node.Client()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Shutdown()
+
+	stop := make(chan struct{})
+	done := make(chan error)
+	go func() { done <- adversary.Run(client, b.node.ZMQEndpoint(), stop) }()
+	defer func() {
+		close(stop)
+		if err := <-done; err != nil {
+			t.Error(err)
+		}
+	}()
+
+	// The battle is over when the spend hasn't changed for a while
+	var last wire.MsgTx
+	settled := time.Now()
+	waitFor(t, "battle to settle", func() bool {
+		spend, ok := b.node.Spender(coin.OutPoint)
+		if !ok {
+			return false
+		}
+		if spend.TxHash() != last.TxHash() {
+			last, settled = *spend, time.Now()
+		}
+		return time.Since(settled) > 500*time.Millisecond
+	})
+
+	for _, tx := range b.node.MineBlock() {
+		if msgTxSpends(tx, coin.OutPoint) {
+			waitFor(t, "battle to end", func() bool {
+				_, ok := getMonitored(coin.OutPoint.String())
+				return !ok
+			})
+			return tx
+		}
+	}
+	t.Fatal("contested utxo was not spent")
+	return nil
+}
+
+func p2wpkhScript(key *btcec.PrivateKey) []byte {
+	script, _ := txscript.NewScriptBuilder().
+		AddOp(txscript.OP_0).
+		AddData(btcutil.Hash160(key.PubKey().SerializeCompressed())).
+		Script()
+	return script
+}
+
+// outcome classifies the confirmed spend of a contested utxo. A burn is ours if it carries
+// our burn message.
+func outcome(b *battle, spend *wire.MsgTx) string {
+	ourBurn, _ := txscript.NullDataScript([]byte(b.config.BurnMessage))
+	switch {
+	case paysTo(spend, b.destination):
+		return "won"
+	case bytes.Equal(spend.TxOut[0].PkScript, ourBurn):
+		return "burned by us"
+	case txscript.IsUnspendable(spend.TxOut[0].PkScript):
+		return "burned by them"
+	default:
+		return "lost"
+	}
+}
+
+func TestAdversaries(t *testing.T) {
+	b := startBattle(t)
+
+	for _, test := range []struct {
+		config  AdversaryConfig
+		outcome string
+	}{
+		// Our two-input replacements are larger, so we reach the utxo value first and burn it
+		{simpleBumper(), "burned by us"},
+		// It gives up at its fee cap before we have to burn
+		{inputBumper(), "won"},
+		// A burn of the whole utxo value can't be outbid
+		{burner(), "burned by them"},
+	} {
+		t.Run(test.config.Name, func(t *testing.T) {
+			if result := outcome(b, contest(t, b, test.config)); result != test.outcome {
+				t.Errorf("battle against %s %s, expected %s", test.config.Name, result, test.outcome)
+			}
+		})
+	}
+}
+
+func TestParseAdversaryConfig(t *testing.T) {
+	config, err := parseAdversaryConfig("custom:multiplier=1.5,increment=2,input,burn=3,rounds=10,delay=200ms")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.FeeMultiplier != 1.5 || config.FeeRateIncrement != 2 || !config.ExtraInput ||
+		config.BurnAfter != 3 || config.MaxRounds != 10 || config.Delay != 200*time.Millisecond {
+		t.Errorf("unexpected config %+v", config)
+	}
+
+	for _, spec := range []string{"simple", "input", "burner"} {
+		if _, err := parseAdversaryConfig(spec); err != nil {
+			t.Errorf("%s: %v", spec, err)
+		}
+	}
+	if _, err := parseAdversaryConfig("custom:bogus"); err == nil {
+		t.Errorf("expected unknown option to fail")
+	}
+}
@@ -0,0 +1,393 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"maps"
+	"net"
+	"net/http"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/rpcclient"
+)
+
+// engagementsPaused stops us from sweeping newly detected utxos. Running battles go on.
+var engagementsPaused atomic.Bool
+
+// defaultDescriptorRange is how many addresses of a ranged descriptor are watched by default
+const defaultDescriptorRange = 1000
+
+// Timeouts of the control API, so a stalled client can't hold a connection open.
+// Abandon and replace wait for the node, which the write timeout leaves time for.
+const (
+	apiReadHeaderTimeout = 5 * time.Second
+	apiReadTimeout       = 10 * time.Second
+	apiWriteTimeout      = time.Minute
+)
+
+// apiServer is the local HTTP/JSON control and status API
+type apiServer struct {
+	client *rpcclient.Client
+	config *Config
+	token  string
+}
+
+// startAPIServer serves the control API on a localhost address or a unix:/path socket
+func startAPIServer(client *rpcclient.Client, config *Config) error {
+	token, err := apiToken(config)
+	if err != nil {
+		return err
+	}
+
+	var listener net.Listener
+	if path, ok := strings.CutPrefix(config.API, "unix:"); ok {
+		os.Remove(path)
+		listener, err = net.Listen("unix", path)
+		if err == nil {
+			err = os.Chmod(path, 0600)
+		}
+	} else {
+		listener, err = net.Listen("tcp", config.API)
+	}
+	if err != nil {
+		return fmt.Errorf("error listening for the control API: %v", err)
+	}
+
+	s := &apiServer{client: client, config: config, token: token}
+	slog.Info("Serving control API", "address", config.API)
+	server := &http.Server{
+		Handler:           s.handler(),
+		ReadHeaderTimeout: apiReadHeaderTimeout,
+		ReadTimeout:       apiReadTimeout,
+		WriteTimeout:      apiWriteTimeout,
+	}
+	go server.Serve(listener)
+	return nil
+}
+
+// apiToken returns the configured token, or writes a random one to the token file
+func apiToken(config *Config) (string, error) {
+	if config.APIToken != "" {
+		return config.APIToken, nil
+	}
+
+	var token [32]byte
+	rand.Read(token[:])
+	encoded := hex.EncodeToString(token[:])
+
+	if err := os.WriteFile(config.APITokenFile, []byte(encoded), 0600); err != nil {
+		return "", fmt.Errorf("error writing API token file: %v", err)
+	}
+	slog.Info("Wrote control API token", "file", config.APITokenFile)
+	return encoded, nil
+}
+
+func (s *apiServer) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /v1/status", s.handleStatus)
+	mux.HandleFunc("GET /v1/battles", s.handleBattles)
+	mux.HandleFunc("GET /v1/battles/{outpoint}", s.withBattle(s.handleBattle))
+	mux.HandleFunc("POST /v1/battles/{outpoint}/abandon", s.withBattle(s.handleAbandon))
+	mux.HandleFunc("POST /v1/battles/{outpoint}/burn", s.withBattle(s.handleBurn))
+	mux.HandleFunc("POST /v1/battles/{outpoint}/replace", s.withBattle(s.handleReplace))
+	mux.HandleFunc("POST /v1/pause", s.handlePause(true))
+	mux.HandleFunc("POST /v1/resume", s.handlePause(false))
+	mux.HandleFunc("GET /v1/descriptors", s.handleDescriptors)
+	mux.HandleFunc("POST /v1/descriptors", s.handleAddDescriptor)
+	mux.HandleFunc("DELETE /v1/descriptors/{id}", s.handleRemoveDescriptor)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(s.token)) != 1 {
+			writeError(w, http.StatusUnauthorized, fmt.Errorf("missing or invalid bearer token"))
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+// battleStatus is a battle as reported by the API
+type battleStatus struct {
+	ID          string         `json:"id"`
+	Outpoint    string         `json:"outpoint"`
+	Address     string         `json:"address"`
+	Amount      btcutil.Amount `json:"amount"`
+	State       battleState    `json:"state"`
+	Destination string         `json:"destination,omitempty"`
+	Counterpart string         `json:"counterpart,omitempty"`
+	Funding     string         `json:"funding,omitempty"`
+	History     []battleEvent  `json:"history"`
+	// Views maps the nodes to the transaction spending the utxo in their mempool
+	Views map[string]string `json:"views,omitempty"`
+}
+
+func (u *TrackedUTXO) status() battleStatus {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	status := battleStatus{
+		ID:       u.ID,
+		Outpoint: fmt.Sprintf("%s:%d", u.TxID, u.N),
+		Address:  u.Address,
+		Amount:   u.Amount,
+		State:    u.State(),
+		History:  slices.Clone(u.History),
+		Views:    maps.Clone(u.Views),
+	}
+	if u.Destination != nil {
+		status.Destination = u.Destination.EncodeAddress()
+	}
+	if u.Counterpart != nil {
+		status.Counterpart = u.Counterpart.Txid
+	}
+	if u.Funding != nil {
+		status.Funding = fundingID(*u.Funding)
+	}
+	return status
+}
+
+// reservation is a wallet coin reserved to fund the replacements of a battle
+type reservation struct {
+	Coin   string `json:"coin"`
+	Battle string `json:"battle"`
+}
+
+// botStatus is the health of the bot as reported by the API and the dashboard
+type botStatus struct {
+	Paused       bool          `json:"paused"`
+	Battles      int           `json:"battles"`
+	Reservations []reservation `json:"reservations"`
+	Node         struct {
+		Height   int64      `json:"height"`
+		LastSeen *time.Time `json:"last_seen,omitempty"`
+		Error    string     `json:"error,omitempty"`
+	} `json:"node"`
+	ZMQ struct {
+		Endpoint    string     `json:"endpoint"`
+		LastMessage *time.Time `json:"last_message,omitempty"`
+		Messages    uint64     `json:"messages"`
+		Gaps        uint64     `json:"gaps"`
+	} `json:"zmq"`
+}
+
+func currentStatus(config *Config) botStatus {
+	status := botStatus{
+		Paused:       engagementsPaused.Load(),
+		Battles:      len(monitoredSnapshot()),
+		Reservations: []reservation{},
+	}
+
+	fundingReservationsMu.Lock()
+	for coin, battle := range fundingReservations {
+		status.Reservations = append(status.Reservations, reservation{Coin: coin, Battle: battle.ID})
+	}
+	fundingReservationsMu.Unlock()
+	sort.Slice(status.Reservations, func(i, j int) bool { return status.Reservations[i].Coin < status.Reservations[j].Coin })
+
+	status.Node.Height = tipHeight.Load()
+	nodeHealth.Lock()
+	if !nodeHealth.lastSeen.IsZero() {
+		lastSeen := nodeHealth.lastSeen
+		status.Node.LastSeen = &lastSeen
+	}
+	if nodeHealth.err != nil {
+		status.Node.Error = nodeHealth.err.Error()
+	}
+	nodeHealth.Unlock()
+
+	status.ZMQ.Endpoint = config.ZMQ
+	if last := zmqLastMessage.Load(); last != 0 {
+		lastMessage := time.Unix(0, last)
+		status.ZMQ.LastMessage = &lastMessage
+	}
+	status.ZMQ.Messages = zmqMessages.Load()
+	status.ZMQ.Gaps = zmqGaps.Load()
+
+	return status
+}
+
+func (s *apiServer) handleStatus(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, currentStatus(s.config))
+}
+
+// battleStatuses returns all battles ordered by outpoint
+func battleStatuses() []battleStatus {
+	battles := []battleStatus{}
+	for _, utxo := range monitoredSnapshot() {
+		battles = append(battles, utxo.status())
+	}
+	sort.Slice(battles, func(i, j int) bool { return battles[i].Outpoint < battles[j].Outpoint })
+	return battles
+}
+
+func (s *apiServer) handleBattles(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, battleStatuses())
+}
+
+// withBattle looks up the battle over the {outpoint} of the request
+func (s *apiServer) withBattle(handle func(http.ResponseWriter, *http.Request, *TrackedUTXO)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		utxo, ok := getMonitored(r.PathValue("outpoint"))
+		if !ok {
+			writeError(w, http.StatusNotFound, fmt.Errorf("no battle over %s", r.PathValue("outpoint")))
+			return
+		}
+		handle(w, r, utxo)
+	}
+}
+
+func (s *apiServer) handleBattle(w http.ResponseWriter, r *http.Request, utxo *TrackedUTXO) {
+	writeJSON(w, http.StatusOK, utxo.status())
+}
+
+// abandonBattle stops fighting over a utxo
+func abandonBattle(utxo *TrackedUTXO) {
+	utxo.setState(stateAbandoned)
+	utxo.logger().Warn("Abandoned battle")
+	publishBattle(BattleResolved{Battle: utxo, Outcome: stateAbandoned})
+}
+
+// forceBurn burns a utxo to fees in the battle handler, once it answered the counterpart it handles
+func forceBurn(client *rpcclient.Client, config *Config, utxo *TrackedUTXO) error {
+	return utxo.awaitBattle(func() error {
+		utxo.logger().Warn("Force burning utxo")
+
+		privateKeyWIF, _ := utxo.privateKey()
+		_, err := BurnTransaction(client, nil, utxo, privateKeyWIF, config)
+		return err
+	})
+}
+
+func (s *apiServer) handleAbandon(w http.ResponseWriter, r *http.Request, utxo *TrackedUTXO) {
+	abandonBattle(utxo)
+
+	writeJSON(w, http.StatusOK, utxo.status())
+}
+
+func (s *apiServer) handleBurn(w http.ResponseWriter, r *http.Request, utxo *TrackedUTXO) {
+	if err := forceBurn(s.client, s.config, utxo); err != nil {
+		writeError(w, http.StatusBadGateway, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, utxo.status())
+}
+
+// fixedFeeRateStrategy pays the fee rate asked for in the control API
+type fixedFeeRateStrategy float64
+
+func (s fixedFeeRateStrategy) ReplacementFee(conflict *Conflict, ourVSize int32, utxo *TrackedUTXO) (btcutil.Amount, bool) {
+	fee := btcutil.Amount(float64(s) * float64(ourVSize))
+	return fee, fee >= utxo.Amount
+}
+
+func (s *apiServer) handleReplace(w http.ResponseWriter, r *http.Request, utxo *TrackedUTXO) {
+	var req struct {
+		FeeRate float64 `json:"feerate"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.FeeRate <= 0 {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("expected a positive feerate in sat/vbyte"))
+		return
+	}
+
+	if err := forceReplace(s.client, s.config, utxo, req.FeeRate); err != nil {
+		writeError(w, http.StatusConflict, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, utxo.status())
+}
+
+// forceReplace replaces the counterpart, or our own sweep without one, at feeRate in the
+// battle handler. It returns why the replacement wasn't accepted.
+func forceReplace(client *rpcclient.Client, config *Config, utxo *TrackedUTXO, feeRate float64) error {
+	return utxo.awaitBattle(func() error {
+		utxo.logger().Warn("Replacing from the control API", "feerate", feeRate)
+
+		utxo.mu.Lock()
+		counterpart := utxo.Counterpart
+		utxo.mu.Unlock()
+
+		privateKeyWIF, _ := utxo.privateKey()
+		if counterpart == nil {
+			_, err := broadcastSweep(client, utxo, privateKeyWIF, config, feeRate)
+			return err
+		}
+		return replaceCounterpart(client, fixedFeeRateStrategy(feeRate), counterpart, utxo, privateKeyWIF, config)
+	})
+}
+
+func (s *apiServer) handlePause(paused bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		engagementsPaused.Store(paused)
+		slog.Warn("Changed engagements from the control API", "paused", paused)
+
+		writeJSON(w, http.StatusOK, map[string]bool{"paused": paused})
+	}
+}
+
+func (s *apiServer) handleDescriptors(w http.ResponseWriter, r *http.Request) {
+	type descriptor struct {
+		ID         string `json:"id"`
+		Descriptor string `json:"descriptor"`
+		Addresses  int    `json:"addresses"`
+	}
+
+	descriptors := []descriptor{}
+	watchedDescriptorsMu.Lock()
+	for id, watched := range watchedDescriptors {
+		descriptors = append(descriptors, descriptor{ID: id, Descriptor: watched.public, Addresses: len(watched.addresses)})
+	}
+	watchedDescriptorsMu.Unlock()
+	sort.Slice(descriptors, func(i, j int) bool { return descriptors[i].ID < descriptors[j].ID })
+
+	writeJSON(w, http.StatusOK, descriptors)
+}
+
+func (s *apiServer) handleAddDescriptor(w http.ResponseWriter, r *http.Request) {
+	req := struct {
+		Descriptor string `json:"descriptor"`
+		Range      uint32 `json:"range"`
+	}{Range: defaultDescriptorRange}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	id, count, err := watchDescriptor(req.Descriptor, req.Range)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]any{"id": id, "addresses": count})
+}
+
+func (s *apiServer) handleRemoveDescriptor(w http.ResponseWriter, r *http.Request) {
+	if !unwatchDescriptor(r.PathValue("id")) {
+		writeError(w, http.StatusNotFound, fmt.Errorf("descriptor is not watched"))
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
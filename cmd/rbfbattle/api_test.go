@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/btcec/v2"
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/wire"
+)
+
+// startAPI serves the control API of the shared battle
+func startAPI(t *testing.T, b *battle) *httptest.Server {
+	t.Helper()
+
+	client, err := b.node.Client()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &apiServer{client: client, config: b.config, token: "secret"}
+	server := httptest.NewServer(s.handler())
+	t.Cleanup(server.Close)
+	return server
+}
+
+// apiCall calls the API and decodes the response into out
+func apiCall(t *testing.T, server *httptest.Server, method, path string, body any, out any) int {
+	t.Helper()
+
+	var reqBody bytes.Buffer
+	if body != nil {
+		json.NewEncoder(&reqBody).Encode(body)
+	}
+	req, _ := http.NewRequest(method, server.URL+path, &reqBody)
+	req.Header.Set("Authorization", "Bearer secret")
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	if out != nil && res.StatusCode == http.StatusOK {
+		if err := json.NewDecoder(res.Body).Decode(out); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return res.StatusCode
+}
+
+func TestAPIRequiresToken(t *testing.T) {
+	s := &apiServer{config: &Config{}, token: "secret"}
+	server := httptest.NewServer(s.handler())
+	defer server.Close()
+
+	for _, auth := range []string{"", "Bearer wrong", "secret"} {
+		req, _ := http.NewRequest("GET", server.URL+"/v1/status", nil)
+		if auth != "" {
+			req.Header.Set("Authorization", auth)
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != http.StatusUnauthorized {
+			t.Errorf("expected %q to be rejected, got %d", auth, res.StatusCode)
+		}
+	}
+}
+
+func TestAPIBattles(t *testing.T) {
+	b := startBattle(t)
+	server := startAPI(t, b)
+	_, script := b.watch(t)
+
+	funding := b.send(t, script, 100_000)
+	outpoint := wire.OutPoint{Hash: funding.TxHash(), Index: 0}
+	path := fmt.Sprintf("/v1/battles/%s:%d", outpoint.Hash, outpoint.Index)
+
+	// The sweep is recorded once its broadcast returns
+	waitFor(t, "sweep", func() bool {
+		utxo, ok := getMonitoredOutPoint(outpoint)
+		return ok && len(utxo.status().History) == 1
+	})
+
+	var battle battleStatus
+	if code := apiCall(t, server, "GET", path, nil, &battle); code != http.StatusOK {
+		t.Fatalf("expected the battle, got %d", code)
+	}
+	if battle.State != stateSweeping || len(battle.History) != 1 || battle.History[0].Kind != "sweep" {
+		t.Errorf("expected a sweeping battle with a sweep, got %+v", battle)
+	}
+
+	var battles []battleStatus
+	apiCall(t, server, "GET", "/v1/battles", nil, &battles)
+	found := false
+	for _, listed := range battles {
+		found = found || listed.ID == battle.ID
+	}
+	if !found {
+		t.Errorf("expected battle %s in %+v", battle.ID, battles)
+	}
+
+	// A replacement paying less than our sweep is refused with the reason
+	if code := apiCall(t, server, "POST", path+"/replace", map[string]float64{"feerate": 1}, nil); code != http.StatusConflict {
+		t.Errorf("expected a cheaper replacement to be refused, got %d", code)
+	}
+	var replaced battleStatus
+	if code := apiCall(t, server, "POST", path+"/replace", map[string]float64{"feerate": 50}, &replaced); code != http.StatusOK {
+		t.Fatalf("expected the replacement, got %d", code)
+	}
+	if len(replaced.History) != 2 {
+		t.Errorf("expected the replacement in the history, got %+v", replaced.History)
+	}
+
+	var abandoned battleStatus
+	apiCall(t, server, "POST", path+"/abandon", nil, &abandoned)
+	if abandoned.State != stateAbandoned {
+		t.Errorf("expected an abandoned battle, got %s", abandoned.State)
+	}
+	if code := apiCall(t, server, "GET", path, nil, nil); code != http.StatusNotFound {
+		t.Errorf("expected the abandoned battle to be gone, got %d", code)
+	}
+}
+
+func TestAPIPause(t *testing.T) {
+	b := startBattle(t)
+	server := startAPI(t, b)
+	_, script := b.watch(t)
+
+	apiCall(t, server, "POST", "/v1/pause", nil, nil)
+	defer apiCall(t, server, "POST", "/v1/resume", nil, nil)
+
+	var status struct {
+		Paused bool `json:"paused"`
+	}
+	apiCall(t, server, "GET", "/v1/status", nil, &status)
+	if !status.Paused {
+		t.Error("expected engagements to be paused")
+	}
+
+	funding := b.send(t, script, 100_000)
+	time.Sleep(300 * time.Millisecond)
+
+	if _, ok := b.node.Spender(wire.OutPoint{Hash: funding.TxHash(), Index: 0}); ok {
+		t.Error("expected no sweep while paused")
+	}
+}
+
+func TestAPIDescriptors(t *testing.T) {
+	b := startBattle(t)
+	server := startAPI(t, b)
+
+	key, _ := btcec.NewPrivateKey()
+	wif, _ := btcutil.NewWIF(key, network, true)
+	descriptor := fmt.Sprintf("wpkh(%s)", wif.String())
+	address, _ := addressForPubKey("wpkh", key.PubKey())
+
+	var added struct {
+		ID        string `json:"id"`
+		Addresses int    `json:"addresses"`
+	}
+	apiCall(t, server, "POST", "/v1/descriptors", map[string]any{"descriptor": descriptor}, &added)
+	if added.Addresses != 1 {
+		t.Errorf("expected 1 watched address, got %d", added.Addresses)
+	}
+	if _, ok := watchedKey(address.EncodeAddress()); !ok {
+		t.Error("expected the descriptor address to be watched")
+	}
+
+	// Only the public form is listed
+	var listed []struct {
+		ID         string `json:"id"`
+		Descriptor string `json:"descriptor"`
+	}
+	apiCall(t, server, "GET", "/v1/descriptors", nil, &listed)
+	public := fmt.Sprintf("wpkh(%x)", key.PubKey().SerializeCompressed())
+	found := false
+	for _, watched := range listed {
+		found = found || watched.ID == added.ID && watched.Descriptor == public
+	}
+	if !found {
+		t.Errorf("expected %s to be listed as %s, got %+v", added.ID, public, listed)
+	}
+
+	for _, watchRange := range []uint32{0, maxDescriptorRange + 1} {
+		if code := apiCall(t, server, "POST", "/v1/descriptors", map[string]any{"descriptor": descriptor, "range": watchRange}, nil); code != http.StatusBadRequest {
+			t.Errorf("expected a range of %d to be refused, got %d", watchRange, code)
+		}
+	}
+
+	if code := apiCall(t, server, "DELETE", "/v1/descriptors/"+added.ID, nil, nil); code != http.StatusNoContent {
+		t.Errorf("expected the descriptor to be removed, got %d", code)
+	}
+	if _, ok := watchedKey(address.EncodeAddress()); ok {
+		t.Error("expected the descriptor address to be unwatched")
+	}
+}
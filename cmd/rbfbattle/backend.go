@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"sort"
+
+	"github.com/btcsuite/btcd/btcjson"
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/rpcclient"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+)
+
+// ChainBackend is where the bot looks up the mempool and the chain, follows new transactions
+// and broadcasts. The wallet funding our replacements is always bitcoind's.
+type ChainBackend interface {
+	// MempoolEntry looks up an unconfirmed transaction
+	MempoolEntry(txid string) (*mempoolSummary, error)
+	// Broadcast sends a transaction to the network
+	Broadcast(tx *wire.MsgTx) (*chainhash.Hash, error)
+	// PrevOut returns the output an input spends
+	PrevOut(outpoint wire.OutPoint) (*wire.TxOut, error)
+	// EstimateFeeRate returns the fee rate in sat/vbyte to confirm within blocks
+	EstimateFeeRate(blocks int) (float64, error)
+	// TipHeight returns the height of the best block
+	TipHeight() (int64, error)
+	// WatchTransactions queues new mempool transactions, and the confirmed transactions spending
+	// monitored outpoints with their confirmations, until it fails
+	WatchTransactions(queue chan<- queuedTx) error
+}
+
+// mempoolSummary is what we need to know about a transaction in the mempool
+type mempoolSummary struct {
+	// Fee includes the fees of the descendants when the backend knows them
+	Fee   btcutil.Amount
+	VSize int32
+}
+
+// newChainBackend creates the backend selected with backend
+func newChainBackend(client *rpcclient.Client, config *Config) (ChainBackend, error) {
+	switch config.Backend {
+	case "btcd":
+		return newBtcdBackend(config.Btcd, config.BtcdNoFilter)
+	case "esplora":
+		return newEsploraBackend(config.Esplora), nil
+	case "electrum":
+		return newElectrumBackend(config.Electrum), nil
+	default:
+		return &bitcoindBackend{client: client, zmq: config.ZMQ}, nil
+	}
+}
+
+// bitcoindBackend follows the mempool of a node over RPC and ZMQ
+type bitcoindBackend struct {
+	client *rpcclient.Client
+	zmq    string
+}
+
+func (b *bitcoindBackend) MempoolEntry(txid string) (*mempoolSummary, error) {
+	entry, err := b.client.GetMempoolEntry(txid)
+	if err != nil {
+		return nil, err
+	}
+	return summarizeMempoolEntry(entry)
+}
+
+func summarizeMempoolEntry(entry *btcjson.GetMempoolEntryResult) (*mempoolSummary, error) {
+	fee, err := btcutil.NewAmount(entry.Fees.Descendant)
+	if err != nil {
+		return nil, err
+	}
+	return &mempoolSummary{Fee: fee, VSize: entry.VSize}, nil
+}
+
+func (b *bitcoindBackend) Broadcast(tx *wire.MsgTx) (*chainhash.Hash, error) {
+	hash, err := b.client.SendRawTransaction(tx, true)
+	return hash, bitcoindRejection(err)
+}
+
+func (b *bitcoindBackend) PrevOut(outpoint wire.OutPoint) (*wire.TxOut, error) {
+	tx, err := b.client.GetRawTransactionVerbose(&outpoint.Hash)
+	if err != nil {
+		return nil, err
+	}
+	if int(outpoint.Index) >= len(tx.Vout) {
+		return nil, fmt.Errorf("transaction %s has no output %d", outpoint.Hash, outpoint.Index)
+	}
+	return txOutFromResult(tx.Vout[outpoint.Index])
+}
+
+func (b *bitcoindBackend) EstimateFeeRate(blocks int) (float64, error) {
+	estimate, err := b.client.EstimateSmartFee(int64(blocks), &btcjson.EstimateModeConservative)
+	if err != nil {
+		return 0, err
+	}
+	if estimate.FeeRate == nil {
+		return 0, fmt.Errorf("no fee estimate: %v", estimate.Errors)
+	}
+	// Convert from BTC/kvB to sat/vbyte
+	return *estimate.FeeRate * 1_0000_0000 / 1000, nil
+}
+
+func (b *bitcoindBackend) TipHeight() (int64, error) {
+	return b.client.GetBlockCount()
+}
+
+// WatchTransactions follows ZMQ, which announces the transactions of every block as well
+func (b *bitcoindBackend) WatchTransactions(queue chan<- queuedTx) error {
+	return watchMempool(b.client, b.zmq, primaryNode, queue)
+}
+
+// confirmationsAt returns the confirmations of a transaction in the block at height
+func confirmationsAt(height int64) int64 {
+	return max(tipHeight.Load()-height+1, 1)
+}
+
+// txOutFromResult converts an output of a verbose transaction
+func txOutFromResult(vout btcjson.Vout) (*wire.TxOut, error) {
+	amount, err := btcutil.NewAmount(vout.Value)
+	if err != nil {
+		return nil, err
+	}
+	script, err := hex.DecodeString(vout.ScriptPubKey.Hex)
+	if err != nil {
+		return nil, err
+	}
+	return wire.NewTxOut(int64(amount), script), nil
+}
+
+// watchedScripts returns the watched output scripts in order
+func watchedScripts() [][]byte {
+	ourScriptsMu.RLock()
+	scripts := make([][]byte, 0, len(ourScripts))
+	for script := range ourScripts {
+		scripts = append(scripts, []byte(script))
+	}
+	ourScriptsMu.RUnlock()
+
+	sort.Slice(scripts, func(i, j int) bool {
+		return bytes.Compare(scripts[i], scripts[j]) < 0
+	})
+	return scripts
+}
+
+// watchedAddresses returns the addresses of the watched output scripts in order.
+// Scripts without an address, like pay-to-pubkey, are left out.
+func watchedAddresses() []string {
+	var addresses []string
+	for _, script := range watchedScripts() {
+		class, decoded, _, err := txscript.ExtractPkScriptAddrs(script, network)
+		if err != nil || class == txscript.PubKeyTy || len(decoded) != 1 {
+			continue
+		}
+		addresses = append(addresses, decoded[0].EncodeAddress())
+	}
+	sort.Strings(addresses)
+	return addresses
+}
+
+// feeFromPrevOuts works out the fee of tx from the outputs it spends, for backends that don't report it
+func feeFromPrevOuts(backend ChainBackend, tx *wire.MsgTx) (btcutil.Amount, error) {
+	var in, out int64
+	for _, txIn := range tx.TxIn {
+		prevOut, err := backend.PrevOut(txIn.PreviousOutPoint)
+		if err != nil {
+			return 0, err
+		}
+		in += prevOut.Value
+	}
+	for _, txOut := range tx.TxOut {
+		out += txOut.Value
+	}
+	return btcutil.Amount(in - out), nil
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/btcec/v2"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+)
+
+// backendFixture is a watched address with a confirmed parent paying to it and an unconfirmed child spending it
+type backendFixture struct {
+	address string
+	script  []byte
+	parent  *wire.MsgTx
+	child   *wire.MsgTx
+}
+
+func newBackendFixture(t *testing.T) *backendFixture {
+	t.Helper()
+
+	key, _ := btcec.NewPrivateKey()
+	address, err := addressForPubKey("wpkh", key.PubKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	script := p2wpkhScript(key)
+
+	parent := wire.NewMsgTx(2)
+	parent.AddTxIn(wire.NewTxIn(&wire.OutPoint{Hash: chainhash.Hash{1}}, nil, nil))
+	parent.AddTxOut(wire.NewTxOut(50_000, script))
+	child := spendP2WPKH(t, key, wire.OutPoint{Hash: parent.TxHash()}, parent.TxOut[0], 500)
+
+	watchAddress(address.EncodeAddress(), "")
+	t.Cleanup(func() { unwatchAddress(address.EncodeAddress()) })
+
+	return &backendFixture{address: address.EncodeAddress(), script: script, parent: parent, child: child}
+}
+
+// monitorParent starts a battle over the output of the parent, whose spend by the child confirms
+func (f *backendFixture) monitorParent(t *testing.T) {
+	t.Helper()
+
+	utxo := &TrackedUTXO{TxID: f.parent.TxHash().String(), Script: newScriptPubKeyResult(f.script)}
+	monitor(utxo)
+	t.Cleanup(func() { cleanup(utxo) })
+}
+
+// checkBackend runs the lookups every backend answers the same way against a server holding the fixture
+func checkBackend(t *testing.T, backend ChainBackend, f *backendFixture) {
+	t.Helper()
+
+	hash, err := backend.Broadcast(f.child)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *hash != f.child.TxHash() {
+		t.Errorf("expected broadcast txid %s, got %s", f.child.TxHash(), hash)
+	}
+
+	entry, err := backend.MempoolEntry(f.child.TxHash().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry.Fee != 500 || int64(entry.VSize) != txVirtualSize(f.child) {
+		t.Errorf("expected a fee of 500 sats over %d vbytes, got %+v", txVirtualSize(f.child), entry)
+	}
+
+	prevOut, err := backend.PrevOut(f.child.TxIn[0].PreviousOutPoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if prevOut.Value != 50_000 || string(prevOut.PkScript) != string(f.script) {
+		t.Errorf("unexpected prevout %+v", prevOut)
+	}
+}
+
+// waitQueued returns the next queued transaction
+func waitQueued(t *testing.T, queue <-chan queuedTx) queuedTx {
+	t.Helper()
+
+	select {
+	case queued := <-queue:
+		return queued
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for a transaction")
+		return queuedTx{}
+	}
+}
+
+func TestBitcoindBackend(t *testing.T) {
+	node, err := newMockNode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer node.Close()
+	node.FeeRate = 12
+	client, err := node.Client()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f := newBackendFixture(t)
+	node.Import(f.parent)
+	backend := &bitcoindBackend{client: client}
+	checkBackend(t, backend, f)
+
+	if feeRate, err := backend.EstimateFeeRate(1); err != nil || feeRate != 12 {
+		t.Errorf("expected a fee rate of 12 sat/vbyte, got %v (%v)", feeRate, err)
+	}
+	if _, err := backend.TipHeight(); err != nil {
+		t.Error(err)
+	}
+}
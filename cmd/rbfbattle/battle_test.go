@@ -0,0 +1,358 @@
+package main
+
+import (
+	"encoding/hex"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/btcec/v2"
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// battle runs the bot against a mock node, with a second mock node as its peer
+type battle struct {
+	node        *mockNode
+	peer        *mockNode
+	config      *Config
+	destination btcutil.Address
+}
+
+var (
+	sharedBattle     *battle
+	sharedBattleErr  error
+	sharedBattleOnce sync.Once
+)
+
+// startBattle starts a mock node with a funded wallet and runs the bot against it.
+// The bot can't be stopped, so every test shares it and watches its own keys.
+func startBattle(t testing.TB) *battle {
+	t.Helper()
+
+	sharedBattleOnce.Do(func() {
+		sharedBattle, sharedBattleErr = newBattle()
+	})
+	if sharedBattleErr != nil {
+		t.Fatal(sharedBattleErr)
+	}
+
+	sharedBattle.node.FundWallet(btc(0.01))
+	return sharedBattle
+}
+
+func newBattle() (*battle, error) {
+	node, err := newMockNode()
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := node.Client()
+	if err != nil {
+		return nil, err
+	}
+
+	node.FundWallet(btc(0.01))
+
+	batchClient, err := node.BatchClient()
+	if err != nil {
+		return nil, err
+	}
+	batch := &rpcBatch{client: batchClient}
+
+	destinationKey, _ := btcec.NewPrivateKey()
+	destination, err := addressForPubKey("wpkh", destinationKey.PubKey())
+	if err != nil {
+		return nil, err
+	}
+
+	// Reset the bot state left by other tests
+	monitoredUtxosMu.Lock()
+	monitoredUtxos = make(map[wire.OutPoint]*TrackedUTXO)
+	monitoredUtxosMu.Unlock()
+	ourScripts = make(map[string]string)
+	fundingReservations = make(map[string]*TrackedUTXO)
+	destinations = &staticDestination{address: destination}
+	ourDestinations = make(map[string]struct{})
+	replacementPolicy = detectReplacementPolicy(client, batch)
+
+	// The peer only knows the transactions a test imports into it
+	peer, err := newMockNode()
+	if err != nil {
+		return nil, err
+	}
+	peerClient, err := peer.Client()
+	if err != nil {
+		return nil, err
+	}
+
+	config := &Config{
+		ZMQ:         node.ZMQEndpoint(),
+		BurnMessage: "rbfbattle",
+		peers:       peerSet{{Name: peer.RPCHost(), Client: peerClient, ZMQ: peer.ZMQEndpoint()}},
+		batch:       batch,
+		backend:     &bitcoindBackend{client: client},
+	}
+
+	if _, err := selectUnspentUtxo(client); err != nil {
+		return nil, err
+	}
+	nodeFullRBF = checkReplacementPolicy(client, config)
+
+	startPipeline(client, config, 4)
+	go monitorMempoolWithZMQ(client, config)
+	go watchPeerMempool(config.peers[0])
+
+	// Give the subscribers time to connect so no notification is missed
+	time.Sleep(200 * time.Millisecond)
+
+	return &battle{node: node, peer: peer, config: config, destination: destination}, nil
+}
+
+// watch adds a new key to the watched addresses and returns it with its P2WPKH script
+func (b *battle) watch(t testing.TB) (*btcec.PrivateKey, []byte) {
+	t.Helper()
+
+	key, err := btcec.NewPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	address, err := btcutil.NewAddressWitnessPubKeyHash(btcutil.Hash160(key.PubKey().SerializeCompressed()), network)
+	if err != nil {
+		t.Fatal(err)
+	}
+	script, _ := txscript.PayToAddrScript(address)
+
+	watchAddress(address.EncodeAddress(), hex.EncodeToString(key.Serialize()))
+	return key, script
+}
+
+// send pays amount to script from a coin outside the bot's wallet
+func (b *battle) send(t testing.TB, script []byte, amount btcutil.Amount) *wire.MsgTx {
+	t.Helper()
+
+	key, _ := btcec.NewPrivateKey()
+	faucet := p2wpkhScript(key)
+	coin := Coin{OutPoint: b.node.Fund(faucet, amount+1000), Output: wire.NewTxOut(int64(amount+1000), faucet), Key: key}
+
+	tx := wire.NewMsgTx(2)
+	tx.AddTxIn(wire.NewTxIn(&coin.OutPoint, nil, nil))
+	tx.AddTxOut(wire.NewTxOut(int64(amount), script))
+	if err := signCoins(tx, []Coin{coin}); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.node.Submit(tx); err != nil {
+		t.Fatal(err)
+	}
+	return tx
+}
+
+// sweepRecorded tells if the battle over outpoint recorded our sweep, which it does once
+// the broadcast returns and so after the node has it
+func sweepRecorded(outpoint wire.OutPoint) bool {
+	utxo, ok := getMonitoredOutPoint(outpoint)
+	return ok && len(utxo.status().History) > 0
+}
+
+// waitFor polls until cond holds
+func waitFor(t testing.TB, what string, cond func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+// paysTo checks if a transaction has a single output paying to address
+func paysTo(tx *wire.MsgTx, address btcutil.Address) bool {
+	script, _ := txscript.PayToAddrScript(address)
+	return len(tx.TxOut) == 1 && string(tx.TxOut[0].PkScript) == string(script)
+}
+
+// spendP2WPKH spends a P2WPKH output to a new address the way a counterpart with the key would
+func spendP2WPKH(t testing.TB, key *btcec.PrivateKey, outpoint wire.OutPoint, prev *wire.TxOut, fee btcutil.Amount) *wire.MsgTx {
+	t.Helper()
+
+	other, _ := btcec.NewPrivateKey()
+	tx := wire.NewMsgTx(2)
+	tx.AddTxIn(wire.NewTxIn(&outpoint, nil, nil))
+	tx.AddTxOut(wire.NewTxOut(prev.Value-int64(fee), p2wpkhScript(other)))
+
+	if err := signCoins(tx, []Coin{{OutPoint: outpoint, Output: prev, Key: key}}); err != nil {
+		t.Fatal(err)
+	}
+	return tx
+}
+
+func TestBattleUncontested(t *testing.T) {
+	b := startBattle(t)
+	_, script := b.watch(t)
+	won := testutil.ToFloat64(metricBattles.WithLabelValues("won"))
+	recovered := testutil.ToFloat64(metricValueRecovered)
+
+	funding := b.send(t, script, 100_000)
+	outpoint := wire.OutPoint{Hash: funding.TxHash(), Index: 0}
+
+	waitFor(t, "sweep", func() bool {
+		sweep, ok := b.node.Spender(outpoint)
+		return ok && paysTo(sweep, b.destination) && sweepRecorded(outpoint)
+	})
+
+	b.node.MineBlock()
+	waitFor(t, "battle to end", func() bool { return len(monitoredSnapshot()) == 0 })
+
+	if got := testutil.ToFloat64(metricBattles.WithLabelValues("won")); got != won+1 {
+		t.Errorf("expected %v won battles, got %v", won+1, got)
+	}
+	if got := testutil.ToFloat64(metricValueRecovered) - recovered; got <= 0 || got >= 100_000 {
+		t.Errorf("expected to recover the value minus fees, got %v sats", got)
+	}
+}
+
+func TestBattleReplacesCounterpart(t *testing.T) {
+	b := startBattle(t)
+	key, script := b.watch(t)
+
+	funding := b.send(t, script, 100_000)
+	outpoint := wire.OutPoint{Hash: funding.TxHash(), Index: 0}
+
+	waitFor(t, "sweep", func() bool {
+		_, ok := b.node.Spender(outpoint)
+		return ok
+	})
+
+	counterpart := spendP2WPKH(t, key, outpoint, funding.TxOut[0], 5_000)
+	if err := b.node.Submit(counterpart); err != nil {
+		t.Fatalf("counterpart rejected: %v", err)
+	}
+
+	// The replacement adds a wallet input to outbid the counterpart
+	waitFor(t, "replacement", func() bool {
+		tx, ok := b.node.Spender(outpoint)
+		return ok && tx.TxHash() != counterpart.TxHash() && paysTo(tx, b.destination) && len(tx.TxIn) == 2
+	})
+
+	b.node.MineBlock()
+	waitFor(t, "battle to end", func() bool { return len(monitoredSnapshot()) == 0 })
+}
+
+func TestBattleAnswersEarlyCounterpart(t *testing.T) {
+	b := startBattle(t)
+	key, script := b.watch(t)
+
+	// The counterpart follows the payment before our sweep
+	funding := b.send(t, script, 100_000)
+	outpoint := wire.OutPoint{Hash: funding.TxHash(), Index: 0}
+	counterpart := spendP2WPKH(t, key, outpoint, funding.TxOut[0], 20_000)
+	if err := b.node.Submit(counterpart); err != nil {
+		t.Fatalf("counterpart rejected: %v", err)
+	}
+
+	waitFor(t, "replacement", func() bool {
+		tx, ok := b.node.Spender(outpoint)
+		return ok && paysTo(tx, b.destination) && len(tx.TxIn) == 2
+	})
+
+	b.node.MineBlock()
+	waitFor(t, "battle to end", func() bool { return len(monitoredSnapshot()) == 0 })
+}
+
+func TestBattleLooksUpSweepConflict(t *testing.T) {
+	b := startBattle(t)
+	key, script := b.watch(t)
+
+	faucetKey, _ := btcec.NewPrivateKey()
+	faucet := p2wpkhScript(faucetKey)
+	coin := Coin{OutPoint: b.node.Fund(faucet, 101_000), Output: wire.NewTxOut(101_000, faucet), Key: faucetKey}
+	funding := wire.NewMsgTx(2)
+	funding.AddTxIn(wire.NewTxIn(&coin.OutPoint, nil, nil))
+	funding.AddTxOut(wire.NewTxOut(100_000, script))
+	if err := signCoins(funding, []Coin{coin}); err != nil {
+		t.Fatal(err)
+	}
+	outpoint := wire.OutPoint{Hash: funding.TxHash(), Index: 0}
+
+	// The bot only hears of the payment, so the node rejecting our sweep is all that
+	// tells of the counterpart
+	counterpart := spendP2WPKH(t, key, outpoint, funding.TxOut[0], 20_000)
+	for _, tx := range []*wire.MsgTx{funding, counterpart} {
+		if err := b.node.SubmitUnannounced(tx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	b.node.Announce(funding)
+
+	waitFor(t, "replacement", func() bool {
+		tx, ok := b.node.Spender(outpoint)
+		return ok && paysTo(tx, b.destination) && len(tx.TxIn) == 2
+	})
+
+	b.node.MineBlock()
+	waitFor(t, "battle to end", func() bool { return len(monitoredSnapshot()) == 0 })
+}
+
+func TestBattleSweepsPayToPubKey(t *testing.T) {
+	b := startBattle(t)
+
+	key, _ := btcec.NewPrivateKey()
+	scripts, err := payToPubKeyScripts(hex.EncodeToString(key.Serialize()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	watchScript(scripts[0], hex.EncodeToString(key.Serialize()))
+
+	// The output has no address, only its script is watched
+	funding := b.send(t, scripts[0], 100_000)
+	outpoint := wire.OutPoint{Hash: funding.TxHash(), Index: 0}
+
+	waitFor(t, "sweep", func() bool {
+		tx, ok := b.node.Spender(outpoint)
+		return ok && paysTo(tx, b.destination)
+	})
+}
+
+func TestBattleReplacesTaprootCounterpart(t *testing.T) {
+	b := startBattle(t)
+
+	key, _ := btcec.NewPrivateKey()
+	address, err := addressForPubKey("tr", key.PubKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	script, _ := txscript.PayToAddrScript(address)
+	watchAddress(address.EncodeAddress(), hex.EncodeToString(key.Serialize()))
+
+	funding := b.send(t, script, 100_000)
+	outpoint := wire.OutPoint{Hash: funding.TxHash(), Index: 0}
+
+	waitFor(t, "sweep", func() bool {
+		_, ok := b.node.Spender(outpoint)
+		return ok
+	})
+
+	other, _ := btcec.NewPrivateKey()
+	counterpart := wire.NewMsgTx(2)
+	counterpart.AddTxIn(wire.NewTxIn(&outpoint, nil, nil))
+	counterpart.AddTxOut(wire.NewTxOut(100_000-5_000, p2wpkhScript(other)))
+	if err := signCoins(counterpart, []Coin{{OutPoint: outpoint, Output: funding.TxOut[0], Key: key}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.node.Submit(counterpart); err != nil {
+		t.Fatalf("counterpart rejected: %v", err)
+	}
+
+	// The taproot signature commits to the wallet input, which the wallet told us about
+	waitFor(t, "replacement", func() bool {
+		tx, ok := b.node.Spender(outpoint)
+		return ok && tx.TxHash() != counterpart.TxHash() && paysTo(tx, b.destination) && len(tx.TxIn) == 2
+	})
+
+	b.node.MineBlock()
+	waitFor(t, "battle to end", func() bool { return len(monitoredSnapshot()) == 0 })
+}
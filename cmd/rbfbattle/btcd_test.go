@@ -0,0 +1,268 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/btcjson"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/btcsuite/websocket"
+)
+
+// btcdStandIn answers the RPC websocket of btcd from a set of transactions
+type btcdStandIn struct {
+	mu        sync.Mutex
+	txs       map[string]*wire.MsgTx
+	confirmed map[string]bool
+	blocks    map[string]*wire.MsgBlock
+	conn      *websocket.Conn
+
+	// filters receives the addresses of every loadtxfilter
+	filters chan []string
+}
+
+func newBtcdStandIn(t *testing.T) (*btcdStandIn, string) {
+	s := &btcdStandIn{
+		txs:       make(map[string]*wire.MsgTx),
+		confirmed: make(map[string]bool),
+		blocks:    make(map[string]*wire.MsgBlock),
+		filters:   make(chan []string, 10),
+	}
+	server := httptest.NewServer(http.HandlerFunc(s.serve))
+	t.Cleanup(server.Close)
+	return s, "ws://user:pass@" + strings.TrimPrefix(server.URL, "http://")
+}
+
+func (s *btcdStandIn) add(tx *wire.MsgTx, confirmed bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.txs[tx.TxHash().String()] = tx
+	s.confirmed[tx.TxHash().String()] = confirmed
+}
+
+func (s *btcdStandIn) serve(w http.ResponseWriter, r *http.Request) {
+	upgrader := websocket.Upgrader{}
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	s.mu.Lock()
+	s.conn = conn
+	s.mu.Unlock()
+
+	for {
+		_, message, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		var request struct {
+			ID     uint64            `json:"id"`
+			Method string            `json:"method"`
+			Params []json.RawMessage `json:"params"`
+		}
+		if err := json.Unmarshal(message, &request); err != nil {
+			return
+		}
+
+		result, rpcErr := s.handle(request.Method, request.Params)
+		s.write(map[string]any{"id": request.ID, "result": result, "error": rpcErr})
+	}
+}
+
+func (s *btcdStandIn) handle(method string, params []json.RawMessage) (any, *btcjson.RPCError) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var param string
+	if len(params) > 0 {
+		json.Unmarshal(params[0], &param)
+	}
+
+	switch method {
+	case "getinfo":
+		return map[string]any{"version": 240200}, nil
+	case "getrawtransaction":
+		tx, ok := s.txs[param]
+		if !ok {
+			return nil, btcjson.NewRPCError(btcjson.ErrRPCNoTxInfo, "No information available about transaction")
+		}
+		result := newTxRawResult(tx)
+		if s.confirmed[param] {
+			result.Confirmations = 1
+		}
+		return result, nil
+	case "sendrawtransaction":
+		raw, _ := hex.DecodeString(param)
+		tx := wire.NewMsgTx(2)
+		if err := tx.Deserialize(bytes.NewReader(raw)); err != nil {
+			return nil, btcjson.NewRPCError(btcjson.ErrRPCDeserialization, "TX decode failed: "+err.Error())
+		}
+		if _, ok := s.txs[tx.TxHash().String()]; ok {
+			return nil, btcjson.NewRPCError(btcjson.ErrRPCTxAlreadyInChain, "TX rejected: already have transaction in mempool "+tx.TxHash().String())
+		}
+		s.txs[tx.TxHash().String()] = tx
+		return tx.TxHash().String(), nil
+	case "getblock":
+		block, ok := s.blocks[param]
+		if !ok {
+			return nil, btcjson.NewRPCError(btcjson.ErrRPCBlockNotFound, "Block not found")
+		}
+		var buf bytes.Buffer
+		block.Serialize(&buf)
+		return hex.EncodeToString(buf.Bytes()), nil
+	case "estimatefee":
+		return 0.00012, nil
+	case "getblockcount":
+		return 812345, nil
+	case "notifyblocks", "notifynewtransactions":
+		return nil, nil
+	case "loadtxfilter":
+		var addresses []string
+		if len(params) > 1 {
+			json.Unmarshal(params[1], &addresses)
+		}
+		s.filters <- addresses
+		return nil, nil
+	}
+	return nil, btcjson.NewRPCError(btcjson.ErrRPCMethodNotFound.Code, "Method not found")
+}
+
+func (s *btcdStandIn) write(message any) {
+	data, _ := json.Marshal(message)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.conn.WriteMessage(websocket.TextMessage, data)
+}
+
+// notify pushes a notification to the client
+func (s *btcdStandIn) notify(method string, params ...any) {
+	s.write(map[string]any{"jsonrpc": "1.0", "method": method, "params": params, "id": nil})
+}
+
+func TestBtcdBackend(t *testing.T) {
+	standIn, url := newBtcdStandIn(t)
+	f := newBackendFixture(t)
+	standIn.add(f.parent, true)
+
+	backend, err := newBtcdBackend(url, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backend.client.Shutdown()
+	checkBackend(t, backend, f)
+
+	// btcd reports a transaction it already has with its own code
+	if _, err := backend.Broadcast(f.child); !errors.Is(err, errAlreadyKnown) {
+		t.Errorf("expected the transaction to be known already, got %v", err)
+	}
+
+	if feeRate, err := backend.EstimateFeeRate(1); err != nil || feeRate != 12 {
+		t.Errorf("expected a fee rate of 12 sat/vbyte, got %v (%v)", feeRate, err)
+	}
+	if height, err := backend.TipHeight(); err != nil || height != 812345 {
+		t.Errorf("expected height 812345, got %d (%v)", height, err)
+	}
+
+	queue := make(chan queuedTx, 1)
+	go backend.WatchTransactions(queue)
+	if addresses := <-standIn.filters; !slices.Contains(addresses, f.address) {
+		t.Fatalf("expected %s in the filter, got %v", f.address, addresses)
+	}
+
+	standIn.notify("relevanttxaccepted", txHex(f.child))
+	queued := waitQueued(t, queue)
+	if queued.msg.TxHash() != f.child.TxHash() || len(queued.msg.TxIn[0].Witness) != 2 {
+		t.Errorf("expected the child with its witness, got %+v", queued.msg)
+	}
+
+	// The block confirming the child carries it as matching the filter
+	var header bytes.Buffer
+	block := &wire.BlockHeader{Version: 4}
+	block.Serialize(&header)
+	standIn.notify("filteredblockconnected", 812346, hex.EncodeToString(header.Bytes()), []string{txHex(f.child)})
+	queued = waitQueued(t, queue)
+	if queued.msg.TxHash() != f.child.TxHash() || queued.confirmations != 1 || queued.blockHash != block.BlockHash().String() {
+		t.Errorf("expected the child confirmed in %s, got %s with %d confirmations in %q",
+			block.BlockHash(), queued.msg.TxHash(), queued.confirmations, queued.blockHash)
+	}
+	waitFor(t, "the connected block", func() bool {
+		height, err := backend.TipHeight()
+		return err == nil && height == 812346
+	})
+}
+
+func TestBtcdBackendNoFilter(t *testing.T) {
+	standIn, url := newBtcdStandIn(t)
+	f := newBackendFixture(t)
+
+	backend, err := newBtcdBackend(url, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backend.client.Shutdown()
+
+	// Every announcement fetches the block again
+	queue := make(chan queuedTx, 100)
+	go backend.WatchTransactions(queue)
+
+	// Without a filter nothing matches, so the block confirming the child is fetched whole
+	block := wire.NewMsgBlock(&wire.BlockHeader{Version: 4})
+	block.AddTransaction(f.child)
+	standIn.mu.Lock()
+	standIn.blocks[block.BlockHash().String()] = block
+	standIn.mu.Unlock()
+
+	var header bytes.Buffer
+	block.Header.Serialize(&header)
+	// The client may not have subscribed yet, so announce the block until it arrives
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		standIn.notify("filteredblockconnected", 812346, hex.EncodeToString(header.Bytes()), []string{})
+		select {
+		case queued := <-queue:
+			if queued.msg.TxHash() != f.child.TxHash() || queued.confirmations != 1 || queued.blockHash != block.BlockHash().String() {
+				t.Errorf("expected the child confirmed in %s, got %s with %d confirmations in %q",
+					block.BlockHash(), queued.msg.TxHash(), queued.confirmations, queued.blockHash)
+			}
+			return
+		case <-time.After(100 * time.Millisecond):
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for the block")
+		}
+	}
+}
+
+func TestBtcdRejection(t *testing.T) {
+	tests := map[string]error{
+		"-26: TX rejected: transaction 1a2b: replacement transaction has an insufficient fee rate: needs more than 2000, has 1500": errInsufficientFee,
+		"-26: TX rejected: transaction 1a2b has 100 fees which is under the required amount of 200":                                errInsufficientFee,
+		"-26: TX rejected: transaction output 0: payment is dust: 100":                                                             errDust,
+		"-25: TX rejected: orphan transaction 1a2b references outputs of unknown or fully-spent transaction 3c4d":                  errMissingInputs,
+		"-26: TX rejected: output already spent in mempool: output=3c4d:0, tx=5e6f":                                                errNotReplaceable,
+		"-26: TX rejected: 1a2b: replacement transaction evicts more transactions than permitted: max is 100, evicts 101":          errTooManyReplacements,
+		"-26: TX rejected: transaction 1a2b is not standard: transaction version 4 is not in the valid range of 1-3":               nil,
+	}
+	for msg, expected := range tests {
+		err := btcdRejection(errors.New(msg))
+		if expected != nil && !errors.Is(err, expected) {
+			t.Errorf("%q: expected %v, got %v", msg, expected, rejectionCause(err))
+		}
+		if cause := rejectionCause(err); cause != expected {
+			t.Errorf("%q: expected cause %v, got %v", msg, expected, cause)
+		}
+	}
+}
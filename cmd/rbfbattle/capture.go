@@ -0,0 +1,365 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/btcsuite/btcd/btcjson"
+	"github.com/btcsuite/btcd/rpcclient"
+)
+
+// A capture file has one JSON entry per line. The header comes first, followed by every
+// ZMQ message and RPC call in the order they happened.
+const (
+	captureHeader = "header"
+	captureZMQ    = "zmq"
+	captureRPC    = "rpc"
+)
+
+type captureEntry struct {
+	// T is the monotonic time since the recording started
+	T    time.Duration `json:"t"`
+	Kind string        `json:"kind"`
+
+	// Header
+	LockTimeSeed uint64 `json:"locktime_seed,omitempty"`
+
+	// ZMQ message. The body is hex encoded. Height is the chain tip when it arrived.
+	Topic  string `json:"topic,omitempty"`
+	Body   string `json:"body,omitempty"`
+	Seq    uint32 `json:"seq,omitempty"`
+	Height int64  `json:"height,omitempty"`
+
+	// RPC call. Path holds the wallet of wallet calls.
+	Path   string            `json:"path,omitempty"`
+	Method string            `json:"method,omitempty"`
+	Params []json.RawMessage `json:"params,omitempty"`
+	Result json.RawMessage   `json:"result,omitempty"`
+	Error  *btcjson.RPCError `json:"error,omitempty"`
+}
+
+// capture records the session when --record is set
+var capture *recorder
+
+// recorder writes the ZMQ messages we receive and the RPC calls we make to a capture file
+type recorder struct {
+	mu    sync.Mutex
+	start time.Time
+	file  *os.File
+	w     *bufio.Writer
+}
+
+func newRecorder(path string) (*recorder, error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, fmt.Errorf("error creating capture file: %v", err)
+	}
+
+	r := &recorder{start: time.Now(), file: file, w: bufio.NewWriter(file)}
+	r.record(&captureEntry{Kind: captureHeader, LockTimeSeed: lockTimeSeed})
+
+	slog.Info("Recording ZMQ messages and RPC calls", "file", path)
+	return r, nil
+}
+
+// record appends an entry and flushes it so a crash keeps everything up to it
+func (r *recorder) record(entry *captureEntry) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	entry.T = time.Since(r.start)
+	line, err := json.Marshal(entry)
+	if err != nil {
+		slog.Error("Error encoding capture entry", "err", err)
+		return
+	}
+
+	r.w.Write(append(line, '\n'))
+	r.w.Flush()
+}
+
+// recordZMQ records a multipart ZMQ message
+func (r *recorder) recordZMQ(msgs [][]byte) {
+	entry := &captureEntry{Kind: captureZMQ, Topic: string(msgs[0]), Body: hex.EncodeToString(msgs[1]), Height: tipHeight.Load()}
+	if len(msgs) > 2 && len(msgs[2]) == 4 {
+		entry.Seq = binary.LittleEndian.Uint32(msgs[2])
+	}
+	r.record(entry)
+}
+
+// recordRPC records a single or batched JSON-RPC exchange
+func (r *recorder) recordRPC(path string, reqBody, resBody []byte, _ time.Duration) {
+	type response struct {
+		ID     json.RawMessage   `json:"id"`
+		Result json.RawMessage   `json:"result"`
+		Error  *btcjson.RPCError `json:"error"`
+	}
+
+	var reqs []jsonRPCRequest
+	var responses []response
+
+	if bytes.HasPrefix(bytes.TrimSpace(reqBody), []byte("[")) {
+		json.Unmarshal(reqBody, &reqs)
+		json.Unmarshal(resBody, &responses)
+	} else {
+		var req jsonRPCRequest
+		var res response
+		json.Unmarshal(reqBody, &req)
+		json.Unmarshal(resBody, &res)
+		reqs, responses = []jsonRPCRequest{req}, []response{res}
+	}
+
+	// Responses carry the id of their request
+	byID := make(map[string]response)
+	for _, res := range responses {
+		byID[string(res.ID)] = res
+	}
+
+	for _, req := range reqs {
+		res := byID[string(req.ID)]
+		r.record(&captureEntry{
+			Kind:   captureRPC,
+			Path:   path,
+			Method: req.Method,
+			Params: req.Params,
+			Result: res.Result,
+			Error:  res.Error,
+		})
+	}
+}
+
+// replayNode serves a capture: RPC calls are answered with the recorded responses and
+// the ZMQ messages are fed to the bot one at a time
+type replayNode struct {
+	mu       sync.Mutex
+	header   *captureEntry
+	messages []*captureEntry
+	byCall   map[string][]*captureEntry
+	byMethod map[string][]*captureEntry
+
+	decisions     *json.Encoder
+	decisionsFile *os.File
+
+	listener net.Listener
+}
+
+// loadCapture reads a capture file
+func loadCapture(path string) (*replayNode, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("error opening capture file: %v", err)
+	}
+	defer file.Close()
+
+	n := &replayNode{
+		byCall:   make(map[string][]*captureEntry),
+		byMethod: make(map[string][]*captureEntry),
+	}
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(nil, 64<<20)
+	for line := 1; scanner.Scan(); line++ {
+		entry := &captureEntry{}
+		if err := json.Unmarshal(scanner.Bytes(), entry); err != nil {
+			return nil, fmt.Errorf("error parsing capture line %d: %v", line, err)
+		}
+
+		switch entry.Kind {
+		case captureHeader:
+			n.header = entry
+		case captureZMQ:
+			n.messages = append(n.messages, entry)
+		case captureRPC:
+			key := callKey(entry.Path, entry.Method, entry.Params)
+			n.byCall[key] = append(n.byCall[key], entry)
+			n.byMethod[entry.Path+" "+entry.Method] = append(n.byMethod[entry.Path+" "+entry.Method], entry)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("error reading capture file: %v", err)
+	}
+	if n.header == nil {
+		return nil, fmt.Errorf("capture file %s has no header", path)
+	}
+
+	return n, nil
+}
+
+func callKey(path, method string, params []json.RawMessage) string {
+	var buf bytes.Buffer
+	for _, param := range params {
+		json.Compact(&buf, param)
+		buf.WriteByte(',')
+	}
+	return path + " " + method + " " + buf.String()
+}
+
+// answer returns the recorded response of a call. Calls are matched with the same call,
+// or the same method when the parameters differ, in recorded order. The last response is reused.
+func (n *replayNode) answer(path string, req jsonRPCRequest) *captureEntry {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	for _, queue := range []struct {
+		entries map[string][]*captureEntry
+		key     string
+	}{
+		{n.byCall, callKey(path, req.Method, req.Params)},
+		{n.byMethod, path + " " + req.Method},
+	} {
+		entries := queue.entries[queue.key]
+		if len(entries) == 0 {
+			continue
+		}
+		if len(entries) > 1 {
+			queue.entries[queue.key] = entries[1:]
+		}
+		return entries[0]
+	}
+	return nil
+}
+
+func (n *replayNode) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if bytes.HasPrefix(bytes.TrimSpace(body), []byte("[")) {
+		var reqs []jsonRPCRequest
+		if err := json.Unmarshal(body, &reqs); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		responses := make([]jsonRPCResponse, len(reqs))
+		for i, req := range reqs {
+			responses[i] = n.call(r.URL.Path, req)
+		}
+		json.NewEncoder(w).Encode(responses)
+		return
+	}
+
+	var req jsonRPCRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	json.NewEncoder(w).Encode(n.call(r.URL.Path, req))
+}
+
+// isDecision checks if a call is something the bot decided to do rather than a lookup
+func isDecision(method string) bool {
+	return method == "sendrawtransaction" || method == "submitpackage"
+}
+
+func (n *replayNode) call(path string, req jsonRPCRequest) jsonRPCResponse {
+	res := jsonRPCResponse{ID: req.ID}
+
+	entry := n.answer(path, req)
+	if entry == nil {
+		res.Error = btcjson.NewRPCError(btcjson.ErrRPCMethodNotFound.Code, "Method not found in capture")
+	} else {
+		res.Result, res.Error = entry.Result, entry.Error
+	}
+
+	if isDecision(req.Method) && n.decisions != nil {
+		n.mu.Lock()
+		n.decisions.Encode(map[string]any{"method": req.Method, "params": req.Params})
+		n.mu.Unlock()
+	}
+
+	return res
+}
+
+// start serves RPC on localhost
+func (n *replayNode) start() error {
+	var err error
+	n.listener, err = net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return fmt.Errorf("error listening for RPC: %v", err)
+	}
+	go http.Serve(n.listener, n)
+
+	return nil
+}
+
+// run feeds the recorded ZMQ messages to the bot in lockstep instead of publishing them on a
+// timer. Each message is processed, and the battles it started or contested have answered,
+// before the chain tip moves to the next recorded height and the next message is fed, so a
+// replay makes the same decisions in the same order every time. With --replayspeed the
+// recorded gap to the next message, divided by the speed, is waited out first.
+func (n *replayNode) run(client *rpcclient.Client, config *Config) error {
+	start := time.Now()
+
+	var last time.Duration
+	for i, msg := range n.messages {
+		body, err := hex.DecodeString(msg.Body)
+		if err != nil {
+			return fmt.Errorf("error decoding captured message %d: %v", i, err)
+		}
+
+		if config.ReplaySpeed > 0 && msg.T > last {
+			time.Sleep(time.Duration(float64(msg.T-last) / config.ReplaySpeed))
+		}
+		last = msg.T
+
+		// Captures from before heights were recorded keep the tip of the start
+		if msg.Height != 0 && tipHeight.Swap(msg.Height) != msg.Height && config.SelfBumpBlocks > 0 {
+			checkSelfBumps(client, config)
+			battleWork.Wait()
+		}
+
+		msgs := [][]byte{[]byte(msg.Topic), body, binary.LittleEndian.AppendUint32(nil, msg.Seq)}
+		for _, queued := range zmqQueuedTxs(msgs, start.Add(msg.T), primaryNode, client) {
+			processNow(client, config, queued)
+		}
+		battleWork.Wait()
+	}
+
+	if n.decisionsFile != nil {
+		if err := n.decisionsFile.Close(); err != nil {
+			return fmt.Errorf("error writing decisions file: %v", err)
+		}
+	}
+	return nil
+}
+
+// replayCapture points the config at a node replaying the capture, whose run feeds the
+// recorded messages to the bot
+func replayCapture(config *Config) (*replayNode, error) {
+	node, err := loadCapture(config.Replay)
+	if err != nil {
+		return nil, err
+	}
+	if err := node.start(); err != nil {
+		return nil, err
+	}
+
+	if config.ReplayDecisions != "" {
+		node.decisionsFile, err = os.Create(config.ReplayDecisions)
+		if err != nil {
+			return nil, fmt.Errorf("error creating decisions file: %v", err)
+		}
+		node.decisions = json.NewEncoder(node.decisionsFile)
+	}
+
+	// Make the same random choices as the recorded session
+	seedLockTime(node.header.LockTimeSeed)
+
+	config.RPCHost = node.listener.Addr().String()
+	config.RPCUser, config.RPCPassword, config.RPCCookiePath = "replay", "replay", ""
+
+	return node, nil
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/btcec/v2"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/rpcclient"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+)
+
+func TestRecordAndReplay(t *testing.T) {
+	node, err := newMockNode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer node.Close()
+
+	path := filepath.Join(t.TempDir(), "capture.jsonl")
+	rec, err := newRecorder(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	host, err := startRPCProxy(node.RPCHost(), nil, rec.recordRPC)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := newTestClient(t, host)
+
+	key, _ := btcec.NewPrivateKey()
+	script := p2wpkhScript(key)
+	tx := spendP2WPKH(t, key, node.Fund(script, 50_000), wire.NewTxOut(50_000, script), 500)
+	if _, err := client.SendRawTransaction(tx, false); err != nil {
+		t.Fatal(err)
+	}
+	recordedHeight, err := client.GetBlockCount()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec.recordZMQ([][]byte{[]byte("hashtx"), {1, 2, 3}, {7, 0, 0, 0}})
+
+	replay, err := loadCapture(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if replay.header.LockTimeSeed != lockTimeSeed {
+		t.Errorf("expected lock time seed %d, got %d", lockTimeSeed, replay.header.LockTimeSeed)
+	}
+	if len(replay.messages) != 1 || replay.messages[0].Body != "010203" || replay.messages[0].Seq != 7 {
+		t.Errorf("unexpected messages %+v", replay.messages)
+	}
+
+	var decisions bytes.Buffer
+	replay.decisions = json.NewEncoder(&decisions)
+	if err := replay.start(); err != nil {
+		t.Fatal(err)
+	}
+	replayClient := newTestClient(t, replay.listener.Addr().String())
+
+	// The same calls get the recorded answers without a node
+	if height, err := replayClient.GetBlockCount(); err != nil || height != recordedHeight {
+		t.Errorf("expected recorded height %d, got %d, %v", recordedHeight, height, err)
+	}
+	txHash, err := replayClient.SendRawTransaction(tx, false)
+	if err != nil || *txHash != tx.TxHash() {
+		t.Errorf("expected recorded txid %s, got %v, %v", tx.TxHash(), txHash, err)
+	}
+	if _, err := replayClient.GetBestBlockHash(); err == nil || !strings.Contains(err.Error(), "not found in capture") {
+		t.Errorf("expected unrecorded call to fail, got %v", err)
+	}
+
+	scanner := bufio.NewScanner(&decisions)
+	var lines []string
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	if len(lines) != 1 || !strings.Contains(lines[0], `"sendrawtransaction"`) {
+		t.Errorf("expected the broadcast as the only decision, got %v", lines)
+	}
+}
+
+func TestReplayRunsInLockstep(t *testing.T) {
+	b := startBattle(t)
+	_, script := b.watch(t)
+
+	payment := wire.NewMsgTx(2)
+	payment.AddTxIn(wire.NewTxIn(&wire.OutPoint{Hash: chainhash.Hash{7}}, nil, nil))
+	payment.AddTxOut(wire.NewTxOut(100_000, script))
+	defer func() {
+		if utxo, ok := getMonitored(wire.OutPoint{Hash: payment.TxHash()}.String()); ok {
+			cleanup(utxo)
+		}
+	}()
+
+	// The node describes the payment, as it does for every payment to us from ZMQ
+	described, err := json.Marshal(newTxRawResult(payment))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	replay := &replayNode{
+		header: &captureEntry{Kind: captureHeader},
+		messages: []*captureEntry{
+			{T: time.Hour, Kind: captureZMQ, Topic: "rawtx", Body: txHex(payment), Seq: 1},
+		},
+		byCall: make(map[string][]*captureEntry),
+		byMethod: map[string][]*captureEntry{
+			"/ getnetworkinfo":    {{Kind: captureRPC, Method: "getnetworkinfo", Result: json.RawMessage(`{"version":280000}`)}},
+			"/ getrawtransaction": {{Kind: captureRPC, Method: "getrawtransaction", Result: described}},
+		},
+	}
+	var decisions bytes.Buffer
+	replay.decisions = json.NewEncoder(&decisions)
+	if err := replay.start(); err != nil {
+		t.Fatal(err)
+	}
+	client := newTestClient(t, replay.listener.Addr().String())
+
+	// At speed 0 the message is handled right away however late it was recorded, and the
+	// sweep of the payment is decided before run returns
+	start := time.Now()
+	if err := replay.run(client, &Config{backend: &bitcoindBackend{client: client}}); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("expected the replay to skip the recorded gaps, took %v", elapsed)
+	}
+
+	if !strings.Contains(decisions.String(), `"sendrawtransaction"`) {
+		t.Errorf("expected the sweep of the payment as a decision, got %q", decisions.String())
+	}
+}
+
+func TestReplaySpeed(t *testing.T) {
+	// Transactions of nobody the bot watches
+	unrelated := func(seq uint32) *captureEntry {
+		tx := wire.NewMsgTx(2)
+		tx.AddTxIn(wire.NewTxIn(&wire.OutPoint{Hash: chainhash.Hash{byte(seq)}}, nil, nil))
+		tx.AddTxOut(wire.NewTxOut(1000, []byte{txscript.OP_TRUE}))
+		return &captureEntry{T: time.Duration(seq) * 200 * time.Millisecond, Kind: captureZMQ, Topic: "rawtx", Body: txHex(tx), Seq: seq}
+	}
+	replay := &replayNode{
+		header:   &captureEntry{Kind: captureHeader},
+		messages: []*captureEntry{unrelated(1), unrelated(2), unrelated(3)},
+	}
+
+	// 600ms of recorded gaps take 60ms at 10x
+	start := time.Now()
+	if err := replay.run(nil, &Config{ReplaySpeed: 10}); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 60*time.Millisecond || elapsed > 600*time.Millisecond {
+		t.Errorf("expected the replay to take about 60ms at 10x speed, took %v", elapsed)
+	}
+}
+
+func newTestClient(t *testing.T, host string) *rpcclient.Client {
+	t.Helper()
+
+	client, err := rpcclient.New(&rpcclient.ConnConfig{
+		Host:         host,
+		User:         "user",
+		Pass:         "pass",
+		HTTPPostMode: true,
+		DisableTLS:   true,
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(client.Shutdown)
+	return client
+}
@@ -0,0 +1,333 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/rpcclient"
+	"github.com/gdamore/tcell/v2"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/rivo/tview"
+)
+
+// dashboard is the full-screen terminal UI showing battles, the log feed, the funding pool,
+// node and ZMQ health and our profit and loss
+type dashboard struct {
+	client *rpcclient.Client
+	config *Config
+
+	app     *tview.Application
+	pages   *tview.Pages
+	battles *tview.Table
+	feed    *tview.TextView
+	health  *tview.TextView
+	funding *tview.TextView
+	pnl     *tview.TextView
+
+	// shown is the battles in the table, row 1 onwards
+	shown []battleStatus
+	// wallet is the latest listunspent summary of the funding pool
+	wallet string
+	// nodes is how many nodes we broadcast to, ours and the peers
+	nodes int
+}
+
+func newDashboard(client *rpcclient.Client, config *Config) *dashboard {
+	d := &dashboard{
+		client:  client,
+		config:  config,
+		app:     tview.NewApplication(),
+		battles: tview.NewTable().SetSelectable(true, false).SetFixed(1, 0),
+		feed:    tview.NewTextView().SetDynamicColors(true).SetMaxLines(1000),
+		health:  tview.NewTextView().SetDynamicColors(true),
+		funding: tview.NewTextView().SetDynamicColors(true),
+		pnl:     tview.NewTextView().SetDynamicColors(true),
+		nodes:   1 + len(config.peers),
+	}
+
+	d.battles.SetBorder(true).SetTitle(" Battles ")
+	d.feed.SetBorder(true).SetTitle(" Events ")
+	d.health.SetBorder(true).SetTitle(" Health ")
+	d.funding.SetBorder(true).SetTitle(" Funding ")
+	d.pnl.SetBorder(true).SetTitle(" Profit and loss ")
+	d.feed.SetChangedFunc(func() { d.app.Draw() })
+
+	side := tview.NewFlex().SetDirection(tview.FlexRow).
+		AddItem(d.health, 0, 1, false).
+		AddItem(d.funding, 0, 1, false).
+		AddItem(d.pnl, 0, 1, false)
+	top := tview.NewFlex().
+		AddItem(d.battles, 0, 3, true).
+		AddItem(side, 0, 1, false)
+	help := tview.NewTextView().SetText(" a abandon   b burn   p pause/resume   q quit")
+	layout := tview.NewFlex().SetDirection(tview.FlexRow).
+		AddItem(top, 0, 1, true).
+		AddItem(d.feed, 0, 1, false).
+		AddItem(help, 1, 0, false)
+
+	d.pages = tview.NewPages().AddPage("main", layout, true, true)
+	d.app.SetRoot(d.pages, true).SetInputCapture(d.handleKey)
+
+	return d
+}
+
+// run shows the dashboard until q is pressed. The logs are written to the event feed meanwhile.
+func (d *dashboard) run() error {
+	handler, err := newLogHandler(feedWriter{tview.ANSIWriter(d.feed)}, d.config.LogFormat, d.config.logLevel)
+	if err != nil {
+		return err
+	}
+	slog.SetDefault(slog.New(handler))
+
+	// Redraw as soon as a battle changes. The ticker below keeps the health panel current.
+	bus.Subscribe(func(e Event) {
+		if _, ok := e.(TxSeen); !ok {
+			go d.app.QueueUpdateDraw(d.render)
+		}
+	})
+
+	go func() {
+		for i := 0; ; i++ {
+			// The wallet is polled less often to keep RPC calls down
+			if i%5 == 0 {
+				wallet := d.walletSummary()
+				d.app.QueueUpdate(func() { d.wallet = wallet })
+			}
+			d.app.QueueUpdateDraw(d.render)
+			time.Sleep(time.Second)
+		}
+	}()
+
+	return d.app.Run()
+}
+
+// walletSummary sums up the confirmed coins in the wallet that fund our replacements
+func (d *dashboard) walletSummary() string {
+	unspent, err := d.client.ListUnspentMin(1)
+	if err != nil {
+		return fmt.Sprintf("[red]%v[-]", tview.Escape(err.Error()))
+	}
+
+	var total float64
+	for _, utxo := range unspent {
+		total += utxo.Amount
+	}
+	return fmt.Sprintf("%d confirmed coins, %s", len(unspent), btcAmount(total))
+}
+
+// render updates every panel but the event feed
+func (d *dashboard) render() {
+	d.renderBattles(battleStatuses())
+
+	status := currentStatus(d.config)
+
+	var health strings.Builder
+	if status.Node.Error != "" {
+		fmt.Fprintf(&health, "Node  [red]%s[-]\n", tview.Escape(status.Node.Error))
+	} else {
+		fmt.Fprintf(&health, "Node  [green]ok[-] height %d%s\n", status.Node.Height, since(status.Node.LastSeen))
+	}
+	fmt.Fprintf(&health, "ZMQ   %d messages, %d gaps%s\n", status.ZMQ.Messages, status.ZMQ.Gaps, since(status.ZMQ.LastMessage))
+	if status.Paused {
+		health.WriteString("[yellow]Engagements paused[-]\n")
+	}
+	d.health.SetText(health.String())
+
+	var funding strings.Builder
+	fmt.Fprintf(&funding, "%s\n%d reserved\n", d.wallet, len(status.Reservations))
+	for _, r := range status.Reservations {
+		fmt.Fprintf(&funding, " %s %s\n", shortOutpoint(r.Coin), r.Battle)
+	}
+	d.funding.SetText(funding.String())
+
+	d.pnl.SetText(fmt.Sprintf(
+		"Won %.0f  lost %.0f  burned %.0f\nRecovered [green]%s[-]\nFees paid %s\nBurned    [red]%s[-]\n",
+		counterValue(metricBattles.WithLabelValues("won")),
+		counterValue(metricBattles.WithLabelValues("lost")),
+		counterValue(metricBattles.WithLabelValues("burned")),
+		btcutil.Amount(counterValue(metricValueRecovered)),
+		btcutil.Amount(counterValue(metricFeesPaid)),
+		btcutil.Amount(counterValue(metricBurned)),
+	))
+}
+
+func (d *dashboard) renderBattles(battles []battleStatus) {
+	// Keep the selection on the same battle as rows come and go
+	var selected string
+	if row, _ := d.battles.GetSelection(); row > 0 && row <= len(d.shown) {
+		selected = d.shown[row-1].ID
+	}
+
+	d.shown = battles
+	d.battles.Clear()
+	for col, title := range []string{"Battle", "Outpoint", "Amount", "State", "Fee rate ladder", "Counterpart", "Ours on"} {
+		d.battles.SetCell(0, col, tview.NewTableCell(title).SetTextColor(tcell.ColorYellow).SetSelectable(false))
+	}
+
+	for i, battle := range battles {
+		row := i + 1
+		d.battles.SetCell(row, 0, tview.NewTableCell(battle.ID))
+		d.battles.SetCell(row, 1, tview.NewTableCell(shortOutpoint(battle.Outpoint)))
+		d.battles.SetCell(row, 2, tview.NewTableCell(battle.Amount.String()).SetAlign(tview.AlignRight))
+		d.battles.SetCell(row, 3, tview.NewTableCell(string(battle.State)).SetTextColor(stateColor(battle.State)))
+		d.battles.SetCell(row, 4, tview.NewTableCell(feeLadder(battle.History)).SetExpansion(1))
+		d.battles.SetCell(row, 5, tview.NewTableCell(shortTxID(battle.Counterpart)))
+		d.battles.SetCell(row, 6, tview.NewTableCell(nodesHoldingOurs(battle, d.nodes)))
+		if battle.ID == selected {
+			d.battles.Select(row, 0)
+		}
+	}
+}
+
+func (d *dashboard) handleKey(event *tcell.EventKey) *tcell.EventKey {
+	// Leave the keys to the confirmation dialog when it's open
+	if name, _ := d.pages.GetFrontPage(); name != "main" {
+		return event
+	}
+
+	switch event.Rune() {
+	case 'q':
+		d.app.Stop()
+	case 'p':
+		paused := !engagementsPaused.Load()
+		engagementsPaused.Store(paused)
+		slog.Warn("Changed engagements from the dashboard", "paused", paused)
+	case 'a':
+		d.confirm("Abandon", func(utxo *TrackedUTXO) {
+			abandonBattle(utxo)
+		})
+	case 'b':
+		d.confirm("Burn", func(utxo *TrackedUTXO) {
+			if err := forceBurn(d.client, d.config, utxo); err != nil {
+				utxo.logger().Error("Error burning utxo", "err", err)
+			}
+		})
+	default:
+		return event
+	}
+	return nil
+}
+
+// confirm asks before running an action on the selected battle
+func (d *dashboard) confirm(action string, run func(utxo *TrackedUTXO)) {
+	row, _ := d.battles.GetSelection()
+	if row < 1 || row > len(d.shown) {
+		return
+	}
+	battle := d.shown[row-1]
+
+	modal := tview.NewModal().
+		SetText(fmt.Sprintf("%s battle %s over %s?", action, battle.ID, battle.Outpoint)).
+		AddButtons([]string{action, "Cancel"}).
+		SetDoneFunc(func(_ int, label string) {
+			d.pages.RemovePage("confirm")
+			if label != action {
+				return
+			}
+			if utxo, ok := getMonitored(battle.Outpoint); ok {
+				// Burning calls the node, which must not block the UI
+				go run(utxo)
+			}
+		})
+	d.pages.AddPage("confirm", modal, false, true)
+}
+
+// feedWriter escapes log lines that would otherwise be read as colour tags
+type feedWriter struct {
+	w io.Writer
+}
+
+func (f feedWriter) Write(p []byte) (int, error) {
+	if _, err := io.WriteString(f.w, tview.Escape(string(p))); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// runDashboard shows the dashboard and exits when it's closed
+func runDashboard(client *rpcclient.Client, config *Config) {
+	if err := newDashboard(client, config).run(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
+
+// feeLadder shows the fee rates of our transactions in a battle, from the sweep to the latest replacement
+func feeLadder(history []battleEvent) string {
+	var rates []string
+	for _, event := range history {
+		if event.Kind == "counterpart" || event.FeeRate == 0 {
+			continue
+		}
+		rates = append(rates, fmt.Sprintf("%.1f", event.FeeRate))
+	}
+	return strings.Join(rates, " → ")
+}
+
+// nodesHoldingOurs shows how many of the nodes have our latest transaction in their mempool
+func nodesHoldingOurs(battle battleStatus, nodes int) string {
+	var ours string
+	for _, event := range battle.History {
+		if event.Kind != "counterpart" {
+			ours = event.TxID
+		}
+	}
+
+	holding := 0
+	for _, txid := range battle.Views {
+		if txid == ours {
+			holding++
+		}
+	}
+	return fmt.Sprintf("%d/%d", holding, nodes)
+}
+
+func stateColor(state battleState) tcell.Color {
+	switch state {
+	case stateContested, stateReplaced:
+		return tcell.ColorYellow
+	case stateWon:
+		return tcell.ColorGreen
+	case stateLost, stateBurned:
+		return tcell.ColorRed
+	default:
+		return tcell.ColorWhite
+	}
+}
+
+func counterValue(c prometheus.Counter) float64 {
+	var m dto.Metric
+	c.Write(&m)
+	return m.GetCounter().GetValue()
+}
+
+func btcAmount(btc float64) string {
+	amount, _ := btcutil.NewAmount(btc)
+	return amount.String()
+}
+
+func since(t *time.Time) string {
+	if t == nil {
+		return ""
+	}
+	return fmt.Sprintf(", %s ago", time.Since(*t).Round(time.Second))
+}
+
+func shortOutpoint(outpoint string) string {
+	txid, vout, _ := strings.Cut(outpoint, ":")
+	return shortTxID(txid) + ":" + vout
+}
+
+func shortTxID(txid string) string {
+	if len(txid) <= 12 {
+		return txid
+	}
+	return txid[:8] + "…" + txid[len(txid)-4:]
+}
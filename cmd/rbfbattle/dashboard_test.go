@@ -0,0 +1,39 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/rivo/tview"
+)
+
+func TestFeeLadder(t *testing.T) {
+	history := []battleEvent{
+		{Kind: "sweep", FeeRate: 2},
+		{Kind: "counterpart", FeeRate: 3},
+		{Kind: "replacement", FeeRate: 4.5},
+		{Kind: "burn", FeeRate: 80},
+	}
+
+	if got, want := feeLadder(history), "2.0 → 4.5 → 80.0"; got != want {
+		t.Errorf("expected ladder %q, got %q", want, got)
+	}
+}
+
+func TestDashboardKeepsSelection(t *testing.T) {
+	d := &dashboard{battles: tview.NewTable().SetSelectable(true, false)}
+
+	first := battleStatus{ID: "aaaa", Outpoint: "11:0", State: stateSweeping}
+	second := battleStatus{ID: "bbbb", Outpoint: "22:0", State: stateContested}
+	d.renderBattles([]battleStatus{first, second})
+	d.battles.Select(2, 0)
+
+	// A new battle sorted before the selected one moves it down a row
+	d.renderBattles([]battleStatus{{ID: "cccc", Outpoint: "00:0"}, first, second})
+
+	if row, _ := d.battles.GetSelection(); row != 3 {
+		t.Errorf("expected battle bbbb to stay selected at row 3, got row %d", row)
+	}
+	if got := d.battles.GetCell(3, 3).Text; got != string(stateContested) {
+		t.Errorf("expected state %s, got %s", stateContested, got)
+	}
+}
@@ -0,0 +1,390 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/btcsuite/btcd/btcec/v2"
+	"github.com/btcsuite/btcd/btcec/v2/schnorr"
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/btcutil/hdkeychain"
+	"github.com/btcsuite/btcd/rpcclient"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+)
+
+// DestinationProvider hands out the address a new battle sweeps the utxo to.
+type DestinationProvider interface {
+	// Next returns the destination for the next battle.
+	Next() (btcutil.Address, error)
+}
+
+var (
+	destinations DestinationProvider
+
+	// The output scripts of every destination we have handed out, so our own transactions
+	// are recognised even when they don't pay the current destination.
+	ourDestinations   = make(map[string]struct{})
+	ourDestinationsMu sync.RWMutex
+)
+
+// newDestinationProvider creates the destination provider selected in the config
+func newDestinationProvider(config *Config) (DestinationProvider, error) {
+	switch {
+	case config.DestinationWallet != "":
+		client, err := newRPCClient(config, config.DestinationWallet)
+		if err != nil {
+			return nil, fmt.Errorf("error connecting to destination wallet %s: %v", config.DestinationWallet, err)
+		}
+		return &walletDestination{client: client}, nil
+	case config.DestinationDescriptor != "":
+		desc, err := parseRangedDescriptor(config.DestinationDescriptor)
+		if err != nil {
+			return nil, fmt.Errorf("invalid destination descriptor: %v", err)
+		}
+		return newDescriptorDestination(desc, config.DestinationDescriptor, config.DestinationIndex, config.DestinationIndexFile)
+	case len(config.decodedDestinationAddresses) == 1:
+		return &staticDestination{address: config.decodedDestinationAddresses[0]}, nil
+	default:
+		return &rotatingDestination{addresses: config.decodedDestinationAddresses}, nil
+	}
+}
+
+// nextDestination picks the destination for a new battle and remembers it as ours
+func nextDestination() (btcutil.Address, error) {
+	addr, err := destinations.Next()
+	if err != nil {
+		return nil, err
+	}
+	script, err := txscript.PayToAddrScript(addr)
+	if err != nil {
+		return nil, fmt.Errorf("error creating script for destination %s: %v", addr, err)
+	}
+
+	ourDestinationsMu.Lock()
+	ourDestinations[string(script)] = struct{}{}
+	ourDestinationsMu.Unlock()
+
+	return addr, nil
+}
+
+// isOurDestination checks if an output script is one we have swept to
+func isOurDestination(script []byte) bool {
+	ourDestinationsMu.RLock()
+	defer ourDestinationsMu.RUnlock()
+
+	_, ok := ourDestinations[string(script)]
+	return ok
+}
+
+// paysToDestination checks if an output script pays to the destination of a battle
+func paysToDestination(script []byte, destination btcutil.Address) bool {
+	if destination == nil {
+		return false
+	}
+	destinationScript, err := txscript.PayToAddrScript(destination)
+	return err == nil && bytes.Equal(script, destinationScript)
+}
+
+// dustThreshold returns the smallest output value the node will relay for a script.
+// Like Bitcoin Core it's the cost of creating and spending the output at the
+// 3 sat/vbyte dust relay fee, which is 546 sats for P2PKH and 294 sats for P2WPKH.
+func dustThreshold(script []byte) btcutil.Amount {
+	if txscript.IsUnspendable(script) {
+		return 0
+	}
+
+	// Output plus an input spending it. Witness data is discounted.
+	size := wire.NewTxOut(0, script).SerializeSize() + 32 + 4 + 1 + 4
+	if txscript.IsWitnessProgram(script) {
+		size += 107 / 4
+	} else {
+		size += 107
+	}
+
+	return btcutil.Amount(3 * size)
+}
+
+// staticDestination sweeps everything to the same address
+type staticDestination struct {
+	address btcutil.Address
+}
+
+func (d *staticDestination) Next() (btcutil.Address, error) {
+	return d.address, nil
+}
+
+// rotatingDestination uses a list of addresses in turn
+type rotatingDestination struct {
+	mu        sync.Mutex
+	addresses []btcutil.Address
+	next      int
+}
+
+func (d *rotatingDestination) Next() (btcutil.Address, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	addr := d.addresses[d.next%len(d.addresses)]
+	d.next++
+	return addr, nil
+}
+
+// descriptorDestination derives a fresh address from a ranged descriptor for every sweep.
+// The next index is written to file before an address is handed out, so a restart
+// resumes after the last address instead of reusing it.
+type descriptorDestination struct {
+	mu    sync.Mutex
+	desc  *rangedDescriptor
+	index uint32
+
+	// file keeps the next index for descriptor. Empty doesn't keep it
+	file       string
+	descriptor string
+}
+
+// destinationIndex is the content of the destination index file
+type destinationIndex struct {
+	Descriptor string `json:"descriptor"`
+	Next       uint32 `json:"next"`
+}
+
+// newDescriptorDestination derives from index, or from where the index file says a previous
+// run of the same descriptor stopped when that is further
+func newDescriptorDestination(desc *rangedDescriptor, descriptor string, index uint32, file string) (*descriptorDestination, error) {
+	d := &descriptorDestination{desc: desc, index: index, file: file, descriptor: descriptor}
+	if file == "" {
+		return d, nil
+	}
+
+	data, err := os.ReadFile(file)
+	if errors.Is(err, os.ErrNotExist) {
+		return d, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("error reading destination index file: %v", err)
+	}
+
+	var saved destinationIndex
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return nil, fmt.Errorf("error parsing destination index file %s: %v", file, err)
+	}
+	if saved.Descriptor != descriptor {
+		slog.Warn("Destination index file is for another descriptor. Ignoring it", "file", file)
+		return d, nil
+	}
+	if saved.Next > d.index {
+		slog.Info("Resuming destination derivation", "index", saved.Next, "file", file)
+		d.index = saved.Next
+	}
+	return d, nil
+}
+
+func (d *descriptorDestination) Next() (btcutil.Address, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	addr, err := d.desc.derive(d.index)
+	if err != nil {
+		return nil, fmt.Errorf("error deriving destination %d: %v", d.index, err)
+	}
+
+	if err := d.save(d.index + 1); err != nil {
+		return nil, err
+	}
+
+	slog.Info("Derived destination", "address", addr.EncodeAddress(), "index", d.index)
+	d.index++
+	return addr, nil
+}
+
+// save writes the next index to the index file
+func (d *descriptorDestination) save(next uint32) error {
+	if d.file == "" {
+		return nil
+	}
+
+	data, err := json.Marshal(destinationIndex{Descriptor: d.descriptor, Next: next})
+	if err != nil {
+		return err
+	}
+
+	// Replace the file in one step so a crash can't leave it empty
+	tmp := d.file + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return fmt.Errorf("error writing destination index file: %v", err)
+	}
+	if err := os.Rename(tmp, d.file); err != nil {
+		return fmt.Errorf("error writing destination index file: %v", err)
+	}
+	return nil
+}
+
+// walletDestination asks a separate (cold, watch-only) wallet for a new address
+type walletDestination struct {
+	client *rpcclient.Client
+}
+
+func (d *walletDestination) Next() (btcutil.Address, error) {
+	// Use a raw request as rpcclient decodes the result with mainnet parameters
+	res, err := d.client.RawRequest("getnewaddress", nil)
+	if err != nil {
+		return nil, fmt.Errorf("error getting new destination address: %v", err)
+	}
+
+	var address string
+	if err := json.Unmarshal(res, &address); err != nil {
+		return nil, fmt.Errorf("error parsing new destination address: %v", err)
+	}
+
+	return btcutil.DecodeAddress(address, network)
+}
+
+// rangedDescriptor is a single-key output descriptor over an extended public key
+// ending with a /* wildcard, such as wpkh([d34db33f/84h/0h/0h]xpub.../0/*)
+type rangedDescriptor struct {
+	scriptType string
+	key        *hdkeychain.ExtendedKey
+	path       []uint32
+}
+
+// splitDescriptor returns the script type and the key expression without its origin of a
+// pkh(), wpkh(), sh(wpkh()) or tr() descriptor. The checksum is accepted but not verified.
+func splitDescriptor(descriptor string) (scriptType, key string, err error) {
+	descriptor, _, _ = strings.Cut(strings.TrimSpace(descriptor), "#")
+
+	for _, prefix := range []string{"sh(wpkh(", "wpkh(", "pkh(", "tr("} {
+		if strings.HasPrefix(descriptor, prefix) {
+			closing := strings.Count(prefix, "(")
+			if !strings.HasSuffix(descriptor, strings.Repeat(")", closing)) {
+				return "", "", fmt.Errorf("unbalanced parentheses in %s", descriptor)
+			}
+			scriptType = strings.TrimSuffix(prefix, "(")
+			key = descriptor[len(prefix) : len(descriptor)-closing]
+			break
+		}
+	}
+	if scriptType == "" {
+		return "", "", fmt.Errorf("unsupported descriptor %s", descriptor)
+	}
+
+	// Drop the key origin
+	if strings.HasPrefix(key, "[") {
+		end := strings.Index(key, "]")
+		if end < 0 {
+			return "", "", fmt.Errorf("unterminated key origin in %s", descriptor)
+		}
+		key = key[end+1:]
+	}
+
+	return scriptType, key, nil
+}
+
+// parseRangedDescriptor parses a destination descriptor over an extended public key
+func parseRangedDescriptor(descriptor string) (*rangedDescriptor, error) {
+	desc, err := parseExtendedDescriptor(descriptor)
+	if err != nil {
+		return nil, err
+	}
+	if desc.key.IsPrivate() {
+		return nil, fmt.Errorf("destination descriptor must use an extended public key")
+	}
+	return desc, nil
+}
+
+// parseExtendedDescriptor parses a descriptor over an extended key ending with /*
+func parseExtendedDescriptor(descriptor string) (*rangedDescriptor, error) {
+	scriptType, inner, err := splitDescriptor(descriptor)
+	if err != nil {
+		return nil, err
+	}
+
+	parts := strings.Split(inner, "/")
+	if len(parts) < 2 || parts[len(parts)-1] != "*" {
+		return nil, fmt.Errorf("descriptor is not ranged, expected the key path to end with /*")
+	}
+
+	key, err := hdkeychain.NewKeyFromString(parts[0])
+	if err != nil {
+		return nil, fmt.Errorf("error parsing extended key: %v", err)
+	}
+	if !key.IsForNet(network) {
+		return nil, fmt.Errorf("extended key is not for %s", network.Name)
+	}
+
+	var path []uint32
+	for _, part := range parts[1 : len(parts)-1] {
+		index, err := strconv.ParseUint(part, 10, 31)
+		if err != nil {
+			return nil, fmt.Errorf("invalid or hardened path element %q", part)
+		}
+		path = append(path, uint32(index))
+	}
+
+	return &rangedDescriptor{
+		scriptType: scriptType,
+		key:        key,
+		path:       path,
+	}, nil
+}
+
+// deriveKey returns the extended key at the wildcard index
+func (d *rangedDescriptor) deriveKey(index uint32) (*hdkeychain.ExtendedKey, error) {
+	key := d.key
+	for _, i := range d.path {
+		var err error
+		key, err = key.Derive(i)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return key.Derive(index)
+}
+
+// derive returns the address at the wildcard index
+func (d *rangedDescriptor) derive(index uint32) (btcutil.Address, error) {
+	key, err := d.deriveKey(index)
+	if err != nil {
+		return nil, err
+	}
+
+	pubKey, err := key.ECPubKey()
+	if err != nil {
+		return nil, err
+	}
+
+	return addressForPubKey(d.scriptType, pubKey)
+}
+
+// addressForPubKey returns the single-key address of the given descriptor script type
+func addressForPubKey(scriptType string, pubKey *btcec.PublicKey) (btcutil.Address, error) {
+	pubKeyHash := btcutil.Hash160(pubKey.SerializeCompressed())
+
+	switch scriptType {
+	case "pkh":
+		return btcutil.NewAddressPubKeyHash(pubKeyHash, network)
+	case "wpkh":
+		return btcutil.NewAddressWitnessPubKeyHash(pubKeyHash, network)
+	case "sh(wpkh":
+		redeemScript, err := txscript.NewScriptBuilder().
+			AddOp(txscript.OP_0).
+			AddData(pubKeyHash).
+			Script()
+		if err != nil {
+			return nil, err
+		}
+		return btcutil.NewAddressScriptHash(redeemScript, network)
+	case "tr":
+		outputKey := txscript.ComputeTaprootKeyNoScript(pubKey)
+		return btcutil.NewAddressTaproot(schnorr.SerializePubKey(outputKey), network)
+	default:
+		return nil, fmt.Errorf("unsupported script type %s", scriptType)
+	}
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/btcec/v2"
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/btcutil/hdkeychain"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+)
+
+func TestDescriptorDestination(t *testing.T) {
+	master, err := hdkeychain.NewMaster(bytes.Repeat([]byte{1}, 32), network)
+	if err != nil {
+		t.Fatal(err)
+	}
+	account, _ := master.Derive(hdkeychain.HardenedKeyStart + 84)
+	xpub, _ := account.Neuter()
+
+	desc, err := parseRangedDescriptor("wpkh([d34db33f/84h]" + xpub.String() + "/0/*)#checksum")
+	if err != nil {
+		t.Fatalf("error parsing descriptor: %v", err)
+	}
+
+	provider := &descriptorDestination{desc: desc, index: 5}
+	for i := uint32(5); i < 7; i++ {
+		addr, err := provider.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		change, _ := account.Derive(0)
+		child, _ := change.Derive(i)
+		pubKey, _ := child.ECPubKey()
+		expected, _ := btcutil.NewAddressWitnessPubKeyHash(btcutil.Hash160(pubKey.SerializeCompressed()), network)
+
+		if addr.EncodeAddress() != expected.EncodeAddress() {
+			t.Errorf("address %d is wrong. expected %s, received %s", i, expected, addr)
+		}
+	}
+
+	if _, err := parseRangedDescriptor("wpkh(" + xpub.String() + "/0/1)"); err == nil {
+		t.Errorf("expected an error for a non-ranged descriptor")
+	}
+}
+
+func TestDescriptorDestinationResumes(t *testing.T) {
+	master, err := hdkeychain.NewMaster(bytes.Repeat([]byte{2}, 32), network)
+	if err != nil {
+		t.Fatal(err)
+	}
+	xpub, _ := master.Neuter()
+	descriptor := "wpkh(" + xpub.String() + "/0/*)"
+	desc, err := parseRangedDescriptor(descriptor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(t.TempDir(), "destindex")
+
+	seen := make(map[string]bool)
+	for run := 0; run < 2; run++ {
+		// Every run starts from the configured index like after a restart
+		provider, err := newDescriptorDestination(desc, descriptor, 0, file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for range 2 {
+			addr, err := provider.Next()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if seen[addr.EncodeAddress()] {
+				t.Fatalf("destination %s was reused in run %d", addr, run)
+			}
+			seen[addr.EncodeAddress()] = true
+		}
+	}
+
+	// A file written for another descriptor isn't used
+	other, err := newDescriptorDestination(desc, descriptor+"#other", 1, file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if other.index != 1 {
+		t.Errorf("expected the index of another descriptor to be ignored, starting at %d", other.index)
+	}
+}
+
+func TestDestinationScripts(t *testing.T) {
+	addr, err := btcutil.DecodeAddress("bcrt1qhuwxrtqe2akhr4rz8vv97waw9g75ma4umekjln", network)
+	if err != nil {
+		t.Fatal(err)
+	}
+	script, _ := txscript.PayToAddrScript(addr)
+	other, _ := btcutil.DecodeAddress("mitTWaqPkdhcnW6mPAmhxi2pqmonRE4kns", network)
+	otherScript, _ := txscript.PayToAddrScript(other)
+
+	previous := destinations
+	destinations = &staticDestination{address: addr}
+	defer func() { destinations = previous }()
+
+	if _, err := nextDestination(); err != nil {
+		t.Fatal(err)
+	}
+	if !isOurDestination(script) || isOurDestination(otherScript) {
+		t.Error("expected only the script of the handed out destination to be ours")
+	}
+
+	if !paysToDestination(script, addr) || paysToDestination(otherScript, addr) {
+		t.Error("expected only the destination script to pay to the destination")
+	}
+	if paysToDestination(script, nil) {
+		t.Error("expected nothing to pay to a missing destination")
+	}
+}
+
+// countingDestination counts the destinations handed out
+type countingDestination struct {
+	DestinationProvider
+	count int
+}
+
+func (d *countingDestination) Next() (btcutil.Address, error) {
+	d.count++
+	return d.DestinationProvider.Next()
+}
+
+func TestDepositAnnouncedAgainKeepsDestination(t *testing.T) {
+	key, _ := btcec.NewPrivateKey()
+	address, err := addressForPubKey("wpkh", key.PubKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	watchAddress(address.EncodeAddress(), hex.EncodeToString(key.Serialize()))
+	defer unwatchAddress(address.EncodeAddress())
+
+	previous := destinations
+	counting := &countingDestination{DestinationProvider: &staticDestination{address: address}}
+	destinations = counting
+	defer func() { destinations = previous }()
+
+	payment := wire.NewMsgTx(2)
+	payment.AddTxIn(wire.NewTxIn(&wire.OutPoint{Index: 11}, nil, nil))
+	payment.AddTxOut(wire.NewTxOut(100_000, p2wpkhScript(key)))
+	outpoint := wire.OutPoint{Hash: payment.TxHash(), Index: 0}
+
+	// The battle over the deposit is starting when another node announces it
+	if !claim(outpoint) {
+		t.Fatal("expected to claim the deposit")
+	}
+	defer release(outpoint)
+
+	processTransaction(nil, newTxRawResult(payment), time.Now(), "peer", &Config{})
+	if counting.count != 0 {
+		t.Errorf("expected no destination for a deposit announced again, %d were handed out", counting.count)
+	}
+	if claim(outpoint) {
+		t.Error("expected the deposit to stay claimed")
+	}
+}
+
+func TestDustThreshold(t *testing.T) {
+	for address, expected := range map[string]btcutil.Amount{
+		"mitTWaqPkdhcnW6mPAmhxi2pqmonRE4kns":                               546,
+		"bcrt1qhuwxrtqe2akhr4rz8vv97waw9g75ma4umekjln":                     294,
+		"bcrt1pclm3u06yang46craktcg2ellcpsvuqxm33n3a2jxajq06rea7cws4algse": 330,
+	} {
+		addr, err := btcutil.DecodeAddress(address, network)
+		if err != nil {
+			t.Fatal(err)
+		}
+		script, _ := txscript.PayToAddrScript(addr)
+
+		if dust := dustThreshold(script); dust != expected {
+			t.Errorf("dust threshold for %s is wrong. expected %d, received %d", address, expected, dust)
+		}
+	}
+}
@@ -0,0 +1,494 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+)
+
+const (
+	electrumTimeout        = 30 * time.Second
+	electrumRetryInterval  = 5 * time.Second
+	electrumResyncInterval = 30 * time.Second
+	electrumProtocol       = "1.4"
+	// blockchain.scripthash.unsubscribe came with 1.4.2, so it is asked for when the server has it
+	electrumProtocolMax = "1.4.2"
+)
+
+// electrumBackend talks the Electrum protocol to a server such as electrs or Fulcrum.
+// New transactions are found by subscribing to the script hashes of the watched addresses.
+type electrumBackend struct {
+	// addr is host:port, prefixed with ssl:// for TLS
+	addr string
+
+	mu   sync.Mutex
+	conn *electrumConn
+	// fees caches the fees the server reported for mempool transactions
+	fees map[string]btcutil.Amount
+}
+
+func newElectrumBackend(addr string) *electrumBackend {
+	return &electrumBackend{addr: addr, fees: make(map[string]btcutil.Amount)}
+}
+
+// electrumConn is a connection carrying requests and subscription notifications
+type electrumConn struct {
+	conn   net.Conn
+	nextID uint64
+
+	mu      sync.Mutex
+	pending map[uint64]chan electrumMessage
+	err     error
+
+	notifications chan electrumMessage
+	closed        chan struct{}
+}
+
+// electrumMessage is a response, or a notification when it has a method
+type electrumMessage struct {
+	ID     *uint64          `json:"id"`
+	Result json.RawMessage  `json:"result"`
+	Error  *json.RawMessage `json:"error"`
+	Method string           `json:"method"`
+	Params json.RawMessage  `json:"params"`
+}
+
+func dialElectrum(addr string) (*electrumConn, error) {
+	var conn net.Conn
+	var err error
+	if host, ok := strings.CutPrefix(addr, "ssl://"); ok {
+		conn, err = tls.DialWithDialer(&net.Dialer{Timeout: electrumTimeout}, "tcp", host, nil)
+	} else {
+		conn, err = net.DialTimeout("tcp", strings.TrimPrefix(addr, "tcp://"), electrumTimeout)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	c := &electrumConn{
+		conn:          conn,
+		pending:       make(map[uint64]chan electrumMessage),
+		notifications: make(chan electrumMessage, 1000),
+		closed:        make(chan struct{}),
+	}
+	go c.read()
+
+	var version []string
+	if err := c.call("server.version", []any{"rbfbattle", []string{electrumProtocol, electrumProtocolMax}}, &version); err != nil {
+		c.conn.Close()
+		return nil, fmt.Errorf("error negotiating the Electrum protocol: %v", err)
+	}
+	slog.Info("Connected to Electrum server", "server", addr, "version", version)
+
+	return c, nil
+}
+
+// read dispatches responses to their calls and queues notifications until the connection fails
+func (c *electrumConn) read() {
+	scanner := bufio.NewScanner(c.conn)
+	scanner.Buffer(make([]byte, 64<<10), 16<<20)
+
+	for scanner.Scan() {
+		var message electrumMessage
+		if err := json.Unmarshal(scanner.Bytes(), &message); err != nil {
+			slog.Debug("Ignoring Electrum message", "err", err)
+			continue
+		}
+
+		if message.ID == nil {
+			// A full queue only delays the mempool until the next resync
+			select {
+			case c.notifications <- message:
+			default:
+				slog.Warn("Electrum notification queue is full", "method", message.Method)
+			}
+			continue
+		}
+
+		c.mu.Lock()
+		response, ok := c.pending[*message.ID]
+		delete(c.pending, *message.ID)
+		c.mu.Unlock()
+		if ok {
+			response <- message
+		}
+	}
+
+	c.mu.Lock()
+	c.err = scanner.Err()
+	if c.err == nil {
+		c.err = fmt.Errorf("connection closed by the server")
+	}
+	c.mu.Unlock()
+	close(c.closed)
+}
+
+// call sends a request and decodes its result into result
+func (c *electrumConn) call(method string, params []any, result any) error {
+	response := make(chan electrumMessage, 1)
+
+	c.mu.Lock()
+	if c.err != nil {
+		c.mu.Unlock()
+		return c.err
+	}
+	c.nextID++
+	id := c.nextID
+	c.pending[id] = response
+	request, err := json.Marshal(map[string]any{"jsonrpc": "2.0", "id": id, "method": method, "params": params})
+	if err == nil {
+		_, err = c.conn.Write(append(request, '\n'))
+	}
+	c.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	select {
+	case message := <-response:
+		if message.Error != nil {
+			return fmt.Errorf("electrum %s: %s", method, *message.Error)
+		}
+		if result == nil {
+			return nil
+		}
+		return json.Unmarshal(message.Result, result)
+	case <-c.closed:
+		return c.err
+	case <-time.After(electrumTimeout):
+		return fmt.Errorf("electrum %s timed out", method)
+	}
+}
+
+// connection returns the current connection to the server, reconnecting if it failed
+func (e *electrumBackend) connection() (*electrumConn, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.conn != nil {
+		select {
+		case <-e.conn.closed:
+		default:
+			return e.conn, nil
+		}
+	}
+
+	conn, err := dialElectrum(e.addr)
+	if err != nil {
+		return nil, err
+	}
+	e.conn = conn
+	return conn, nil
+}
+
+func (e *electrumBackend) call(method string, params []any, result any) error {
+	conn, err := e.connection()
+	if err != nil {
+		return err
+	}
+	return conn.call(method, params, result)
+}
+
+func (e *electrumBackend) rawTransaction(txid string) (*wire.MsgTx, error) {
+	var txHex string
+	if err := e.call("blockchain.transaction.get", []any{txid}, &txHex); err != nil {
+		return nil, err
+	}
+	raw, err := hex.DecodeString(txHex)
+	if err != nil {
+		return nil, err
+	}
+	tx := wire.NewMsgTx(wire.TxVersion)
+	if err := tx.Deserialize(bytes.NewReader(raw)); err != nil {
+		return nil, fmt.Errorf("error decoding transaction %s: %v", txid, err)
+	}
+	return tx, nil
+}
+
+// MempoolEntry returns the fee of the transaction alone. Unless the server reported it
+// for a watched address, it is worked out from the spent outputs.
+func (e *electrumBackend) MempoolEntry(txid string) (*mempoolSummary, error) {
+	tx, err := e.rawTransaction(txid)
+	if err != nil {
+		return nil, err
+	}
+	entry := &mempoolSummary{VSize: int32(txVirtualSize(tx))}
+
+	e.mu.Lock()
+	fee, ok := e.fees[txid]
+	e.mu.Unlock()
+	if ok {
+		entry.Fee = fee
+		return entry, nil
+	}
+
+	if entry.Fee, err = feeFromPrevOuts(e, tx); err != nil {
+		return nil, err
+	}
+	return entry, nil
+}
+
+func (e *electrumBackend) Broadcast(tx *wire.MsgTx) (*chainhash.Hash, error) {
+	var buf bytes.Buffer
+	if err := tx.Serialize(&buf); err != nil {
+		return nil, err
+	}
+
+	var txid string
+	if err := e.call("blockchain.transaction.broadcast", []any{hex.EncodeToString(buf.Bytes())}, &txid); err != nil {
+		return nil, err
+	}
+	return chainhash.NewHashFromStr(txid)
+}
+
+func (e *electrumBackend) PrevOut(outpoint wire.OutPoint) (*wire.TxOut, error) {
+	tx, err := e.rawTransaction(outpoint.Hash.String())
+	if err != nil {
+		return nil, err
+	}
+	if int(outpoint.Index) >= len(tx.TxOut) {
+		return nil, fmt.Errorf("transaction %s has no output %d", outpoint.Hash, outpoint.Index)
+	}
+	return tx.TxOut[outpoint.Index], nil
+}
+
+func (e *electrumBackend) EstimateFeeRate(blocks int) (float64, error) {
+	var btcPerKvB float64
+	if err := e.call("blockchain.estimatefee", []any{blocks}, &btcPerKvB); err != nil {
+		return 0, err
+	}
+	if btcPerKvB <= 0 {
+		return 0, fmt.Errorf("no fee estimate for %d blocks", blocks)
+	}
+	return btcPerKvB * 1_0000_0000 / 1000, nil
+}
+
+func (e *electrumBackend) TipHeight() (int64, error) {
+	var header struct {
+		Height int64 `json:"height"`
+	}
+	if err := e.call("blockchain.headers.subscribe", []any{}, &header); err != nil {
+		return 0, err
+	}
+	return header.Height, nil
+}
+
+// electrumSeenTx is a transaction queued from the subscription to a script hash
+type electrumSeenTx struct {
+	scriptHash string
+	// height is the height it was queued at, 0 in the mempool
+	height int64
+}
+
+// WatchTransactions subscribes to the watched addresses and reconnects whenever the connection fails.
+// The spends of our battles show up in the history of the address of the utxo when they confirm.
+func (e *electrumBackend) WatchTransactions(queue chan<- queuedTx) error {
+	seen := make(map[string]electrumSeenTx)
+	for {
+		err := e.watchScriptHashes(queue, seen)
+		slog.Warn("Electrum subscription lost", "server", e.addr, "err", err)
+		time.Sleep(electrumRetryInterval)
+	}
+}
+
+// electrumScriptHash is the key of an output script in the Electrum protocol
+func electrumScriptHash(script []byte) string {
+	hash := sha256.Sum256(script)
+	slices.Reverse(hash[:])
+	return hex.EncodeToString(hash[:])
+}
+
+// battleScriptHashes returns the script hashes of the utxos we battle over
+func battleScriptHashes() map[string]struct{} {
+	scriptHashes := make(map[string]struct{})
+	for _, utxo := range monitoredSnapshot() {
+		if script, err := hex.DecodeString(utxo.Script.Hex); err == nil {
+			scriptHashes[electrumScriptHash(script)] = struct{}{}
+		}
+	}
+	return scriptHashes
+}
+
+// forget drops the seen transactions matching drop along with their reported fees
+func (e *electrumBackend) forget(seen map[string]electrumSeenTx, drop func(txid string, tx electrumSeenTx) bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	for txid, tx := range seen {
+		if drop(txid, tx) {
+			delete(seen, txid)
+			delete(e.fees, txid)
+		}
+	}
+}
+
+func (e *electrumBackend) watchScriptHashes(queue chan<- queuedTx, seen map[string]electrumSeenTx) error {
+	conn, err := e.connection()
+	if err != nil {
+		return err
+	}
+
+	subscribed := make(map[string]struct{})
+	resync := time.NewTicker(electrumResyncInterval)
+	defer resync.Stop()
+
+	for {
+		// Addresses come and go with the API, so subscribe to new ones as they show up
+		watched := make(map[string]struct{})
+		for _, script := range watchedScripts() {
+			scriptHash := electrumScriptHash(script)
+			watched[scriptHash] = struct{}{}
+			if _, ok := subscribed[scriptHash]; ok {
+				continue
+			}
+			var status *string
+			if err := conn.call("blockchain.scripthash.subscribe", []any{scriptHash}, &status); err != nil {
+				return err
+			}
+			subscribed[scriptHash] = struct{}{}
+			if status != nil {
+				e.queueMempool(conn, scriptHash, queue, seen)
+				e.queueConfirmedSpends(conn, scriptHash, queue, seen)
+			}
+		}
+
+		// and unsubscribe from the ones that went
+		for scriptHash := range subscribed {
+			if _, ok := watched[scriptHash]; ok {
+				continue
+			}
+			var unsubscribed bool
+			if err := conn.call("blockchain.scripthash.unsubscribe", []any{scriptHash}, &unsubscribed); err != nil {
+				slog.Debug("Failed to unsubscribe from an address that is no longer watched", "scripthash", scriptHash, "err", err)
+			}
+			delete(subscribed, scriptHash)
+			e.forget(seen, func(_ string, tx electrumSeenTx) bool { return tx.scriptHash == scriptHash })
+		}
+
+		select {
+		case <-conn.closed:
+			return conn.err
+		case <-resync.C:
+			// The confirmed spends of resolved battles won't be queued again
+			battles := battleScriptHashes()
+			e.forget(seen, func(_ string, tx electrumSeenTx) bool {
+				_, battle := battles[tx.scriptHash]
+				return tx.height > 0 && !battle
+			})
+		case message := <-conn.notifications:
+			if message.Method != "blockchain.scripthash.subscribe" {
+				continue
+			}
+			var params []json.RawMessage
+			var scriptHash string
+			if json.Unmarshal(message.Params, &params) != nil || len(params) == 0 || json.Unmarshal(params[0], &scriptHash) != nil {
+				continue
+			}
+			if _, ok := subscribed[scriptHash]; !ok {
+				continue
+			}
+			e.queueMempool(conn, scriptHash, queue, seen)
+			e.queueConfirmedSpends(conn, scriptHash, queue, seen)
+		}
+	}
+}
+
+// queueMempool queues the mempool transactions of a script hash we haven't seen yet, and forgets
+// the ones that left the mempool
+func (e *electrumBackend) queueMempool(conn *electrumConn, scriptHash string, queue chan<- queuedTx, seen map[string]electrumSeenTx) {
+	seenAt := time.Now()
+
+	var mempool []struct {
+		TxHash string `json:"tx_hash"`
+		Fee    int64  `json:"fee"`
+	}
+	if err := conn.call("blockchain.scripthash.get_mempool", []any{scriptHash}, &mempool); err != nil {
+		slog.Error("Error getting the mempool of a watched address", "scripthash", scriptHash, "err", err)
+		return
+	}
+
+	inMempool := make(map[string]struct{}, len(mempool))
+	for _, entry := range mempool {
+		inMempool[entry.TxHash] = struct{}{}
+		if _, ok := seen[entry.TxHash]; ok {
+			continue
+		}
+
+		tx, err := e.rawTransaction(entry.TxHash)
+		if err != nil {
+			slog.Error("Error getting transaction", "txid", entry.TxHash, "err", err)
+			continue
+		}
+
+		e.mu.Lock()
+		seen[entry.TxHash] = electrumSeenTx{scriptHash: scriptHash}
+		e.fees[entry.TxHash] = btcutil.Amount(entry.Fee)
+		e.mu.Unlock()
+
+		queue <- queuedTx{msg: tx, seenAt: seenAt, node: primaryNode}
+	}
+
+	// Replaced transactions are gone, and confirmed ones show up in the history
+	e.forget(seen, func(txid string, tx electrumSeenTx) bool {
+		_, ok := inMempool[txid]
+		return tx.scriptHash == scriptHash && tx.height == 0 && !ok
+	})
+}
+
+// queueConfirmedSpends queues the confirmed transactions of a script hash spending a utxo we battle over
+func (e *electrumBackend) queueConfirmedSpends(conn *electrumConn, scriptHash string, queue chan<- queuedTx, seen map[string]electrumSeenTx) {
+	// Only the script of a battle has its spends in the history
+	if _, ok := battleScriptHashes()[scriptHash]; !ok {
+		return
+	}
+	seenAt := time.Now()
+
+	var history []struct {
+		TxHash string `json:"tx_hash"`
+		Height int64  `json:"height"`
+	}
+	if err := conn.call("blockchain.scripthash.get_history", []any{scriptHash}, &history); err != nil {
+		slog.Error("Error getting the history of a watched address", "scripthash", scriptHash, "err", err)
+		return
+	}
+
+	for _, entry := range history {
+		// Mempool transactions have a height of 0, or -1 with unconfirmed parents
+		if entry.Height <= 0 || seen[entry.TxHash].height > 0 {
+			continue
+		}
+
+		tx, err := e.rawTransaction(entry.TxHash)
+		if err != nil {
+			slog.Error("Error getting transaction", "txid", entry.TxHash, "err", err)
+			continue
+		}
+
+		e.mu.Lock()
+		seen[entry.TxHash] = electrumSeenTx{scriptHash: scriptHash, height: entry.Height}
+		delete(e.fees, entry.TxHash)
+		e.mu.Unlock()
+
+		if !slices.ContainsFunc(tx.TxIn, func(txIn *wire.TxIn) bool {
+			_, ok := getMonitoredOutPoint(txIn.PreviousOutPoint)
+			return ok
+		}) {
+			continue
+		}
+		queue <- queuedTx{msg: tx, seenAt: seenAt, node: primaryNode, confirmations: confirmationsAt(entry.Height)}
+	}
+}
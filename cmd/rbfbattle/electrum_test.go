@@ -0,0 +1,224 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"net"
+	"sync"
+	"testing"
+
+	"github.com/btcsuite/btcd/wire"
+)
+
+// electrumStandIn answers the Electrum calls of electrumBackend from a set of transactions
+type electrumStandIn struct {
+	mu   sync.Mutex
+	txs  map[string]*wire.MsgTx
+	conn net.Conn
+	// heights of the confirmed transactions in the history of every script hash
+	heights map[string]int64
+
+	subscribed   chan string
+	unsubscribed chan string
+}
+
+func newElectrumStandIn(t *testing.T) (*electrumStandIn, string) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	s := &electrumStandIn{
+		txs:          make(map[string]*wire.MsgTx),
+		heights:      make(map[string]int64),
+		subscribed:   make(chan string, 100),
+		unsubscribed: make(chan string, 100),
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s, listener.Addr().String()
+}
+
+func (s *electrumStandIn) add(tx *wire.MsgTx) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.txs[tx.TxHash().String()] = tx
+}
+
+func (s *electrumStandIn) serve(conn net.Conn) {
+	defer conn.Close()
+
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		var request struct {
+			ID     uint64            `json:"id"`
+			Method string            `json:"method"`
+			Params []json.RawMessage `json:"params"`
+		}
+		if err := json.Unmarshal(scanner.Bytes(), &request); err != nil {
+			return
+		}
+
+		var param string
+		if len(request.Params) > 0 {
+			json.Unmarshal(request.Params[0], &param)
+		}
+		result, errMessage := s.handle(conn, request.Method, param)
+
+		response := map[string]any{"jsonrpc": "2.0", "id": request.ID, "result": result}
+		if errMessage != "" {
+			response["error"] = map[string]any{"code": 1, "message": errMessage}
+		}
+		s.write(conn, response)
+	}
+}
+
+func (s *electrumStandIn) handle(conn net.Conn, method, param string) (any, string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch method {
+	case "server.version":
+		return []string{"ElectrumX 1.16.0", electrumProtocol}, ""
+	case "blockchain.transaction.get":
+		tx, ok := s.txs[param]
+		if !ok {
+			return nil, "missing transaction"
+		}
+		return txHex(tx), ""
+	case "blockchain.transaction.broadcast":
+		raw, _ := hex.DecodeString(param)
+		tx := wire.NewMsgTx(2)
+		if err := tx.Deserialize(bytes.NewReader(raw)); err != nil {
+			return nil, "TX decode failed"
+		}
+		s.txs[tx.TxHash().String()] = tx
+		return tx.TxHash().String(), ""
+	case "blockchain.estimatefee":
+		// 0.00012 BTC/kvB is 12 sat/vbyte
+		return 0.00012, ""
+	case "blockchain.headers.subscribe":
+		return map[string]any{"height": 812345, "hex": ""}, ""
+	case "blockchain.scripthash.subscribe":
+		s.conn = conn
+		select {
+		case s.subscribed <- param:
+		default:
+		}
+		return nil, ""
+	case "blockchain.scripthash.unsubscribe":
+		select {
+		case s.unsubscribed <- param:
+		default:
+		}
+		return true, ""
+	case "blockchain.scripthash.get_mempool":
+		var mempool []map[string]any
+		for txid := range s.txs {
+			if _, ok := s.heights[txid]; !ok {
+				mempool = append(mempool, map[string]any{"tx_hash": txid, "height": 0, "fee": 500})
+			}
+		}
+		return mempool, ""
+	case "blockchain.scripthash.get_history":
+		var history []map[string]any
+		for txid, height := range s.heights {
+			history = append(history, map[string]any{"tx_hash": txid, "height": height})
+		}
+		return history, ""
+	}
+	return nil, "unknown method " + method
+}
+
+func (s *electrumStandIn) write(conn net.Conn, message any) {
+	data, _ := json.Marshal(message)
+	conn.Write(append(data, '\n'))
+}
+
+// notify tells the subscriber the status of a script hash changed
+func (s *electrumStandIn) notify(scriptHash string) {
+	s.mu.Lock()
+	conn := s.conn
+	s.mu.Unlock()
+
+	s.write(conn, map[string]any{"jsonrpc": "2.0", "method": "blockchain.scripthash.subscribe", "params": []string{scriptHash, "status"}})
+}
+
+func TestElectrumBackend(t *testing.T) {
+	standIn, addr := newElectrumStandIn(t)
+	f := newBackendFixture(t)
+	standIn.add(f.parent)
+
+	backend := newElectrumBackend(addr)
+	checkBackend(t, backend, f)
+
+	if feeRate, err := backend.EstimateFeeRate(1); err != nil || feeRate != 12 {
+		t.Errorf("expected a fee rate of 12 sat/vbyte, got %v (%v)", feeRate, err)
+	}
+	if height, err := backend.TipHeight(); err != nil || height != 812345 {
+		t.Errorf("expected height 812345, got %d (%v)", height, err)
+	}
+
+	// Only the child is in the mempool of the watched address
+	standIn.mu.Lock()
+	delete(standIn.txs, f.parent.TxHash().String())
+	standIn.mu.Unlock()
+
+	queue := make(chan queuedTx, 1)
+	go backend.WatchTransactions(queue)
+	// Other tests may have left addresses watched
+	for scriptHash := range standIn.subscribed {
+		if scriptHash == electrumScriptHash(f.script) {
+			break
+		}
+	}
+
+	standIn.notify(electrumScriptHash(f.script))
+	queued := waitQueued(t, queue)
+	if queued.msg.TxHash() != f.child.TxHash() || len(queued.msg.TxIn[0].Witness) != 2 {
+		t.Errorf("expected the child with its witness, got %+v", queued.msg)
+	}
+
+	entry, err := backend.MempoolEntry(f.child.TxHash().String())
+	if err != nil || entry.Fee != 500 {
+		t.Errorf("expected the reported fee of 500 sats, got %+v (%v)", entry, err)
+	}
+
+	// The child spending the utxo of a battle confirms
+	f.monitorParent(t)
+	standIn.mu.Lock()
+	standIn.heights[f.child.TxHash().String()] = 812340
+	standIn.mu.Unlock()
+
+	standIn.notify(electrumScriptHash(f.script))
+	queued = waitQueued(t, queue)
+	if queued.msg.TxHash() != f.child.TxHash() || queued.confirmations < 1 {
+		t.Errorf("expected the child confirmed, got %s with %d confirmations", queued.msg.TxHash(), queued.confirmations)
+	}
+	backend.mu.Lock()
+	_, cached := backend.fees[f.child.TxHash().String()]
+	backend.mu.Unlock()
+	if cached {
+		t.Error("expected the fee of the confirmed child to be forgotten")
+	}
+
+	// An address that is no longer watched is unsubscribed from
+	unwatchAddress(f.address)
+	standIn.notify(electrumScriptHash(f.script))
+	for scriptHash := range standIn.unsubscribed {
+		if scriptHash == electrumScriptHash(f.script) {
+			break
+		}
+	}
+}
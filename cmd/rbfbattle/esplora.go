@@ -0,0 +1,308 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/btcsuite/websocket"
+)
+
+const (
+	esploraTimeout = 10 * time.Second
+	// esploraResyncInterval is how often the tracked addresses are brought up to date
+	esploraResyncInterval = 30 * time.Second
+	esploraRetryInterval  = 5 * time.Second
+)
+
+// esploraBackend looks transactions up over the REST API of an Esplora server and follows
+// the watched addresses over its WebSocket, as served by mempool.space
+type esploraBackend struct {
+	// url is the base of the API, such as https://mempool.space/api
+	url  string
+	http *http.Client
+}
+
+func newEsploraBackend(url string) *esploraBackend {
+	return &esploraBackend{
+		url:  strings.TrimSuffix(url, "/"),
+		http: &http.Client{Timeout: esploraTimeout},
+	}
+}
+
+// esploraTx is a transaction as described by the REST API
+type esploraTx struct {
+	TxID   string `json:"txid"`
+	Fee    int64  `json:"fee"`
+	Weight int64  `json:"weight"`
+	Vin    []struct {
+		TxID string `json:"txid"`
+		Vout uint32 `json:"vout"`
+	} `json:"vin"`
+	Vout []struct {
+		ScriptPubKey string `json:"scriptpubkey"`
+		Value        int64  `json:"value"`
+	} `json:"vout"`
+	Status struct {
+		Confirmed   bool   `json:"confirmed"`
+		BlockHeight int64  `json:"block_height"`
+		BlockHash   string `json:"block_hash"`
+	} `json:"status"`
+}
+
+// spendsMonitored tells if the transaction spends one of the outpoints we battle over
+func (tx *esploraTx) spendsMonitored() bool {
+	for _, vin := range tx.Vin {
+		hash, err := chainhash.NewHashFromStr(vin.TxID)
+		if err != nil {
+			continue
+		}
+		if _, ok := getMonitoredOutPoint(wire.OutPoint{Hash: *hash, Index: vin.Vout}); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// request calls the REST API and returns the body of a successful response
+func (e *esploraBackend) request(method, path string, body io.Reader) ([]byte, error) {
+	req, err := http.NewRequest(method, e.url+path, body)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "text/plain")
+	}
+
+	resp, err := e.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 8<<20))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		// Broadcast errors carry the reject reason of the node behind the server
+		return nil, fmt.Errorf("esplora %s %s: %s: %s", method, path, resp.Status, strings.TrimSpace(string(data)))
+	}
+	return data, nil
+}
+
+func (e *esploraBackend) transaction(txid string) (*esploraTx, error) {
+	data, err := e.request(http.MethodGet, "/tx/"+txid, nil)
+	if err != nil {
+		return nil, err
+	}
+	var tx esploraTx
+	if err := json.Unmarshal(data, &tx); err != nil {
+		return nil, fmt.Errorf("error decoding transaction %s: %v", txid, err)
+	}
+	return &tx, nil
+}
+
+// rawTransaction fetches a transaction with its witnesses
+func (e *esploraBackend) rawTransaction(txid string) (*wire.MsgTx, error) {
+	data, err := e.request(http.MethodGet, "/tx/"+txid+"/hex", nil)
+	if err != nil {
+		return nil, err
+	}
+	raw, err := hex.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil {
+		return nil, err
+	}
+	tx := wire.NewMsgTx(wire.TxVersion)
+	if err := tx.Deserialize(bytes.NewReader(raw)); err != nil {
+		return nil, fmt.Errorf("error decoding transaction %s: %v", txid, err)
+	}
+	return tx, nil
+}
+
+// MempoolEntry returns the fee of the transaction alone, as Esplora doesn't track descendants
+func (e *esploraBackend) MempoolEntry(txid string) (*mempoolSummary, error) {
+	tx, err := e.transaction(txid)
+	if err != nil {
+		return nil, err
+	}
+	if tx.Status.Confirmed {
+		return nil, fmt.Errorf("transaction %s is not in the mempool", txid)
+	}
+	return &mempoolSummary{Fee: btcutil.Amount(tx.Fee), VSize: int32((tx.Weight + 3) / 4)}, nil
+}
+
+func (e *esploraBackend) Broadcast(tx *wire.MsgTx) (*chainhash.Hash, error) {
+	var buf bytes.Buffer
+	if err := tx.Serialize(&buf); err != nil {
+		return nil, err
+	}
+
+	data, err := e.request(http.MethodPost, "/tx", strings.NewReader(hex.EncodeToString(buf.Bytes())))
+	if err != nil {
+		return nil, err
+	}
+	return chainhash.NewHashFromStr(strings.TrimSpace(string(data)))
+}
+
+func (e *esploraBackend) PrevOut(outpoint wire.OutPoint) (*wire.TxOut, error) {
+	tx, err := e.transaction(outpoint.Hash.String())
+	if err != nil {
+		return nil, err
+	}
+	if int(outpoint.Index) >= len(tx.Vout) {
+		return nil, fmt.Errorf("transaction %s has no output %d", outpoint.Hash, outpoint.Index)
+	}
+
+	vout := tx.Vout[outpoint.Index]
+	script, err := hex.DecodeString(vout.ScriptPubKey)
+	if err != nil {
+		return nil, err
+	}
+	return wire.NewTxOut(vout.Value, script), nil
+}
+
+// EstimateFeeRate returns the estimate for the nearest target at or after blocks
+func (e *esploraBackend) EstimateFeeRate(blocks int) (float64, error) {
+	data, err := e.request(http.MethodGet, "/fee-estimates", nil)
+	if err != nil {
+		return 0, err
+	}
+	var estimates map[string]float64
+	if err := json.Unmarshal(data, &estimates); err != nil {
+		return 0, fmt.Errorf("error decoding fee estimates: %v", err)
+	}
+
+	var targets []int
+	for target := range estimates {
+		if n, err := strconv.Atoi(target); err == nil && n >= blocks {
+			targets = append(targets, n)
+		}
+	}
+	if len(targets) == 0 {
+		return 0, fmt.Errorf("no fee estimate for %d blocks", blocks)
+	}
+	sort.Ints(targets)
+	return estimates[strconv.Itoa(targets[0])], nil
+}
+
+func (e *esploraBackend) TipHeight() (int64, error) {
+	data, err := e.request(http.MethodGet, "/blocks/tip/height", nil)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+}
+
+// WatchTransactions follows the watched addresses and reconnects whenever the WebSocket drops.
+// The spends of our battles show up on the address of the utxo when they confirm.
+func (e *esploraBackend) WatchTransactions(queue chan<- queuedTx) error {
+	for {
+		err := e.watchAddresses(queue)
+		slog.Warn("Esplora WebSocket disconnected", "url", e.url, "err", err)
+		time.Sleep(esploraRetryInterval)
+	}
+}
+
+// esploraAddressEvent is a WebSocket message about the tracked addresses
+type esploraAddressEvent struct {
+	Multi map[string]struct {
+		Mempool   []esploraTx `json:"mempool"`
+		Confirmed []esploraTx `json:"confirmed"`
+	} `json:"multi-address-transactions"`
+	Single []esploraTx `json:"address-transactions"`
+	// SingleConfirmed are the transactions of a single tracked address in a new block
+	SingleConfirmed []esploraTx `json:"block-transactions"`
+}
+
+func (e *esploraBackend) watchAddresses(queue chan<- queuedTx) error {
+	wsURL := "ws" + strings.TrimPrefix(e.url, "http") + "/v1/ws"
+	conn, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	messages := make(chan []byte)
+	failed := make(chan error, 1)
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			_, message, err := conn.ReadMessage()
+			if err != nil {
+				failed <- err
+				return
+			}
+			select {
+			case messages <- message:
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	var tracked []string
+	resync := time.NewTicker(esploraResyncInterval)
+	defer resync.Stop()
+
+	for {
+		// Addresses come and go with the API, so keep the tracked ones up to date
+		if addresses := watchedAddresses(); !slices.Equal(addresses, tracked) {
+			request, _ := json.Marshal(map[string][]string{"track-addresses": addresses})
+			if err := conn.WriteMessage(websocket.TextMessage, request); err != nil {
+				return err
+			}
+			slog.Info("Tracking addresses on Esplora", "url", e.url, "addresses", len(addresses))
+			tracked = addresses
+		}
+
+		select {
+		case err := <-failed:
+			return err
+		case <-resync.C:
+		case message := <-messages:
+			seenAt := time.Now()
+
+			var event esploraAddressEvent
+			if err := json.Unmarshal(message, &event); err != nil {
+				slog.Debug("Ignoring Esplora message", "err", err)
+				continue
+			}
+			txs := append(event.Single, event.SingleConfirmed...)
+			for _, address := range event.Multi {
+				txs = append(txs, address.Mempool...)
+				txs = append(txs, address.Confirmed...)
+			}
+			for _, tx := range txs {
+				// Of the confirmed transactions only the spends of our battles matter
+				if tx.Status.Confirmed && !tx.spendsMonitored() {
+					continue
+				}
+				raw, err := e.rawTransaction(tx.TxID)
+				if err != nil {
+					slog.Error("Error getting transaction", "txid", tx.TxID, "err", err)
+					continue
+				}
+				queued := queuedTx{msg: raw, seenAt: seenAt, node: primaryNode}
+				if tx.Status.Confirmed {
+					queued.confirmations = confirmationsAt(tx.Status.BlockHeight)
+					queued.blockHash = tx.Status.BlockHash
+				}
+				queue <- queued
+			}
+		}
+	}
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/btcsuite/btcd/wire"
+	"github.com/btcsuite/websocket"
+)
+
+// esploraStandIn serves the REST API and the address tracking WebSocket of an Esplora server
+type esploraStandIn struct {
+	mu      sync.Mutex
+	txs     map[string]*wire.MsgTx
+	fees    map[string]int64
+	conn    *websocket.Conn
+	tracked chan []string
+}
+
+func newEsploraStandIn(t *testing.T) (*esploraStandIn, *httptest.Server) {
+	s := &esploraStandIn{
+		txs:     make(map[string]*wire.MsgTx),
+		fees:    make(map[string]int64),
+		tracked: make(chan []string, 10),
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/tx/{txid}", s.handleTx)
+	mux.HandleFunc("GET /api/tx/{txid}/hex", s.handleTxHex)
+	mux.HandleFunc("POST /api/tx", s.handleBroadcast)
+	mux.HandleFunc("GET /api/fee-estimates", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"1": 25.5, "3": 12, "6": 8.25}`))
+	})
+	mux.HandleFunc("GET /api/blocks/tip/height", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("812345"))
+	})
+	mux.HandleFunc("GET /api/v1/ws", s.handleWebSocket)
+
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return s, server
+}
+
+func (s *esploraStandIn) add(tx *wire.MsgTx, fee int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.txs[tx.TxHash().String()] = tx
+	s.fees[tx.TxHash().String()] = fee
+}
+
+func (s *esploraStandIn) lookup(w http.ResponseWriter, r *http.Request) (*wire.MsgTx, int64, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tx, ok := s.txs[r.PathValue("txid")]
+	if !ok {
+		http.Error(w, "Transaction not found", http.StatusNotFound)
+	}
+	return tx, s.fees[r.PathValue("txid")], ok
+}
+
+func (s *esploraStandIn) handleTx(w http.ResponseWriter, r *http.Request) {
+	tx, fee, ok := s.lookup(w, r)
+	if !ok {
+		return
+	}
+
+	var vout []map[string]any
+	for _, txOut := range tx.TxOut {
+		vout = append(vout, map[string]any{"scriptpubkey": hex.EncodeToString(txOut.PkScript), "value": txOut.Value})
+	}
+	json.NewEncoder(w).Encode(map[string]any{
+		"txid":   tx.TxHash().String(),
+		"fee":    fee,
+		"weight": tx.SerializeSizeStripped()*3 + tx.SerializeSize(),
+		"vout":   vout,
+		"status": map[string]any{"confirmed": false},
+	})
+}
+
+func (s *esploraStandIn) handleTxHex(w http.ResponseWriter, r *http.Request) {
+	if tx, _, ok := s.lookup(w, r); ok {
+		w.Write([]byte(txHex(tx)))
+	}
+}
+
+func (s *esploraStandIn) handleBroadcast(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	raw, err := hex.DecodeString(strings.TrimSpace(string(body)))
+	tx := wire.NewMsgTx(2)
+	if err != nil || tx.Deserialize(bytes.NewReader(raw)) != nil {
+		http.Error(w, "sendrawtransaction RPC error: {\"code\":-22,\"message\":\"TX decode failed\"}", http.StatusBadRequest)
+		return
+	}
+	s.add(tx, 500)
+	w.Write([]byte(tx.TxHash().String()))
+}
+
+func (s *esploraStandIn) handleWebSocket(w http.ResponseWriter, r *http.Request) {
+	upgrader := websocket.Upgrader{}
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	s.mu.Lock()
+	s.conn = conn
+	s.mu.Unlock()
+
+	for {
+		_, message, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		var request struct {
+			TrackAddresses []string `json:"track-addresses"`
+		}
+		if json.Unmarshal(message, &request) == nil {
+			s.tracked <- request.TrackAddresses
+		}
+	}
+}
+
+// announce pushes a mempool transaction of a tracked address
+func (s *esploraStandIn) announce(address string, tx *wire.MsgTx) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	message, _ := json.Marshal(map[string]any{
+		"multi-address-transactions": map[string]any{
+			address: map[string]any{
+				"mempool": []any{map[string]any{"txid": tx.TxHash().String(), "status": map[string]any{"confirmed": false}}},
+			},
+		},
+	})
+	return s.conn.WriteMessage(websocket.TextMessage, message)
+}
+
+// announceConfirmed pushes a transaction of a tracked address confirmed in a block
+func (s *esploraStandIn) announceConfirmed(address string, tx *wire.MsgTx, height int64, blockHash string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var vin []any
+	for _, txIn := range tx.TxIn {
+		vin = append(vin, map[string]any{"txid": txIn.PreviousOutPoint.Hash.String(), "vout": txIn.PreviousOutPoint.Index})
+	}
+	message, _ := json.Marshal(map[string]any{
+		"multi-address-transactions": map[string]any{
+			address: map[string]any{
+				"confirmed": []any{map[string]any{
+					"txid":   tx.TxHash().String(),
+					"vin":    vin,
+					"status": map[string]any{"confirmed": true, "block_height": height, "block_hash": blockHash},
+				}},
+			},
+		},
+	})
+	return s.conn.WriteMessage(websocket.TextMessage, message)
+}
+
+func TestEsploraBackend(t *testing.T) {
+	standIn, server := newEsploraStandIn(t)
+	f := newBackendFixture(t)
+	standIn.add(f.parent, 0)
+
+	backend := newEsploraBackend(server.URL + "/api/")
+	checkBackend(t, backend, f)
+
+	// The nearest target at or after 2 blocks
+	if feeRate, err := backend.EstimateFeeRate(2); err != nil || feeRate != 12 {
+		t.Errorf("expected a fee rate of 12 sat/vbyte, got %v (%v)", feeRate, err)
+	}
+	if height, err := backend.TipHeight(); err != nil || height != 812345 {
+		t.Errorf("expected height 812345, got %d (%v)", height, err)
+	}
+
+	queue := make(chan queuedTx, 1)
+	go backend.WatchTransactions(queue)
+	if tracked := <-standIn.tracked; !slices.Contains(tracked, f.address) {
+		t.Fatalf("expected %s to be tracked, got %v", f.address, tracked)
+	}
+
+	if err := standIn.announce(f.address, f.child); err != nil {
+		t.Fatal(err)
+	}
+	queued := waitQueued(t, queue)
+	if queued.msg.TxHash() != f.child.TxHash() || len(queued.msg.TxIn[0].Witness) != 2 {
+		t.Errorf("expected the child with its witness, got %+v", queued.msg)
+	}
+
+	// The child spending the utxo of a battle confirms
+	f.monitorParent(t)
+	if err := standIn.announceConfirmed(f.address, f.child, 812340, "00000000000000000001"); err != nil {
+		t.Fatal(err)
+	}
+	queued = waitQueued(t, queue)
+	if queued.msg.TxHash() != f.child.TxHash() || queued.confirmations < 1 || queued.blockHash != "00000000000000000001" {
+		t.Errorf("expected the child confirmed in block 1, got %s with %d confirmations in %q", queued.msg.TxHash(), queued.confirmations, queued.blockHash)
+	}
+}
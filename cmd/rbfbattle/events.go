@@ -0,0 +1,143 @@
+package main
+
+import (
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/btcsuite/btcd/btcjson"
+	"github.com/btcsuite/btcd/btcutil"
+)
+
+// Event is something that happened while watching the mempool or fighting a battle.
+// The battle code publishes events on the bus and the side effects, like metrics,
+// notifications, the battle history and the dashboard, subscribe to them.
+type Event interface {
+	event()
+}
+
+// TxSeen is a transaction taken off the queue for processing
+type TxSeen struct {
+	Tx     *btcjson.TxRawResult
+	SeenAt time.Time
+}
+
+// BattleStarted is a payment to a watched address we're about to sweep
+type BattleStarted struct {
+	Battle *TrackedUTXO
+}
+
+// SweepSent is our transaction spending the utxo alone, the first one or a self-bump
+type SweepSent struct {
+	Battle  *TrackedUTXO
+	TxID    string
+	FeeRate float64
+	Fee     btcutil.Amount
+}
+
+// CounterpartDetected is a transaction of someone else spending the utxo
+type CounterpartDetected struct {
+	Battle      *TrackedUTXO
+	Counterpart *btcjson.TxRawResult
+	FeeRate     float64
+	Fee         btcutil.Amount
+}
+
+// ReplacementSent is our replacement of a counterpart accepted by the node
+type ReplacementSent struct {
+	Battle      *TrackedUTXO
+	Counterpart string
+	TxID        string
+	FeeRate     float64
+	Fee         btcutil.Amount
+}
+
+// ReplacementRejected is our replacement of a counterpart refused by the node
+type ReplacementRejected struct {
+	Battle *TrackedUTXO
+	// Reason is what rejectionReason made of Err
+	Reason string
+	Err    error
+}
+
+// BurnSent is our transaction burning the utxo to fees
+type BurnSent struct {
+	Battle *TrackedUTXO
+	TxID   string
+}
+
+// BattleResolved ends a battle as won, lost, burned or abandoned
+type BattleResolved struct {
+	Battle  *TrackedUTXO
+	Outcome battleState
+	// TxID is the transaction that decided the battle, if any
+	TxID string
+	// Fee is what we paid when we won or burned
+	Fee btcutil.Amount
+}
+
+// FundingCoinChanged is a wallet coin reserved to fund the replacements of a battle,
+// or released with a nil Coin when the battle is over
+type FundingCoinChanged struct {
+	Battle *TrackedUTXO
+	Coin   *btcjson.ListUnspentResult
+}
+
+func (TxSeen) event()              {}
+func (BattleStarted) event()       {}
+func (SweepSent) event()           {}
+func (CounterpartDetected) event() {}
+func (ReplacementSent) event()     {}
+func (ReplacementRejected) event() {}
+func (BurnSent) event()            {}
+func (BattleResolved) event()      {}
+func (FundingCoinChanged) event()  {}
+
+// eventBus delivers every published event to all subscribers, in order of subscription.
+// Delivery is synchronous, so subscribers must not block. Slow work belongs in a goroutine.
+type eventBus struct {
+	mu          sync.RWMutex
+	nextID      int
+	subscribers []subscriber
+}
+
+// subscriber is a handler registered on the bus
+type subscriber struct {
+	id      int
+	handler func(Event)
+}
+
+var bus = &eventBus{}
+
+// Subscribe registers a handler for every event published from now on.
+// The returned ID detaches it again with Unsubscribe.
+func (b *eventBus) Subscribe(handler func(Event)) int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.nextID++
+	b.subscribers = append(b.subscribers, subscriber{id: b.nextID, handler: handler})
+	return b.nextID
+}
+
+// Unsubscribe stops delivering events to the handler registered as id
+func (b *eventBus) Unsubscribe(id int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	// Publish may be ranging over the old slice, so build a new one
+	b.subscribers = slices.DeleteFunc(slices.Clone(b.subscribers), func(s subscriber) bool {
+		return s.id == id
+	})
+}
+
+// Publish hands an event to every subscriber
+func (b *eventBus) Publish(e Event) {
+	b.mu.RLock()
+	subscribers := b.subscribers
+	b.mu.RUnlock()
+
+	for _, s := range subscribers {
+		s.handler(e)
+	}
+}
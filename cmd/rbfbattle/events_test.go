@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/btcsuite/btcd/wire"
+)
+
+// battleEvents collects the event types published for battles over a script
+type battleEvents struct {
+	mu     sync.Mutex
+	script string
+	kinds  []string
+}
+
+func (b *battleEvents) observe(e Event) {
+	var utxo *TrackedUTXO
+	switch e := e.(type) {
+	case BattleStarted:
+		utxo = e.Battle
+	case SweepSent:
+		utxo = e.Battle
+	case BattleResolved:
+		utxo = e.Battle
+	case FundingCoinChanged:
+		utxo = e.Battle
+	default:
+		return
+	}
+	if utxo.Script.Hex != b.script {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.kinds = append(b.kinds, reflect.TypeOf(e).Name())
+}
+
+func TestBattleEventsUncontested(t *testing.T) {
+	b := startBattle(t)
+	_, script := b.watch(t)
+	events := &battleEvents{script: hex.EncodeToString(script)}
+	defer bus.Unsubscribe(bus.Subscribe(events.observe))
+
+	funding := b.send(t, script, 100_000)
+	outpoint := wire.OutPoint{Hash: funding.TxHash(), Index: 0}
+
+	waitFor(t, "sweep", func() bool {
+		_, ok := b.node.Spender(outpoint)
+		return ok && sweepRecorded(outpoint)
+	})
+	b.node.MineBlock()
+	waitFor(t, "battle to end", func() bool {
+		_, ok := getMonitored(fmt.Sprintf("%s:%d", outpoint.Hash, outpoint.Index))
+		return !ok
+	})
+
+	events.mu.Lock()
+	defer events.mu.Unlock()
+
+	if want := []string{"BattleStarted", "SweepSent", "BattleResolved"}; !reflect.DeepEqual(events.kinds, want) {
+		t.Errorf("expected events %v, got %v", want, events.kinds)
+	}
+}
+
+func TestEventBusOrder(t *testing.T) {
+	b := &eventBus{}
+
+	var got []string
+	b.Subscribe(func(e Event) { got = append(got, "first") })
+	b.Subscribe(func(e Event) {
+		got = append(got, "second")
+		// Subscribers may publish in turn
+		if _, ok := e.(TxSeen); ok {
+			b.Publish(BurnSent{})
+		}
+	})
+
+	b.Publish(TxSeen{})
+
+	if want := []string{"first", "second", "first", "second"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %v, got %v", want, got)
+	}
+}
+
+func TestEventBusUnsubscribe(t *testing.T) {
+	b := &eventBus{}
+
+	var got []string
+	first := b.Subscribe(func(e Event) { got = append(got, "first") })
+	b.Subscribe(func(e Event) {
+		got = append(got, "second")
+		// Detaching while publishing takes effect from the next event
+		b.Unsubscribe(first)
+	})
+
+	b.Publish(TxSeen{})
+	b.Publish(TxSeen{})
+
+	if want := []string{"first", "second", "second"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %v, got %v", want, got)
+	}
+}
@@ -1,11 +1,15 @@
 package main
 
 import (
-	"log"
+	"log/slog"
 
 	"github.com/btcsuite/btcd/btcutil"
 )
 
+// incrementalRelayFeeRate is the default fee rate in sat/vbyte a replacement must pay
+// on top of the transactions it replaces (BIP125 rule 4)
+const incrementalRelayFeeRate = 1.0
+
 // newFee tries to calculate a new feeRate to replace a counterpart transaction.
 // If the new calculated fee is too high, try to burn the transaction
 // See the current Replace-By-Fee rules:
@@ -18,7 +22,7 @@ func newFee(attackingFee btcutil.Amount, attackingTxSize, ourEstimatedTxSize int
 
 	newFee = btcutil.Amount(float64(ourEstimatedTxSize) * newFeeRate)
 
-	log.Printf("newFee=%d, originalFee: %d, estimatedTxSize: %d, originalFeeRate: %f, newFeeRate: %f", newFee, attackingFee, ourEstimatedTxSize, originalFeeRate, newFeeRate)
+	slog.Debug("Calculated replacement fee", "fee", newFee, "counterpart_fee", attackingFee, "vsize", ourEstimatedTxSize, "counterpart_feerate", originalFeeRate, "feerate", newFeeRate)
 
 	if newFee >= utxo.Amount {
 		burn = true
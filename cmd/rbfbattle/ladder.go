@@ -0,0 +1,156 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/rpcclient"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+)
+
+// replacementLadder holds replacements of a battle signed ahead of time at increasing fee rates,
+// so a counterpart can be answered with a single broadcast instead of a round of wallet RPCs
+type replacementLadder struct {
+	// funding is the wallet coin every rung spends
+	funding string
+	rungs   []ladderRung
+	burn    *wire.MsgTx
+}
+
+// ladderRung is a signed replacement paying Fee
+type ladderRung struct {
+	Tx      *wire.MsgTx
+	Fee     btcutil.Amount
+	FeeRate float64
+}
+
+// subscribeLadder pre-signs a ladder for every battle in the background. The funding coin is reserved
+// when the battle starts, and the ladder is rebuilt whenever the coin changes. It returns the
+// subscription on the bus.
+func subscribeLadder(client *rpcclient.Client, config *Config) int {
+	return bus.Subscribe(func(e Event) {
+		switch e := e.(type) {
+		case BattleStarted:
+			battleWork.Add(1)
+			go func() {
+				defer battleWork.Done()
+				if _, err := reserveFunding(client, e.Battle); err != nil {
+					e.Battle.logger().Warn("Failed to reserve a wallet utxo for the replacement ladder", "err", err)
+				}
+			}()
+		case FundingCoinChanged:
+			if e.Coin == nil {
+				e.Battle.mu.Lock()
+				e.Battle.Ladder = nil
+				e.Battle.mu.Unlock()
+				return
+			}
+			battleWork.Add(1)
+			go func() {
+				defer battleWork.Done()
+				rebuildLadder(client, e.Battle, config)
+			}()
+		}
+	})
+}
+
+// rebuildLadder signs a new ladder for the battle and keeps it unless the funding coin changed meanwhile
+func rebuildLadder(client *rpcclient.Client, utxo *TrackedUTXO, config *Config) {
+	ladder, err := buildLadder(client, utxo, config)
+	if err != nil {
+		utxo.logger().Warn("Failed to pre-sign replacements", "err", err)
+		return
+	}
+
+	utxo.mu.Lock()
+	defer utxo.mu.Unlock()
+	if utxo.Funding == nil || fundingID(*utxo.Funding) != ladder.funding {
+		return
+	}
+	utxo.Ladder = ladder
+
+	var top float64
+	if len(ladder.rungs) > 0 {
+		top = ladder.rungs[len(ladder.rungs)-1].FeeRate
+	}
+	slog.Debug("Pre-signed replacement ladder", "battle", utxo.ID, "funding", ladder.funding, "rungs", len(ladder.rungs), "max_feerate", top)
+}
+
+// buildLadder signs replacements spending the utxo and its funding coin from ladderminfeerate upwards,
+// each laddergrowth times the previous one, up to the fee rate where we'd rather burn. It also signs the burn.
+func buildLadder(client *rpcclient.Client, utxo *TrackedUTXO, config *Config) (*replacementLadder, error) {
+	utxo.mu.Lock()
+	funding := utxo.Funding
+	utxo.mu.Unlock()
+	if funding == nil {
+		return nil, fmt.Errorf("no funding coin reserved")
+	}
+
+	privateKeyWIF, ok := utxo.privateKey()
+	if !ok {
+		return nil, fmt.Errorf("address %s is no longer watched", utxo.Address)
+	}
+
+	fundingSats, err := btcutil.NewAmount(funding.Amount)
+	if err != nil {
+		return nil, err
+	}
+	destScript, err := txscript.PayToAddrScript(utxo.Destination)
+	if err != nil {
+		return nil, fmt.Errorf("error creating destination script: %v", err)
+	}
+	vsize := estimateTransactionSize(destScript, utxo.Amount+fundingSats, utxo.Script.Hex, funding.ScriptPubKey)
+
+	ladder := &replacementLadder{funding: fundingID(*funding)}
+	feeRate := config.LadderMinFeeRate
+	for i := 0; i < config.LadderRungs; i++ {
+		fee := btcutil.Amount(feeRate * float64(vsize))
+		output := utxo.Amount + fundingSats - fee
+		if fee >= utxo.Amount || output < dustThreshold(destScript) {
+			break
+		}
+
+		tx, err := signReplacement(client, int64(output), *funding, utxo, privateKeyWIF, config)
+		if err != nil {
+			return nil, err
+		}
+		ladder.rungs = append(ladder.rungs, ladderRung{Tx: tx, Fee: fee, FeeRate: feeRate})
+		feeRate *= config.LadderGrowth
+	}
+
+	ladder.burn, err = signBurn(client, utxo, privateKeyWIF, config)
+	if err != nil {
+		return nil, err
+	}
+
+	return ladder, nil
+}
+
+// ladderRung returns the cheapest pre-signed replacement paying at least fee with the current funding coin
+func (u *TrackedUTXO) ladderRung(fee btcutil.Amount) (ladderRung, bool) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if u.Ladder == nil || u.Funding == nil || u.Ladder.funding != fundingID(*u.Funding) {
+		return ladderRung{}, false
+	}
+	for _, rung := range u.Ladder.rungs {
+		if rung.Fee >= fee {
+			return rung, true
+		}
+	}
+	return ladderRung{}, false
+}
+
+// presignedBurn returns the burn signed with the ladder, if any
+func (u *TrackedUTXO) presignedBurn() *wire.MsgTx {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if u.Ladder == nil {
+		return nil
+	}
+	return u.Ladder.burn
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/btcsuite/btcd/wire"
+)
+
+func TestLadderAnswersCounterpart(t *testing.T) {
+	b := startBattle(t)
+	key, script := b.watch(t)
+
+	funding := b.send(t, script, 100_000)
+	outpoint := wire.OutPoint{Hash: funding.TxHash(), Index: 0}
+
+	waitFor(t, "sweep", func() bool {
+		_, ok := b.node.Spender(outpoint)
+		return ok
+	})
+	utxo, ok := getMonitored(fmt.Sprintf("%s:%d", outpoint.Hash, outpoint.Index))
+	if !ok {
+		t.Fatal("expected the utxo to be monitored")
+	}
+
+	client, err := b.node.Client()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := reserveFunding(client, utxo); err != nil {
+		t.Fatal(err)
+	}
+
+	config := *b.config
+	config.LadderRungs, config.LadderMinFeeRate, config.LadderGrowth = 10, 2, 1.5
+	ladder, err := buildLadder(client, utxo, &config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ladder.rungs) < 2 || ladder.burn == nil {
+		t.Fatalf("expected rungs and a burn, got %d rungs", len(ladder.rungs))
+	}
+	for i := 1; i < len(ladder.rungs); i++ {
+		if ladder.rungs[i].Fee <= ladder.rungs[i-1].Fee {
+			t.Fatalf("expected increasing fees, got %v after %v", ladder.rungs[i].Fee, ladder.rungs[i-1].Fee)
+		}
+	}
+	utxo.mu.Lock()
+	utxo.Ladder = ladder
+	utxo.mu.Unlock()
+
+	counterpart := spendP2WPKH(t, key, outpoint, funding.TxOut[0], 5_000)
+	if err := b.node.Submit(counterpart); err != nil {
+		t.Fatalf("counterpart rejected: %v", err)
+	}
+
+	var answer *wire.MsgTx
+	waitFor(t, "replacement", func() bool {
+		tx, ok := b.node.Spender(outpoint)
+		answer = tx
+		return ok && tx.TxHash() != counterpart.TxHash()
+	})
+
+	var used *ladderRung
+	for i, rung := range ladder.rungs {
+		if rung.Tx.TxHash() == answer.TxHash() {
+			used = &ladder.rungs[i]
+		}
+	}
+	if used == nil {
+		t.Fatal("expected the replacement to be a pre-signed rung")
+	}
+	if used.Fee <= 5_000 {
+		t.Errorf("expected a rung outbidding the counterpart, got fee %v", used.Fee)
+	}
+
+	b.node.MineBlock()
+	waitFor(t, "battle to end", func() bool { return len(monitoredSnapshot()) == 0 })
+}
+
+func TestSubscribeLadder(t *testing.T) {
+	b := startBattle(t)
+	client, err := b.node.Client()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Shutdown()
+
+	config := *b.config
+	config.LadderRungs, config.LadderMinFeeRate, config.LadderGrowth = 4, 2, 1.5
+	defer bus.Unsubscribe(subscribeLadder(client, &config))
+
+	_, script := b.watch(t)
+	funding := b.send(t, script, 100_000)
+	outpoint := wire.OutPoint{Hash: funding.TxHash(), Index: 0}
+
+	// The ladder is signed for the coin reserved when the battle starts
+	var utxo *TrackedUTXO
+	signed := func() bool {
+		utxo, _ = getMonitoredOutPoint(outpoint)
+		if utxo == nil {
+			return false
+		}
+		utxo.mu.Lock()
+		defer utxo.mu.Unlock()
+		return utxo.Ladder != nil && utxo.Funding != nil && utxo.Ladder.funding == fundingID(*utxo.Funding)
+	}
+	waitFor(t, "ladder", signed)
+
+	// Releasing the coin drops the ladder and reserving one again rebuilds it
+	releaseFunding(utxo)
+	utxo.mu.Lock()
+	dropped := utxo.Ladder == nil
+	utxo.mu.Unlock()
+	if !dropped {
+		t.Error("expected the ladder to be dropped with its funding coin")
+	}
+	if _, err := reserveFunding(client, utxo); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "rebuilt ladder", signed)
+
+	waitFor(t, "sweep", func() bool { return sweepRecorded(outpoint) })
+	b.node.MineBlock()
+	waitFor(t, "battle to end", func() bool { return len(monitoredSnapshot()) == 0 })
+}
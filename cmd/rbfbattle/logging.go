@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/fatih/color"
+)
+
+// levelSuccess is for battles going our way. It's shown in green on terminals.
+const levelSuccess = slog.LevelInfo + 2
+
+// newLogHandler creates a handler writing text, coloured by level on terminals, or JSON lines
+func newLogHandler(w io.Writer, format string, level slog.Level) (slog.Handler, error) {
+	switch format {
+	case "text":
+		return newColorHandler(w, level), nil
+	case "json":
+		return slog.NewJSONHandler(w, &slog.HandlerOptions{
+			Level: level,
+			ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+				if a.Key == slog.LevelKey && len(groups) == 0 && a.Value.Any() == levelSuccess {
+					return slog.String(slog.LevelKey, "SUCCESS")
+				}
+				return a
+			},
+		}), nil
+	default:
+		return nil, fmt.Errorf("unknown log format %s", format)
+	}
+}
+
+// parseLogLevel parses debug, info, warn or error
+func parseLogLevel(s string) (slog.Level, error) {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(s)); err != nil {
+		return 0, fmt.Errorf("invalid log level %s", s)
+	}
+	return level, nil
+}
+
+// success logs a battle going our way
+func success(logger *slog.Logger, msg string, args ...any) {
+	logger.Log(context.Background(), levelSuccess, msg, args...)
+}
+
+// fatal logs an error and exits
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
+
+// colorHandler writes the time and message followed by the attributes as key=value pairs,
+// the whole line coloured by its level
+type colorHandler struct {
+	mu    *sync.Mutex
+	w     io.Writer
+	buf   *bytes.Buffer
+	inner slog.Handler
+}
+
+func newColorHandler(w io.Writer, level slog.Level) *colorHandler {
+	buf := &bytes.Buffer{}
+	return &colorHandler{
+		mu:  &sync.Mutex{},
+		w:   w,
+		buf: buf,
+		// The inner handler formats the attributes only
+		inner: slog.NewTextHandler(buf, &slog.HandlerOptions{
+			Level: level,
+			ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+				if len(groups) == 0 && (a.Key == slog.TimeKey || a.Key == slog.LevelKey || a.Key == slog.MessageKey) {
+					return slog.Attr{}
+				}
+				return a
+			},
+		}),
+	}
+}
+
+func (h *colorHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.inner.Enabled(ctx, level)
+}
+
+func (h *colorHandler) Handle(ctx context.Context, r slog.Record) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.buf.Reset()
+	if err := h.inner.Handle(ctx, r); err != nil {
+		return err
+	}
+
+	line := r.Message
+	if attrs := strings.TrimSpace(h.buf.String()); attrs != "" {
+		line += " " + attrs
+	}
+
+	switch {
+	case r.Level >= slog.LevelError:
+		line = color.RedString("%s", line)
+	case r.Level >= slog.LevelWarn:
+		line = color.YellowString("%s", line)
+	case r.Level >= levelSuccess:
+		line = color.GreenString("%s", line)
+	case r.Level < slog.LevelInfo:
+		line = color.New(color.Faint).Sprint(line)
+	}
+
+	_, err := fmt.Fprintf(h.w, "%s %s\n", r.Time.Format("2006/01/02 15:04:05.000000"), line)
+	return err
+}
+
+func (h *colorHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &colorHandler{mu: h.mu, w: h.w, buf: h.buf, inner: h.inner.WithAttrs(attrs)}
+}
+
+func (h *colorHandler) WithGroup(name string) slog.Handler {
+	return &colorHandler{mu: h.mu, w: h.w, buf: h.buf, inner: h.inner.WithGroup(name)}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+func TestColorHandler(t *testing.T) {
+	var buf bytes.Buffer
+	logger := slog.New(newColorHandler(&buf, slog.LevelInfo)).With("battle", "0badf00d")
+
+	logger.Debug("hidden")
+	logger.Info("Replaced counterpart transaction", "feerate", 12.5, "counterpart", "ab")
+
+	line := buf.String()
+	if strings.Contains(line, "hidden") {
+		t.Errorf("debug line was written at info level: %q", line)
+	}
+	if !strings.HasSuffix(line, "Replaced counterpart transaction battle=0badf00d feerate=12.5 counterpart=ab\n") {
+		t.Errorf("unexpected line %q", line)
+	}
+}
+
+func TestJSONHandler(t *testing.T) {
+	var buf bytes.Buffer
+	handler, err := newLogHandler(&buf, "json", slog.LevelInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	utxo := &TrackedUTXO{TxID: "aa", N: 1, ID: "0badf00d"}
+	utxo.setState(stateReplaced)
+
+	previous := slog.Default()
+	slog.SetDefault(slog.New(handler))
+	success(utxo.logger(), "Replaced counterpart transaction", "our_txid", "bb")
+	slog.SetDefault(previous)
+
+	// Bots of other tests may log in between
+	var line map[string]any
+	for _, raw := range strings.Split(buf.String(), "\n") {
+		if strings.Contains(raw, "0badf00d") {
+			if err := json.Unmarshal([]byte(raw), &line); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	for key, expected := range map[string]string{
+		"level":    "SUCCESS",
+		"battle":   "0badf00d",
+		"outpoint": "aa:1",
+		"state":    "replaced",
+		"our_txid": "bb",
+	} {
+		if line[key] != expected {
+			t.Errorf("expected %s=%s, got %v", key, expected, line[key])
+		}
+	}
+
+	if _, err := newLogHandler(&buf, "xml", slog.LevelInfo); err == nil {
+		t.Errorf("expected unknown format to fail")
+	}
+}
@@ -1,11 +1,15 @@
 package main
 
 import (
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
-	"log"
 	"log/slog"
+	"os"
 	"strconv"
-	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/btcsuite/btcd/btcjson"
 	"github.com/btcsuite/btcd/btcutil"
@@ -14,8 +18,6 @@ import (
 	"github.com/btcsuite/btcd/rpcclient"
 	"github.com/btcsuite/btcd/txscript"
 	"github.com/btcsuite/btcd/wire"
-
-	"github.com/fatih/color"
 )
 
 const (
@@ -24,7 +26,7 @@ const (
 )
 
 func init() {
-	log.SetFlags(log.LstdFlags | log.Lmicroseconds)
+	slog.SetDefault(slog.New(newColorHandler(os.Stderr, slog.LevelInfo)))
 }
 
 var network = &chaincfg.RegressionNetParams
@@ -42,40 +44,83 @@ type TrackedUTXO struct {
 	// New
 	Script btcjson.ScriptPubKeyResult
 	Tx     *btcjson.TxRawResult
+
+	// Destination is where this battle sweeps the utxo to
+	Destination btcutil.Address
+
+	// ID identifies the battle over the utxo in the logs
+	ID    string
+	state atomic.Value
+
+	// mu guards the battle state below
+	mu sync.Mutex
+	// Our current sweep transaction while no counterpart has shown up
+	SpendTx        *wire.MsgTx
+	InitialFeeRate float64
+	SpendFeeRate   float64
+	SpendHeight    int64
+	Bumps          int
+	// Fee is what our current transaction pays
+	Fee btcutil.Amount
+	// Contested is set once a counterpart has tried to spend the utxo
+	Contested bool
+	// DetectedAt is when we received the transaction we're responding to
+	DetectedAt time.Time
+	// Counterpart is the latest transaction contesting the utxo
+	Counterpart *btcjson.TxRawResult
+	// Funding is the wallet coin reserved for our replacements
+	Funding *btcjson.ListUnspentResult
+	// Ladder holds replacements pre-signed with the funding coin
+	Ladder *replacementLadder
+	// Views maps the nodes to the transaction spending the utxo in their mempool
+	Views map[string]string
+	// answered is the latest counterpart we responded to, which other nodes may announce again
+	answered string
+	// pending answers the counterpart the battle handler handles next, before the queued
+	// actions. handling is set while the handler runs.
+	pending  func()
+	actions  []func()
+	handling bool
+	// History lists the transactions of the battle in order
+	History []battleEvent
 }
 
-// extractUTXOs extracts all addresses that received funds in a transaction
+// extractUTXOs extracts all outputs of a transaction that can be spent, with or without an address
 func extractUTXOs(tx *btcjson.TxRawResult) []*TrackedUTXO {
-	var addresses []*TrackedUTXO
+	var utxos []*TrackedUTXO
 
 	// Process each output (vout) in the transaction
 	for _, vout := range tx.Vout {
-		// Extract addresses from the scriptPubKey
-		if vout.ScriptPubKey.Address != "" {
-			amount, _ := btcutil.NewAmount(vout.Value)
-
-			addresses = append(addresses, &TrackedUTXO{
-				Address: vout.ScriptPubKey.Address,
-				Amount:  amount,
-				N:       vout.N,
-				TxID:    tx.Txid,
-				Script:  vout.ScriptPubKey,
-				Tx:      tx,
-			})
+		script, err := hex.DecodeString(vout.ScriptPubKey.Hex)
+		if err != nil || txscript.IsUnspendable(script) {
+			continue
 		}
+		amount, _ := btcutil.NewAmount(vout.Value)
+
+		utxos = append(utxos, &TrackedUTXO{
+			Address: vout.ScriptPubKey.Address,
+			Amount:  amount,
+			N:       vout.N,
+			TxID:    tx.Txid,
+			Script:  vout.ScriptPubKey,
+			Tx:      tx,
+		})
 	}
 
-	return addresses
+	return utxos
 }
 
-// processTransaction processes a transaction that got added to the mempool
-func processTransaction(client *rpcclient.Client, tx *btcjson.TxRawResult, config *Config) {
+// processTransaction processes a transaction that got added to the mempool of node
+func processTransaction(client *rpcclient.Client, tx *btcjson.TxRawResult, seenAt time.Time, node string, config *Config) {
+	bus.Publish(TxSeen{Tx: tx, SeenAt: seenAt})
+
 	txID := tx.Txid
 
 	utxos := extractUTXOs(tx)
 
 	for _, vout := range tx.Vout {
-		isSentToUs := vout.ScriptPubKey.Address == config.DestinationAddress
+		script, _ := hex.DecodeString(vout.ScriptPubKey.Hex)
+		isSentToUs := isOurDestination(script)
 		voutValue, _ := btcutil.NewAmount(vout.Value)
 
 		if tx.Confirmations > 0 {
@@ -83,44 +128,32 @@ func processTransaction(client *rpcclient.Client, tx *btcjson.TxRawResult, confi
 			for _, vin := range tx.Vin {
 				id := vin.Txid + ":" + strconv.Itoa(int(vin.Vout))
 
-				if monitoredUtxo, ok := monitoredUtxos[id]; ok {
-					if isSentToUs {
-						log.Printf(color.GreenString("RBF battle won for %s and transaction was received by us\n"+
-							"\ttxid=%s\n"+
-							"\tutxo=%s:%d\n"+
-							"\treceived_value=%f BTC\n"+
-							"\toriginal_value=%f BTC\n"+
-							"\tblock_hash=%s"),
-							monitoredUtxo.Address,
-							txID,
-							monitoredUtxo.TxID,
-							monitoredUtxo.N,
-							(monitoredUtxo.Amount - voutValue).ToBTC(),
-							monitoredUtxo.Amount.ToBTC(),
-							tx.BlockHash,
+				if monitoredUtxo, ok := getMonitored(id); ok {
+					monitoredUtxo.mu.Lock()
+					fee := monitoredUtxo.Fee
+					monitoredUtxo.mu.Unlock()
+
+					if paysToDestination(script, monitoredUtxo.Destination) {
+						monitoredUtxo.setState(stateWon)
+						success(monitoredUtxo.logger(), "RBF battle won and transaction was received by us",
+							"address", monitoredUtxo.Address,
+							"our_txid", txID,
+							"received_value", voutValue,
+							"original_value", monitoredUtxo.Amount,
+							"block_hash", tx.BlockHash,
 						)
+						publishBattle(BattleResolved{Battle: monitoredUtxo, Outcome: stateWon, TxID: txID, Fee: fee})
 					} else {
-						log.Printf(color.RedString("RBF battle lost for %s\n"+
-							"\ttxid=%s\n"+
-							"\tutxo=%s:%d\n"+
-							"\treceived_value=%f BTC\n"+
-							"\toriginal_value=%f BTC\n"+
-							"\tblock_hash=%s"),
-							monitoredUtxo.Address,
-							txID,
-							monitoredUtxo.TxID,
-							monitoredUtxo.N,
-							(monitoredUtxo.Amount - voutValue).ToBTC(),
-							monitoredUtxo.Amount.ToBTC(),
-							tx.BlockHash,
+						monitoredUtxo.setState(stateLost)
+						monitoredUtxo.logger().Error("RBF battle lost",
+							"address", monitoredUtxo.Address,
+							"counterpart", txID,
+							"received_value", voutValue,
+							"original_value", monitoredUtxo.Amount,
+							"block_hash", tx.BlockHash,
 						)
-
-						cleanup(monitoredUtxo)
+						publishBattle(BattleResolved{Battle: monitoredUtxo, Outcome: stateLost, TxID: txID})
 					}
-
-					// Select a new utxo to spend for the next battle
-					unspentUtxo = nil
-					selectUnspentUtxo(client)
 				}
 			}
 			return
@@ -130,7 +163,7 @@ func processTransaction(client *rpcclient.Client, tx *btcjson.TxRawResult, confi
 			// Maybe the attacker is trying to fool us by sending a small amount to our address
 			// and the rest to himself in another output.
 			// Since our transactions have one output only, we try to replace it again.
-			log.Printf("Transaction %s has multiple outputs and is sending %f BTC to our address", txID, voutValue.ToBTC())
+			slog.Info("Transaction has multiple outputs and is sending to our address", "txid", txID, "value", voutValue)
 		} else if isSentToUs {
 			// This is our own replacement transaction
 			return
@@ -138,45 +171,72 @@ func processTransaction(client *rpcclient.Client, tx *btcjson.TxRawResult, confi
 	}
 
 	for _, utxo := range utxos {
-		// Check if utxo address is watched by us
-
-		privKey, ok := ourAddresses[utxo.Address]
+		// Check if the utxo script is watched by us
+		privKey, ok := utxo.privateKey()
 
 		if !ok {
 			continue
 		}
 
 		if tx.Confirmations > 0 {
-			log.Printf("Transaction to watched address %s was confirmed\n"+
-				"\ttxid=%s\n"+
-				"\tblock_hash=%s",
-				utxo.Address,
-				txID,
-				tx.BlockHash,
+			slog.Info("Transaction to watched address was confirmed",
+				"address", utxo.Address,
+				"txid", txID,
+				"block_hash", tx.BlockHash,
 			)
 
 			// delete(monitoredUtxos, txID)
 			return
 		}
 
-		log.Printf(color.YellowString(
-			"Detected transaction to watched address %s. Trying to spend it\n"+
-				"\ttxid=%s\n"+
-				"\tvout=%d\n"+
-				"\tamount=%f BTC",
-		),
-			utxo.Address,
-			txID,
-			utxo.N,
-			utxo.Amount.ToBTC(),
-		)
+		if engagementsPaused.Load() {
+			slog.Warn("Engagements are paused. Not spending transaction to watched address", "address", utxo.Address, "txid", txID)
+			return
+		}
 
-		monitor(utxo)
+		// Peers announce the same deposit again, which must not start a second battle or
+		// use up a destination
+		if !claim(utxo.outPoint()) {
+			continue
+		}
 
-		_, err := SpendTransaction(client, utxo, privKey, config)
+		destination, err := nextDestination()
+		if err != nil {
+			release(utxo.outPoint())
+			slog.Error("Failed to get a destination address", "err", err)
+			return
+		}
+		utxo.Destination = destination
+		utxo.DetectedAt = seenAt
+
+		if !monitor(utxo) {
+			continue
+		}
+		bus.Publish(BattleStarted{Battle: utxo})
+
+		utxo.logger().Warn("Detected transaction to watched address. Trying to spend it",
+			"address", utxo.Address,
+			"amount", utxo.Amount,
+		)
+
+		_, err = SpendTransaction(client, utxo, privKey, config)
 		if err != nil {
 			// Someone else was faster and spent the UTXO first.
-			log.Printf(color.RedString("Failed to send initial spend transaction: %v"), err)
+			utxo.logger().Error("Failed to send initial spend transaction", "err", err)
+		}
+
+		// Answer the spends that arrived before the battle started, or the one our node
+		// preferred over the sweep
+		spends := takeParked(utxo.outPoint())
+		if len(spends) == 0 && err != nil && conflictRejection(err) {
+			if spender, err := mempoolSpender(client, utxo.outPoint()); err != nil {
+				utxo.logger().Error("Failed to look up the spend conflicting with the sweep", "err", err)
+			} else if spender != nil {
+				spends = append(spends, parkedSpend{tx: spender, seenAt: time.Now(), node: primaryNode})
+			}
+		}
+		for _, spend := range spends {
+			processTransaction(client, spend.tx, spend.seenAt, spend.node, config)
 		}
 		return
 	}
@@ -189,26 +249,116 @@ func processTransaction(client *rpcclient.Client, tx *btcjson.TxRawResult, confi
 	for _, vin := range tx.Vin {
 		id := vin.Txid + ":" + strconv.Itoa(int(vin.Vout))
 
-		if utxo, ok := monitoredUtxos[id]; ok {
+		if utxo, ok := getMonitored(id); ok {
+			utxo.recordView(node, txID)
+
+			utxo.mu.Lock()
+			if utxo.answered == txID {
+				// Another node announced it first
+				utxo.mu.Unlock()
+				return
+			}
+			utxo.answered = txID
+			utxo.Contested = true
+			utxo.DetectedAt = seenAt
+			utxo.mu.Unlock()
+			utxo.setState(stateContested)
+
 			for _, vout := range tx.Vout {
 				if vout.ScriptPubKey.Asm == "OP_RETURN" {
-					log.Printf(color.RedString("Transaction %s has an OP_RETURN output"), txID)
+					utxo.logger().Error("Counterpart has an OP_RETURN output", "counterpart", txID)
 				}
 			}
 
-			privateKeyWIF := ourAddresses[utxo.Address]
+			privateKeyWIF, _ := utxo.privateKey()
+
+			answerCounterpart(client, tx, utxo, privateKeyWIF, config)
+
+			return
+		}
+	}
 
-			go TryReplacingAttacker(client, tx, utxo, privateKeyWIF, config)
+	// A spend of a payment to us whose battle hasn't started waits for the battle
+	if parked, monitored := park(tx, seenAt, node); parked {
+		return
+	} else if monitored {
+		processTransaction(client, tx, seenAt, node, config)
+		return
+	}
 
+	// A TRUC transaction may only have one unconfirmed child, so a transaction spending
+	// another output of the parent of a monitored utxo blocks us until we evict it.
+	if utxo, ok := trucSiblingOf(tx); ok {
+		utxo.mu.Lock()
+		if utxo.answered == txID {
+			utxo.mu.Unlock()
 			return
 		}
+		utxo.answered = txID
+		utxo.Contested = true
+		utxo.DetectedAt = seenAt
+		utxo.mu.Unlock()
+		utxo.setState(stateContested)
+
+		privateKeyWIF, _ := utxo.privateKey()
+		answerCounterpart(client, tx, utxo, privateKeyWIF, config)
 	}
 }
 
 // SpendTransaction tries to spend the UTXO we're watching to our destination address.
 // This might fail if another bot is faster and spends the UTXO first, in which we'll engage in the RBF battle.
 func SpendTransaction(client *rpcclient.Client, trackedUtxo *TrackedUTXO, privateKeyWIF string, config *Config) (string, error) {
+	feeRate := defaultFeeRate
+
+	// If we can get fee estimates from the node, use that instead
+	// TODO do not let EstimateSmartFee block here
+	if nodeFeeRate, ok := estimateNextBlockFeeRate(config.backend); ok {
+		trackedUtxo.logger().Debug("Fee estimate from node", "feerate", nodeFeeRate)
+		feeRate = nodeFeeRate
+	} else {
+		trackedUtxo.logger().Debug("No fee estimate from node, using default fee rate", "feerate", defaultFeeRate)
+	}
+
+	return broadcastSweep(client, trackedUtxo, privateKeyWIF, config, feeRate)
+}
+
+// mempoolSpender asks the node for the mempool transaction spending outpoint, or nil without one
+func mempoolSpender(client *rpcclient.Client, outpoint wire.OutPoint) (*btcjson.TxRawResult, error) {
+	param, _ := json.Marshal([]map[string]any{{"txid": outpoint.Hash.String(), "vout": outpoint.Index}})
+	res, err := client.RawRequest("gettxspendingprevout", []json.RawMessage{param})
+	if err != nil {
+		return nil, fmt.Errorf("error getting the spender of %s: %v", outpoint, err)
+	}
+
+	var spends []struct {
+		SpendingTxID string `json:"spendingtxid"`
+	}
+	if err := json.Unmarshal(res, &spends); err != nil {
+		return nil, fmt.Errorf("error parsing the spender of %s: %v", outpoint, err)
+	}
+	if len(spends) == 0 || spends[0].SpendingTxID == "" {
+		return nil, nil
+	}
 
+	hash, err := chainhash.NewHashFromStr(spends[0].SpendingTxID)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing transaction hash: %v", err)
+	}
+	return client.GetRawTransactionVerbose(hash)
+}
+
+// estimateNextBlockFeeRate returns the node's fee rate estimate in sat/vbyte to get into the next block
+func estimateNextBlockFeeRate(backend ChainBackend) (float64, bool) {
+	feeRate, err := backend.EstimateFeeRate(1)
+	if err != nil {
+		return 0, false
+	}
+	return feeRate, true
+}
+
+// broadcastSweep spends the UTXO we're watching alone to our destination address at feeRate
+// and records it as our current sweep.
+func broadcastSweep(client *rpcclient.Client, trackedUtxo *TrackedUTXO, privateKeyWIF string, config *Config, feeRate float64) (string, error) {
 	// Get
 	outputHash, err := chainhash.NewHashFromStr(trackedUtxo.TxID)
 	if err != nil {
@@ -218,141 +368,152 @@ func SpendTransaction(client *rpcclient.Client, trackedUtxo *TrackedUTXO, privat
 	outputValue := trackedUtxo.Amount
 
 	// Create a new transaction
-	newTx := wire.NewMsgTx(2)
+	newTx := wire.NewMsgTx(txVersionFor(config, trackedUtxo))
 
 	// Add the input
 	outpoint := wire.NewOutPoint(outputHash, outputIndex)
-	txIn := wire.NewTxIn(outpoint, nil, nil)
+	txIn := newTxIn(config, outpoint)
 	newTx.AddTxIn(txIn)
 
-	// Parse destination address
-	// TODO - During startup when we load the config, decode the destination address and check it there
-	destAddr, err := btcutil.DecodeAddress(config.DestinationAddress, network)
-	if err != nil {
-		return "", fmt.Errorf("error decoding destination address: %v", err)
-	}
-
 	// Create destination script
-	destScript, err := txscript.PayToAddrScript(destAddr)
+	destScript, err := txscript.PayToAddrScript(trackedUtxo.Destination)
 	if err != nil {
 		return "", fmt.Errorf("error creating destination script: %v", err)
 	}
 
 	// Estimate transaction size
-	estimatedSize := estimateTransactionSize(config, outputValue, trackedUtxo.Script.Hex)
-
-	feeRate := defaultFeeRate
-
-	// If we can get fee estimates from the node, use that instead
-	// TODO do not let EstimateSmartFee block here
-	feeEstimate, err := client.EstimateSmartFee(1, &btcjson.EstimateModeConservative)
-	if err == nil && feeEstimate.FeeRate != nil {
-		// Convert from BTC/KB to satoshis/vbyte
-		nodeFeeRate := *feeEstimate.FeeRate * 1_0000_0000 / 1000
-		log.Printf("Fee estimate from node: %f sat/vbyte", nodeFeeRate)
-		feeRate = nodeFeeRate
-	} else {
-		log.Printf("No fee estimate from node, using default fee rate %f sat/vbyte", defaultFeeRate)
-	}
+	estimatedSize := estimateTransactionSize(destScript, outputValue, trackedUtxo.Script.Hex)
 
 	// Calculate the fee in satoshis based on estimated size
 	feeSatoshis := int64(float64(estimatedSize) * feeRate)
 
 	// Calculate output amount (input amount - fee)
 	outputSatoshis := int64(outputValue.ToUnit(btcutil.AmountSatoshi)) - feeSatoshis
-	if outputSatoshis <= 0 {
-		return "", fmt.Errorf("not enough funds to cover fee")
+	if outputSatoshis < int64(dustThreshold(destScript)) {
+		return "", errNotEnoughFunds
 	}
 
 	// Add the output
 	txOut := wire.NewTxOut(outputSatoshis, destScript)
 	newTx.AddTxOut(txOut)
 
-	if err := SignInput(client, newTx, 0, privateKeyWIF, trackedUtxo); err != nil {
+	applyLockTime(config, newTx, tipHeight.Load())
+
+	if err := SignInput(config.backend, config.batch, newTx, 0, privateKeyWIF, trackedUtxo); err != nil {
 		return "", fmt.Errorf("error signing transaction: %v", err)
 	}
 
-	log.Printf("Broadcasting fee_rate=%f total_fee=%f sats tx_size=%d", feeRate, float64(feeSatoshis), estimatedSize)
+	trackedUtxo.logger().Info("Broadcasting sweep", "feerate", feeRate, "fee", btcutil.Amount(feeSatoshis), "vsize", estimatedSize)
 
 	// Broadcast the transaction
-	newTxHash, err := client.SendRawTransaction(newTx, true)
+	newTxHash, err := broadcastTransaction(client, config.backend, config.peers, newTx, trackedUtxo)
 	if err != nil {
 		return "", fmt.Errorf("error broadcasting transaction: %v", err)
 	}
 
-	log.Printf(color.GreenString("Spent utxo from watched address %s:%d\n"+
-		"\ttxid=%s\n"+
-		"\tfee_rate=%f sat/vbyte\n"+
-		"\tvalue=%f BTC\n"+
-		"\toutput_value=%f BTC"),
-		trackedUtxo.TxID,
-		trackedUtxo.N,
-		newTxHash,
-		feeRate,
-		trackedUtxo.Amount.ToBTC(),
-		btcutil.Amount(outputSatoshis).ToBTC(),
+	trackedUtxo.mu.Lock()
+	if trackedUtxo.SpendTx == nil {
+		trackedUtxo.InitialFeeRate = feeRate
+	}
+	trackedUtxo.SpendTx = newTx
+	trackedUtxo.SpendFeeRate = feeRate
+	trackedUtxo.Fee = btcutil.Amount(feeSatoshis)
+	trackedUtxo.SpendHeight = tipHeight.Load()
+	trackedUtxo.mu.Unlock()
+
+	publishBattle(SweepSent{Battle: trackedUtxo, TxID: newTxHash.String(), FeeRate: feeRate, Fee: btcutil.Amount(feeSatoshis)})
+
+	success(trackedUtxo.logger(), "Spent utxo from watched address",
+		"our_txid", newTxHash,
+		"feerate", feeRate,
+		"value", trackedUtxo.Amount,
+		"output_value", btcutil.Amount(outputSatoshis),
 	)
 	return newTxHash.String(), nil
 }
 
+// TryReplacingAttacker answers a counterpart transaction with a replacement paying what our fee strategy decides
 func TryReplacingAttacker(client *rpcclient.Client, counterpart *btcjson.TxRawResult, utxo *TrackedUTXO, privateKeyWIF string, config *Config) {
-	mempool, err := client.GetMempoolEntry(counterpart.Txid)
-	if err != nil {
-		log.Printf(color.RedString("Failed to get mempool entry for %s. The attacking transaction was probably already replaced by someone else: %v"), counterpart.Txid, err)
-		return
+	replaceCounterpart(client, feeStrategy, counterpart, utxo, privateKeyWIF, config)
+}
+
+// replaceCounterpart answers a counterpart transaction with a replacement paying what strategy decides.
+// It returns why no replacement was accepted, if none was.
+func replaceCounterpart(client *rpcclient.Client, strategy FeeStrategy, counterpart *btcjson.TxRawResult, utxo *TrackedUTXO, privateKeyWIF string, config *Config) error {
+	logger := utxo.logger().With("counterpart", counterpart.Txid)
+
+	// The wallet coin funding our replacement doesn't depend on the counterpart,
+	// so it's reserved in the same round trip as the counterpart is looked up
+	conflict, unspent, conflictErr, fundingErr := lookupReaction(client, config.backend, config.batch, config.peers, counterpart, utxo)
+	if conflictErr != nil {
+		logger.Error("Failed to get mempool entry for counterpart. It was probably already replaced by someone else", "err", conflictErr)
+		return fmt.Errorf("error looking up counterpart %s: %v", counterpart.Txid, conflictErr)
 	}
 
-	counterFee, _ := btcutil.NewAmount(mempool.Fees.Descendant)
-	vsize := mempool.VSize
-	counterFeeRate := counterFee.ToUnit(btcutil.AmountSatoshi) / float64(vsize)
-
-	log.Printf(
-		color.YellowString("Someone is spending monitored UTXO!\n"+
-			"\tcounterpart=%s\n"+
-			"\tutxo=%s:%d\n"+
-			"\tfee_rate=%f sat/vbyte\n"+
-			"\ttotal_fee=%f BTC\n"+
-			"\tfee_percentage=%f%%"),
-		counterpart.Txid,
-		utxo.TxID,
-		utxo.N,
-		counterFeeRate,
-		counterFee.ToBTC(),
-		(counterFee.ToBTC()/utxo.Amount.ToBTC())*100,
+	counterFee := conflict.Fee
+	counterFeeRate := conflict.FeeRate()
+
+	utxo.mu.Lock()
+	utxo.Counterpart = counterpart
+	utxo.mu.Unlock()
+
+	publishBattle(CounterpartDetected{Battle: utxo, Counterpart: counterpart, FeeRate: counterFeeRate, Fee: counterFee})
+
+	logger.Warn("Someone is spending monitored UTXO!",
+		"feerate", counterFeeRate,
+		"fee", counterFee,
+		"fee_percentage", (counterFee.ToBTC()/utxo.Amount.ToBTC())*100,
 	)
 
+	if !nodeFullRBF && !signalsRBF(counterpart) {
+		logger.Warn("Counterpart does not signal BIP125 and our node is not running full-RBF. The replacement will probably be refused")
+	}
+
+	if conflict.Sibling {
+		logger.Warn("Counterpart is a TRUC sibling. Trying to evict it")
+	}
+
 	if counterFee > utxo.Amount {
-		log.Printf(color.RedString("Counterpart paid more in fee than what the utxo is worth. Giving up."+
-			"\n\tfees=%f BTC\n"+
-			"\tamount=%f BTC"),
-			counterFee.ToBTC(),
-			utxo.Amount.ToBTC(),
+		logger.Error("Counterpart paid more in fee than what the utxo is worth. Giving up.",
+			"fee", counterFee,
+			"amount", utxo.Amount,
 		)
-		return
-	} else if counterFee == utxo.Amount {
-		log.Printf(color.RedString("Counterpart burned the utxo. Giving up."+
-			"\n\tfees=%f BTC\n"+
-			"\tamount=%f BTC"),
-			counterFee.ToBTC(),
-			utxo.Amount.ToBTC(),
+		return fmt.Errorf("counterpart %s paid more in fee than the utxo is worth", counterpart.Txid)
+	} else if counterFee == utxo.Amount && !conflict.Sibling {
+		utxo.setState(stateLost)
+		utxo.logger().Error("Counterpart burned the utxo. Giving up.",
+			"counterpart", counterpart.Txid,
+			"fee", counterFee,
+			"amount", utxo.Amount,
 		)
-		cleanup(utxo)
-		return
+		publishBattle(BattleResolved{Battle: utxo, Outcome: stateLost, TxID: counterpart.Txid})
+		return fmt.Errorf("counterpart %s burned the utxo", counterpart.Txid)
 	}
 
-	// Select the transaction in our wallet we're using as an input along with the utxo we're trying to spend
-	unspent, err := selectUnspentUtxo(client)
-	if err != nil {
-		log.Fatalf(color.RedString("error listing unspent: %v"), err)
-		return
+	// The transaction in our wallet we're using as an input along with the utxo we're trying to spend
+	if fundingErr != nil {
+		logger.Error("Failed to reserve a wallet utxo for the replacement", "err", fundingErr)
+		return fmt.Errorf("error reserving a wallet utxo: %v", fundingErr)
 	}
 	unspentSats, _ := btcutil.NewAmount(unspent.Amount)
 
+	destScript, err := txscript.PayToAddrScript(utxo.Destination)
+	if err != nil {
+		logger.Error("Failed to create destination script", "err", err)
+		return fmt.Errorf("error creating destination script: %v", err)
+	}
+
 	utxoValue := (utxo.Amount)
-	estimatedTxSize := estimateTransactionSize(config, utxoValue+unspentSats, utxo.Script.Hex, unspent.ScriptPubKey)
+	estimatedTxSize := estimateTransactionSize(destScript, utxoValue+unspentSats, utxo.Script.Hex, unspent.ScriptPubKey)
+
+	conflict.MinFee, err = replacementPolicy.MinReplacementFee(conflict, utxo, int32(estimatedTxSize))
+	if err != nil {
+		logger.Error("Failed to evaluate replacement", "err", err)
+		return fmt.Errorf("error evaluating replacement: %v", err)
+	}
 
 	// New fee rate we're trying to counter with
-	newFee, overpaying := newFee(counterFee, vsize, int32(estimatedTxSize), utxo)
+	action, newFee := decideReplacement(strategy, conflict, utxo, unspentSats, int32(estimatedTxSize), destScript)
 	newFeeRate := float64(newFee) / float64(estimatedTxSize)
 
 	// The new output value we're trying to spend
@@ -360,137 +521,186 @@ func TryReplacingAttacker(client *rpcclient.Client, counterpart *btcjson.TxRawRe
 	outputValueSatoshis := btcutil.Amount(utxoValue - newFee + unspentSats)
 	feePercentage := (float64(newFee) / float64(utxoValue)) * 100
 
-	log.Printf("Trying to broadcast replacement for %s\n"+
-		"\tpercentage_paid_in_fees=%f%%\n"+
-		"\tfee_rate=%f sat/vbyte\n"+
-		"\ttotal_fee=%f BTC\n"+
-		"\toutput_value=%f BTC",
-		formatTxId(counterpart.Txid),
-		feePercentage,
-		newFeeRate,
-		newFee.ToBTC(),
-		btcutil.Amount(utxoValue-newFee).ToBTC(),
+	logger.Info("Trying to broadcast replacement",
+		"fee_percentage", feePercentage,
+		"feerate", newFeeRate,
+		"fee", newFee,
+		"output_value", btcutil.Amount(utxoValue-newFee),
 	)
 
-	if overpaying {
-		log.Printf(color.RedString("Burning utxo as we would spend %f%% of the value on fees. %s"), feePercentage, formatTxId(counterpart.Txid))
+	switch action {
+	case burnAction:
+		logger.Error("Burning utxo as we would spend too much of the value on fees", "fee_percentage", feePercentage)
 
 		if _, err := BurnTransaction(client, counterpart, utxo, privateKeyWIF, config); err != nil {
-			log.Printf(color.RedString("Failed to burn transaction: %v"), err)
+			logger.Error("Failed to burn transaction", "err", err)
 		}
-		return
-	}
-
-	if outputValueSatoshis < 547 {
-		log.Printf("Output value is less than dust limit. Giving up.")
-		return
+		return fmt.Errorf("burned the utxo instead of paying %s in fees", newFee)
+	case giveUpAction:
+		logger.Info("Output value is less than dust limit. Giving up.")
+		return fmt.Errorf("output value would be dust")
+	}
+
+	// Broadcast the cheapest pre-signed rung paying at least the fee we decided on,
+	// or sign a replacement now when the ladder doesn't reach it
+	var newTxID string
+	if rung, ok := utxo.ladderRung(newFee); ok {
+		newFee, newFeeRate = rung.Fee, rung.FeeRate
+		logger.Info("Using pre-signed replacement", "feerate", newFeeRate, "fee", newFee)
+
+		var hash *chainhash.Hash
+		if hash, err = broadcastTransaction(client, config.backend, config.peers, rung.Tx, utxo); err == nil {
+			newTxID = hash.String()
+		}
+	} else {
+		newTxID, err = ReplaceTransaction(client, int64(outputValueSatoshis), unspent, counterpart, utxo, privateKeyWIF, config)
 	}
 
-	newTxID, err := ReplaceTransaction(client, int64(outputValueSatoshis), unspent, counterpart, utxo, privateKeyWIF, config)
-
 	// We were able to replace the transaction
 	if err == nil {
+		utxo.mu.Lock()
+		utxo.Fee = newFee
+		utxo.mu.Unlock()
+
+		utxo.setState(stateReplaced)
+		publishBattle(ReplacementSent{Battle: utxo, Counterpart: counterpart.Txid, TxID: newTxID, FeeRate: newFeeRate, Fee: newFee})
+
 		feeIncrease := (counterFeeRate / newFeeRate) * 100
-		log.Printf(color.GreenString("Replaced counterpart transaction %s with new transaction %s, fee_increase=%f%%"), formatTxId(counterpart.Txid), newTxID, feeIncrease)
-		return
+		success(utxo.logger(), "Replaced counterpart transaction",
+			"counterpart", counterpart.Txid,
+			"our_txid", newTxID,
+			"feerate", newFeeRate,
+			"fee_increase", feeIncrease,
+		)
+		return nil
 	}
 
+	reason := rejectionReason(err)
+	bus.Publish(ReplacementRejected{Battle: utxo, Reason: reason, Err: err})
+
 	// We're basing our new feerate on the counterpart feerate
-	if strings.Contains(err.Error(), "-26: insufficient fee") {
+	switch reason {
+	case "insufficient-fee":
 		// The new proposed replacement fee rate is too low.
 		// This is probably because another replacement was broadcasted,
 		// so we just abort and try replacing the other transaction when we detect it.
-		log.Printf(color.RedString("Insufficient fees paid. err=%v"), err)
-		return
-	} else if strings.Contains(err.Error(), "not enough funds to cover fee") {
-		log.Printf(color.RedString("No money left to spend. Burning. err=%v"), err)
+		logger.Error("Insufficient fees paid", "feerate", newFeeRate, "err", err)
+	case "not-enough-funds":
+		logger.Error("No money left to spend. Burning.", "err", err)
 		if _, err := BurnTransaction(client, counterpart, utxo, privateKeyWIF, config); err != nil {
-			log.Printf(color.RedString("Failed to burn transaction. err=%v"), err)
+			logger.Error("Failed to burn transaction", "err", err)
 		}
-		return
-	} else if strings.Contains(err.Error(), "-26: dust") {
-		log.Printf(color.RedString("Replacement was rejected as it would leave only dust. Giving up. %s"), err)
+	case "dust":
+		logger.Error("Replacement was rejected as it would leave only dust. Giving up.", "err", err)
 		if _, err := BurnTransaction(client, counterpart, utxo, privateKeyWIF, config); err != nil {
-			log.Printf(color.RedString("Failed to burn transaction: %v"), err)
+			logger.Error("Failed to burn transaction", "err", err)
 		}
-		return
-	} else if strings.Contains(err.Error(), "bad-txns-inputs-missingorspent") {
+	case "missing-inputs":
 		// We tried to replace a transaction that was already confirmed.
-		log.Printf(color.RedString("Counterpart transaction %s was confirmed. %s"), counterpart.Txid, err)
-		return
+		logger.Error("Counterpart transaction was confirmed", "err", err)
+	default:
+		logger.Error("Error replacing counterattack transaction", "err", err)
 	}
-
-	log.Printf("Error replacing counterattack transaction: %v", err)
+	return fmt.Errorf("replacement rejected: %s: %v", reason, err)
 }
 
 func BurnTransaction(client *rpcclient.Client, counterpart *btcjson.TxRawResult, trackedUtxo *TrackedUTXO, privateKeyWIF string, config *Config) (string, error) {
+	// Use the burn pre-signed with the ladder when there is one
+	newTx := trackedUtxo.presignedBurn()
+	if newTx == nil {
+		var err error
+		newTx, err = signBurn(client, trackedUtxo, privateKeyWIF, config)
+		if err != nil {
+			return "", err
+		}
+	}
 
+	// Broadcast the transaction
+	newTxHash, err := broadcastTransaction(client, config.backend, config.peers, newTx, trackedUtxo)
+	if err != nil {
+		return "", fmt.Errorf("error broadcasting transaction: %v", err)
+	}
+
+	publishBattle(BurnSent{Battle: trackedUtxo, TxID: newTxHash.String()})
+
+	trackedUtxo.setState(stateBurned)
+	success(trackedUtxo.logger(), "Burned utxo", "our_txid", newTxHash)
+
+	publishBattle(BattleResolved{Battle: trackedUtxo, Outcome: stateBurned, TxID: newTxHash.String(), Fee: trackedUtxo.Amount})
+	return newTxHash.String(), nil
+}
+
+// signBurn creates a transaction spending the utxo to an OP_RETURN output, leaving it all to fees
+func signBurn(client *rpcclient.Client, trackedUtxo *TrackedUTXO, privateKeyWIF string, config *Config) (*wire.MsgTx, error) {
 	// Create a transaction spending the output
 	txHash, err := chainhash.NewHashFromStr(trackedUtxo.TxID)
 	if err != nil {
-		return "", fmt.Errorf("error parsing transaction hash: %v", err)
+		return nil, fmt.Errorf("error parsing transaction hash: %v", err)
 	}
 
-	newTx := wire.NewMsgTx(2)
+	newTx := wire.NewMsgTx(txVersionFor(config, trackedUtxo))
 
 	// Add the input
 	outpoint := wire.NewOutPoint(txHash, trackedUtxo.N)
-	txIn := wire.NewTxIn(outpoint, nil, nil)
+	txIn := newTxIn(config, outpoint)
 	newTx.AddTxIn(txIn)
 
 	msg := []byte(config.BurnMessage)
 	// Create destination script
 	destScript, err := txscript.NullDataScript(msg)
 	if err != nil {
-		return "", fmt.Errorf("error creating destination script: %v", err)
+		return nil, fmt.Errorf("error creating destination script: %v", err)
 	}
 
 	// Add the output
 	txOut := wire.NewTxOut(0, destScript)
 	newTx.AddTxOut(txOut)
 
-	if err := SignInput(client, newTx, 0, privateKeyWIF, trackedUtxo); err != nil {
-		return "", fmt.Errorf("error creating signature script: %v", err)
+	applyLockTime(config, newTx, tipHeight.Load())
+
+	if err := SignInput(config.backend, config.batch, newTx, 0, privateKeyWIF, trackedUtxo); err != nil {
+		return nil, fmt.Errorf("error creating signature script: %v", err)
+	}
+
+	return newTx, nil
+}
+
+// ReplaceTransaction creates and broadcasts a transaction to send funds to our destination address
+func ReplaceTransaction(client *rpcclient.Client, outputValue int64, unspent btcjson.ListUnspentResult, counterpart *btcjson.TxRawResult, trackedUtxo *TrackedUTXO, privateKeyWIF string, config *Config) (string, error) {
+	newTx, err := signReplacement(client, outputValue, unspent, trackedUtxo, privateKeyWIF, config)
+	if err != nil {
+		return "", err
 	}
 
 	// Broadcast the transaction
-	newTxHash, err := client.SendRawTransaction(newTx, true)
+	newTxHash, err := broadcastTransaction(client, config.backend, config.peers, newTx, trackedUtxo)
 	if err != nil {
 		return "", fmt.Errorf("error broadcasting transaction: %v", err)
 	}
 
-	log.Printf(color.GreenString("BURNED IN %s"), newTxHash.String())
-
-	cleanup(trackedUtxo)
 	return newTxHash.String(), nil
 }
 
-// ReplaceTransaction creates and broadcasts a transaction to send funds to our destination address
-func ReplaceTransaction(client *rpcclient.Client, outputValue int64, unspent btcjson.ListUnspentResult, counterpart *btcjson.TxRawResult, trackedUtxo *TrackedUTXO, privateKeyWIF string, config *Config) (string, error) {
+// signReplacement creates a transaction spending the utxo and the wallet coin unspent to our destination
+func signReplacement(client *rpcclient.Client, outputValue int64, unspent btcjson.ListUnspentResult, trackedUtxo *TrackedUTXO, privateKeyWIF string, config *Config) (*wire.MsgTx, error) {
 	// Create a transaction spending the output
 	txHash, err := chainhash.NewHashFromStr(trackedUtxo.TxID)
 	if err != nil {
-		return "", fmt.Errorf("error parsing transaction hash: %v", err)
+		return nil, fmt.Errorf("error parsing transaction hash: %v", err)
 	}
 
 	// Create a new transaction
-	newTx := wire.NewMsgTx(2)
+	newTx := wire.NewMsgTx(txVersionFor(config, trackedUtxo))
 
 	// Add the input
 	outpoint := wire.NewOutPoint(txHash, trackedUtxo.N)
-	txIn := wire.NewTxIn(outpoint, nil, nil)
+	txIn := newTxIn(config, outpoint)
 	newTx.AddTxIn(txIn)
 
-	// Parse destination address
-	destAddr, err := btcutil.DecodeAddress(config.DestinationAddress, network)
-	if err != nil {
-		return "", fmt.Errorf("error decoding destination address: %v", err)
-	}
-
 	// Create destination script
-	destScript, err := txscript.PayToAddrScript(destAddr)
+	destScript, err := txscript.PayToAddrScript(trackedUtxo.Destination)
 	if err != nil {
-		return "", fmt.Errorf("error creating destination script: %v", err)
+		return nil, fmt.Errorf("error creating destination script: %v", err)
 	}
 
 	// Add the output
@@ -499,67 +709,179 @@ func ReplaceTransaction(client *rpcclient.Client, outputValue int64, unspent btc
 
 	txHash2, _ := chainhash.NewHashFromStr(unspent.TxID)
 	outpoint2 := wire.NewOutPoint(txHash2, unspent.Vout)
-	txIn2 := wire.NewTxIn(outpoint2, nil, nil)
+	txIn2 := newTxIn(config, outpoint2)
 	newTx.AddTxIn(txIn2)
 
+	unspentAmount, err := btcutil.NewAmount(unspent.Amount)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing wallet utxo amount: %v", err)
+	}
+	unspentScript, err := hex.DecodeString(unspent.ScriptPubKey)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding wallet utxo script: %v", err)
+	}
+
+	applyLockTime(config, newTx, tipHeight.Load())
+
 	sig, _, err := client.SignRawTransactionWithWallet(newTx)
 
 	if err != nil {
-		return "", fmt.Errorf("error signing transaction with wallet: %v", err)
+		return nil, fmt.Errorf("error signing transaction with wallet: %v", err)
 	}
 
-	if err := SignInput(client, sig, 0, privateKeyWIF, trackedUtxo); err != nil {
-		return "", fmt.Errorf("error signing transaction: %v", err)
+	// The wallet told us the output of its coin, so a taproot signature needs no lookup
+	known := map[wire.OutPoint]*wire.TxOut{*outpoint2: wire.NewTxOut(int64(unspentAmount), unspentScript)}
+	if err := signInputWithPrevOuts(config.backend, config.batch, sig, 0, privateKeyWIF, trackedUtxo, known); err != nil {
+		return nil, fmt.Errorf("error signing transaction: %v", err)
 	}
 
-	// Broadcast the transaction
-	newTxHash, err := client.SendRawTransaction(sig, true)
-	if err != nil {
-		return "", fmt.Errorf("error broadcasting transaction: %v", err)
+	return sig, nil
+}
+
+func main() {
+	if len(os.Args) > 1 && os.Args[1] == "simulate" {
+		if err := runSimulate(os.Args[2:]); err != nil {
+			fatal("Error running simulation", "err", err)
+		}
+		return
 	}
 
-	return newTxHash.String(), nil
-}
+	// Load configuration
+	config, err := LoadConfig()
+	if err != nil {
+		fatal("Error loading config", "err", err)
+	}
 
-var rawTransactionQueue = make(chan *btcjson.TxRawResult, 100)
+	handler, err := newLogHandler(os.Stderr, config.LogFormat, config.logLevel)
+	if err != nil {
+		fatal("Error setting up logging", "err", err)
+	}
+	slog.SetDefault(slog.New(handler))
 
-func processor(client *rpcclient.Client, config *Config) {
-	for {
-		select {
-		case tx := <-rawTransactionQueue:
-			processTransaction(client, tx, config)
+	var replay *replayNode
+	if config.Replay != "" {
+		replay, err = replayCapture(config)
+		if err != nil {
+			fatal("Error replaying capture", "err", err)
 		}
 	}
-}
 
-func main() {
-	slog.SetLogLoggerLevel(slog.LevelDebug)
+	var observers []rpcObserver
+	if config.Record != "" {
+		capture, err = newRecorder(config.Record)
+		if err != nil {
+			fatal(err.Error())
+		}
+		observers = append(observers, capture.recordRPC)
+	}
+	if config.Metrics != "" {
+		startMetricsServer(config.Metrics)
+		observers = append(observers, observeRPC)
+	}
 
-	// Load configuration
-	config, err := LoadConfig()
+	// Calls to the node go through a proxy that retries them and survives node restarts
+	transport, err := newRPCTransport(config.RPCUser, config.RPCPassword, config.RPCCookiePath, config.RPCTimeout)
 	if err != nil {
-		log.Fatalf("Error loading config: %v", err)
+		fatal(err.Error())
 	}
+	config.RPCHost, err = startRPCProxy(config.RPCHost, transport, observers...)
+	if err != nil {
+		fatal(err.Error())
+	}
+	config.RPCUser, config.RPCPassword, config.RPCCookiePath = transport.localUser, transport.localPass, ""
 
 	// Connect to Bitcoin node
 	client := connectToBitcoinNode(config)
 	defer client.Shutdown()
 
+	if !config.NoRPCBatch {
+		batchClient, err := newBatchRPCClient(config, config.RPCWallet)
+		if err != nil {
+			fatal("Error connecting to Bitcoin node", "err", err)
+		}
+		defer batchClient.Shutdown()
+		config.batch = &rpcBatch{client: batchClient}
+	}
+
 	// Check if the wallet has any spendable utxo we can use when replacing transactions
 	_, err = selectUnspentUtxo(client)
 	if err != nil {
-		log.Fatalf("%v", err)
+		fatal(err.Error())
+	}
+
+	destinations, err = newDestinationProvider(config)
+	if err != nil {
+		fatal(err.Error())
 	}
 
+	nodeFullRBF = checkReplacementPolicy(client, config)
+	replacementPolicy = detectReplacementPolicy(client, config.batch)
+
 	// Load our addresses and private keys
 	err = loadAddressesAndKeys(config.AddressFile)
 	if err != nil {
-		log.Fatalf("Error loading addresses and keys: %v", err)
+		fatal("Error loading addresses and keys", "err", err)
+	}
+
+	config.backend, err = newChainBackend(client, config)
+	if err != nil {
+		fatal("Error connecting to the chain backend", "backend", config.Backend, "err", err)
+	}
+
+	bus.Subscribe(newNotifiers(config).notifyEvent)
+
+	if config.LadderRungs > 0 {
+		subscribeLadder(client, config)
+	}
+
+	config.peers, err = connectPeers(config)
+	if err != nil {
+		fatal(err.Error())
+	}
+	for _, peer := range config.peers {
+		go watchPeerMempool(peer)
+	}
+	for _, addr := range config.P2P {
+		// Without ZMQ, confirmations only come from the blocks the p2p nodes announce
+		go listenP2P(addr, rawTransactionQueue, config.NoZMQ)
+	}
+
+	// A replay feeds the captured messages to the bot itself, without ZMQ or timers
+	if replay != nil {
+		slog.Info("Replaying ZMQ messages", "count", len(replay.messages), "file", config.Replay, "speed", config.ReplaySpeed)
+		if err := replay.run(client, config); err != nil {
+			fatal("Error replaying capture", "err", err)
+		}
+		slog.Info("Replay finished", "file", config.Replay)
+		return
 	}
 
-	for i := 0; i < 16; i++ {
-		go processor(client, config)
+	startPipeline(client, config, 16)
+
+	go trackChainTip(config.backend)
+
+	if config.API != "" {
+		if err := startAPIServer(client, config); err != nil {
+			fatal(err.Error())
+		}
 	}
 
+	if config.SelfBumpBlocks > 0 {
+		go runSelfBumpScheduler(client, config)
+	}
+
+	if config.TUI {
+		go runDashboard(client, config)
+	}
+
+	if config.Backend != "bitcoind" {
+		slog.Info("Following the mempool", "backend", config.Backend)
+		if err := config.backend.WatchTransactions(rawTransactionQueue); err != nil {
+			fatal("Failed to follow the mempool", "backend", config.Backend, "err", err)
+		}
+	}
+	if config.NoZMQ {
+		select {}
+	}
 	monitorMempoolWithZMQ(client, config)
 }
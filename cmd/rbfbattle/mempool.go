@@ -0,0 +1,523 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/btcsuite/btcd/btcjson"
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+)
+
+const (
+	// Bitcoin Core limits the number of transactions a replacement may evict (BIP125 rule 5)
+	maxReplacementEvictions = 100
+
+	defaultPolicyVersion = 280000
+)
+
+// policyMempool is a chain and mempool that enforce the replacement rules of a bitcoind
+// version. The simulator fights battles against it and the tests serve it over RPC and ZMQ.
+type policyMempool struct {
+	mu sync.Mutex
+
+	FullRBF bool
+	// Version is the bitcoind version whose policy is enforced, such as 280000
+	Version int32
+	// VerifyScripts enables signature checks on every transaction
+	VerifyScripts bool
+
+	height  int64
+	tip     chainhash.Hash
+	coins   map[wire.OutPoint]*wire.TxOut
+	txs     map[chainhash.Hash]*mempoolTx
+	mempool map[chainhash.Hash]*mempoolTx
+	spentBy map[wire.OutPoint]chainhash.Hash
+	nonce   uint32
+
+	// notify receives the ZMQ notifications bitcoind would publish, with mu held. Nil
+	// drops them.
+	notify     func(topic string, body []byte)
+	mempoolSeq uint64
+}
+
+type mempoolTx struct {
+	tx        *wire.MsgTx
+	fee       btcutil.Amount
+	vsize     int64
+	time      int64
+	height    int64
+	blockHash *chainhash.Hash
+}
+
+// newPolicyMempool creates an empty chain and mempool with full RBF and script checks
+func newPolicyMempool() *policyMempool {
+	return &policyMempool{
+		FullRBF:       true,
+		Version:       defaultPolicyVersion,
+		VerifyScripts: true,
+		coins:         make(map[wire.OutPoint]*wire.TxOut),
+		txs:           make(map[chainhash.Hash]*mempoolTx),
+		mempool:       make(map[chainhash.Hash]*mempoolTx),
+		spentBy:       make(map[wire.OutPoint]chainhash.Hash),
+	}
+}
+
+// announce hands a notification to the notify hook if there is one
+func (m *policyMempool) announce(topic string, body []byte) {
+	if m.notify != nil {
+		m.notify(topic, body)
+	}
+}
+
+// Fund creates a confirmed output paying to script out of thin air
+func (m *policyMempool) Fund(script []byte, amount btcutil.Amount) wire.OutPoint {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	// A coinbase-like transaction so getrawtransaction finds the output
+	m.nonce++
+	tx := wire.NewMsgTx(2)
+	tx.AddTxIn(wire.NewTxIn(wire.NewOutPoint(&chainhash.Hash{}, wire.MaxPrevOutIndex), binary.LittleEndian.AppendUint32(nil, m.nonce), nil))
+	tx.AddTxOut(wire.NewTxOut(int64(amount), script))
+
+	txHash := tx.TxHash()
+	tip := m.tip
+	m.txs[txHash] = &mempoolTx{tx: tx, height: m.height, blockHash: &tip}
+
+	outpoint := wire.OutPoint{Hash: txHash, Index: 0}
+	m.coins[outpoint] = tx.TxOut[0]
+	return outpoint
+}
+
+// Submit adds a transaction to the mempool like sendrawtransaction
+func (m *policyMempool) Submit(tx *wire.MsgTx) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.accept(tx, false)
+}
+
+// MempoolFee returns the fee of a mempool transaction
+func (m *policyMempool) MempoolFee(txHash chainhash.Hash) (btcutil.Amount, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	entry, ok := m.mempool[txHash]
+	if !ok {
+		return 0, false
+	}
+	return entry.fee, true
+}
+
+// MineBlock confirms every mempool transaction in a new block
+func (m *policyMempool) MineBlock() []*wire.MsgTx {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.height++
+
+	// Parents before children
+	var block []*wire.MsgTx
+	var entries []*mempoolTx
+	for len(m.mempool) > 0 {
+		for txHash, entry := range m.mempool {
+			if len(m.mempoolParents(entry.tx)) > 0 {
+				continue
+			}
+
+			for _, txIn := range entry.tx.TxIn {
+				delete(m.coins, txIn.PreviousOutPoint)
+				delete(m.spentBy, txIn.PreviousOutPoint)
+			}
+			for i, txOut := range entry.tx.TxOut {
+				if !txscript.IsUnspendable(txOut.PkScript) {
+					m.coins[wire.OutPoint{Hash: txHash, Index: uint32(i)}] = txOut
+				}
+			}
+
+			delete(m.mempool, txHash)
+			block = append(block, entry.tx)
+			entries = append(entries, entry)
+		}
+	}
+
+	// The header isn't valid, but its hash is the tip the node reports
+	msgBlock := wire.MsgBlock{
+		Header:       wire.BlockHeader{Version: 4, PrevBlock: m.tip, Timestamp: time.Unix(time.Now().Unix(), 0), Nonce: uint32(m.height)},
+		Transactions: block,
+	}
+	m.tip = msgBlock.BlockHash()
+	tip := m.tip
+	for _, entry := range entries {
+		entry.height = m.height
+		entry.blockHash = &tip
+	}
+
+	for _, tx := range block {
+		m.publishTx(tx)
+	}
+	m.announce("hashblock", reverseBytes(tip[:]))
+	var buf bytes.Buffer
+	msgBlock.Serialize(&buf)
+	m.announce("rawblock", buf.Bytes())
+	m.announce("sequence", append(reverseBytes(tip[:]), 'C'))
+
+	return block
+}
+
+// prevOut returns the output spent by an outpoint, either confirmed or in the mempool
+func (m *policyMempool) prevOut(outpoint wire.OutPoint) (*wire.TxOut, *mempoolTx, bool) {
+	if out, ok := m.coins[outpoint]; ok {
+		return out, nil, true
+	}
+	if parent, ok := m.mempool[outpoint.Hash]; ok && int(outpoint.Index) < len(parent.tx.TxOut) {
+		return parent.tx.TxOut[outpoint.Index], parent, true
+	}
+	return nil, nil, false
+}
+
+// mempoolParents returns the unconfirmed parents of a transaction
+func (m *policyMempool) mempoolParents(tx *wire.MsgTx) map[chainhash.Hash]*mempoolTx {
+	parents := make(map[chainhash.Hash]*mempoolTx)
+	for _, txIn := range tx.TxIn {
+		if parent, ok := m.mempool[txIn.PreviousOutPoint.Hash]; ok {
+			parents[txIn.PreviousOutPoint.Hash] = parent
+		}
+	}
+	return parents
+}
+
+// descendants returns txHash and all its mempool descendants
+func (m *policyMempool) descendants(txHash chainhash.Hash) map[chainhash.Hash]*mempoolTx {
+	result := make(map[chainhash.Hash]*mempoolTx)
+	queue := []chainhash.Hash{txHash}
+
+	for len(queue) > 0 {
+		hash := queue[0]
+		queue = queue[1:]
+
+		entry, ok := m.mempool[hash]
+		if !ok {
+			continue
+		}
+		if _, seen := result[hash]; seen {
+			continue
+		}
+		result[hash] = entry
+
+		for i := range entry.tx.TxOut {
+			if child, ok := m.spentBy[wire.OutPoint{Hash: hash, Index: uint32(i)}]; ok {
+				queue = append(queue, child)
+			}
+		}
+	}
+	return result
+}
+
+// ancestors returns txHash and all its mempool ancestors
+func (m *policyMempool) ancestors(txHash chainhash.Hash) map[chainhash.Hash]*mempoolTx {
+	result := make(map[chainhash.Hash]*mempoolTx)
+	queue := []chainhash.Hash{txHash}
+
+	for len(queue) > 0 {
+		hash := queue[0]
+		queue = queue[1:]
+
+		entry, ok := m.mempool[hash]
+		if !ok {
+			continue
+		}
+		if _, seen := result[hash]; seen {
+			continue
+		}
+		result[hash] = entry
+
+		for parent := range m.mempoolParents(entry.tx) {
+			queue = append(queue, parent)
+		}
+	}
+	return result
+}
+
+func rejected(format string, args ...any) *btcjson.RPCError {
+	return btcjson.NewRPCError(btcjson.ErrRPCVerifyRejected, fmt.Sprintf(format, args...))
+}
+
+func formatBTC(amount btcutil.Amount) string {
+	return fmt.Sprintf("%.8f", amount.ToBTC())
+}
+
+// accept validates a transaction against the mempool policy and adds it, evicting anything it replaces.
+// A package parent may pay less than the minimum relay fee.
+func (m *policyMempool) accept(tx *wire.MsgTx, packageParent bool) error {
+	txHash := tx.TxHash()
+	if _, ok := m.mempool[txHash]; ok {
+		return nil
+	}
+	if entry, ok := m.txs[txHash]; ok && entry.blockHash != nil {
+		return btcjson.NewRPCError(btcjson.ErrRPCVerifyAlreadyInChain, "Transaction already in block chain")
+	}
+
+	var inputValue int64
+	conflicts := make(map[chainhash.Hash]*mempoolTx)
+	prevOuts := txscript.NewMultiPrevOutFetcher(nil)
+
+	for _, txIn := range tx.TxIn {
+		out, _, ok := m.prevOut(txIn.PreviousOutPoint)
+		if !ok {
+			return btcjson.NewRPCError(btcjson.ErrRPCVerify, "bad-txns-inputs-missingorspent")
+		}
+		if spender, ok := m.spentBy[txIn.PreviousOutPoint]; ok {
+			conflicts[spender] = m.mempool[spender]
+		}
+		inputValue += out.Value
+		prevOuts.AddPrevOut(txIn.PreviousOutPoint, out)
+	}
+
+	var outputValue int64
+	for _, txOut := range tx.TxOut {
+		outputValue += txOut.Value
+		if txOut.Value < int64(dustThreshold(txOut.PkScript)) {
+			return rejected("dust")
+		}
+	}
+	if outputValue > inputValue {
+		return rejected("bad-txns-in-belowout, value in (%s) < value out (%s)", formatBTC(btcutil.Amount(inputValue)), formatBTC(btcutil.Amount(outputValue)))
+	}
+
+	fee := btcutil.Amount(inputValue - outputValue)
+	vsize := txVirtualSize(tx)
+	if minFee := btcutil.Amount(vsize); fee < minFee && !packageParent {
+		return rejected("min relay fee not met, %d < %d", fee, minFee)
+	}
+
+	if err := m.checkTRUC(tx, vsize); err != nil {
+		return err
+	}
+
+	if len(conflicts) > 0 {
+		if err := m.checkReplacement(tx, fee, vsize, conflicts); err != nil {
+			return err
+		}
+	}
+
+	if m.VerifyScripts {
+		sigHashes := txscript.NewTxSigHashes(tx, prevOuts)
+		for i, txIn := range tx.TxIn {
+			prev := prevOuts.FetchPrevOutput(txIn.PreviousOutPoint)
+			vm, err := txscript.NewEngine(prev.PkScript, tx, i, txscript.StandardVerifyFlags, nil, sigHashes, prev.Value, prevOuts)
+			if err == nil {
+				err = vm.Execute()
+			}
+			if err != nil {
+				return rejected("mandatory-script-verify-flag-failed (%v)", err)
+			}
+		}
+	}
+
+	for conflict := range conflicts {
+		for evicted := range m.descendants(conflict) {
+			m.evict(evicted)
+		}
+	}
+
+	entry := &mempoolTx{tx: tx, fee: fee, vsize: vsize, time: time.Now().Unix()}
+	m.mempool[txHash] = entry
+	m.txs[txHash] = entry
+	for _, txIn := range tx.TxIn {
+		m.spentBy[txIn.PreviousOutPoint] = txHash
+	}
+
+	m.publishTx(tx)
+	m.mempoolSeq++
+	m.announce("sequence", binary.LittleEndian.AppendUint64(append(reverseBytes(txHash[:]), 'A'), m.mempoolSeq))
+
+	return nil
+}
+
+// checkTRUC enforces the TRUC (version 3) topology rules
+func (m *policyMempool) checkTRUC(tx *wire.MsgTx, vsize int64) error {
+	txHash := tx.TxHash()
+
+	for parentHash, parent := range m.mempoolParents(tx) {
+		switch {
+		case tx.Version == trucVersion && parent.tx.Version != trucVersion:
+			return rejected("TRUC-violation, version=3 tx %s cannot spend from non-version=3 tx %s", txHash, parentHash)
+		case tx.Version != trucVersion && parent.tx.Version == trucVersion:
+			return rejected("TRUC-violation, non-version=3 tx %s cannot spend from version=3 tx %s", txHash, parentHash)
+		case tx.Version == trucVersion && vsize > trucChildMaxVSize:
+			return rejected("TRUC-violation, version=3 child tx %s is too big: %d > %d virtual bytes", txHash, vsize, trucChildMaxVSize)
+		}
+	}
+
+	if tx.Version == trucVersion && vsize > trucMaxVSize {
+		return rejected("TRUC-violation, version=3 tx %s is too big: %d > %d virtual bytes", txHash, vsize, trucMaxVSize)
+	}
+	return nil
+}
+
+// checkReplacement enforces the replacement rules against the directly conflicting transactions
+func (m *policyMempool) checkReplacement(tx *wire.MsgTx, fee btcutil.Amount, vsize int64, conflicts map[chainhash.Hash]*mempoolTx) error {
+	txHash := tx.TxHash()
+
+	// Rule 1: the conflicts must be replaceable
+	conflictParents := make(map[chainhash.Hash]bool)
+	for _, conflict := range conflicts {
+		if !m.FullRBF && !signalsReplaceability(conflict.tx) {
+			return rejected("txn-mempool-conflict")
+		}
+		for _, txIn := range conflict.tx.TxIn {
+			conflictParents[txIn.PreviousOutPoint.Hash] = true
+		}
+	}
+
+	// Rule 2: no new unconfirmed inputs
+	for i, txIn := range tx.TxIn {
+		if _, unconfirmed := m.mempool[txIn.PreviousOutPoint.Hash]; unconfirmed && !conflictParents[txIn.PreviousOutPoint.Hash] {
+			return rejected("replacement-adds-unconfirmed, replacement %s adds unconfirmed input, idx %d", txHash, i)
+		}
+	}
+
+	evicted := make(map[chainhash.Hash]*mempoolTx)
+	for conflict := range conflicts {
+		for hash, entry := range m.descendants(conflict) {
+			evicted[hash] = entry
+		}
+	}
+	for _, txIn := range tx.TxIn {
+		if _, ok := evicted[txIn.PreviousOutPoint.Hash]; ok {
+			return rejected("bad-txns-spends-conflicting-tx, %s spends conflicting transaction %s", txHash, txIn.PreviousOutPoint.Hash)
+		}
+	}
+
+	// Rule 5: limit the number of evictions
+	if len(evicted) > maxReplacementEvictions {
+		return rejected("too many potential replacements, rejecting replacement %s; too many potential replacements (%d > %d)", txHash, len(evicted), maxReplacementEvictions)
+	}
+
+	// Rule 6: a higher fee rate than every direct conflict. Cluster mempool nodes compare
+	// feerate diagrams instead
+	if m.Version < clusterMempoolVersion {
+		feeRate := float64(fee) / float64(vsize)
+		for _, conflict := range conflicts {
+			if conflictFeeRate := float64(conflict.fee) / float64(conflict.vsize); feeRate <= conflictFeeRate {
+				return rejected("insufficient fee, rejecting replacement %s; new feerate %.8f BTC/kvB <= old feerate %.8f BTC/kvB", txHash, feeRate/1e5, conflictFeeRate/1e5)
+			}
+		}
+	}
+
+	// Rule 3: pay more than everything evicted
+	var evictedFees btcutil.Amount
+	for _, entry := range evicted {
+		evictedFees += entry.fee
+	}
+	if fee < evictedFees {
+		return rejected("insufficient fee, rejecting replacement %s, less fees than conflicting txs; %s < %s", txHash, formatBTC(fee), formatBTC(evictedFees))
+	}
+
+	// Rule 4: pay for our own relay
+	if minAdditional := btcutil.Amount(incrementalRelayFeeRate * float64(vsize)); fee-evictedFees < minAdditional {
+		return rejected("insufficient fee, rejecting replacement %s, not enough additional fees to relay; %s < %s", txHash, formatBTC(fee-evictedFees), formatBTC(minAdditional))
+	}
+
+	if m.Version >= clusterMempoolVersion {
+		return m.checkDiagram(tx, fee, vsize, evicted)
+	}
+	return nil
+}
+
+// checkDiagram accepts a replacement on a cluster mempool node if it improves the feerate diagram
+func (m *policyMempool) checkDiagram(tx *wire.MsgTx, fee btcutil.Amount, vsize int64, evicted map[chainhash.Hash]*mempoolTx) error {
+	old := make(cluster)
+	for hash := range evicted {
+		for ancestor, entry := range m.ancestors(hash) {
+			old[ancestor.String()] = m.clusterTx(entry)
+		}
+	}
+
+	replaced := make(cluster)
+	for id, entry := range old {
+		if _, ok := evicted[*mustHash(id)]; !ok {
+			replaced[id] = entry
+		}
+	}
+	ours := &clusterTx{fee: fee, vsize: vsize}
+	for parent, entry := range m.mempoolParents(tx) {
+		ours.parents = append(ours.parents, parent.String())
+		replaced[parent.String()] = m.clusterTx(entry)
+	}
+	replaced[tx.TxHash().String()] = ours
+
+	if !improvesDiagram(old.chunks(), replaced.chunks()) {
+		return rejected("insufficient fee, rejecting replacement %s; does not improve feerate diagram", tx.TxHash())
+	}
+	return nil
+}
+
+func (m *policyMempool) clusterTx(entry *mempoolTx) *clusterTx {
+	c := &clusterTx{fee: entry.fee, vsize: entry.vsize}
+	for parent := range m.mempoolParents(entry.tx) {
+		c.parents = append(c.parents, parent.String())
+	}
+	return c
+}
+
+func mustHash(s string) *chainhash.Hash {
+	hash, _ := chainhash.NewHashFromStr(s)
+	return hash
+}
+
+// signalsReplaceability checks if a transaction is replaceable without full-RBF
+func signalsReplaceability(tx *wire.MsgTx) bool {
+	if tx.Version == trucVersion {
+		return true
+	}
+	for _, txIn := range tx.TxIn {
+		if txIn.Sequence < sequenceLockTime {
+			return true
+		}
+	}
+	return false
+}
+
+// evict removes a transaction from the mempool
+func (m *policyMempool) evict(txHash chainhash.Hash) {
+	entry, ok := m.mempool[txHash]
+	if !ok {
+		return
+	}
+
+	for _, txIn := range entry.tx.TxIn {
+		if m.spentBy[txIn.PreviousOutPoint] == txHash {
+			delete(m.spentBy, txIn.PreviousOutPoint)
+		}
+	}
+	delete(m.mempool, txHash)
+	delete(m.txs, txHash)
+
+	m.mempoolSeq++
+	m.announce("sequence", binary.LittleEndian.AppendUint64(append(reverseBytes(txHash[:]), 'R'), m.mempoolSeq))
+}
+
+// publishTx publishes hashtx and rawtx notifications for a transaction
+func (m *policyMempool) publishTx(tx *wire.MsgTx) {
+	txHash := tx.TxHash()
+	m.announce("hashtx", reverseBytes(txHash[:]))
+
+	var buf bytes.Buffer
+	tx.Serialize(&buf)
+	m.announce("rawtx", buf.Bytes())
+}
+
+func reverseBytes(b []byte) []byte {
+	reversed := make([]byte, len(b))
+	for i := range b {
+		reversed[len(b)-1-i] = b[i]
+	}
+	return reversed
+}
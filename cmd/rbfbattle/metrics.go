@@ -0,0 +1,225 @@
+package main
+
+import (
+	"encoding/binary"
+	"log/slog"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// metricsRegistry holds our metrics only, without the Go runtime collectors of the default registry
+var metricsRegistry = prometheus.NewRegistry()
+
+var (
+	metricBattles = promauto.With(metricsRegistry).NewCounterVec(prometheus.CounterOpts{
+		Name: "rbfbattle_battles_total",
+		Help: "Battles over watched utxos by outcome (won, lost, burned, abandoned).",
+	}, []string{"outcome"})
+
+	metricReplacementsSent = promauto.With(metricsRegistry).NewCounter(prometheus.CounterOpts{
+		Name: "rbfbattle_replacements_sent_total",
+		Help: "Replacements of counterpart transactions accepted by the node.",
+	})
+
+	metricReplacementsRejected = promauto.With(metricsRegistry).NewCounterVec(prometheus.CounterOpts{
+		Name: "rbfbattle_replacements_rejected_total",
+		Help: "Replacements of counterpart transactions rejected by the node by reason.",
+	}, []string{"reason"})
+
+	metricFeesPaid = promauto.With(metricsRegistry).NewCounter(prometheus.CounterOpts{
+		Name: "rbfbattle_fees_paid_sats_total",
+		Help: "Fees paid by our confirmed sweeps and burns in satoshis.",
+	})
+
+	metricValueRecovered = promauto.With(metricsRegistry).NewCounter(prometheus.CounterOpts{
+		Name: "rbfbattle_value_recovered_sats_total",
+		Help: "Value of won utxos minus the fees we paid for them in satoshis.",
+	})
+
+	metricBurned = promauto.With(metricsRegistry).NewCounter(prometheus.CounterOpts{
+		Name: "rbfbattle_burned_sats_total",
+		Help: "Value of the utxos we burned in satoshis.",
+	})
+
+	metricZMQMessages = promauto.With(metricsRegistry).NewCounterVec(prometheus.CounterOpts{
+		Name: "rbfbattle_zmq_messages_total",
+		Help: "ZMQ messages received by topic.",
+	}, []string{"topic"})
+
+	metricZMQGaps = promauto.With(metricsRegistry).NewCounterVec(prometheus.CounterOpts{
+		Name: "rbfbattle_zmq_gaps_total",
+		Help: "Gaps in the ZMQ sequence numbers by topic, which means messages were dropped.",
+	}, []string{"topic"})
+
+	metricPipelineDropped = promauto.With(metricsRegistry).NewCounterVec(prometheus.CounterOpts{
+		Name: "rbfbattle_pipeline_dropped_total",
+		Help: "Transactions dropped by the pipeline: irrelevant ones that don't concern us and counterparts superseded by a newer one before we answered them.",
+	}, []string{"reason"})
+
+	metricPipelineLatency = promauto.With(metricsRegistry).NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "rbfbattle_pipeline_latency_seconds",
+		Help:    "Time from receiving a transaction to it leaving a pipeline stage.",
+		Buckets: prometheus.ExponentialBuckets(0.0005, 2, 14),
+	}, []string{"stage"})
+
+	metricRPCLatency = promauto.With(metricsRegistry).NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "rbfbattle_rpc_duration_seconds",
+		Help:    "Latency of RPC calls to the node by method.",
+		Buckets: prometheus.ExponentialBuckets(0.0005, 2, 14),
+	}, []string{"method"})
+
+	metricReactionLatency = promauto.With(metricsRegistry).NewHistogram(prometheus.HistogramOpts{
+		Name:    "rbfbattle_detection_to_broadcast_seconds",
+		Help:    "Time from receiving a transaction over ZMQ to broadcasting our response to it.",
+		Buckets: prometheus.ExponentialBuckets(0.001, 2, 14),
+	})
+)
+
+// The queue of every pipeline stage reports its depth
+func init() {
+	queues := map[string]chan queuedTx{
+		"receive": rawTransactionQueue,
+		"enrich":  enrichQueue,
+		"urgent":  urgentQueue,
+		"normal":  normalQueue,
+	}
+	for stage, queue := range queues {
+		promauto.With(metricsRegistry).NewGaugeFunc(prometheus.GaugeOpts{
+			Name:        "rbfbattle_queue_depth",
+			Help:        "Transactions waiting in the queue of a pipeline stage.",
+			ConstLabels: prometheus.Labels{"stage": stage},
+		}, func() float64 { return float64(len(queue)) })
+	}
+}
+
+// Timeouts of the metrics server, so a stalled scraper can't hold a connection open
+const (
+	metricsReadHeaderTimeout = 5 * time.Second
+	metricsReadTimeout       = 10 * time.Second
+	metricsWriteTimeout      = time.Minute
+)
+
+// startMetricsServer serves the metrics on addr at /metrics
+func startMetricsServer(addr string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{}))
+
+	server := &http.Server{
+		Addr:              addr,
+		Handler:           mux,
+		ReadHeaderTimeout: metricsReadHeaderTimeout,
+		ReadTimeout:       metricsReadTimeout,
+		WriteTimeout:      metricsWriteTimeout,
+	}
+
+	slog.Info("Serving metrics", "url", "http://"+addr+"/metrics")
+	go func() {
+		if err := server.ListenAndServe(); err != nil {
+			fatal("Error serving metrics", "err", err)
+		}
+	}()
+}
+
+// observeRPC records the latency of every call in a JSON-RPC exchange
+func observeRPC(_ string, reqBody, _ []byte, elapsed time.Duration) {
+	for _, req := range parseRPCCalls(reqBody) {
+		metricRPCLatency.WithLabelValues(req.Method).Observe(elapsed.Seconds())
+	}
+}
+
+var (
+	// zmqSequences is the last sequence number received per topic
+	zmqSequences   = make(map[string]uint32)
+	zmqSequencesMu sync.Mutex
+
+	// zmqLastMessage is the time of the latest ZMQ message in unix nanoseconds
+	zmqLastMessage atomic.Int64
+	zmqMessages    atomic.Uint64
+	zmqGaps        atomic.Uint64
+)
+
+// observeZMQ counts a multipart ZMQ message and checks its sequence number for gaps
+func observeZMQ(msgs [][]byte) {
+	topic := string(msgs[0])
+	metricZMQMessages.WithLabelValues(topic).Inc()
+	zmqLastMessage.Store(time.Now().UnixNano())
+	zmqMessages.Add(1)
+
+	if len(msgs) < 3 || len(msgs[2]) != 4 {
+		return
+	}
+	seq := binary.LittleEndian.Uint32(msgs[2])
+
+	zmqSequencesMu.Lock()
+	defer zmqSequencesMu.Unlock()
+
+	if last, ok := zmqSequences[topic]; ok && seq > last+1 {
+		slog.Warn("Missed ZMQ messages", "count", seq-last-1, "topic", topic)
+		metricZMQGaps.WithLabelValues(topic).Inc()
+		zmqGaps.Add(1)
+	}
+	zmqSequences[topic] = seq
+}
+
+func init() {
+	bus.Subscribe(countEvent)
+}
+
+// countEvent counts battle outcomes, replacements and the value they moved
+func countEvent(e Event) {
+	switch e := e.(type) {
+	case ReplacementSent:
+		metricReplacementsSent.Inc()
+	case ReplacementRejected:
+		metricReplacementsRejected.WithLabelValues(e.Reason).Inc()
+	case BattleResolved:
+		metricBattles.WithLabelValues(string(e.Outcome)).Inc()
+		switch e.Outcome {
+		case stateWon:
+			metricFeesPaid.Add(float64(e.Fee))
+			metricValueRecovered.Add(float64(e.Battle.Amount - e.Fee))
+		case stateBurned:
+			metricBurned.Add(float64(e.Battle.Amount))
+			metricFeesPaid.Add(float64(e.Battle.Amount))
+		}
+	}
+}
+
+// rejectionReason classifies why the node refused one of our transactions
+func rejectionReason(err error) string {
+	switch rejectionCause(err) {
+	case errInsufficientFee:
+		return "insufficient-fee"
+	case errNotEnoughFunds:
+		return "not-enough-funds"
+	case errDust:
+		return "dust"
+	case errMissingInputs:
+		return "missing-inputs"
+	case errNotReplaceable:
+		return "not-replaceable"
+	case errTooManyReplacements:
+		return "too-many-replacements"
+	case errAlreadyKnown:
+		return "already-known"
+	default:
+		return "other"
+	}
+}
+
+// observeReaction records the time from detecting the transaction we responded to until our broadcast
+func observeReaction(utxo *TrackedUTXO) {
+	utxo.mu.Lock()
+	defer utxo.mu.Unlock()
+
+	if !utxo.DetectedAt.IsZero() {
+		metricReactionLatency.Observe(time.Since(utxo.DetectedAt).Seconds())
+		utxo.DetectedAt = time.Time{}
+	}
+}
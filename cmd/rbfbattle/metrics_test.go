@@ -0,0 +1,41 @@
+package main
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestRejectionReason(t *testing.T) {
+	tests := map[string]string{
+		"error broadcasting transaction: -26: insufficient fee, rejecting replacement": "insufficient-fee",
+		"error broadcasting transaction: -26: dust":                                    "dust",
+		"error broadcasting transaction: -25: bad-txns-inputs-missingorspent":          "missing-inputs",
+		"error broadcasting transaction: -26: txn-mempool-conflict":                    "not-replaceable",
+		"not enough funds to cover fee":                                                "not-enough-funds",
+		"-26: mandatory-script-verify-flag-failed":                                     "other",
+	}
+	for msg, expected := range tests {
+		if reason := rejectionReason(errors.New(msg)); reason != expected {
+			t.Errorf("%q: expected %s, got %s", msg, expected, reason)
+		}
+	}
+}
+
+func TestObserveZMQGaps(t *testing.T) {
+	gaps := testutil.ToFloat64(metricZMQGaps.WithLabelValues("testtopic"))
+	messages := testutil.ToFloat64(metricZMQMessages.WithLabelValues("testtopic"))
+
+	for _, seq := range []byte{1, 2, 5, 6, 0} {
+		observeZMQ([][]byte{[]byte("testtopic"), {0xaa}, {seq, 0, 0, 0}})
+	}
+
+	// Only the jump from 2 to 5 is a gap, the restart at 0 is not
+	if got := testutil.ToFloat64(metricZMQGaps.WithLabelValues("testtopic")) - gaps; got != 1 {
+		t.Errorf("expected 1 gap, got %v", got)
+	}
+	if got := testutil.ToFloat64(metricZMQMessages.WithLabelValues("testtopic")) - messages; got != 5 {
+		t.Errorf("expected 5 messages, got %v", got)
+	}
+}
@@ -0,0 +1,647 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/btcsuite/btcd/btcec/v2"
+	"github.com/btcsuite/btcd/btcjson"
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/rpcclient"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+)
+
+// mockNode is an in-process stand-in for bitcoind. It serves the RPC calls the bot uses
+// on top of a policyMempool and publishes its hashtx, rawtx, rawblock and sequence notifications
+// over ZMQ, so whole battles can run in tests.
+type mockNode struct {
+	*policyMempool
+
+	// FeeRate is returned by estimatesmartfee in sat/vbyte. 0 means no estimate.
+	FeeRate float64
+	// Latency delays every RPC request, like a node on another host
+	Latency time.Duration
+
+	wallet map[string]*btcec.PrivateKey
+
+	listener  net.Listener
+	publisher zmqPublisher
+	endpoint  string
+	zmqSeq    map[string]uint32
+}
+
+// newMockNode starts a mock node with an RPC server and a ZMQ publisher on localhost
+func newMockNode() (*mockNode, error) {
+	n := &mockNode{
+		policyMempool: newPolicyMempool(),
+		FeeRate:       2,
+		wallet:        make(map[string]*btcec.PrivateKey),
+		zmqSeq:        make(map[string]uint32),
+	}
+	n.notify = n.publish
+
+	publisher, err := newZMQPublisher("tcp://127.0.0.1:*")
+	if err != nil {
+		return nil, fmt.Errorf("error binding ZMQ publisher: %v", err)
+	}
+	n.publisher = publisher
+	n.endpoint = publisher.Endpoint()
+
+	n.listener, err = net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, fmt.Errorf("error listening for RPC: %v", err)
+	}
+	go http.Serve(n.listener, n)
+
+	return n, nil
+}
+
+// Close stops the RPC server and the ZMQ publisher
+func (n *mockNode) Close() {
+	n.listener.Close()
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.publisher.Close()
+}
+
+// RPCHost returns the host:port of the RPC server
+func (n *mockNode) RPCHost() string {
+	return n.listener.Addr().String()
+}
+
+// ZMQEndpoint returns the endpoint notifications are published on
+func (n *mockNode) ZMQEndpoint() string {
+	return n.endpoint
+}
+
+// Client returns an RPC client connected to the node
+func (n *mockNode) Client() (*rpcclient.Client, error) {
+	return rpcclient.New(n.connConfig(), nil)
+}
+
+// BatchClient returns an RPC client sending JSON-RPC batches to the node
+func (n *mockNode) BatchClient() (*rpcclient.Client, error) {
+	return rpcclient.NewBatch(n.connConfig())
+}
+
+func (n *mockNode) connConfig() *rpcclient.ConnConfig {
+	return &rpcclient.ConnConfig{
+		Host:         n.RPCHost(),
+		User:         "mock",
+		Pass:         "mock",
+		HTTPPostMode: true,
+		DisableTLS:   true,
+	}
+}
+
+// NewWalletScript adds a new P2WPKH key to the wallet and returns its script
+func (n *mockNode) NewWalletScript() []byte {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.newWalletScript()
+}
+
+func (n *mockNode) newWalletScript() []byte {
+	key, _ := btcec.NewPrivateKey()
+	script, _ := txscript.NewScriptBuilder().
+		AddOp(txscript.OP_0).
+		AddData(btcutil.Hash160(key.PubKey().SerializeCompressed())).
+		Script()
+	n.wallet[string(script)] = key
+	return script
+}
+
+// Import adds a transaction as confirmed, so the outputs of a transaction made on another
+// node can be spent on this one
+func (n *mockNode) Import(tx *wire.MsgTx) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	txHash := tx.TxHash()
+	tip := n.tip
+	n.txs[txHash] = &mempoolTx{tx: tx, height: n.height, blockHash: &tip}
+
+	for i, out := range tx.TxOut {
+		n.coins[wire.OutPoint{Hash: txHash, Index: uint32(i)}] = out
+	}
+}
+
+// Tx returns a confirmed or imported transaction
+func (n *mockNode) Tx(txHash chainhash.Hash) (*wire.MsgTx, bool) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	entry, ok := n.txs[txHash]
+	if !ok {
+		return nil, false
+	}
+	return entry.tx, true
+}
+
+// FundWallet creates a confirmed wallet output
+func (n *mockNode) FundWallet(amount btcutil.Amount) wire.OutPoint {
+	return n.Fund(n.NewWalletScript(), amount)
+}
+
+// SendToScript pays amount to script from a wallet output and adds the transaction to the mempool
+func (n *mockNode) SendToScript(script []byte, amount btcutil.Amount) (*wire.MsgTx, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	fee := btcutil.Amount(200 * max(n.FeeRate, 1))
+
+	for outpoint, out := range n.coins {
+		if _, ok := n.wallet[string(out.PkScript)]; !ok || btcutil.Amount(out.Value) < amount+fee+1000 {
+			continue
+		}
+		if _, spent := n.spentBy[outpoint]; spent {
+			continue
+		}
+
+		tx := wire.NewMsgTx(2)
+		tx.AddTxIn(wire.NewTxIn(&outpoint, nil, nil))
+		tx.AddTxOut(wire.NewTxOut(int64(amount), script))
+		tx.AddTxOut(wire.NewTxOut(out.Value-int64(amount+fee), n.newWalletScript()))
+
+		if _, err := n.signWithWallet(tx); err != nil {
+			return nil, err
+		}
+		if err := n.accept(tx, false); err != nil {
+			return nil, err
+		}
+		return tx, nil
+	}
+
+	return nil, fmt.Errorf("no wallet output can pay %d sats", amount)
+}
+
+// SubmitUnannounced adds a transaction to the mempool without the ZMQ notifications, as if
+// the bot missed them
+func (n *mockNode) SubmitUnannounced(tx *wire.MsgTx) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	notify := n.notify
+	n.notify = nil
+	defer func() { n.notify = notify }()
+	return n.accept(tx, false)
+}
+
+// Announce publishes the hashtx and rawtx notifications of a transaction
+func (n *mockNode) Announce(tx *wire.MsgTx) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.publishTx(tx)
+}
+
+// Spender returns the mempool transaction spending an outpoint
+func (n *mockNode) Spender(outpoint wire.OutPoint) (*wire.MsgTx, bool) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	txHash, ok := n.spentBy[outpoint]
+	if !ok {
+		return nil, false
+	}
+	return n.mempool[txHash].tx, true
+}
+
+// MempoolSize returns the number of transactions in the mempool
+func (n *mockNode) MempoolSize() int {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return len(n.mempool)
+}
+
+// publish sends a notification with bitcoind's per-topic sequence number
+func (n *mockNode) publish(topic string, body []byte) {
+	seq := binary.LittleEndian.AppendUint32(nil, n.zmqSeq[topic])
+	n.zmqSeq[topic]++
+
+	n.publisher.Publish([]byte(topic), body, seq)
+}
+
+// signWithWallet signs every input spending a wallet output and reports if all inputs are signed
+func (n *mockNode) signWithWallet(tx *wire.MsgTx) (bool, error) {
+	prevOuts := txscript.NewMultiPrevOutFetcher(nil)
+	for _, txIn := range tx.TxIn {
+		if out, _, ok := n.prevOut(txIn.PreviousOutPoint); ok {
+			prevOuts.AddPrevOut(txIn.PreviousOutPoint, out)
+		} else if entry, ok := n.txs[txIn.PreviousOutPoint.Hash]; ok && int(txIn.PreviousOutPoint.Index) < len(entry.tx.TxOut) {
+			prevOuts.AddPrevOut(txIn.PreviousOutPoint, entry.tx.TxOut[txIn.PreviousOutPoint.Index])
+		}
+	}
+
+	sigHashes := txscript.NewTxSigHashes(tx, prevOuts)
+	complete := true
+
+	for i, txIn := range tx.TxIn {
+		prev := prevOuts.FetchPrevOutput(txIn.PreviousOutPoint)
+		if prev == nil {
+			complete = false
+			continue
+		}
+
+		key, ok := n.wallet[string(prev.PkScript)]
+		if !ok {
+			if len(txIn.Witness) == 0 && len(txIn.SignatureScript) == 0 {
+				complete = false
+			}
+			continue
+		}
+
+		witness, err := txscript.WitnessSignature(tx, sigHashes, i, prev.Value, prev.PkScript, txscript.SigHashAll, key, true)
+		if err != nil {
+			return false, err
+		}
+		txIn.Witness = witness
+	}
+
+	return complete, nil
+}
+
+func (n *mockNode) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	n.mu.Lock()
+	latency := n.Latency
+	n.mu.Unlock()
+	time.Sleep(latency)
+
+	if bytes.HasPrefix(bytes.TrimSpace(body), []byte("[")) {
+		var reqs []jsonRPCRequest
+		if err := json.Unmarshal(body, &reqs); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		responses := make([]jsonRPCResponse, len(reqs))
+		for i, req := range reqs {
+			responses[i] = n.call(req)
+		}
+		json.NewEncoder(w).Encode(responses)
+		return
+	}
+
+	var req jsonRPCRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	json.NewEncoder(w).Encode(n.call(req))
+}
+
+func (n *mockNode) call(req jsonRPCRequest) jsonRPCResponse {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	res := jsonRPCResponse{ID: req.ID}
+	result, err := n.handle(req.Method, req.Params)
+	if err != nil {
+		if rpcErr, ok := err.(*btcjson.RPCError); ok {
+			res.Error = rpcErr
+		} else {
+			res.Error = btcjson.NewRPCError(btcjson.ErrRPCMisc, err.Error())
+		}
+		return res
+	}
+
+	res.Result = result
+	return res
+}
+
+// param decodes an optional positional parameter
+func param[T any](params []json.RawMessage, i int, value T) (T, error) {
+	if i >= len(params) || string(params[i]) == "null" {
+		return value, nil
+	}
+	if err := json.Unmarshal(params[i], &value); err != nil {
+		return value, btcjson.NewRPCError(btcjson.ErrRPCInvalidParameter, fmt.Sprintf("invalid parameter %d: %v", i, err))
+	}
+	return value, nil
+}
+
+func decodeTx(rawHex string) (*wire.MsgTx, error) {
+	raw, err := hex.DecodeString(rawHex)
+	if err != nil {
+		return nil, btcjson.NewRPCError(btcjson.ErrRPCDeserialization, "TX decode failed")
+	}
+	tx := wire.NewMsgTx(2)
+	if err := tx.Deserialize(bytes.NewReader(raw)); err != nil {
+		return nil, btcjson.NewRPCError(btcjson.ErrRPCDeserialization, "TX decode failed")
+	}
+	return tx, nil
+}
+
+func (n *mockNode) handle(method string, params []json.RawMessage) (any, error) {
+	switch method {
+	case "getnetworkinfo":
+		return map[string]any{
+			"version":        n.Version,
+			"subversion":     fmt.Sprintf("/Satoshi:%d.%d.%d/", n.Version/10000, n.Version/100%100, n.Version%100),
+			"relayfee":       0.00001,
+			"incrementalfee": 0.00001,
+		}, nil
+
+	case "getblockcount":
+		return n.height, nil
+
+	case "getmempoolinfo":
+		var bytes int64
+		for _, entry := range n.mempool {
+			bytes += entry.vsize
+		}
+		return map[string]any{"loaded": true, "size": len(n.mempool), "bytes": bytes, "fullrbf": n.FullRBF}, nil
+
+	case "getpeerinfo":
+		return []any{}, nil
+
+	case "estimatesmartfee":
+		target, err := param(params, 0, int64(1))
+		if err != nil {
+			return nil, err
+		}
+		if n.FeeRate == 0 {
+			return map[string]any{"errors": []string{"Insufficient data or no feerate found"}, "blocks": 0}, nil
+		}
+		return map[string]any{"feerate": n.FeeRate * 1000 / 1e8, "blocks": target}, nil
+
+	case "getrawtransaction":
+		txid, err := param(params, 0, "")
+		if err != nil {
+			return nil, err
+		}
+		// Verbosity is a bool or an int depending on the client
+		verbose, err := param(params, 1, json.RawMessage("false"))
+		if err != nil {
+			return nil, err
+		}
+
+		txHash, err := chainhash.NewHashFromStr(txid)
+		if err != nil {
+			return nil, btcjson.NewRPCError(btcjson.ErrRPCInvalidParameter, "txid must be hexadecimal string")
+		}
+		entry, ok := n.txs[*txHash]
+		if !ok {
+			return nil, btcjson.NewRPCError(btcjson.ErrRPCInvalidAddressOrKey, "No such mempool or blockchain transaction. Use gettransaction for wallet transactions.")
+		}
+
+		result := newTxRawResult(entry.tx)
+		if v := string(verbose); v == "false" || v == "0" {
+			return result.Hex, nil
+		}
+		if entry.blockHash != nil {
+			result.BlockHash = entry.blockHash.String()
+			result.Confirmations = uint64(n.height - entry.height + 1)
+		}
+		return result, nil
+
+	case "decoderawtransaction":
+		rawHex, err := param(params, 0, "")
+		if err != nil {
+			return nil, err
+		}
+		tx, err := decodeTx(rawHex)
+		if err != nil {
+			return nil, err
+		}
+		result := newTxRawResult(tx)
+		result.Hex = ""
+		return result, nil
+
+	case "getmempoolentry":
+		txid, err := param(params, 0, "")
+		if err != nil {
+			return nil, err
+		}
+		txHash, err := chainhash.NewHashFromStr(txid)
+		if err != nil {
+			return nil, btcjson.NewRPCError(btcjson.ErrRPCInvalidParameter, "txid must be hexadecimal string")
+		}
+		if _, ok := n.mempool[*txHash]; !ok {
+			return nil, btcjson.NewRPCError(btcjson.ErrRPCInvalidAddressOrKey, "Transaction not in mempool")
+		}
+		return n.mempoolEntry(*txHash), nil
+
+	case "gettxspendingprevout":
+		prevOuts, err := param(params, 0, []struct {
+			TxID string `json:"txid"`
+			Vout uint32 `json:"vout"`
+		}{})
+		if err != nil {
+			return nil, err
+		}
+		spends := []map[string]any{}
+		for _, prevOut := range prevOuts {
+			txHash, err := chainhash.NewHashFromStr(prevOut.TxID)
+			if err != nil {
+				return nil, btcjson.NewRPCError(btcjson.ErrRPCInvalidParameter, "txid must be hexadecimal string")
+			}
+			spend := map[string]any{"txid": prevOut.TxID, "vout": prevOut.Vout}
+			if spender, ok := n.spentBy[wire.OutPoint{Hash: *txHash, Index: prevOut.Vout}]; ok {
+				spend["spendingtxid"] = spender.String()
+			}
+			spends = append(spends, spend)
+		}
+		return spends, nil
+
+	case "sendrawtransaction":
+		rawHex, err := param(params, 0, "")
+		if err != nil {
+			return nil, err
+		}
+		tx, err := decodeTx(rawHex)
+		if err != nil {
+			return nil, err
+		}
+		if err := n.accept(tx, false); err != nil {
+			return nil, err
+		}
+		return tx.TxHash().String(), nil
+
+	case "submitpackage":
+		rawTxs, err := param(params, 0, []string{})
+		if err != nil {
+			return nil, err
+		}
+		return n.submitPackage(rawTxs)
+
+	case "listunspent":
+		minConf, err := param(params, 0, int64(1))
+		if err != nil {
+			return nil, err
+		}
+		return n.listUnspent(minConf), nil
+
+	case "signrawtransactionwithwallet":
+		rawHex, err := param(params, 0, "")
+		if err != nil {
+			return nil, err
+		}
+		tx, err := decodeTx(rawHex)
+		if err != nil {
+			return nil, err
+		}
+		complete, err := n.signWithWallet(tx)
+		if err != nil {
+			return nil, err
+		}
+		var buf bytes.Buffer
+		tx.Serialize(&buf)
+		return map[string]any{"hex": hex.EncodeToString(buf.Bytes()), "complete": complete}, nil
+
+	case "getnewaddress":
+		script := n.newWalletScript()
+		_, addresses, _, _ := txscript.ExtractPkScriptAddrs(script, network)
+		return addresses[0].EncodeAddress(), nil
+	}
+
+	return nil, btcjson.NewRPCError(btcjson.ErrRPCMethodNotFound.Code, "Method not found")
+}
+
+func (n *mockNode) mempoolEntry(txHash chainhash.Hash) map[string]any {
+	entry := n.mempool[txHash]
+
+	var descendantFees, ancestorFees btcutil.Amount
+	var descendantSize, ancestorSize int64
+	descendants, ancestors := n.descendants(txHash), n.ancestors(txHash)
+	for _, d := range descendants {
+		descendantFees += d.fee
+		descendantSize += d.vsize
+	}
+	for _, a := range ancestors {
+		ancestorFees += a.fee
+		ancestorSize += a.vsize
+	}
+
+	depends := []string{}
+	for parent := range n.mempoolParents(entry.tx) {
+		depends = append(depends, parent.String())
+	}
+	spentBy := []string{}
+	for i := range entry.tx.TxOut {
+		if child, ok := n.spentBy[wire.OutPoint{Hash: txHash, Index: uint32(i)}]; ok {
+			spentBy = append(spentBy, child.String())
+		}
+	}
+
+	return map[string]any{
+		"vsize":           entry.vsize,
+		"weight":          entry.tx.SerializeSizeStripped()*3 + entry.tx.SerializeSize(),
+		"time":            entry.time,
+		"height":          n.height,
+		"descendantcount": len(descendants),
+		"descendantsize":  descendantSize,
+		"ancestorcount":   len(ancestors),
+		"ancestorsize":    ancestorSize,
+		"wtxid":           entry.tx.WitnessHash().String(),
+		"fees": map[string]any{
+			"base":       entry.fee.ToBTC(),
+			"modified":   entry.fee.ToBTC(),
+			"ancestor":   ancestorFees.ToBTC(),
+			"descendant": descendantFees.ToBTC(),
+		},
+		"depends":            depends,
+		"spentby":            spentBy,
+		"bip125-replaceable": signalsReplaceability(entry.tx),
+		"unbroadcast":        false,
+	}
+}
+
+func (n *mockNode) submitPackage(rawTxs []string) (any, error) {
+	var txs []*wire.MsgTx
+	for _, rawHex := range rawTxs {
+		tx, err := decodeTx(rawHex)
+		if err != nil {
+			return nil, err
+		}
+		txs = append(txs, tx)
+	}
+
+	results := make(map[string]any)
+	var replaced []string
+	packageMsg := "success"
+
+	for i, tx := range txs {
+		before := make(map[chainhash.Hash]bool)
+		for txHash := range n.mempool {
+			before[txHash] = true
+		}
+
+		result := map[string]any{"txid": tx.TxHash().String()}
+		// Parents may be paid for by the child
+		if err := n.accept(tx, i < len(txs)-1); err != nil {
+			packageMsg = "transaction failed"
+			result["error"] = err.(*btcjson.RPCError).Message
+		} else {
+			entry := n.mempool[tx.TxHash()]
+			result["vsize"] = entry.vsize
+			result["fees"] = map[string]any{"base": entry.fee.ToBTC()}
+		}
+		results[tx.WitnessHash().String()] = result
+
+		for txHash := range before {
+			if _, ok := n.mempool[txHash]; !ok {
+				replaced = append(replaced, txHash.String())
+			}
+		}
+	}
+
+	return map[string]any{
+		"package_msg":           packageMsg,
+		"tx-results":            results,
+		"replaced-transactions": replaced,
+	}, nil
+}
+
+func (n *mockNode) listUnspent(minConf int64) []btcjson.ListUnspentResult {
+	unspent := []btcjson.ListUnspentResult{}
+
+	add := func(outpoint wire.OutPoint, out *wire.TxOut, confirmations int64) {
+		if _, ok := n.wallet[string(out.PkScript)]; !ok || confirmations < minConf {
+			return
+		}
+		if _, spent := n.spentBy[outpoint]; spent {
+			return
+		}
+		_, addresses, _, _ := txscript.ExtractPkScriptAddrs(out.PkScript, network)
+		unspent = append(unspent, btcjson.ListUnspentResult{
+			TxID:          outpoint.Hash.String(),
+			Vout:          outpoint.Index,
+			Address:       addresses[0].EncodeAddress(),
+			ScriptPubKey:  hex.EncodeToString(out.PkScript),
+			Amount:        btcutil.Amount(out.Value).ToBTC(),
+			Confirmations: confirmations,
+			Spendable:     true,
+		})
+	}
+
+	for outpoint, out := range n.coins {
+		confirmations := int64(1)
+		if entry, ok := n.txs[outpoint.Hash]; ok {
+			confirmations = n.height - entry.height + 1
+		}
+		add(outpoint, out, confirmations)
+	}
+	for txHash, entry := range n.mempool {
+		for i, out := range entry.tx.TxOut {
+			add(wire.OutPoint{Hash: txHash, Index: uint32(i)}, out, 0)
+		}
+	}
+
+	return unspent
+}
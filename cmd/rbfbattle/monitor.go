@@ -1,15 +1,280 @@
 package main
 
-import "strconv"
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+	"strconv"
+	"sync"
+	"time"
 
-// txid -> vout
-var monitoredUtxos = make(map[string]*TrackedUTXO)
+	"github.com/btcsuite/btcd/btcjson"
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+)
 
-func monitor(utxo *TrackedUTXO) {
-	id := utxo.TxID + ":" + strconv.Itoa(int(utxo.N))
-	monitoredUtxos[id] = utxo
+var (
+	// outpoint -> utxo, so spends are matched on the raw outpoints of a transaction
+	monitoredUtxos   = make(map[wire.OutPoint]*TrackedUTXO)
+	monitoredUtxosMu sync.RWMutex
+	// The outpoints of battles about to start, claimed before they get a destination
+	claimedOutPoints = make(map[wire.OutPoint]struct{})
+	// The outpoints paid to watched scripts whose battles haven't started yet, with the spends
+	// that arrived before them
+	incomingOutPoints = make(map[wire.OutPoint]*incomingOutPoint)
+)
+
+// Payments that never start a battle, like confirmed ones, are forgotten after a while
+const incomingOutPointTTL = 10 * time.Minute
+
+type incomingOutPoint struct {
+	seenAt time.Time
+	spends []parkedSpend
+}
+
+// parkedSpend is a spend of an incoming outpoint waiting for its battle to start
+type parkedSpend struct {
+	tx     *btcjson.TxRawResult
+	seenAt time.Time
+	node   string
+}
+
+// expectIncoming indexes an outpoint paid to a watched script, so a spend arriving before its
+// battle starts is kept for the battle instead of being dropped as not ours
+func expectIncoming(outpoint wire.OutPoint) {
+	monitoredUtxosMu.Lock()
+	defer monitoredUtxosMu.Unlock()
+
+	if _, ok := monitoredUtxos[outpoint]; ok {
+		return
+	}
+	if _, ok := incomingOutPoints[outpoint]; ok {
+		return
+	}
+	for expected, incoming := range incomingOutPoints {
+		if time.Since(incoming.seenAt) > incomingOutPointTTL {
+			delete(incomingOutPoints, expected)
+		}
+	}
+	incomingOutPoints[outpoint] = &incomingOutPoint{seenAt: time.Now()}
+}
+
+// isIncoming tells if an outpoint was paid to a watched script and its battle hasn't started
+func isIncoming(outpoint wire.OutPoint) bool {
+	monitoredUtxosMu.RLock()
+	defer monitoredUtxosMu.RUnlock()
+
+	_, ok := incomingOutPoints[outpoint]
+	return ok
+}
+
+// park keeps a spend of an incoming outpoint until its battle starts. It reports whether the
+// spend was parked, or else whether one of its outpoints became a battle meanwhile.
+func park(tx *btcjson.TxRawResult, seenAt time.Time, node string) (parked, monitored bool) {
+	monitoredUtxosMu.Lock()
+	defer monitoredUtxosMu.Unlock()
+
+	for _, vin := range tx.Vin {
+		hash, err := chainhash.NewHashFromStr(vin.Txid)
+		if err != nil {
+			continue
+		}
+		outpoint := wire.OutPoint{Hash: *hash, Index: vin.Vout}
+		if incoming, ok := incomingOutPoints[outpoint]; ok {
+			incoming.spends = append(incoming.spends, parkedSpend{tx: tx, seenAt: seenAt, node: node})
+			return true, false
+		}
+		if _, ok := monitoredUtxos[outpoint]; ok {
+			monitored = true
+		}
+	}
+	return false, monitored
+}
+
+// takeParked returns the spends parked for an outpoint and stops expecting it
+func takeParked(outpoint wire.OutPoint) []parkedSpend {
+	monitoredUtxosMu.Lock()
+	defer monitoredUtxosMu.Unlock()
+
+	incoming, ok := incomingOutPoints[outpoint]
+	if !ok {
+		return nil
+	}
+	delete(incomingOutPoints, outpoint)
+	return incoming.spends
+}
+
+// claim reserves the outpoint of a new battle, unless a battle over it is already fought or
+// about to start. The claim ends with monitor or release.
+func claim(outpoint wire.OutPoint) bool {
+	monitoredUtxosMu.Lock()
+	defer monitoredUtxosMu.Unlock()
+
+	if _, ok := monitoredUtxos[outpoint]; ok {
+		return false
+	}
+	if _, ok := claimedOutPoints[outpoint]; ok {
+		return false
+	}
+	claimedOutPoints[outpoint] = struct{}{}
+	return true
+}
+
+// release gives up the claim on an outpoint when its battle can't start
+func release(outpoint wire.OutPoint) {
+	monitoredUtxosMu.Lock()
+	delete(claimedOutPoints, outpoint)
+	monitoredUtxosMu.Unlock()
+}
+
+// monitor starts a battle over the utxo, unless one is already fought over its outpoint
+func monitor(utxo *TrackedUTXO) bool {
+	monitoredUtxosMu.Lock()
+	defer monitoredUtxosMu.Unlock()
+
+	delete(claimedOutPoints, utxo.outPoint())
+	if _, ok := monitoredUtxos[utxo.outPoint()]; ok {
+		return false
+	}
+	utxo.ID = newBattleID()
+	utxo.setState(stateSweeping)
+	monitoredUtxos[utxo.outPoint()] = utxo
+	return true
+}
+
+// outPoint returns the outpoint of the utxo
+func (utxo *TrackedUTXO) outPoint() wire.OutPoint {
+	outpoint := wire.OutPoint{Index: utxo.N}
+	if hash, err := chainhash.NewHashFromStr(utxo.TxID); err == nil {
+		outpoint.Hash = *hash
+	}
+	return outpoint
+}
+
+// privateKey returns the private key spending the utxo when we watch its script
+func (utxo *TrackedUTXO) privateKey() (string, bool) {
+	script, err := hex.DecodeString(utxo.Script.Hex)
+	if err != nil {
+		return "", false
+	}
+	return watchedScriptKey(script)
+}
+
+// publishBattle records an event in its battle before handing it to the subscribers,
+// so the history is complete and a resolved battle is no longer monitored by the time they see it
+func publishBattle(e Event) {
+	recordBattle(e)
+	bus.Publish(e)
+}
+
+// recordBattle keeps the history of our transactions and the counterparts in a battle,
+// and stops monitoring the utxo once the battle is resolved
+func recordBattle(e Event) {
+	var utxo *TrackedUTXO
+	var event battleEvent
+
+	switch e := e.(type) {
+	case SweepSent:
+		utxo, event = e.Battle, battleEvent{Kind: "sweep", TxID: e.TxID, FeeRate: e.FeeRate, Fee: e.Fee}
+	case CounterpartDetected:
+		utxo, event = e.Battle, battleEvent{Kind: "counterpart", TxID: e.Counterpart.Txid, FeeRate: e.FeeRate, Fee: e.Fee}
+	case ReplacementSent:
+		utxo, event = e.Battle, battleEvent{Kind: "replacement", TxID: e.TxID, FeeRate: e.FeeRate, Fee: e.Fee}
+	case BurnSent:
+		utxo, event = e.Battle, battleEvent{Kind: "burn", TxID: e.TxID, Fee: e.Battle.Amount}
+	case BattleResolved:
+		cleanup(e.Battle)
+		return
+	default:
+		return
+	}
+
+	event.Time = time.Now()
+	utxo.mu.Lock()
+	utxo.History = append(utxo.History, event)
+	utxo.mu.Unlock()
 }
 
 func cleanup(utxo *TrackedUTXO) {
-	delete(monitoredUtxos, utxo.TxID+":"+strconv.Itoa(int(utxo.N)))
+	monitoredUtxosMu.Lock()
+	delete(monitoredUtxos, utxo.outPoint())
+	monitoredUtxosMu.Unlock()
+
+	releaseFunding(utxo)
+}
+
+// getMonitored returns the monitored utxo for a txid:vout outpoint
+func getMonitored(id string) (*TrackedUTXO, bool) {
+	outpoint, err := wire.NewOutPointFromString(id)
+	if err != nil {
+		return nil, false
+	}
+	return getMonitoredOutPoint(*outpoint)
+}
+
+// getMonitoredOutPoint returns the monitored utxo at an outpoint
+func getMonitoredOutPoint(outpoint wire.OutPoint) (*TrackedUTXO, bool) {
+	monitoredUtxosMu.RLock()
+	defer monitoredUtxosMu.RUnlock()
+
+	utxo, ok := monitoredUtxos[outpoint]
+	return utxo, ok
+}
+
+// monitoredSnapshot returns all monitored utxos
+func monitoredSnapshot() []*TrackedUTXO {
+	monitoredUtxosMu.RLock()
+	defer monitoredUtxosMu.RUnlock()
+
+	utxos := make([]*TrackedUTXO, 0, len(monitoredUtxos))
+	for _, utxo := range monitoredUtxos {
+		utxos = append(utxos, utxo)
+	}
+	return utxos
+}
+
+// battleState is where a battle over a monitored utxo stands
+type battleState string
+
+const (
+	stateSweeping  battleState = "sweeping"
+	stateContested battleState = "contested"
+	stateReplaced  battleState = "replaced"
+	stateBurned    battleState = "burned"
+	stateWon       battleState = "won"
+	stateLost      battleState = "lost"
+	stateAbandoned battleState = "abandoned"
+)
+
+// battleEvent is a transaction in the history of a battle
+type battleEvent struct {
+	Time time.Time `json:"time"`
+	// Kind is sweep, counterpart, replacement or burn
+	Kind    string         `json:"kind"`
+	TxID    string         `json:"txid"`
+	FeeRate float64        `json:"feerate,omitempty"`
+	Fee     btcutil.Amount `json:"fee,omitempty"`
+}
+
+// newBattleID returns a short random id to correlate the log lines of a battle
+func newBattleID() string {
+	var id [4]byte
+	rand.Read(id[:])
+	return hex.EncodeToString(id[:])
+}
+
+// State returns where the battle over the utxo stands
+func (u *TrackedUTXO) State() battleState {
+	state, _ := u.state.Load().(battleState)
+	return state
+}
+
+func (u *TrackedUTXO) setState(state battleState) {
+	u.state.Store(state)
+}
+
+// logger returns a logger carrying the battle id, outpoint and state
+func (u *TrackedUTXO) logger() *slog.Logger {
+	return slog.With("battle", u.ID, "outpoint", u.TxID+":"+strconv.Itoa(int(u.N)), "state", u.State())
 }
@@ -1,42 +1,109 @@
 package main
 
 import (
-	"log"
+	"log/slog"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/btcsuite/btcd/rpcclient"
 )
 
-func connectToBitcoinNode(config *Config) *rpcclient.Client {
-	user := config.RPCUser
-	pass := config.RPCPassword
+const (
+	tipPollInterval = 5 * time.Second
+	// nodeStartupTimeout is how long we wait for the node to answer when starting
+	nodeStartupTimeout = 5 * time.Minute
+)
 
-	host := config.RPCHost
-	if config.RPCWallet != "" {
-		host += "/wallet/" + config.RPCWallet
-	}
+// tipHeight is the latest block height seen on the node
+var tipHeight atomic.Int64
 
-	log.Printf("Connecting to node %s", host)
+// nodeHealth is the outcome of the latest poll of the node
+var nodeHealth struct {
+	sync.Mutex
+	lastSeen time.Time
+	err      error
+}
 
-	connCfg := &rpcclient.ConnConfig{
-		Host:         host,
-		User:         user,
-		Pass:         pass,
-		CookiePath:   config.RPCCookiePath,
-		HTTPPostMode: true,
-		DisableTLS:   true,
+func setNodeHealth(err error) {
+	nodeHealth.Lock()
+	defer nodeHealth.Unlock()
+
+	if err == nil {
+		nodeHealth.lastSeen = time.Now()
 	}
+	nodeHealth.err = err
+}
 
-	client, err := rpcclient.New(connCfg, nil)
+func connectToBitcoinNode(config *Config) *rpcclient.Client {
+	client, err := newRPCClient(config, config.RPCWallet)
 	if err != nil {
-		log.Fatalf("Error connecting to Bitcoin node: %v", err)
+		fatal("Error connecting to Bitcoin node", "err", err)
 	}
 
-	// Test connection
+	// The node may still be starting, so wait for it unless it refuses our credentials
+	deadline := time.Now().Add(nodeStartupTimeout)
 	blockCount, err := client.GetBlockCount()
-	if err != nil {
-		log.Fatalf("Error connecting to Bitcoin node: %v", err)
+	for err != nil {
+		if strings.Contains(err.Error(), errRPCUnauthorized.Error()) || time.Now().After(deadline) {
+			fatal("Error connecting to Bitcoin node", "err", err)
+		}
+		slog.Warn("Waiting for Bitcoin node", "err", err)
+		time.Sleep(tipPollInterval)
+		blockCount, err = client.GetBlockCount()
 	}
 
-	log.Printf("Successfully connected to Bitcoin node. Current block height: %d", blockCount)
+	tipHeight.Store(blockCount)
+	setNodeHealth(nil)
+
+	slog.Info("Successfully connected to Bitcoin node", "height", blockCount)
 	return client
 }
+
+// trackChainTip keeps tipHeight up to date by polling the chain backend
+func trackChainTip(backend ChainBackend) {
+	for {
+		time.Sleep(tipPollInterval)
+
+		height, err := backend.TipHeight()
+		setNodeHealth(err)
+		if err != nil {
+			slog.Error("Error getting block count", "err", err)
+			continue
+		}
+
+		if previous := tipHeight.Swap(height); previous != height {
+			slog.Info("New block", "height", height)
+		}
+	}
+}
+
+// newRPCClient creates a client for the node, scoped to a wallet if one is given
+func newRPCClient(config *Config, wallet string) (*rpcclient.Client, error) {
+	connCfg := rpcConnConfig(config, wallet)
+	slog.Info("Connecting to node", "host", connCfg.Host)
+
+	return rpcclient.New(connCfg, nil)
+}
+
+// newBatchRPCClient creates a client sending its calls to the node in JSON-RPC batches
+func newBatchRPCClient(config *Config, wallet string) (*rpcclient.Client, error) {
+	return rpcclient.NewBatch(rpcConnConfig(config, wallet))
+}
+
+func rpcConnConfig(config *Config, wallet string) *rpcclient.ConnConfig {
+	host := config.RPCHost
+	if wallet != "" {
+		host += "/wallet/" + wallet
+	}
+
+	return &rpcclient.ConnConfig{
+		Host:         host,
+		User:         config.RPCUser,
+		Pass:         config.RPCPassword,
+		CookiePath:   config.RPCCookiePath,
+		HTTPPostMode: true,
+		DisableTLS:   true,
+	}
+}
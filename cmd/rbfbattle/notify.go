@@ -0,0 +1,251 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/smtp"
+	"os"
+	"os/exec"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/btcsuite/btcd/btcutil"
+)
+
+// Battle events we send notifications for
+const (
+	eventStarted = "started"
+	eventWon     = "won"
+	eventLost    = "lost"
+	eventBurned  = "burned"
+)
+
+var notificationEvents = []string{eventStarted, eventWon, eventLost, eventBurned}
+
+// notifierSet delivers battle events to the configured sinks
+type notifierSet []*notifier
+
+// notification is the payload sent to the sinks
+type notification struct {
+	Event    string         `json:"event"`
+	Time     time.Time      `json:"time"`
+	Battle   string         `json:"battle"`
+	Outpoint string         `json:"outpoint"`
+	Address  string         `json:"address"`
+	Amount   btcutil.Amount `json:"amount"`
+	// TxID is the transaction that decided the battle
+	TxID string `json:"txid,omitempty"`
+}
+
+// notificationSink delivers a notification somewhere
+type notificationSink interface {
+	Name() string
+	Send(n notification) error
+}
+
+// notifier delivers the events it's interested in to a sink in the background,
+// at most rate notifications a minute
+type notifier struct {
+	sink   notificationSink
+	events []string
+	rate   int
+	queue  chan notification
+}
+
+func newNotifier(sink notificationSink, events []string, rate int) *notifier {
+	n := &notifier{
+		sink:   sink,
+		events: events,
+		rate:   rate,
+		queue:  make(chan notification, 100),
+	}
+	go n.run()
+	return n
+}
+
+func (n *notifier) run() {
+	var windowStart time.Time
+	var sent int
+
+	for notification := range n.queue {
+		if time.Since(windowStart) >= time.Minute {
+			windowStart = time.Now()
+			sent = 0
+		}
+		if sent >= n.rate {
+			slog.Warn("Dropped notification over the rate limit", "sink", n.sink.Name(), "event", notification.Event, "battle", notification.Battle)
+			continue
+		}
+		sent++
+
+		if err := n.sink.Send(notification); err != nil {
+			slog.Error("Error sending notification", "sink", n.sink.Name(), "event", notification.Event, "battle", notification.Battle, "err", err)
+		}
+	}
+}
+
+// notifyEvent turns battles starting and ending into notifications
+func (notifiers notifierSet) notifyEvent(e Event) {
+	switch e := e.(type) {
+	case BattleStarted:
+		notifiers.notify(eventStarted, e.Battle, "")
+	case BattleResolved:
+		if slices.Contains(notificationEvents, string(e.Outcome)) {
+			notifiers.notify(string(e.Outcome), e.Battle, e.TxID)
+		}
+	}
+}
+
+// notify sends a battle event to every notifier interested in it. It never blocks the battle.
+func (notifiers notifierSet) notify(event string, utxo *TrackedUTXO, txid string) {
+	n := notification{
+		Event:    event,
+		Time:     time.Now(),
+		Battle:   utxo.ID,
+		Outpoint: fmt.Sprintf("%s:%d", utxo.TxID, utxo.N),
+		Address:  utxo.Address,
+		Amount:   utxo.Amount,
+		TxID:     txid,
+	}
+
+	for _, notifier := range notifiers {
+		if !slices.Contains(notifier.events, event) {
+			continue
+		}
+		select {
+		case notifier.queue <- n:
+		default:
+			slog.Warn("Notification queue is full", "sink", notifier.sink.Name(), "event", event, "battle", utxo.ID)
+		}
+	}
+}
+
+// newNotifiers creates a notifier for every sink set in the config
+func newNotifiers(config *Config) notifierSet {
+	var sinks []notificationSink
+	if config.NotifyWebhook != "" {
+		sinks = append(sinks, &webhookSink{url: config.NotifyWebhook, secret: config.NotifyWebhookSecret})
+	}
+	if config.NotifyCommand != "" {
+		sinks = append(sinks, &commandSink{command: config.NotifyCommand})
+	}
+	if config.NotifySMTP != "" {
+		sinks = append(sinks, &smtpSink{addr: config.NotifySMTP, from: config.NotifySMTPFrom, to: config.NotifySMTPTo})
+	}
+
+	var notifiers notifierSet
+	for _, sink := range sinks {
+		notifiers = append(notifiers, newNotifier(sink, config.NotifyEvents, config.NotifyRate))
+	}
+	return notifiers
+}
+
+// webhookSink posts the notification as JSON. With a secret the body is signed
+// with HMAC-SHA256 in the X-Rbfbattle-Signature header.
+type webhookSink struct {
+	url    string
+	secret string
+}
+
+func (s *webhookSink) Name() string { return "webhook" }
+
+func (s *webhookSink) Send(n notification) error {
+	body, err := json.Marshal(n)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", s.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if s.secret != "" {
+		req.Header.Set("X-Rbfbattle-Signature", "sha256="+webhookSignature(s.secret, body))
+	}
+
+	client := http.Client{Timeout: 10 * time.Second}
+	res, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("error posting webhook: %v", err)
+	}
+	res.Body.Close()
+
+	if res.StatusCode/100 != 2 {
+		return fmt.Errorf("webhook responded with %s", res.Status)
+	}
+	return nil
+}
+
+// webhookSignature is the hex HMAC-SHA256 of the body
+func webhookSignature(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// commandSink runs a shell command with the JSON notification on stdin and
+// the event, battle and outpoint in RBFBATTLE_* environment variables
+type commandSink struct {
+	command string
+}
+
+func (s *commandSink) Name() string { return "command" }
+
+func (s *commandSink) Send(n notification) error {
+	body, err := json.Marshal(n)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, "sh", "-c", s.command)
+	cmd.Stdin = bytes.NewReader(body)
+	cmd.Env = append(os.Environ(),
+		"RBFBATTLE_EVENT="+n.Event,
+		"RBFBATTLE_BATTLE="+n.Battle,
+		"RBFBATTLE_OUTPOINT="+n.Outpoint,
+	)
+
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("error running notify command: %v: %s", err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// smtpSink mails the notification through a local relay without authentication
+type smtpSink struct {
+	addr string
+	from string
+	to   []string
+}
+
+func (s *smtpSink) Name() string { return "smtp" }
+
+func (s *smtpSink) Send(n notification) error {
+	var msg strings.Builder
+	fmt.Fprintf(&msg, "From: %s\r\n", s.from)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(s.to, ", "))
+	fmt.Fprintf(&msg, "Subject: rbfbattle: battle %s %s\r\n", n.Battle, n.Event)
+	fmt.Fprintf(&msg, "Date: %s\r\n\r\n", n.Time.Format(time.RFC1123Z))
+	fmt.Fprintf(&msg, "Battle %s over %s %s.\r\n\r\n", n.Battle, n.Outpoint, n.Event)
+	fmt.Fprintf(&msg, "Address: %s\r\nAmount: %s\r\n", n.Address, n.Amount)
+	if n.TxID != "" {
+		fmt.Fprintf(&msg, "Transaction: %s\r\n", n.TxID)
+	}
+
+	if err := smtp.SendMail(s.addr, nil, s.from, s.to, []byte(msg.String())); err != nil {
+		return fmt.Errorf("error sending mail: %v", err)
+	}
+	return nil
+}
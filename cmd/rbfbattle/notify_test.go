@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// webhookStandIn records the notifications posted to it
+type webhookStandIn struct {
+	mu            sync.Mutex
+	notifications []notification
+	signatures    []string
+}
+
+func (s *webhookStandIn) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+
+	var n notification
+	if err := json.Unmarshal(body, &n); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.notifications = append(s.notifications, n)
+	if r.Header.Get("X-Rbfbattle-Signature") == "sha256="+webhookSignature("secret", body) {
+		s.signatures = append(s.signatures, n.Event)
+	}
+}
+
+func (s *webhookStandIn) received() []notification {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]notification(nil), s.notifications...)
+}
+
+var testBattle = &TrackedUTXO{ID: "0badf00d", TxID: "aa", N: 1, Address: "bcrt1qtest", Amount: 100_000}
+
+func TestWebhookNotifications(t *testing.T) {
+	standIn := &webhookStandIn{}
+	server := httptest.NewServer(standIn)
+	defer server.Close()
+
+	sink := &webhookSink{url: server.URL, secret: "secret"}
+	notifiers := notifierSet{newNotifier(sink, []string{eventWon, eventLost}, 10)}
+
+	notifiers.notify(eventStarted, testBattle, "")
+	notifiers.notify(eventWon, testBattle, "bb")
+
+	waitFor(t, "webhook", func() bool { return len(standIn.received()) > 0 })
+	time.Sleep(100 * time.Millisecond)
+
+	received := standIn.received()
+	if len(received) != 1 {
+		t.Fatalf("expected only the won event, got %+v", received)
+	}
+	n := received[0]
+	if n.Event != eventWon || n.Battle != "0badf00d" || n.Outpoint != "aa:1" || n.TxID != "bb" || n.Amount != 100_000 {
+		t.Errorf("unexpected notification %+v", n)
+	}
+	if len(standIn.signatures) != 1 {
+		t.Error("expected a valid signature")
+	}
+}
+
+func TestNotificationRateLimit(t *testing.T) {
+	standIn := &webhookStandIn{}
+	server := httptest.NewServer(standIn)
+	defer server.Close()
+
+	notifiers := notifierSet{newNotifier(&webhookSink{url: server.URL}, notificationEvents, 2)}
+
+	for i := 0; i < 5; i++ {
+		notifiers.notify(eventStarted, testBattle, "")
+	}
+
+	waitFor(t, "webhook", func() bool { return len(standIn.received()) >= 2 })
+	time.Sleep(100 * time.Millisecond)
+
+	if got := len(standIn.received()); got != 2 {
+		t.Errorf("expected 2 notifications within the rate limit, got %d", got)
+	}
+}
+
+func TestCommandNotification(t *testing.T) {
+	out := filepath.Join(t.TempDir(), "event")
+	sink := &commandSink{command: `echo "$RBFBATTLE_EVENT $RBFBATTLE_OUTPOINT" > ` + out}
+
+	if err := sink.Send(notification{Event: eventBurned, Outpoint: "aa:1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	got, _ := os.ReadFile(out)
+	if string(got) != "burned aa:1\n" {
+		t.Errorf("expected the event in the environment, got %q", got)
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/btcsuite/btcd/peer"
+	"github.com/btcsuite/btcd/wire"
+)
+
+const (
+	p2pDialTimeout      = 10 * time.Second
+	p2pRetryInterval    = 10 * time.Second
+	p2pUserAgentName    = "rbfbattle"
+	p2pUserAgentVersion = "0.1.0"
+)
+
+// p2pPeers are the nodes we're connected to over the P2P protocol, by address
+var p2pPeers = struct {
+	sync.Mutex
+	peers map[string]*peer.Peer
+}{peers: make(map[string]*peer.Peer)}
+
+// listenP2P connects to a node over the Bitcoin P2P protocol and queues the transactions it relays,
+// reconnecting whenever the connection drops. With blocks, the transactions of the blocks it
+// announces are queued as well, so battles resolve without ZMQ.
+func listenP2P(addr string, queue chan<- queuedTx, blocks bool) {
+	for {
+		p, err := connectP2P(addr, queue, blocks)
+		if err != nil {
+			slog.Warn("Failed to connect to P2P peer", "peer", addr, "err", err)
+			time.Sleep(p2pRetryInterval)
+			continue
+		}
+		slog.Info("Connected to P2P peer", "peer", addr, "user_agent", p.UserAgent(), "height", p.StartingHeight())
+
+		p.WaitForDisconnect()
+
+		p2pPeers.Lock()
+		delete(p2pPeers.peers, addr)
+		p2pPeers.Unlock()
+
+		slog.Warn("Disconnected from P2P peer", "peer", addr)
+		time.Sleep(p2pRetryInterval)
+	}
+}
+
+// connectP2P completes the version handshake with a node. Transactions it announces are requested
+// and queued as seen by addr, and so are the blocks with blocks.
+func connectP2P(addr string, queue chan<- queuedTx, blocks bool) (*peer.Peer, error) {
+	conn, err := net.DialTimeout("tcp", addr, p2pDialTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	verack := make(chan struct{})
+	config := &peer.Config{
+		UserAgentName:    p2pUserAgentName,
+		UserAgentVersion: p2pUserAgentVersion,
+		ChainParams:      network,
+		// We don't serve blocks, but understand witnesses
+		Services: wire.SFNodeWitness,
+		Listeners: peer.MessageListeners{
+			OnVerAck: func(p *peer.Peer, msg *wire.MsgVerAck) {
+				close(verack)
+			},
+			OnInv: func(p *peer.Peer, msg *wire.MsgInv) {
+				requestInventory(p, msg, blocks)
+			},
+			OnTx: func(p *peer.Peer, msg *wire.MsgTx) {
+				queue <- queuedTx{msg: msg, seenAt: time.Now(), node: addr}
+			},
+			// A block is only requested when announced, so it is the tip and confirms its transactions once
+			OnBlock: func(p *peer.Peer, msg *wire.MsgBlock, buf []byte) {
+				seenAt := time.Now()
+				blockHash := msg.BlockHash().String()
+				for _, tx := range msg.Transactions {
+					queue <- queuedTx{msg: tx, seenAt: seenAt, node: addr, confirmations: 1, blockHash: blockHash}
+				}
+			},
+		},
+	}
+
+	// The dialed address is resolved, so hostnames work too
+	p, err := peer.NewOutboundPeer(config, conn.RemoteAddr().String())
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	p.AssociateConnection(conn)
+
+	select {
+	case <-verack:
+	case <-time.After(p2pDialTimeout):
+		p.Disconnect()
+		return nil, fmt.Errorf("no verack from %s", addr)
+	}
+
+	p2pPeers.Lock()
+	p2pPeers.peers[addr] = p
+	p2pPeers.Unlock()
+
+	return p, nil
+}
+
+// requestInventory asks for the transactions in an inv, and the blocks with blocks, with their witnesses
+func requestInventory(p *peer.Peer, msg *wire.MsgInv, blocks bool) {
+	getData := wire.NewMsgGetData()
+	for _, inv := range msg.InvList {
+		switch {
+		case inv.Type == wire.InvTypeTx || inv.Type == wire.InvTypeWitnessTx:
+			getData.AddInvVect(wire.NewInvVect(wire.InvTypeWitnessTx, &inv.Hash))
+		case blocks && (inv.Type == wire.InvTypeBlock || inv.Type == wire.InvTypeWitnessBlock):
+			getData.AddInvVect(wire.NewInvVect(wire.InvTypeWitnessBlock, &inv.Hash))
+		}
+	}
+	if len(getData.InvList) > 0 {
+		p.QueueMessage(getData, nil)
+	}
+}
+
+// announceP2P relays a transaction to the P2P peers. The transaction is pushed without
+// an inv first, which nodes accept and saves a round trip.
+func announceP2P(tx *wire.MsgTx) {
+	p2pPeers.Lock()
+	defer p2pPeers.Unlock()
+
+	for _, p := range p2pPeers.peers {
+		p.QueueMessage(tx, nil)
+	}
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+)
+
+// fakeP2PNode speaks the P2P protocol over raw wire messages. It accepts a connection,
+// serves the transactions and blocks it announces and collects the transactions it's sent.
+type fakeP2PNode struct {
+	listener net.Listener
+	received chan *wire.MsgTx
+
+	mu     sync.Mutex
+	conn   net.Conn
+	served map[chainhash.Hash]wire.Message
+}
+
+func newFakeP2PNode(t *testing.T) *fakeP2PNode {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &fakeP2PNode{
+		listener: listener,
+		received: make(chan *wire.MsgTx, 10),
+		served:   make(map[chainhash.Hash]wire.Message),
+	}
+
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		f.mu.Lock()
+		f.conn = conn
+		f.mu.Unlock()
+		f.run(conn)
+	}()
+
+	t.Cleanup(func() {
+		listener.Close()
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		if f.conn != nil {
+			f.conn.Close()
+		}
+	})
+
+	return f
+}
+
+func (f *fakeP2PNode) run(conn net.Conn) {
+	for {
+		_, msg, _, err := wire.ReadMessageWithEncodingN(conn, wire.ProtocolVersion, network.Net, wire.WitnessEncoding)
+		if err != nil {
+			return
+		}
+
+		switch msg := msg.(type) {
+		case *wire.MsgVersion:
+			me := wire.NewNetAddressIPPort(net.IPv4(127, 0, 0, 1), 0, wire.SFNodeNetwork|wire.SFNodeWitness)
+			version := wire.NewMsgVersion(me, &msg.AddrMe, 1, 0)
+			version.Services = wire.SFNodeNetwork | wire.SFNodeWitness
+			f.send(version)
+			f.send(wire.NewMsgVerAck())
+		case *wire.MsgGetData:
+			f.mu.Lock()
+			for _, inv := range msg.InvList {
+				if served, ok := f.served[inv.Hash]; ok {
+					f.sendLocked(served)
+				}
+			}
+			f.mu.Unlock()
+		case *wire.MsgTx:
+			f.received <- msg
+		}
+	}
+}
+
+func (f *fakeP2PNode) send(msg wire.Message) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.sendLocked(msg)
+}
+
+func (f *fakeP2PNode) sendLocked(msg wire.Message) {
+	wire.WriteMessageWithEncodingN(f.conn, msg, wire.ProtocolVersion, network.Net, wire.WitnessEncoding)
+}
+
+// announce sends an inv for the transaction and serves it when asked
+func (f *fakeP2PNode) announce(tx *wire.MsgTx) {
+	hash := tx.TxHash()
+	f.mu.Lock()
+	f.served[hash] = tx
+	f.mu.Unlock()
+
+	inv := wire.NewMsgInv()
+	inv.AddInvVect(wire.NewInvVect(wire.InvTypeTx, &hash))
+	f.send(inv)
+}
+
+// announceBlock sends an inv for the block and serves it when asked
+func (f *fakeP2PNode) announceBlock(block *wire.MsgBlock) {
+	hash := block.BlockHash()
+	f.mu.Lock()
+	f.served[hash] = block
+	f.mu.Unlock()
+
+	inv := wire.NewMsgInv()
+	inv.AddInvVect(wire.NewInvVect(wire.InvTypeBlock, &hash))
+	f.send(inv)
+}
+
+func TestP2PListener(t *testing.T) {
+	f := newFakeP2PNode(t)
+	addr := f.listener.Addr().String()
+
+	queue := make(chan queuedTx, 1)
+	p, err := connectP2P(addr, queue, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		p.Disconnect()
+		p2pPeers.Lock()
+		delete(p2pPeers.peers, addr)
+		p2pPeers.Unlock()
+	})
+
+	tx := wire.NewMsgTx(2)
+	tx.AddTxIn(&wire.TxIn{
+		PreviousOutPoint: wire.OutPoint{Index: 1},
+		Witness:          wire.TxWitness{make([]byte, 71), make([]byte, 33)},
+		Sequence:         wire.MaxTxInSequenceNum - 2,
+	})
+	tx.AddTxOut(wire.NewTxOut(50_000, make([]byte, 22)))
+	f.announce(tx)
+
+	select {
+	case queued := <-queue:
+		if queued.msg.TxHash() != tx.TxHash() || queued.node != addr {
+			t.Errorf("expected %s from %s, got %s from %s", tx.TxHash(), addr, queued.msg.TxHash(), queued.node)
+		}
+		if len(queued.msg.TxIn) != 1 || len(queued.msg.TxIn[0].Witness) != 2 {
+			t.Errorf("expected the witness to be relayed, got %+v", queued.msg.TxIn)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the relayed transaction")
+	}
+
+	// The block confirming the transaction is requested and its transactions queued
+	block := wire.NewMsgBlock(&wire.BlockHeader{Version: 4, Timestamp: time.Unix(1_700_000_000, 0)})
+	block.AddTransaction(tx)
+	f.announceBlock(block)
+
+	select {
+	case queued := <-queue:
+		if queued.msg.TxHash() != tx.TxHash() || queued.confirmations != 1 || queued.blockHash != block.BlockHash().String() {
+			t.Errorf("expected %s confirmed in %s, got %s with %d confirmations in %q",
+				tx.TxHash(), block.BlockHash(), queued.msg.TxHash(), queued.confirmations, queued.blockHash)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the block")
+	}
+
+	ours := tx.Copy()
+	ours.TxOut[0].Value = 40_000
+	announceP2P(ours)
+
+	select {
+	case received := <-f.received:
+		if received.TxHash() != ours.TxHash() {
+			t.Errorf("expected %s to be announced, got %s", ours.TxHash(), received.TxHash())
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for our transaction")
+	}
+}
@@ -0,0 +1,325 @@
+package main
+
+import (
+	"encoding/hex"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/btcsuite/btcd/btcjson"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/rpcclient"
+	"github.com/btcsuite/btcd/wire"
+)
+
+// Mempool transactions go through a pipeline of stages connected by bounded queues. A full
+// queue makes the stage before it wait, which shows in the queue depth and latency metrics.
+//
+//	receive   rawTransactionQueue       transactions and announcements from ZMQ, peers, p2p and backends
+//	enrich    enrichQueue               announcements by txid waiting for their transaction
+//	dispatch  urgentQueue, normalQueue  transactions that concern us waiting to be processed
+//
+// Transactions are filtered as soon as they are known: announcements carrying the transaction
+// right away, announcements by txid once the enrich stage fetched it. Raw transactions are
+// matched on their outpoints and output scripts against the monitored utxos and the watched
+// scripts, without calling the node or encoding addresses. Transactions that don't concern
+// us are dropped there, the rest is never dropped. The outputs paying watched scripts are
+// indexed as they pass, so a spend arriving before the battle over one starts waits for it.
+//
+// ZMQ announces the transactions of a block as rawtx once more, which may be handled after the
+// block. Payments to a watched script from ZMQ are rare, so the enrich stage asks the node if
+// they are confirmed before they start a battle. Spends of monitored utxos skip the node.
+var (
+	rawTransactionQueue = make(chan queuedTx, 100)
+	enrichQueue         = make(chan queuedTx, 100)
+	urgentQueue         = make(chan queuedTx, 100)
+	normalQueue         = make(chan queuedTx, 100)
+)
+
+// battleWork counts the goroutines working on battles in the background, so a replay
+// can wait for them before feeding the next message
+var battleWork sync.WaitGroup
+
+// queuedTx is a mempool transaction waiting to be processed
+type queuedTx struct {
+	tx *btcjson.TxRawResult
+	// msg is set instead of tx when the transaction arrived raw. It is only described
+	// once it turns out to concern us.
+	msg    *wire.MsgTx
+	seenAt time.Time
+	// node announced the transaction
+	node string
+	// txid is set instead of tx when a node announced the transaction by txid only,
+	// and client fetches it from that node. Raw ZMQ announcements set client too.
+	txid   string
+	client *rpcclient.Client
+	// confirmations and blockHash describe a raw transaction that arrived in a block
+	confirmations int64
+	blockHash     string
+}
+
+// txPriority tells how a transaction concerns us
+type txPriority int
+
+const (
+	irrelevantTx txPriority = iota
+	// normalTx pays to a watched script
+	normalTx
+	// urgentTx spends a utxo we battle over or blocks one as a TRUC sibling
+	urgentTx
+)
+
+// startPipeline runs workers goroutines for every stage. With a single worker transactions
+// are processed in the order they were received.
+func startPipeline(client *rpcclient.Client, config *Config, workers int) {
+	prioritize := workers > 1
+	for range workers {
+		go filterStage(prioritize)
+		go enrichStage(prioritize)
+		go dispatchStage(client, config)
+	}
+}
+
+// filterStage passes announcements by txid on to the enrich stage and dispatches the rest
+func filterStage(prioritize bool) {
+	for queued := range rawTransactionQueue {
+		if queued.tx == nil && queued.msg == nil {
+			enrichQueue <- queued
+			continue
+		}
+		dispatch(queued, prioritize)
+	}
+}
+
+// enrichStage fetches the transactions announced by txid from the node that announced them
+func enrichStage(prioritize bool) {
+	for queued := range enrichQueue {
+		if enrich(&queued) {
+			dispatch(queued, prioritize)
+		}
+	}
+}
+
+// enrich fetches the transaction announced by txid
+func enrich(queued *queuedTx) bool {
+	txHash, err := chainhash.NewHashFromStr(queued.txid)
+	if err != nil {
+		slog.Error("Error parsing transaction hash from hashtx", "err", err)
+		return false
+	}
+
+	tx, err := queued.client.GetRawTransactionVerbose(txHash)
+	if err != nil {
+		// For our own transactions this is gonna fail as zmq sends the hashtx event before it's available in our local mempool
+		slog.Debug("Error getting transaction", "txid", queued.txid, "err", err)
+		return false
+	}
+	metricPipelineLatency.WithLabelValues("enrich").Observe(time.Since(queued.seenAt).Seconds())
+
+	queued.tx = tx
+	return true
+}
+
+// dispatch queues a transaction that concerns us by priority and drops the others
+func dispatch(queued queuedTx, prioritize bool) {
+	priority := classify(&queued)
+	if priority == irrelevantTx {
+		return
+	}
+	if needsNode(&queued, priority) {
+		enrichQueue <- queued
+		return
+	}
+
+	if priority == urgentTx && prioritize {
+		urgentQueue <- queued
+	} else {
+		normalQueue <- queued
+	}
+}
+
+// classify tells how a transaction concerns us and describes it when it does
+func classify(queued *queuedTx) txPriority {
+	var priority txPriority
+	if queued.msg != nil {
+		priority = classifyTx(queued.msg)
+	} else {
+		priority = classifyTxResult(queued.tx)
+	}
+
+	if priority == irrelevantTx {
+		metricPipelineDropped.WithLabelValues("irrelevant").Inc()
+		return priority
+	}
+	if queued.tx == nil {
+		queued.tx = newTxRawResult(queued.msg)
+		queued.tx.Confirmations = uint64(queued.confirmations)
+		queued.tx.BlockHash = queued.blockHash
+	}
+	return priority
+}
+
+// needsNode tells if a raw ZMQ payment to a watched script must be described by the node,
+// which knows if it is confirmed already, and prepares it for the enrich stage
+func needsNode(queued *queuedTx, priority txPriority) bool {
+	if priority != normalTx || queued.msg == nil || queued.client == nil || queued.txid != "" || queued.confirmations > 0 {
+		return false
+	}
+	queued.txid = queued.msg.TxHash().String()
+	return true
+}
+
+// processNow takes a transaction through every stage right away, as a replay does
+func processNow(client *rpcclient.Client, config *Config, queued queuedTx) {
+	if queued.tx == nil && queued.msg == nil && !enrich(&queued) {
+		return
+	}
+	priority := classify(&queued)
+	if priority == irrelevantTx {
+		return
+	}
+	if needsNode(&queued, priority) && !enrich(&queued) {
+		return
+	}
+	processTransaction(client, queued.tx, queued.seenAt, queued.node, config)
+}
+
+// dispatchStage processes the queued transactions, those touching our battles first
+func dispatchStage(client *rpcclient.Client, config *Config) {
+	for {
+		var queued queuedTx
+		select {
+		case queued = <-urgentQueue:
+		default:
+			select {
+			case queued = <-urgentQueue:
+			case queued = <-normalQueue:
+			}
+		}
+		metricPipelineLatency.WithLabelValues("dispatch").Observe(time.Since(queued.seenAt).Seconds())
+
+		processTransaction(client, queued.tx, queued.seenAt, queued.node, config)
+	}
+}
+
+// classifyTx checks if a raw transaction concerns us without calling the node
+func classifyTx(tx *wire.MsgTx) txPriority {
+	for _, txIn := range tx.TxIn {
+		if contestsMonitored(txIn.PreviousOutPoint) {
+			return urgentTx
+		}
+	}
+	priority := irrelevantTx
+	for i, txOut := range tx.TxOut {
+		if _, ok := watchedScriptKey(txOut.PkScript); ok {
+			expectIncoming(wire.OutPoint{Hash: tx.TxHash(), Index: uint32(i)})
+			priority = normalTx
+		}
+	}
+	return priority
+}
+
+// classifyTxResult checks like classifyTx if a transaction described by the node concerns us
+func classifyTxResult(tx *btcjson.TxRawResult) txPriority {
+	for _, vin := range tx.Vin {
+		hash, err := chainhash.NewHashFromStr(vin.Txid)
+		if err != nil {
+			continue
+		}
+		if contestsMonitored(wire.OutPoint{Hash: *hash, Index: vin.Vout}) {
+			return urgentTx
+		}
+	}
+	priority := irrelevantTx
+	for _, vout := range tx.Vout {
+		script, err := hex.DecodeString(vout.ScriptPubKey.Hex)
+		if err != nil {
+			continue
+		}
+		if _, ok := watchedScriptKey(script); ok {
+			if hash, err := chainhash.NewHashFromStr(tx.Txid); err == nil {
+				expectIncoming(wire.OutPoint{Hash: *hash, Index: vout.N})
+			}
+			priority = normalTx
+		}
+	}
+	return priority
+}
+
+// contestsMonitored tells if spending an outpoint contests a utxo we battle over, or one
+// paid to us whose battle is about to start, by spending it or as its TRUC sibling
+func contestsMonitored(outpoint wire.OutPoint) bool {
+	if _, ok := getMonitoredOutPoint(outpoint); ok {
+		return true
+	}
+	if isIncoming(outpoint) {
+		return true
+	}
+	_, ok := trucSiblingAt(outpoint)
+	return ok
+}
+
+// answerCounterpart hands a counterpart to the handler of its battle, which answers the
+// counterparts of a battle one at a time. A counterpart still waiting when a newer one shows
+// up is dropped, as only the newer one can still be outbid.
+func answerCounterpart(client *rpcclient.Client, counterpart *btcjson.TxRawResult, utxo *TrackedUTXO, privateKeyWIF string, config *Config) {
+	utxo.mu.Lock()
+	if utxo.pending != nil {
+		metricPipelineDropped.WithLabelValues("superseded").Inc()
+	}
+	utxo.pending = func() { TryReplacingAttacker(client, counterpart, utxo, privateKeyWIF, config) }
+	utxo.mu.Unlock()
+
+	utxo.runHandler()
+}
+
+// inBattle queues an action on the battle, such as a self-bump or an API command. The handler
+// runs it after the counterpart it answers, so it never races a replacement for the funding coin.
+func (utxo *TrackedUTXO) inBattle(action func()) {
+	utxo.mu.Lock()
+	utxo.actions = append(utxo.actions, action)
+	utxo.mu.Unlock()
+
+	utxo.runHandler()
+}
+
+// awaitBattle runs action in the battle handler and returns its error
+func (utxo *TrackedUTXO) awaitBattle(action func() error) error {
+	done := make(chan error, 1)
+	utxo.inBattle(func() { done <- action() })
+	return <-done
+}
+
+// runHandler starts the handler of the battle unless it is running
+func (utxo *TrackedUTXO) runHandler() {
+	utxo.mu.Lock()
+	running := utxo.handling
+	utxo.handling = true
+	utxo.mu.Unlock()
+
+	if running {
+		return
+	}
+
+	battleWork.Add(1)
+	go func() {
+		defer battleWork.Done()
+		for {
+			utxo.mu.Lock()
+			next := utxo.pending
+			utxo.pending = nil
+			if next == nil && len(utxo.actions) > 0 {
+				next = utxo.actions[0]
+				utxo.actions = utxo.actions[1:]
+			}
+			if next == nil {
+				utxo.handling = false
+				utxo.mu.Unlock()
+				return
+			}
+			utxo.mu.Unlock()
+
+			next()
+		}
+	}()
+}
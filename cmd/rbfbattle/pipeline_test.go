@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/btcec/v2"
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/rpcclient"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestClassifyTx(t *testing.T) {
+	key, _ := btcec.NewPrivateKey()
+	address, err := addressForPubKey("wpkh", key.PubKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	watchAddress(address.EncodeAddress(), hex.EncodeToString(key.Serialize()))
+	defer unwatchAddress(address.EncodeAddress())
+
+	other, _ := btcec.NewPrivateKey()
+	payment := wire.NewMsgTx(2)
+	payment.AddTxIn(wire.NewTxIn(&wire.OutPoint{Index: 7}, nil, nil))
+	payment.AddTxOut(wire.NewTxOut(100_000, p2wpkhScript(key)))
+	if priority := classifyTx(payment); priority != normalTx {
+		t.Errorf("expected a payment to a watched address to be normal, got %v", priority)
+	}
+
+	utxo := &TrackedUTXO{Address: address.EncodeAddress(), Amount: btcutil.Amount(100_000), TxID: payment.TxHash().String()}
+	monitor(utxo)
+	defer cleanup(utxo)
+
+	counterpart := wire.NewMsgTx(2)
+	counterpart.AddTxIn(wire.NewTxIn(&wire.OutPoint{Hash: payment.TxHash(), Index: 0}, nil, nil))
+	counterpart.AddTxOut(wire.NewTxOut(90_000, p2wpkhScript(other)))
+	if priority := classifyTx(counterpart); priority != urgentTx {
+		t.Errorf("expected a counterpart to be urgent, got %v", priority)
+	}
+	if priority := classifyTxResult(newTxRawResult(counterpart)); priority != urgentTx {
+		t.Errorf("expected a counterpart described by the node to be urgent, got %v", priority)
+	}
+
+	// A counterpart from a block is described as confirmed
+	confirmed := queuedTx{msg: counterpart, confirmations: 1, blockHash: "00000000000000000001"}
+	if classify(&confirmed) != urgentTx || confirmed.tx.Confirmations != 1 || confirmed.tx.BlockHash != confirmed.blockHash {
+		t.Errorf("expected a confirmed counterpart, got %d confirmations in %q", confirmed.tx.Confirmations, confirmed.tx.BlockHash)
+	}
+
+	scripts, err := payToPubKeyScripts(hex.EncodeToString(other.Serialize()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	watchScript(scripts[1], hex.EncodeToString(other.Serialize()))
+	defer unwatchScript(scripts[1])
+
+	bare := wire.NewMsgTx(2)
+	bare.AddTxIn(wire.NewTxIn(&wire.OutPoint{Index: 9}, nil, nil))
+	bare.AddTxOut(wire.NewTxOut(90_000, scripts[1]))
+	if priority := classifyTx(bare); priority != normalTx {
+		t.Errorf("expected a payment to a watched pay-to-pubkey script to be normal, got %v", priority)
+	}
+	if priority := classifyTxResult(newTxRawResult(bare)); priority != normalTx {
+		t.Errorf("expected a pay-to-pubkey payment described by the node to be normal, got %v", priority)
+	}
+
+	unrelated := wire.NewMsgTx(2)
+	unrelated.AddTxIn(wire.NewTxIn(&wire.OutPoint{Index: 8}, nil, nil))
+	unrelated.AddTxOut(wire.NewTxOut(90_000, p2wpkhScript(other)))
+	if priority := classifyTx(unrelated); priority != irrelevantTx {
+		t.Errorf("expected an unrelated transaction to be irrelevant, got %v", priority)
+	}
+}
+
+func TestParkSpendOfIncomingPayment(t *testing.T) {
+	key, _ := btcec.NewPrivateKey()
+	script := p2wpkhScript(key)
+	watchScript(script, hex.EncodeToString(key.Serialize()))
+	defer unwatchScript(script)
+
+	payment := wire.NewMsgTx(2)
+	payment.AddTxIn(wire.NewTxIn(&wire.OutPoint{Index: 11}, nil, nil))
+	payment.AddTxOut(wire.NewTxOut(100_000, script))
+	outpoint := wire.OutPoint{Hash: payment.TxHash(), Index: 0}
+	defer takeParked(outpoint)
+
+	other, _ := btcec.NewPrivateKey()
+	spend := wire.NewMsgTx(2)
+	spend.AddTxIn(wire.NewTxIn(&outpoint, nil, nil))
+	spend.AddTxOut(wire.NewTxOut(90_000, p2wpkhScript(other)))
+
+	// Before the payment is seen, its spend doesn't concern us
+	if priority := classifyTx(spend); priority != irrelevantTx {
+		t.Errorf("expected the spend of an unknown payment to be irrelevant, got %v", priority)
+	}
+
+	// Once it is, the spend is kept until the battle starts
+	classifyTx(payment)
+	if priority := classifyTx(spend); priority != urgentTx {
+		t.Errorf("expected the spend of a payment to us to be urgent, got %v", priority)
+	}
+	if parked, _ := park(newTxRawResult(spend), time.Now(), primaryNode); !parked {
+		t.Fatal("expected the spend to be parked")
+	}
+
+	spends := takeParked(outpoint)
+	if len(spends) != 1 || spends[0].tx.Txid != spend.TxHash().String() {
+		t.Errorf("expected the parked spend, got %d", len(spends))
+	}
+	if isIncoming(outpoint) {
+		t.Error("expected the outpoint to be forgotten once the battle started")
+	}
+}
+
+func TestPipelineDropsIrrelevant(t *testing.T) {
+	b := startBattle(t)
+	dropped := testutil.ToFloat64(metricPipelineDropped.WithLabelValues("irrelevant"))
+
+	other, _ := btcec.NewPrivateKey()
+	b.send(t, p2wpkhScript(other), 50_000)
+
+	waitFor(t, "the transaction to be dropped", func() bool {
+		return testutil.ToFloat64(metricPipelineDropped.WithLabelValues("irrelevant")) > dropped
+	})
+}
+
+func TestZMQQueuedTxs(t *testing.T) {
+	key, _ := btcec.NewPrivateKey()
+	payment := wire.NewMsgTx(2)
+	payment.AddTxIn(wire.NewTxIn(&wire.OutPoint{Index: 3}, nil, nil))
+	payment.AddTxOut(wire.NewTxOut(100_000, p2wpkhScript(key)))
+	client := &rpcclient.Client{}
+
+	var buf bytes.Buffer
+	payment.Serialize(&buf)
+	queued := zmqQueuedTxs([][]byte{[]byte("rawtx"), buf.Bytes()}, time.Now(), primaryNode, client)
+	if len(queued) != 1 || queued[0].msg.TxHash() != payment.TxHash() || queued[0].txid != "" || queued[0].confirmations != 0 {
+		t.Fatalf("expected the raw transaction to be decoded without the node, got %+v", queued)
+	}
+
+	// Only payments to us are described by the node, as they may be confirmed already
+	if needsNode(&queued[0], urgentTx) {
+		t.Error("expected a counterpart to skip the node")
+	}
+	if !needsNode(&queued[0], normalTx) || queued[0].txid != payment.TxHash().String() {
+		t.Error("expected a payment to us to be described by the node")
+	}
+
+	block := wire.MsgBlock{Header: wire.BlockHeader{Nonce: 1}, Transactions: []*wire.MsgTx{payment}}
+	buf.Reset()
+	block.Serialize(&buf)
+	queued = zmqQueuedTxs([][]byte{[]byte("rawblock"), buf.Bytes()}, time.Now(), primaryNode, client)
+	if len(queued) != 1 || queued[0].confirmations != 1 || queued[0].blockHash != block.BlockHash().String() {
+		t.Fatalf("expected the block transaction to be confirmed, got %+v", queued)
+	}
+	if needsNode(&queued[0], normalTx) {
+		t.Error("expected a confirmed payment to skip the node")
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"math/rand/v2"
+	"regexp"
+	"strconv"
+	"sync"
+
+	"github.com/btcsuite/btcd/btcjson"
+	"github.com/btcsuite/btcd/rpcclient"
+	"github.com/btcsuite/btcd/wire"
+)
+
+const (
+	// sequenceRBF signals opt-in replaceability (BIP125) and enables nLockTime
+	sequenceRBF = wire.MaxTxInSequenceNum - 2
+	// sequenceLockTime does not signal replaceability but enables nLockTime
+	sequenceLockTime = wire.MaxTxInSequenceNum - 1
+
+	// Bitcoin Core enables full-RBF by default from this version
+	fullRBFDefaultVersion = 28
+)
+
+// nodeFullRBF is set if our node replaces transactions that don't signal BIP125
+var nodeFullRBF bool
+
+var (
+	// lockTimeSeed seeds the random nLockTime offsets so a replay makes the same transactions
+	lockTimeSeed = rand.Uint64()
+	lockTimeRand = rand.New(rand.NewPCG(lockTimeSeed, 0))
+	lockTimeMu   sync.Mutex
+)
+
+// seedLockTime restarts the nLockTime offsets from a seed
+func seedLockTime(seed uint64) {
+	lockTimeMu.Lock()
+	defer lockTimeMu.Unlock()
+
+	lockTimeSeed = seed
+	lockTimeRand = rand.New(rand.NewPCG(seed, 0))
+}
+
+// newTxIn creates an input with the sequence number of our transaction policy
+func newTxIn(config *Config, outpoint *wire.OutPoint) *wire.TxIn {
+	txIn := wire.NewTxIn(outpoint, nil, nil)
+
+	switch {
+	case !config.NoRBFSignal:
+		txIn.Sequence = sequenceRBF
+	case config.AntiFeeSniping:
+		txIn.Sequence = sequenceLockTime
+	}
+
+	return txIn
+}
+
+// applyLockTime sets an anti-fee-sniping nLockTime at the tip height like Bitcoin Core does,
+// sometimes going back up to 100 blocks so delayed transactions don't stand out.
+func applyLockTime(config *Config, tx *wire.MsgTx, height int64) {
+	if !config.AntiFeeSniping {
+		return
+	}
+
+	lockTimeMu.Lock()
+	if lockTimeRand.IntN(10) == 0 {
+		height -= lockTimeRand.Int64N(100)
+	}
+	lockTimeMu.Unlock()
+
+	tx.LockTime = uint32(max(height, 0))
+}
+
+// signalsRBF checks if a transaction is replaceable without full-RBF.
+// TRUC transactions are always replaceable.
+func signalsRBF(tx *btcjson.TxRawResult) bool {
+	if tx.Version == trucVersion {
+		return true
+	}
+
+	for _, vin := range tx.Vin {
+		if vin.Sequence < sequenceLockTime {
+			return true
+		}
+	}
+	return false
+}
+
+type mempoolInfo struct {
+	FullRBF *bool `json:"fullrbf"`
+}
+
+var coreVersionRegexp = regexp.MustCompile(`^/Satoshi:(\d+)\.`)
+
+// checkReplacementPolicy warns if our node or its peers may refuse our replacements
+// and returns whether our node runs full-RBF
+func checkReplacementPolicy(client *rpcclient.Client, config *Config) bool {
+	res, err := client.RawRequest("getmempoolinfo", nil)
+	if err != nil {
+		slog.Error("Failed to get mempool info", "err", err)
+		return false
+	}
+
+	var info mempoolInfo
+	if err := json.Unmarshal(res, &info); err != nil {
+		slog.Error("Failed to parse mempool info", "err", err)
+		return false
+	}
+
+	// Nodes before Bitcoin Core 24 don't have the option and never run full-RBF
+	fullRBF := info.FullRBF != nil && *info.FullRBF
+
+	if !fullRBF {
+		slog.Warn("Node is not running full-RBF. Counterpart transactions that don't signal BIP125 can't be replaced. Set mempoolfullrbf=1 on the node")
+		if config.NoRBFSignal {
+			slog.Error("Our transactions don't signal BIP125 and the node will refuse to replace them")
+		}
+	}
+
+	if !config.NoRBFSignal {
+		return fullRBF
+	}
+
+	peers, err := client.GetPeerInfo()
+	if err != nil {
+		slog.Error("Failed to get peer info", "err", err)
+		return fullRBF
+	}
+
+	fullRBFPeers := 0
+	for _, peer := range peers {
+		match := coreVersionRegexp.FindStringSubmatch(peer.SubVer)
+		if match == nil {
+			continue
+		}
+		if version, _ := strconv.Atoi(match[1]); version >= fullRBFDefaultVersion {
+			fullRBFPeers++
+		}
+	}
+
+	if fullRBFPeers < len(peers) {
+		slog.Warn("Not all peers run full-RBF by default. Replacements of our transactions that don't signal BIP125 may not propagate",
+			"full_rbf_peers", fullRBFPeers,
+			"peers", len(peers),
+		)
+	}
+
+	return fullRBF
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/btcsuite/btcd/btcjson"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+)
+
+func TestNewTxIn(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		config   Config
+		sequence uint32
+	}{
+		{"signals BIP125 by default", Config{}, sequenceRBF},
+		{"signals BIP125 with anti-fee-sniping", Config{AntiFeeSniping: true}, sequenceRBF},
+		{"enables nLockTime without signalling", Config{NoRBFSignal: true, AntiFeeSniping: true}, sequenceLockTime},
+		{"final without signalling or nLockTime", Config{NoRBFSignal: true}, wire.MaxTxInSequenceNum},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			txIn := newTxIn(&test.config, wire.NewOutPoint(&chainhash.Hash{1}, 0))
+			if txIn.Sequence != test.sequence {
+				t.Errorf("expected sequence %#x, received %#x", test.sequence, txIn.Sequence)
+			}
+		})
+	}
+}
+
+func TestSignalsRBF(t *testing.T) {
+	for _, test := range []struct {
+		name      string
+		version   int32
+		sequences []uint32
+		signals   bool
+	}{
+		{"BIP125 sequence", 2, []uint32{sequenceRBF}, true},
+		{"one signalling input of several", 2, []uint32{wire.MaxTxInSequenceNum, 0}, true},
+		{"nLockTime sequence", 2, []uint32{sequenceLockTime}, false},
+		{"final sequence", 2, []uint32{wire.MaxTxInSequenceNum}, false},
+		{"TRUC", trucVersion, []uint32{wire.MaxTxInSequenceNum}, true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			tx := &btcjson.TxRawResult{Version: uint32(test.version)}
+			for _, sequence := range test.sequences {
+				tx.Vin = append(tx.Vin, btcjson.Vin{Sequence: sequence})
+			}
+			if signalsRBF(tx) != test.signals {
+				t.Errorf("expected signalling to be %v", test.signals)
+			}
+		})
+	}
+}
+
+func TestApplyLockTime(t *testing.T) {
+	tx := wire.NewMsgTx(2)
+	applyLockTime(&Config{}, tx, 800_000)
+	if tx.LockTime != 0 {
+		t.Errorf("expected no nLockTime without anti-fee-sniping, received %d", tx.LockTime)
+	}
+
+	const height = 800_000
+	config := &Config{AntiFeeSniping: true}
+	lockTimes := func(seed uint64) []uint32 {
+		seedLockTime(seed)
+
+		var lockTimes []uint32
+		for range 100 {
+			tx := wire.NewMsgTx(2)
+			applyLockTime(config, tx, height)
+			lockTimes = append(lockTimes, tx.LockTime)
+		}
+		return lockTimes
+	}
+
+	first := lockTimes(1)
+	if !slices.Equal(first, lockTimes(1)) {
+		t.Error("expected the same seed to make the same nLockTimes")
+	}
+
+	backdated := 0
+	for _, lockTime := range first {
+		if lockTime > height || lockTime < height-99 {
+			t.Errorf("nLockTime %d is outside the last 100 blocks of height %d", lockTime, height)
+		}
+		if lockTime < height {
+			backdated++
+		}
+	}
+	if backdated == 0 || backdated > 30 {
+		t.Errorf("expected about one in ten nLockTimes to be backdated, %d of 100 were", backdated)
+	}
+}
+
+func TestCheckReplacementPolicy(t *testing.T) {
+	node, err := newMockNode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer node.Close()
+	client, err := node.Client()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Shutdown()
+
+	for _, test := range []struct {
+		name    string
+		fullRBF bool
+		config  Config
+	}{
+		{"full-RBF node", true, Config{}},
+		{"opt-in node", false, Config{}},
+		{"opt-in node without signalling", false, Config{NoRBFSignal: true}},
+		{"full-RBF node without signalling", true, Config{NoRBFSignal: true}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			node.mu.Lock()
+			node.FullRBF = test.fullRBF
+			node.mu.Unlock()
+
+			if fullRBF := checkReplacementPolicy(client, &test.config); fullRBF != test.fullRBF {
+				t.Errorf("expected full-RBF to be detected as %v", test.fullRBF)
+			}
+		})
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+
+	"github.com/btcsuite/btcd/btcjson"
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+)
+
+// newTxRawResult describes a transaction the way bitcoind's verbose getrawtransaction does
+func newTxRawResult(tx *wire.MsgTx) *btcjson.TxRawResult {
+	var buf bytes.Buffer
+	tx.Serialize(&buf)
+
+	result := &btcjson.TxRawResult{
+		Hex:      hex.EncodeToString(buf.Bytes()),
+		Txid:     tx.TxHash().String(),
+		Hash:     tx.WitnessHash().String(),
+		Size:     int32(tx.SerializeSize()),
+		Vsize:    int32(txVirtualSize(tx)),
+		Weight:   int32(tx.SerializeSizeStripped()*3 + tx.SerializeSize()),
+		Version:  uint32(tx.Version),
+		LockTime: tx.LockTime,
+	}
+
+	for _, txIn := range tx.TxIn {
+		vin := btcjson.Vin{
+			Txid:     txIn.PreviousOutPoint.Hash.String(),
+			Vout:     txIn.PreviousOutPoint.Index,
+			Sequence: txIn.Sequence,
+			ScriptSig: &btcjson.ScriptSig{
+				Hex: hex.EncodeToString(txIn.SignatureScript),
+			},
+		}
+		vin.ScriptSig.Asm, _ = txscript.DisasmString(txIn.SignatureScript)
+		for _, item := range txIn.Witness {
+			vin.Witness = append(vin.Witness, hex.EncodeToString(item))
+		}
+		result.Vin = append(result.Vin, vin)
+	}
+
+	for i, txOut := range tx.TxOut {
+		result.Vout = append(result.Vout, btcjson.Vout{
+			Value:        btcutil.Amount(txOut.Value).ToBTC(),
+			N:            uint32(i),
+			ScriptPubKey: newScriptPubKeyResult(txOut.PkScript),
+		})
+	}
+
+	return result
+}
+
+// newScriptPubKeyResult describes an output script with bitcoind's type names.
+// Like bitcoind, pay-to-pubkey and bare multisig outputs have no address.
+func newScriptPubKeyResult(script []byte) btcjson.ScriptPubKeyResult {
+	asm, _ := txscript.DisasmString(script)
+	class, addresses, _, _ := txscript.ExtractPkScriptAddrs(script, network)
+
+	result := btcjson.ScriptPubKeyResult{
+		Asm: asm,
+		Hex: hex.EncodeToString(script),
+	}
+
+	switch class {
+	case txscript.PubKeyHashTy:
+		result.Type = "pubkeyhash"
+	case txscript.ScriptHashTy:
+		result.Type = "scripthash"
+	case txscript.WitnessV0PubKeyHashTy:
+		result.Type = "witness_v0_keyhash"
+	case txscript.WitnessV0ScriptHashTy:
+		result.Type = "witness_v0_scripthash"
+	case txscript.WitnessV1TaprootTy:
+		result.Type = "witness_v1_taproot"
+	case txscript.NullDataTy:
+		result.Type = "nulldata"
+	case txscript.PubKeyTy:
+		result.Type = "pubkey"
+		return result
+	case txscript.MultiSigTy:
+		result.Type = "multisig"
+		return result
+	default:
+		result.Type = "nonstandard"
+		return result
+	}
+
+	if len(addresses) == 1 {
+		result.Address = addresses[0].EncodeAddress()
+	}
+	return result
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/btcsuite/btcd/btcjson"
+)
+
+// Why a transaction of ours was refused. Backends wrap the errors of their node in a
+// rejectionError, so the battle logic doesn't depend on the wording of bitcoind or btcd.
+var (
+	errInsufficientFee     = errors.New("insufficient fee")
+	errDust                = errors.New("dust")
+	errMissingInputs       = errors.New("missing inputs")
+	errNotReplaceable      = errors.New("conflicting transaction is not replaceable")
+	errTooManyReplacements = errors.New("too many replaced transactions")
+	errAlreadyKnown        = errors.New("transaction already known")
+	errNotEnoughFunds      = errors.New("not enough funds to cover fee")
+)
+
+// rejectionError is an error of a node together with the reason it stands for
+type rejectionError struct {
+	reason error
+	err    error
+}
+
+func (e *rejectionError) Error() string {
+	return e.err.Error()
+}
+
+func (e *rejectionError) Unwrap() []error {
+	return []error{e.reason, e.err}
+}
+
+type rejectionPattern struct {
+	text   string
+	reason error
+}
+
+// bitcoindRejections are the reject reasons of Bitcoin Core
+var bitcoindRejections = []rejectionPattern{
+	{"insufficient fee", errInsufficientFee},
+	{"min relay fee not met", errInsufficientFee},
+	{"mempool min fee not met", errInsufficientFee},
+	{"-26: dust", errDust},
+	{"bad-txns-inputs-missingorspent", errMissingInputs},
+	{"missing-inputs", errMissingInputs},
+	{"txn-mempool-conflict", errNotReplaceable},
+	{"too many potential replacements", errTooManyReplacements},
+	{"txn-already-in-mempool", errAlreadyKnown},
+	{"txn-already-known", errAlreadyKnown},
+}
+
+// btcdRejections are the mempool rule errors of btcd, which it returns as "TX rejected: ..."
+var btcdRejections = []rejectionPattern{
+	{"has an insufficient fee rate", errInsufficientFee},
+	{"has an insufficient absolute fee", errInsufficientFee},
+	{"fees which is under the required amount", errInsufficientFee},
+	{"has insufficient priority", errInsufficientFee},
+	{"rejected by the rate limiter due to low fees", errInsufficientFee},
+	{"payment is dust", errDust},
+	{"orphan transaction", errMissingInputs},
+	{"output already spent in mempool", errNotReplaceable},
+	{"evicts more transactions than permitted", errTooManyReplacements},
+	{"already have transaction", errAlreadyKnown},
+	{"transaction already exists", errAlreadyKnown},
+}
+
+func matchRejection(err error, patterns []rejectionPattern) error {
+	if err == nil {
+		return nil
+	}
+	msg := err.Error()
+	for _, pattern := range patterns {
+		if strings.Contains(msg, pattern.text) {
+			return &rejectionError{reason: pattern.reason, err: err}
+		}
+	}
+	return err
+}
+
+// bitcoindRejection maps an error of Bitcoin Core to its reason
+func bitcoindRejection(err error) error {
+	return matchRejection(err, bitcoindRejections)
+}
+
+// btcdRejection maps an error of btcd to its reason. btcd reports a transaction it
+// already has with its own code rather than a reject reason.
+func btcdRejection(err error) error {
+	var rpcErr *btcjson.RPCError
+	if errors.As(err, &rpcErr) && rpcErr.Code == btcjson.ErrRPCTxAlreadyInChain {
+		return &rejectionError{reason: errAlreadyKnown, err: err}
+	}
+	return matchRejection(err, btcdRejections)
+}
+
+// rejectionCause returns the reason behind err. Errors that went through fmt.Errorf with %v
+// lost their type, so they are matched again by their message.
+func rejectionCause(err error) error {
+	var rejection *rejectionError
+	if errors.As(err, &rejection) {
+		return rejection.reason
+	}
+	if errors.Is(err, errNotEnoughFunds) || strings.Contains(err.Error(), errNotEnoughFunds.Error()) {
+		return errNotEnoughFunds
+	}
+
+	for _, patterns := range [][]rejectionPattern{bitcoindRejections, btcdRejections} {
+		if errors.As(matchRejection(err, patterns), &rejection) {
+			return rejection.reason
+		}
+	}
+	return nil
+}
+
+// conflictRejection tells if a transaction was refused in favour of a conflicting one in the mempool
+func conflictRejection(err error) bool {
+	switch rejectionCause(err) {
+	case errInsufficientFee, errNotReplaceable, errTooManyReplacements:
+		return true
+	}
+	return false
+}
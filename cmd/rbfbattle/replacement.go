@@ -0,0 +1,360 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math"
+	"slices"
+	"sort"
+
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/rpcclient"
+)
+
+const (
+	// Bitcoin Core replaces the fee rate rule of BIP125 with a feerate diagram comparison
+	// over clusters from this version. Rules 3 and 4 still apply
+	clusterMempoolVersion = 310000
+
+	// Clusters are limited to 64 transactions
+	maxClusterCount = 64
+)
+
+// ReplacementPolicy computes the cheapest replacement the node will accept
+type ReplacementPolicy interface {
+	// MinReplacementFee returns the smallest fee our replacement of vsize vbytes spending utxo
+	// must pay to evict the conflict
+	MinReplacementFee(conflict *Conflict, utxo *TrackedUTXO, vsize int32) (btcutil.Amount, error)
+}
+
+// replacementPolicy is the replacement policy of our node
+var replacementPolicy ReplacementPolicy = bip125Policy{}
+
+// detectReplacementPolicy picks the replacement policy from the node version. The cluster
+// policy walks the mempool with batch unless it is nil.
+func detectReplacementPolicy(client *rpcclient.Client, batch *rpcBatch) ReplacementPolicy {
+	info, err := client.GetNetworkInfo()
+	if err != nil {
+		slog.Warn("Failed to get network info, assuming BIP125 replacement rules", "err", err)
+		return bip125Policy{}
+	}
+
+	if info.Version >= clusterMempoolVersion {
+		slog.Info("Node uses cluster mempool, evaluating replacements by feerate diagram", "version", info.SubVersion)
+		return &clusterPolicy{client: client, batch: batch}
+	}
+
+	slog.Info("Node uses BIP125 replacement rules", "version", info.SubVersion)
+	return bip125Policy{}
+}
+
+// bip125Policy requires the replacement to pay more than everything it evicts (rule 3)
+// plus its own relay at the incremental relay fee rate (rule 4)
+type bip125Policy struct{}
+
+func (bip125Policy) MinReplacementFee(conflict *Conflict, utxo *TrackedUTXO, vsize int32) (btcutil.Amount, error) {
+	return conflict.Fee + btcutil.Amount(math.Ceil(incrementalRelayFeeRate*float64(vsize))), nil
+}
+
+// clusterPolicy accepts a replacement if it improves the feerate diagram of the affected clusters
+// and pays for everything it evicts plus its own relay like under BIP125
+type clusterPolicy struct {
+	client *rpcclient.Client
+	batch  *rpcBatch
+}
+
+func (p *clusterPolicy) MinReplacementFee(conflict *Conflict, utxo *TrackedUTXO, vsize int32) (btcutil.Amount, error) {
+	cluster, err := p.loadCluster(conflict.TxID)
+	if err != nil {
+		// The conflict may only be in the mempool of a peer, which reported its fee and vsize
+		slog.Warn("Failed to load the cluster of the conflict, falling back to BIP125 rules", "txid", conflict.TxID, "err", err)
+		return bip125Policy{}.MinReplacementFee(conflict, utxo, vsize)
+	}
+
+	evicted := cluster.descendantsOf(conflict.TxID)
+
+	var parents []string
+	if _, ok := cluster[utxo.TxID]; ok && !evicted[utxo.TxID] {
+		parents = append(parents, utxo.TxID)
+	}
+
+	fee, ok := cheapestDiagramReplacement(cluster, evicted, parents, int64(vsize))
+	if !ok {
+		return 0, fmt.Errorf("no replacement improves the feerate diagram of the cluster of %s", conflict.TxID)
+	}
+	return fee, nil
+}
+
+type mempoolEntry struct {
+	VSize int64 `json:"vsize"`
+	Fees  struct {
+		Base float64 `json:"base"`
+	} `json:"fees"`
+	Depends []string `json:"depends"`
+	SpentBy []string `json:"spentby"`
+}
+
+// loadCluster walks the in-mempool parents and children of txid. Each step of the walk asks
+// for the entries it reached in one batch.
+func (p *clusterPolicy) loadCluster(txid string) (cluster, error) {
+	c := make(cluster)
+	queue := []string{txid}
+
+	for len(queue) > 0 && len(c) < maxClusterCount {
+		var ids []string
+		for _, id := range queue {
+			if _, ok := c[id]; !ok && !slices.Contains(ids, id) && len(c)+len(ids) < maxClusterCount {
+				ids = append(ids, id)
+			}
+		}
+		queue = nil
+
+		entries, err := p.mempoolEntries(ids)
+		if err != nil {
+			return nil, err
+		}
+
+		for i, entry := range entries {
+			fee, _ := btcutil.NewAmount(entry.Fees.Base)
+			c[ids[i]] = &clusterTx{fee: fee, vsize: entry.VSize, parents: entry.Depends}
+
+			queue = append(queue, entry.Depends...)
+			queue = append(queue, entry.SpentBy...)
+		}
+	}
+
+	return c, nil
+}
+
+// mempoolEntries looks up the mempool entries of txids, in one request when batching
+func (p *clusterPolicy) mempoolEntries(txids []string) ([]mempoolEntry, error) {
+	results := make([]json.RawMessage, len(txids))
+	errs := make([]error, len(txids))
+
+	if p.batch.batching() {
+		p.batch.mu.Lock()
+		futures := make([]rpcclient.FutureRawResult, len(txids))
+		for i, txid := range txids {
+			param, _ := json.Marshal(txid)
+			futures[i] = p.batch.client.RawRequestAsync("getmempoolentry", []json.RawMessage{param})
+		}
+		err := p.batch.client.Send()
+		p.batch.mu.Unlock()
+		if err != nil {
+			return nil, fmt.Errorf("error getting mempool entries: %v", err)
+		}
+
+		for i, future := range futures {
+			results[i], errs[i] = future.Receive()
+		}
+	} else {
+		for i, txid := range txids {
+			param, _ := json.Marshal(txid)
+			results[i], errs[i] = p.client.RawRequest("getmempoolentry", []json.RawMessage{param})
+		}
+	}
+
+	entries := make([]mempoolEntry, len(txids))
+	for i, txid := range txids {
+		if errs[i] != nil {
+			return nil, fmt.Errorf("error getting mempool entry for %s: %v", txid, errs[i])
+		}
+		if err := json.Unmarshal(results[i], &entries[i]); err != nil {
+			return nil, fmt.Errorf("error parsing mempool entry for %s: %v", txid, err)
+		}
+	}
+	return entries, nil
+}
+
+type clusterTx struct {
+	fee     btcutil.Amount
+	vsize   int64
+	parents []string
+}
+
+// cluster is a set of connected mempool transactions by txid
+type cluster map[string]*clusterTx
+
+// descendantsOf returns txid and all its in-cluster descendants
+func (c cluster) descendantsOf(txid string) map[string]bool {
+	descendants := map[string]bool{txid: true}
+
+	for changed := true; changed; {
+		changed = false
+		for id, tx := range c {
+			if descendants[id] {
+				continue
+			}
+			for _, parent := range tx.parents {
+				if descendants[parent] {
+					descendants[id] = true
+					changed = true
+					break
+				}
+			}
+		}
+	}
+	return descendants
+}
+
+type chunk struct {
+	fee   btcutil.Amount
+	vsize int64
+}
+
+func (c chunk) feeRate() float64 {
+	return float64(c.fee) / float64(c.vsize)
+}
+
+// chunks linearizes the cluster by repeatedly picking the ancestor set with the highest
+// fee rate and returns the chunks in mining order. Every chunk has a lower fee rate than
+// the one before it.
+func (c cluster) chunks() []chunk {
+	included := make(map[string]bool)
+
+	var linearization []chunk
+	for len(included) < len(c) {
+		var best []string
+		var bestChunk chunk
+
+		for id := range c {
+			if included[id] {
+				continue
+			}
+
+			ancestors := c.ancestorSet(id, included)
+			var set chunk
+			for _, ancestor := range ancestors {
+				set.fee += c[ancestor].fee
+				set.vsize += c[ancestor].vsize
+			}
+
+			if best == nil || set.feeRate() > bestChunk.feeRate() {
+				best, bestChunk = ancestors, set
+			}
+		}
+
+		for _, id := range best {
+			included[id] = true
+		}
+		linearization = append(linearization, bestChunk)
+	}
+
+	// Merge chunks so fee rates are decreasing
+	var chunks []chunk
+	for _, next := range linearization {
+		for len(chunks) > 0 && next.feeRate() > chunks[len(chunks)-1].feeRate() {
+			last := chunks[len(chunks)-1]
+			chunks = chunks[:len(chunks)-1]
+			next = chunk{fee: last.fee + next.fee, vsize: last.vsize + next.vsize}
+		}
+		chunks = append(chunks, next)
+	}
+
+	return chunks
+}
+
+// ancestorSet returns txid and its in-cluster ancestors that are not yet included
+func (c cluster) ancestorSet(txid string, included map[string]bool) []string {
+	seen := map[string]bool{txid: true}
+	set := []string{txid}
+
+	for i := 0; i < len(set); i++ {
+		for _, parent := range c[set[i]].parents {
+			if _, inCluster := c[parent]; inCluster && !included[parent] && !seen[parent] {
+				seen[parent] = true
+				set = append(set, parent)
+			}
+		}
+	}
+
+	sort.Strings(set)
+	return set
+}
+
+// diagramFee returns the cumulative fee of the feerate diagram after vsize vbytes.
+// The diagram stays flat after the last chunk.
+func diagramFee(chunks []chunk, vsize int64) float64 {
+	var fee float64
+	for _, c := range chunks {
+		if vsize <= c.vsize {
+			return fee + float64(vsize)*c.feeRate()
+		}
+		fee += float64(c.fee)
+		vsize -= c.vsize
+	}
+	return fee
+}
+
+// improvesDiagram checks if the new feerate diagram is nowhere below the old one and above it somewhere
+func improvesDiagram(old, new []chunk) bool {
+	var points []int64
+	for _, chunks := range [][]chunk{old, new} {
+		var vsize int64
+		for _, c := range chunks {
+			vsize += c.vsize
+			points = append(points, vsize)
+		}
+	}
+
+	const epsilon = 1e-9
+	better := false
+	for _, vsize := range points {
+		oldFee, newFee := diagramFee(old, vsize), diagramFee(new, vsize)
+		if newFee < oldFee-epsilon {
+			return false
+		}
+		if newFee > oldFee+epsilon {
+			better = true
+		}
+	}
+	return better
+}
+
+// cheapestDiagramReplacement finds the smallest fee for a transaction of vsize vbytes with
+// the given in-cluster parents that improves the feerate diagram when it evicts the
+// evicted transactions from the cluster. The fee also covers the evicted fees and our
+// own relay at the incremental relay fee rate, as BIP125 rules 3 and 4 still apply.
+func cheapestDiagramReplacement(c cluster, evicted map[string]bool, parents []string, vsize int64) (btcutil.Amount, bool) {
+	old := c.chunks()
+
+	replaced := make(cluster)
+	var total, evictedFees btcutil.Amount
+	for id, tx := range c {
+		total += tx.fee
+		if evicted[id] {
+			evictedFees += tx.fee
+		} else {
+			replaced[id] = tx
+		}
+	}
+
+	const ours = "replacement"
+	improves := func(fee btcutil.Amount) bool {
+		replaced[ours] = &clusterTx{fee: fee, vsize: vsize, parents: parents}
+		return improvesDiagram(old, replaced.chunks())
+	}
+
+	// Paying for the whole cluster and our own relay nearly always improves the diagram,
+	// so search below that and above the BIP125 minimum.
+	relayFee := btcutil.Amount(math.Ceil(incrementalRelayFeeRate * float64(vsize)))
+	minFee := evictedFees + relayFee
+	maxFee := total + relayFee
+	for !improves(maxFee) {
+		if maxFee > btcutil.MaxSatoshi {
+			return 0, false
+		}
+		maxFee *= 2
+	}
+
+	for minFee < maxFee {
+		fee := (minFee + maxFee) / 2
+		if improves(fee) {
+			maxFee = fee
+		} else {
+			minFee = fee + 1
+		}
+	}
+	return maxFee, true
+}
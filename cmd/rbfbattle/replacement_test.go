@@ -0,0 +1,172 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/btcsuite/btcd/btcec/v2"
+	"github.com/btcsuite/btcd/btcjson"
+	"github.com/btcsuite/btcd/rpcclient"
+	"github.com/btcsuite/btcd/wire"
+)
+
+func TestCheapestDiagramReplacement(t *testing.T) {
+	// A single conflict is matched on fee rate
+	c := cluster{"conflict": {fee: 1000, vsize: 200}}
+	fee, ok := cheapestDiagramReplacement(c, c.descendantsOf("conflict"), nil, 250)
+	if !ok || fee != 1250 {
+		t.Errorf("expected a replacement fee of 1250, received %d", fee)
+	}
+
+	// A large low fee rate descendant would improve the diagram with its fee covered, but
+	// rules 3 and 4 still require paying for everything evicted plus our own relay
+	c = cluster{
+		"conflict": {fee: 1000, vsize: 200},
+		"child":    {fee: 100, vsize: 1000, parents: []string{"conflict"}},
+	}
+	fee, ok = cheapestDiagramReplacement(c, c.descendantsOf("conflict"), nil, 100)
+	bip125Fee, _ := bip125Policy{}.MinReplacementFee(&Conflict{Fee: 1100}, nil, 100)
+	if !ok || fee != bip125Fee {
+		t.Errorf("expected the BIP125 replacement fee of %d, received %d", bip125Fee, fee)
+	}
+
+	// A small high fee rate conflict is matched on fee rate, above the BIP125 minimum
+	c = cluster{"conflict": {fee: 1000, vsize: 100}}
+	fee, ok = cheapestDiagramReplacement(c, c.descendantsOf("conflict"), nil, 300)
+	if !ok || fee != 3000 {
+		t.Errorf("expected a replacement fee of 3000, received %d", fee)
+	}
+}
+
+func TestImprovesDiagram(t *testing.T) {
+	old := []chunk{{fee: 1000, vsize: 200}, {fee: 100, vsize: 1000}}
+
+	if improvesDiagram(old, old) {
+		t.Errorf("an equal diagram is not an improvement")
+	}
+	if !improvesDiagram(old, []chunk{{fee: 1200, vsize: 200}}) {
+		t.Errorf("a higher fee rate for the first chunk should improve the diagram")
+	}
+	if improvesDiagram(old, []chunk{{fee: 5000, vsize: 2000}}) {
+		t.Errorf("a lower fee rate at the start should not improve the diagram")
+	}
+}
+
+func TestClusterPolicy(t *testing.T) {
+	entries := map[string]mempoolEntry{
+		"parent":   {VSize: 100, SpentBy: []string{"conflict"}},
+		"conflict": {VSize: 200, Depends: []string{"parent"}, SpentBy: []string{"child"}},
+		"child":    {VSize: 1000, Depends: []string{"conflict"}},
+	}
+	fees := map[string]float64{"parent": 0, "conflict": 0.00001, "child": 0.000001}
+
+	_, client := newRPCStandIn(t, map[string]rpcHandler{
+		"getnetworkinfo": func([]json.RawMessage) (any, *btcjson.RPCError) {
+			return map[string]any{"version": clusterMempoolVersion, "subversion": "/Satoshi:31.0.0/"}, nil
+		},
+		"getmempoolentry": func(params []json.RawMessage) (any, *btcjson.RPCError) {
+			var txid string
+			json.Unmarshal(params[0], &txid)
+			entry, ok := entries[txid]
+			if !ok {
+				return nil, btcjson.NewRPCError(btcjson.ErrRPCInvalidAddressOrKey, "Transaction not in mempool")
+			}
+			entry.Fees.Base = fees[txid]
+			return entry, nil
+		},
+	})
+
+	policy, ok := detectReplacementPolicy(client, nil).(*clusterPolicy)
+	if !ok {
+		t.Fatalf("expected the cluster policy for a cluster mempool node")
+	}
+
+	c, err := policy.loadCluster("conflict")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(c) != 3 {
+		t.Fatalf("expected a cluster of 3 transactions, received %d", len(c))
+	}
+
+	// Our replacement keeps the parent and evicts the conflict and its child
+	fee, err := policy.MinReplacementFee(&Conflict{TxID: "conflict"}, &TrackedUTXO{TxID: "parent"}, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fee != 1200 {
+		t.Errorf("expected a replacement fee of 1200, received %d", fee)
+	}
+
+	// A conflict only a peer has falls back to BIP125 with the fee the peer reported
+	conflict := &Conflict{TxID: "elsewhere", Fee: 1000}
+	fee, err = policy.MinReplacementFee(conflict, &TrackedUTXO{TxID: "parent"}, 100)
+	bip125Fee, _ := bip125Policy{}.MinReplacementFee(conflict, nil, 100)
+	if err != nil || fee != bip125Fee {
+		t.Errorf("expected the BIP125 replacement fee of %d, received %d (%v)", bip125Fee, fee, err)
+	}
+}
+
+func TestLoadClusterBatched(t *testing.T) {
+	node, err := newMockNode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer node.Close()
+
+	// Count the requests reaching the node
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		node.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+
+	batch, err := rpcclient.NewBatch(&rpcclient.ConnConfig{
+		Host:         strings.TrimPrefix(server.URL, "http://"),
+		User:         "mock",
+		Pass:         "mock",
+		HTTPPostMode: true,
+		DisableTLS:   true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer batch.Shutdown()
+
+	// A chain of three transactions, the conflict in the middle
+	key, _ := btcec.NewPrivateKey()
+	outpoint := node.Fund(p2wpkhScript(key), 100_000)
+	prev := wire.NewTxOut(100_000, p2wpkhScript(key))
+	var chain []*wire.MsgTx
+	for range 3 {
+		tx := wire.NewMsgTx(2)
+		tx.AddTxIn(wire.NewTxIn(&outpoint, nil, nil))
+		tx.AddTxOut(wire.NewTxOut(prev.Value-1000, p2wpkhScript(key)))
+		if err := signCoins(tx, []Coin{{OutPoint: outpoint, Output: prev, Key: key}}); err != nil {
+			t.Fatal(err)
+		}
+		if err := node.Submit(tx); err != nil {
+			t.Fatal(err)
+		}
+		chain = append(chain, tx)
+		outpoint, prev = wire.OutPoint{Hash: tx.TxHash()}, tx.TxOut[0]
+	}
+
+	policy := &clusterPolicy{batch: &rpcBatch{client: batch}}
+	c, err := policy.loadCluster(chain[1].TxHash().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(c) != 3 {
+		t.Fatalf("expected a cluster of 3 transactions, received %d", len(c))
+	}
+	// The conflict, then its parent and child together
+	if requests.Load() != 2 {
+		t.Errorf("expected the walk in 2 requests, got %d", requests.Load())
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/btcsuite/btcd/btcjson"
+	"github.com/btcsuite/btcd/rpcclient"
+)
+
+// rpcHandler answers a JSON-RPC call with a result or an error
+type rpcHandler func(params []json.RawMessage) (any, *btcjson.RPCError)
+
+// rpcStandIn is a JSON-RPC server answering calls with handlers and recording them
+type rpcStandIn struct {
+	mu       sync.Mutex
+	handlers map[string]rpcHandler
+	calls    map[string][][]json.RawMessage
+}
+
+// newRPCStandIn starts an RPC stand-in and returns a client connected to it
+func newRPCStandIn(t *testing.T, handlers map[string]rpcHandler) (*rpcStandIn, *rpcclient.Client) {
+	s := &rpcStandIn{
+		handlers: map[string]rpcHandler{
+			"getinfo": func([]json.RawMessage) (any, *btcjson.RPCError) {
+				return nil, btcjson.NewRPCError(btcjson.ErrRPCMethodNotFound.Code, "Method not found")
+			},
+			"getnetworkinfo": func([]json.RawMessage) (any, *btcjson.RPCError) {
+				return map[string]any{"version": 280000, "subversion": "/Satoshi:28.0.0/"}, nil
+			},
+		},
+		calls: make(map[string][][]json.RawMessage),
+	}
+	for method, handler := range handlers {
+		s.handlers[method] = handler
+	}
+
+	server := httptest.NewServer(s)
+	t.Cleanup(server.Close)
+
+	client, err := rpcclient.New(&rpcclient.ConnConfig{
+		Host:         strings.TrimPrefix(server.URL, "http://"),
+		User:         "user",
+		Pass:         "pass",
+		HTTPPostMode: true,
+		DisableTLS:   true,
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(client.Shutdown)
+
+	return s, client
+}
+
+type rpcRequest struct {
+	ID     json.RawMessage   `json:"id"`
+	Method string            `json:"method"`
+	Params []json.RawMessage `json:"params"`
+}
+
+type rpcResponse struct {
+	ID     json.RawMessage   `json:"id"`
+	Result any               `json:"result"`
+	Error  *btcjson.RPCError `json:"error"`
+}
+
+func (s *rpcStandIn) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var req rpcRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	s.mu.Lock()
+	s.calls[req.Method] = append(s.calls[req.Method], req.Params)
+	handler, ok := s.handlers[req.Method]
+	s.mu.Unlock()
+
+	res := rpcResponse{ID: req.ID}
+	if ok {
+		res.Result, res.Error = handler(req.Params)
+	} else {
+		res.Error = btcjson.NewRPCError(btcjson.ErrRPCMethodNotFound.Code, "Method not found")
+	}
+
+	json.NewEncoder(w).Encode(res)
+}
+
+// Calls returns the parameters of every call to method
+func (s *rpcStandIn) Calls(method string) [][]json.RawMessage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.calls[method]
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/btcsuite/btcd/btcjson"
+	"github.com/btcsuite/btcd/rpcclient"
+	"github.com/btcsuite/btcd/wire"
+)
+
+// rpcBatch runs the independent lookups of a reaction concurrently and sends the lookups of
+// the same kind to the node in a single JSON-RPC batch. A nil rpcBatch, as with norpcbatch,
+// makes every call wait for the previous one.
+type rpcBatch struct {
+	// client sends the calls queued on it to the node in one request with Send. The calls
+	// queued by concurrent users would end up in the same batch, so mu is held from the
+	// first call to Send. Without a client the lookups only run concurrently.
+	client *rpcclient.Client
+	mu     sync.Mutex
+}
+
+// batching reports whether calls can be sent to the node in one batch
+func (batch *rpcBatch) batching() bool {
+	return batch != nil && batch.client != nil
+}
+
+// concurrently runs fns at the same time and waits for them, or one after another when batching is off
+func (batch *rpcBatch) concurrently(fns ...func()) {
+	if batch == nil {
+		for _, fn := range fns {
+			fn()
+		}
+		return
+	}
+
+	var wg sync.WaitGroup
+	for _, fn := range fns {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			fn()
+		}()
+	}
+	wg.Wait()
+}
+
+// lookupReaction looks up the counterpart in our mempool and reserves the wallet coin funding the
+// replacement. The node is asked for both in one batch, other backends concurrently.
+func lookupReaction(client *rpcclient.Client, backend ChainBackend, batch *rpcBatch, peers peerSet, counterpart *btcjson.TxRawResult, utxo *TrackedUTXO) (conflict *Conflict, funding btcjson.ListUnspentResult, conflictErr, fundingErr error) {
+	utxo.mu.Lock()
+	reserved := utxo.Funding != nil
+	utxo.mu.Unlock()
+
+	if _, ok := backend.(*bitcoindBackend); !ok || !batch.batching() || reserved {
+		batch.concurrently(
+			func() { conflict, conflictErr = getConflict(backend, peers, counterpart, utxo) },
+			func() { funding, fundingErr = reserveFunding(client, utxo) },
+		)
+		return
+	}
+
+	batch.mu.Lock()
+	entryFuture := batch.client.GetMempoolEntryAsync(counterpart.Txid)
+	unspentFuture := batch.client.ListUnspentMinAsync(1)
+	err := batch.client.Send()
+	batch.mu.Unlock()
+	if err != nil {
+		return nil, btcjson.ListUnspentResult{}, err, err
+	}
+
+	var mempool *mempoolSummary
+	entry, err := entryFuture.Receive()
+	if err == nil {
+		mempool, err = summarizeMempoolEntry(entry)
+	}
+	conflict, conflictErr = newConflict(peers, counterpart, utxo, mempool, err)
+
+	unspent, err := unspentFuture.Receive()
+	if err != nil {
+		return conflict, btcjson.ListUnspentResult{}, conflictErr, err
+	}
+	funding, fundingErr = reserveFundingFrom(client, utxo, unspent)
+	return
+}
+
+// fetchPrevOuts looks up the outputs spent by outpoints. The node is asked in one batch,
+// other backends concurrently.
+func fetchPrevOuts(backend ChainBackend, batch *rpcBatch, outpoints []wire.OutPoint) ([]*wire.TxOut, error) {
+	if len(outpoints) == 0 {
+		return nil, nil
+	}
+
+	if _, ok := backend.(*bitcoindBackend); ok && batch.batching() {
+		return batch.prevOuts(outpoints)
+	}
+
+	prevOuts := make([]*wire.TxOut, len(outpoints))
+	errs := make([]error, len(outpoints))
+	fns := make([]func(), len(outpoints))
+	for i, outpoint := range outpoints {
+		fns[i] = func() { prevOuts[i], errs[i] = backend.PrevOut(outpoint) }
+	}
+	batch.concurrently(fns...)
+
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+	return prevOuts, nil
+}
+
+// prevOuts looks up the transactions of outpoints in a single request to the node
+func (batch *rpcBatch) prevOuts(outpoints []wire.OutPoint) ([]*wire.TxOut, error) {
+	batch.mu.Lock()
+	futures := make([]rpcclient.FutureGetRawTransactionVerboseResult, len(outpoints))
+	for i := range outpoints {
+		futures[i] = batch.client.GetRawTransactionVerboseAsync(&outpoints[i].Hash)
+	}
+	err := batch.client.Send()
+	batch.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	prevOuts := make([]*wire.TxOut, len(outpoints))
+	for i, future := range futures {
+		tx, err := future.Receive()
+		if err != nil {
+			return nil, err
+		}
+		if int(outpoints[i].Index) >= len(tx.Vout) {
+			return nil, fmt.Errorf("transaction %s has no output %d", outpoints[i].Hash, outpoints[i].Index)
+		}
+		if prevOuts[i], err = txOutFromResult(tx.Vout[outpoints[i].Index]); err != nil {
+			return nil, err
+		}
+	}
+	return prevOuts, nil
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/btcec/v2"
+	"github.com/btcsuite/btcd/btcjson"
+	"github.com/btcsuite/btcd/rpcclient"
+	"github.com/btcsuite/btcd/wire"
+)
+
+func TestFetchPrevOuts(t *testing.T) {
+	node, err := newMockNode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer node.Close()
+
+	// Count the requests reaching the node
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		node.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+
+	batch, err := rpcclient.NewBatch(&rpcclient.ConnConfig{
+		Host:         strings.TrimPrefix(server.URL, "http://"),
+		User:         "mock",
+		Pass:         "mock",
+		HTTPPostMode: true,
+		DisableTLS:   true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer batch.Shutdown()
+	client, err := node.Client()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Shutdown()
+
+	backend := &bitcoindBackend{client: client}
+	batching := &rpcBatch{client: batch}
+	outpoints := []wire.OutPoint{node.Fund(node.NewWalletScript(), 1000), node.Fund(node.NewWalletScript(), 2000)}
+	prevOuts, err := fetchPrevOuts(backend, batching, outpoints)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(prevOuts) != 2 || prevOuts[0].Value != 1000 || prevOuts[1].Value != 2000 {
+		t.Errorf("expected outputs of 1000 and 2000 sats, got %+v", prevOuts)
+	}
+	if requests.Load() != 1 {
+		t.Errorf("expected a single request, got %d", requests.Load())
+	}
+
+	if _, err := fetchPrevOuts(backend, batching, []wire.OutPoint{{Index: 1}}); err == nil {
+		t.Error("expected an unknown transaction to fail")
+	}
+}
+
+// BenchmarkReaction measures the time from a counterpart showing up to our replacement being
+// broadcast, against a node answering every request after benchmarkLatency. Compare the
+// sequential and batched runs to see what batching and concurrent lookups save.
+func BenchmarkReaction(b *testing.B) {
+	const benchmarkLatency = 5 * time.Millisecond
+
+	bt := startBattle(b)
+	client, err := bt.node.Client()
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer client.Shutdown()
+
+	bt.node.mu.Lock()
+	bt.node.Latency = benchmarkLatency
+	bt.node.mu.Unlock()
+	defer func() {
+		bt.node.mu.Lock()
+		bt.node.Latency = 0
+		bt.node.mu.Unlock()
+	}()
+
+	for _, batching := range []bool{false, true} {
+		name := "sequential"
+		if batching {
+			name = "batched"
+		}
+
+		// The bot keeps its own config. The reactions are ours, on keys the bot doesn't watch
+		config := *bt.config
+		if !batching {
+			config.batch = nil
+		}
+
+		b.Run(name, func(b *testing.B) {
+			var total time.Duration
+			for range b.N {
+				bt.node.FundWallet(btc(0.01))
+				key, _ := btcec.NewPrivateKey()
+				funding := bt.send(b, p2wpkhScript(key), 100_000)
+				outpoint := wire.OutPoint{Hash: funding.TxHash(), Index: 0}
+
+				counterpart := spendP2WPKH(b, key, outpoint, funding.TxOut[0], 5_000)
+				if err := bt.node.Submit(counterpart); err != nil {
+					b.Fatalf("counterpart rejected: %v", err)
+				}
+				counterpartHash := counterpart.TxHash()
+				counterpartResult, err := client.GetRawTransactionVerbose(&counterpartHash)
+				if err != nil {
+					b.Fatal(err)
+				}
+
+				utxo := &TrackedUTXO{
+					TxID:        outpoint.Hash.String(),
+					N:           outpoint.Index,
+					Amount:      100_000,
+					Script:      btcjson.ScriptPubKeyResult{Hex: hex.EncodeToString(funding.TxOut[0].PkScript)},
+					Destination: bt.destination,
+					ID:          newBattleID(),
+				}
+				utxo.setState(stateContested)
+
+				started := time.Now()
+				replaceCounterpart(client, feeStrategy, counterpartResult, utxo, hex.EncodeToString(key.Serialize()), &config)
+				total += time.Since(started)
+
+				if utxo.State() != stateReplaced {
+					b.Fatalf("expected the counterpart to be replaced, battle is %s", utxo.State())
+				}
+				releaseFunding(utxo)
+				bt.node.MineBlock()
+			}
+			b.ReportMetric(float64(total.Microseconds())/1000/float64(b.N), "ms/reaction")
+		})
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"time"
+)
+
+// rpcObserver is called with every JSON-RPC exchange passing through the RPC proxy
+type rpcObserver func(path string, reqBody, resBody []byte, elapsed time.Duration)
+
+// startRPCProxy starts an HTTP proxy to the RPC server at target passing every call
+// through transport, or straight to the server when it is nil, and to the observers.
+// It returns the host of the proxy.
+func startRPCProxy(target string, transport http.RoundTripper, observers ...rpcObserver) (string, error) {
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", fmt.Errorf("error starting RPC proxy: %v", err)
+	}
+
+	go http.Serve(listener, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, err := io.ReadAll(req.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		forward, err := http.NewRequestWithContext(req.Context(), req.Method, "http://"+target+req.URL.Path, bytes.NewReader(body))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		forward.Header = req.Header.Clone()
+
+		start := time.Now()
+		res, err := transport.RoundTrip(forward)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		defer res.Body.Close()
+
+		resBody, err := io.ReadAll(res.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		elapsed := time.Since(start)
+
+		for _, observe := range observers {
+			observe(req.URL.Path, body, resBody, elapsed)
+		}
+
+		for key, values := range res.Header {
+			w.Header()[key] = values
+		}
+		w.WriteHeader(res.StatusCode)
+		w.Write(resBody)
+	}))
+
+	return listener.Addr().String(), nil
+}
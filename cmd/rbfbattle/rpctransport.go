@@ -0,0 +1,356 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/btcsuite/btcd/btcjson"
+)
+
+const (
+	// rpcMaxAttempts bounds the attempts of an idempotent call
+	rpcMaxAttempts  = 5
+	rpcRetryBackoff = 250 * time.Millisecond
+	rpcMaxBackoff   = 4 * time.Second
+
+	// After rpcBreakerThreshold failures in a row calls fail right away for rpcBreakerCooldown,
+	// so a battle isn't held up by a node that is down
+	rpcBreakerThreshold = 5
+	rpcBreakerCooldown  = 10 * time.Second
+
+	// rpcInWarmup is the error of a node that is still starting
+	rpcInWarmup = -28
+)
+
+// jsonRPCRequest is a JSON-RPC call as it goes over the wire
+type jsonRPCRequest struct {
+	ID     json.RawMessage   `json:"id"`
+	Method string            `json:"method"`
+	Params []json.RawMessage `json:"params"`
+}
+
+// jsonRPCResponse is the answer to a jsonRPCRequest
+type jsonRPCResponse struct {
+	ID     json.RawMessage   `json:"id"`
+	Result any               `json:"result"`
+	Error  *btcjson.RPCError `json:"error"`
+}
+
+// rpcTimeouts are the calls a healthy node answers right away, so a hung node is noticed
+// before a battle is lost. Other calls time out after rpctimeout.
+var rpcTimeouts = map[string]time.Duration{
+	"decoderawtransaction": 5 * time.Second,
+	"estimatesmartfee":     5 * time.Second,
+	"getblockcount":        5 * time.Second,
+	"getmempoolentry":      5 * time.Second,
+	"getnetworkinfo":       5 * time.Second,
+	"getrawtransaction":    5 * time.Second,
+	"gettxout":             5 * time.Second,
+	"sendrawtransaction":   10 * time.Second,
+	"submitpackage":        10 * time.Second,
+	"testmempoolaccept":    10 * time.Second,
+}
+
+// rpcIdempotent are the calls that can be repeated without effect. Only these are retried,
+// as a call that timed out may still have been carried out.
+var rpcIdempotent = map[string]bool{
+	"decoderawtransaction": true,
+	"decodepsbt":           true,
+	"deriveaddresses":      true,
+	"estimatesmartfee":     true,
+	"getaddressinfo":       true,
+	"getbestblockhash":     true,
+	"getblock":             true,
+	"getblockchaininfo":    true,
+	"getblockcount":        true,
+	"getblockhash":         true,
+	"getblockheader":       true,
+	"getdescriptorinfo":    true,
+	"getmempoolentry":      true,
+	"getmempoolinfo":       true,
+	"getnetworkinfo":       true,
+	"getrawmempool":        true,
+	"getrawtransaction":    true,
+	"gettxout":             true,
+	"getwalletinfo":        true,
+	"listunspent":          true,
+	"listwallets":          true,
+	"testmempoolaccept":    true,
+}
+
+// errRPCUnauthorized is returned when the node refuses our credentials, even after reading the cookie again
+var errRPCUnauthorized = errors.New("the node rejected the RPC credentials")
+
+// rpcTransport forwards the calls of the RPC proxy to the node with per-method timeouts,
+// retries idempotent calls while the node is unreachable or starting, and stops calling a
+// node that keeps failing for a while. A restarted node writes a new cookie, which is read
+// again when the node answers 401.
+type rpcTransport struct {
+	// localAuth is the Authorization header the clients of the proxy must send
+	localAuth  string
+	localUser  string
+	localPass  string
+	timeout    time.Duration
+	user, pass string
+	cookiePath string
+
+	mu       sync.Mutex
+	auth     string
+	failures int
+	// openUntil is when the circuit breaker lets calls through again
+	openUntil time.Time
+	lastErr   error
+}
+
+// newRPCTransport creates a transport authenticating with user and pass, or with the cookie
+// when no password is given. Clients of the proxy use localUser and localPass.
+func newRPCTransport(user, pass, cookiePath string, timeout time.Duration) (*rpcTransport, error) {
+	secret := make([]byte, 16)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, err
+	}
+
+	t := &rpcTransport{
+		localUser:  "rbfbattle",
+		localPass:  hex.EncodeToString(secret),
+		timeout:    timeout,
+		user:       user,
+		pass:       pass,
+		cookiePath: cookiePath,
+	}
+	t.localAuth = basicAuth(t.localUser, t.localPass)
+
+	if pass != "" {
+		t.auth = basicAuth(user, pass)
+	} else if err := t.readCookie(); err != nil {
+		// The node may not have written it yet, it's read again on the first 401
+		slog.Warn("Error reading RPC cookie", "path", cookiePath, "err", err)
+	}
+	return t, nil
+}
+
+func basicAuth(user, pass string) string {
+	return "Basic " + base64.StdEncoding.EncodeToString([]byte(user+":"+pass))
+}
+
+// readCookie reads the credentials the node wrote to its cookie file
+func (t *rpcTransport) readCookie() error {
+	data, err := os.ReadFile(t.cookiePath)
+	if err != nil {
+		return err
+	}
+	user, pass, ok := strings.Cut(strings.TrimSpace(string(data)), ":")
+	if !ok {
+		return fmt.Errorf("invalid cookie in %s", t.cookiePath)
+	}
+
+	t.mu.Lock()
+	t.auth = basicAuth(user, pass)
+	t.mu.Unlock()
+	return nil
+}
+
+func (t *rpcTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Header.Get("Authorization") != t.localAuth {
+		return proxyResponse(req, http.StatusUnauthorized, nil), nil
+	}
+
+	body, err := io.ReadAll(req.Body)
+	if err != nil {
+		return nil, err
+	}
+	calls := parseRPCCalls(body)
+
+	if err := t.breakerOpen(); err != nil {
+		return rpcErrorResponse(req, calls, err), nil
+	}
+
+	attempts, timeout := 1, t.timeout
+	if callsIdempotent(calls) {
+		attempts = rpcMaxAttempts
+	}
+	if len(calls) == 1 {
+		if methodTimeout, ok := rpcTimeouts[calls[0].Method]; ok {
+			timeout = methodTimeout
+		}
+	}
+
+	reloadedCookie := false
+	for attempt := 1; ; attempt++ {
+		res, resBody, err := t.forward(req, body, timeout)
+		if err == nil && res.StatusCode == http.StatusUnauthorized {
+			// A restarted node has a new cookie
+			if t.pass == "" && !reloadedCookie {
+				reloadedCookie = true
+				if err := t.readCookie(); err == nil {
+					attempt--
+					continue
+				}
+			}
+			return rpcErrorResponse(req, calls, errRPCUnauthorized), nil
+		}
+
+		if err == nil && !nodeUnavailable(res.StatusCode, resBody) {
+			t.recordSuccess()
+			res.Body = io.NopCloser(bytes.NewReader(resBody))
+			return res, nil
+		}
+		if err == nil {
+			err = fmt.Errorf("node unavailable: %s: %s", res.Status, strings.TrimSpace(string(resBody)))
+		}
+		t.recordFailure(err)
+
+		if attempt >= attempts || t.breakerOpen() != nil {
+			return rpcErrorResponse(req, calls, err), nil
+		}
+
+		backoff := min(rpcRetryBackoff<<(attempt-1), rpcMaxBackoff)
+		slog.Debug("Retrying RPC call", "method", calls[0].Method, "attempt", attempt, "backoff", backoff, "err", err)
+		select {
+		case <-time.After(backoff):
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		}
+	}
+}
+
+// forward makes one attempt of the call, cancelled after timeout or with the request
+func (t *rpcTransport) forward(req *http.Request, body []byte, timeout time.Duration) (*http.Response, []byte, error) {
+	ctx, cancel := context.WithTimeout(req.Context(), timeout)
+	defer cancel()
+
+	forward := req.Clone(ctx)
+	forward.Body = io.NopCloser(bytes.NewReader(body))
+	forward.ContentLength = int64(len(body))
+	t.mu.Lock()
+	forward.Header.Set("Authorization", t.auth)
+	t.mu.Unlock()
+
+	res, err := http.DefaultTransport.RoundTrip(forward)
+	if err != nil {
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return nil, nil, fmt.Errorf("no answer from the node within %s", timeout)
+		}
+		return nil, nil, err
+	}
+	defer res.Body.Close()
+
+	resBody, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+	return res, resBody, nil
+}
+
+// nodeUnavailable tells if a response means the node couldn't handle the call at all
+func nodeUnavailable(status int, body []byte) bool {
+	if status == http.StatusServiceUnavailable {
+		// The work queue of the node is full
+		return true
+	}
+
+	var res struct {
+		Error *btcjson.RPCError `json:"error"`
+	}
+	return json.Unmarshal(body, &res) == nil && res.Error != nil && res.Error.Code == rpcInWarmup
+}
+
+func (t *rpcTransport) breakerOpen() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if time.Now().Before(t.openUntil) {
+		return fmt.Errorf("not calling the node for %s after %d failures: %v", time.Until(t.openUntil).Round(time.Second), t.failures, t.lastErr)
+	}
+	return nil
+}
+
+func (t *rpcTransport) recordFailure(err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.failures++
+	t.lastErr = err
+	if t.failures >= rpcBreakerThreshold {
+		if t.failures == rpcBreakerThreshold {
+			slog.Warn("Node keeps failing, pausing RPC calls", "failures", t.failures, "cooldown", rpcBreakerCooldown, "err", err)
+		}
+		t.openUntil = time.Now().Add(rpcBreakerCooldown)
+	}
+}
+
+func (t *rpcTransport) recordSuccess() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.failures >= rpcBreakerThreshold {
+		slog.Info("Node is answering again", "failures", t.failures)
+	}
+	t.failures = 0
+	t.openUntil = time.Time{}
+}
+
+// parseRPCCalls returns the calls of a single or batched JSON-RPC request
+func parseRPCCalls(body []byte) []jsonRPCRequest {
+	var calls []jsonRPCRequest
+	if bytes.HasPrefix(bytes.TrimSpace(body), []byte("[")) {
+		json.Unmarshal(body, &calls)
+	} else {
+		var call jsonRPCRequest
+		json.Unmarshal(body, &call)
+		calls = []jsonRPCRequest{call}
+	}
+	return calls
+}
+
+func callsIdempotent(calls []jsonRPCRequest) bool {
+	for _, call := range calls {
+		if !rpcIdempotent[call.Method] {
+			return false
+		}
+	}
+	return len(calls) > 0
+}
+
+// rpcErrorResponse answers every call with err
+func rpcErrorResponse(req *http.Request, calls []jsonRPCRequest, err error) *http.Response {
+	responses := make([]jsonRPCResponse, len(calls))
+	for i, call := range calls {
+		responses[i] = jsonRPCResponse{ID: call.ID, Error: btcjson.NewRPCError(btcjson.ErrRPCMisc, err.Error())}
+	}
+
+	var body []byte
+	if len(calls) == 1 {
+		body, _ = json.Marshal(responses[0])
+	} else {
+		body, _ = json.Marshal(responses)
+	}
+	return proxyResponse(req, http.StatusServiceUnavailable, body)
+}
+
+func proxyResponse(req *http.Request, status int, body []byte) *http.Response {
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", status, http.StatusText(status)),
+		StatusCode:    status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{"Content-Type": {"application/json"}},
+		Body:          io.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}
+}
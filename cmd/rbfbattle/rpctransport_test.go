@@ -0,0 +1,189 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/rpcclient"
+)
+
+// newTransportClient starts a node answering with handler and a client calling it through the transport
+func newTransportClient(t *testing.T, transport *rpcTransport, handler http.HandlerFunc) *rpcclient.Client {
+	t.Helper()
+
+	node := httptest.NewServer(handler)
+	t.Cleanup(node.Close)
+
+	host, err := startRPCProxy(strings.TrimPrefix(node.URL, "http://"), transport)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := rpcclient.New(&rpcclient.ConnConfig{
+		Host:         host,
+		User:         transport.localUser,
+		Pass:         transport.localPass,
+		HTTPPostMode: true,
+		DisableTLS:   true,
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(client.Shutdown)
+	return client
+}
+
+func TestRPCTransportCookie(t *testing.T) {
+	cookiePath := filepath.Join(t.TempDir(), ".cookie")
+	os.WriteFile(cookiePath, []byte("__cookie__:first"), 0o600)
+
+	var mu sync.Mutex
+	password := "first"
+	transport, err := newRPCTransport("", "", cookiePath, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := newTransportClient(t, transport, func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if user, pass, _ := r.BasicAuth(); user != "__cookie__" || pass != password {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte(`{"result":100,"error":null,"id":1}`))
+	})
+
+	if _, err := client.GetBlockCount(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A restarted node writes a new cookie
+	mu.Lock()
+	password = "second"
+	mu.Unlock()
+	os.WriteFile(cookiePath, []byte("__cookie__:second"), 0o600)
+	if _, err := client.GetBlockCount(); err != nil {
+		t.Fatalf("expected the new cookie to be read, got %v", err)
+	}
+
+	mu.Lock()
+	password = "unknown"
+	mu.Unlock()
+	if _, err := client.GetBlockCount(); err == nil || !strings.Contains(err.Error(), errRPCUnauthorized.Error()) {
+		t.Errorf("expected the credentials to be rejected, got %v", err)
+	}
+}
+
+func TestRPCTransportRetries(t *testing.T) {
+	transport, err := newRPCTransport("user", "pass", "", time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var calls atomic.Int32
+	client := newTransportClient(t, transport, func(w http.ResponseWriter, r *http.Request) {
+		switch call := calls.Add(1); {
+		case call <= 2:
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(`{"result":null,"error":{"code":-28,"message":"Loading block index…"},"id":1}`))
+		case call == 3:
+			w.Write([]byte(`{"result":100,"error":null,"id":1}`))
+		default:
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	})
+
+	// Idempotent calls are retried while the node is starting
+	if height, err := client.GetBlockCount(); err != nil || height != 100 {
+		t.Fatalf("expected height 100, got %d (%v)", height, err)
+	}
+	if calls.Load() != 3 {
+		t.Errorf("expected 3 attempts, got %d", calls.Load())
+	}
+
+	// Others are tried once, as they may have been carried out
+	if _, err := client.RawRequest("sendrawtransaction", nil); err == nil {
+		t.Error("expected the call to fail")
+	}
+	if calls.Load() != 4 {
+		t.Errorf("expected a single attempt, got %d", calls.Load()-3)
+	}
+}
+
+func TestRPCTransportTimeout(t *testing.T) {
+	transport, err := newRPCTransport("user", "pass", "", 100*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := newTransportClient(t, transport, func(w http.ResponseWriter, r *http.Request) {
+		// The server notices the call was given up once the body is read
+		io.ReadAll(r.Body)
+		select {
+		case <-r.Context().Done():
+		case <-time.After(5 * time.Second):
+		}
+	})
+
+	start := time.Now()
+	_, err = client.RawRequest("walletprocesspsbt", nil)
+	if err == nil || !strings.Contains(err.Error(), "no answer from the node within 100ms") {
+		t.Errorf("expected the call to time out, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("expected the call to give up after 100ms, took %s", elapsed)
+	}
+}
+
+func TestRPCTransportBreaker(t *testing.T) {
+	transport, err := newRPCTransport("user", "pass", "", time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var calls atomic.Int32
+	client := newTransportClient(t, transport, func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	})
+
+	for range rpcBreakerThreshold {
+		client.RawRequest("sendrawtransaction", nil)
+	}
+
+	// The node isn't called until the cooldown is over
+	_, err = client.RawRequest("sendrawtransaction", nil)
+	if err == nil || !strings.Contains(err.Error(), "not calling the node") {
+		t.Errorf("expected the breaker to be open, got %v", err)
+	}
+	if calls.Load() != rpcBreakerThreshold {
+		t.Errorf("expected %d calls to reach the node, got %d", rpcBreakerThreshold, calls.Load())
+	}
+}
+
+func TestRPCTransportLocalAuth(t *testing.T) {
+	transport, err := newRPCTransport("user", "pass", "", time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	host, err := startRPCProxy("127.0.0.1:1", transport)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Other local processes can't use the node through the proxy
+	res, err := http.Post("http://"+host, "application/json", strings.NewReader(`{"method":"getblockcount","id":1}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected status 401, got %d", res.StatusCode)
+	}
+}
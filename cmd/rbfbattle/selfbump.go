@@ -0,0 +1,118 @@
+package main
+
+import (
+	"log/slog"
+	"math"
+	"time"
+
+	"github.com/btcsuite/btcd/rpcclient"
+)
+
+const selfBumpInterval = 30 * time.Second
+
+// runSelfBumpScheduler periodically re-broadcasts our uncontested sweeps at a higher
+// fee rate when they have fallen out of the projected next block or have waited
+// SelfBumpBlocks blocks without confirming.
+func runSelfBumpScheduler(client *rpcclient.Client, config *Config) {
+	slog.Info("Self-bumping uncontested sweeps",
+		"blocks", config.SelfBumpBlocks,
+		"curve", config.SelfBumpCurve,
+		"max_feerate", config.SelfBumpMaxFeeRate,
+	)
+
+	for {
+		time.Sleep(selfBumpInterval)
+		checkSelfBumps(client, config)
+	}
+}
+
+// checkSelfBumps schedules a bump of the uncontested sweeps that waited too long. The bumps
+// run in the battle handlers, so a counterpart answered meanwhile isn't replaced by a sweep.
+func checkSelfBumps(client *rpcclient.Client, config *Config) {
+	height := tipHeight.Load()
+	nextBlockFeeRate, haveEstimate := estimateNextBlockFeeRate(config.backend)
+
+	for _, utxo := range monitoredSnapshot() {
+		utxo.mu.Lock()
+		pending := utxo.SpendTx != nil && !utxo.Contested
+		initialFeeRate := utxo.InitialFeeRate
+		currentFeeRate := utxo.SpendFeeRate
+		waited := height - utxo.SpendHeight
+		bumps := utxo.Bumps
+		utxo.mu.Unlock()
+
+		if !pending {
+			continue
+		}
+
+		outOfNextBlock := haveEstimate && currentFeeRate < nextBlockFeeRate
+		if !outOfNextBlock && waited < config.SelfBumpBlocks {
+			continue
+		}
+
+		feeRate, ok := selfBumpFeeRate(config, initialFeeRate, currentFeeRate, bumps, nextBlockFeeRate)
+		if !ok {
+			continue
+		}
+
+		utxo.inBattle(func() {
+			selfBump(client, config, utxo, currentFeeRate, feeRate, waited, outOfNextBlock)
+		})
+	}
+}
+
+// selfBump replaces our sweep paying currentFeeRate with one paying feeRate, unless the
+// battle moved on since the bump was scheduled
+func selfBump(client *rpcclient.Client, config *Config, utxo *TrackedUTXO, currentFeeRate, feeRate float64, waited int64, outOfNextBlock bool) {
+	if _, ok := getMonitoredOutPoint(utxo.outPoint()); !ok {
+		return
+	}
+	utxo.mu.Lock()
+	unchanged := utxo.SpendTx != nil && !utxo.Contested && utxo.SpendFeeRate == currentFeeRate
+	utxo.mu.Unlock()
+	if !unchanged {
+		return
+	}
+
+	logger := utxo.logger()
+	logger.Warn("Self-bumping sweep",
+		"blocks_waited", waited,
+		"out_of_next_block", outOfNextBlock,
+		"feerate", currentFeeRate,
+		"new_feerate", feeRate,
+	)
+
+	privateKeyWIF, _ := utxo.privateKey()
+	txid, err := broadcastSweep(client, utxo, privateKeyWIF, config, feeRate)
+	if err != nil {
+		logger.Error("Failed to self-bump sweep", "err", err)
+		return
+	}
+
+	utxo.mu.Lock()
+	utxo.Bumps++
+	utxo.mu.Unlock()
+
+	success(logger, "Self-bumped sweep", "our_txid", txid, "feerate", feeRate)
+}
+
+// selfBumpFeeRate returns the fee rate for the next bump of a sweep following the escalation curve.
+// The fee rate is at least the next block estimate and high enough to replace the current sweep,
+// but never above SelfBumpMaxFeeRate. If the upper bound doesn't allow a replacement it returns false.
+func selfBumpFeeRate(config *Config, initialFeeRate, currentFeeRate float64, bumps int, nextBlockFeeRate float64) (float64, bool) {
+	if len(config.SelfBumpCurve) == 0 {
+		return 0, false
+	}
+
+	multiplier := config.SelfBumpCurve[min(bumps, len(config.SelfBumpCurve)-1)]
+
+	minFeeRate := currentFeeRate + incrementalRelayFeeRate
+	feeRate := math.Max(initialFeeRate*multiplier, math.Max(nextBlockFeeRate, minFeeRate))
+	feeRate = math.Min(feeRate, config.SelfBumpMaxFeeRate)
+
+	if feeRate < minFeeRate {
+		return 0, false
+	}
+
+	return feeRate, true
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+)
+
+func TestSelfBumpFeeRate(t *testing.T) {
+	config := &Config{
+		SelfBumpCurve:      []float64{1.5, 3},
+		SelfBumpMaxFeeRate: 20,
+	}
+
+	feeRate, ok := selfBumpFeeRate(config, 4, 4, 0, 0)
+	if !ok || feeRate != 6 {
+		t.Fatalf("first bump should follow the curve. received %f", feeRate)
+	}
+
+	feeRate, _ = selfBumpFeeRate(config, 4, 6, 5, 0)
+	if feeRate != 12 {
+		t.Fatalf("the last curve step should be reused. received %f", feeRate)
+	}
+
+	feeRate, _ = selfBumpFeeRate(config, 4, 6, 0, 15)
+	if feeRate != 15 {
+		t.Fatalf("bump should reach the next block estimate. received %f", feeRate)
+	}
+
+	feeRate, _ = selfBumpFeeRate(config, 4, 6, 1, 50)
+	if feeRate != 20 {
+		t.Fatalf("bump should be capped. received %f", feeRate)
+	}
+
+	if _, ok := selfBumpFeeRate(config, 4, 19.5, 1, 50); ok {
+		t.Fatalf("bump should not be possible above the upper bound")
+	}
+}
+
+func TestSelfBumpSkipsAnsweredBattle(t *testing.T) {
+	utxo := &TrackedUTXO{TxID: chainhash.Hash{9}.String(), SpendTx: wire.NewMsgTx(2), SpendFeeRate: 4}
+	monitor(utxo)
+	defer cleanup(utxo)
+
+	// A counterpart was answered after the bump was scheduled. The bump would need the node,
+	// which the test doesn't have.
+	utxo.mu.Lock()
+	utxo.Contested = true
+	utxo.mu.Unlock()
+	selfBump(nil, &Config{}, utxo, 4, 6, 2, false)
+
+	utxo.mu.Lock()
+	utxo.Contested = false
+	utxo.SpendFeeRate = 5
+	utxo.mu.Unlock()
+	selfBump(nil, &Config{}, utxo, 4, 6, 2, false)
+
+	if utxo.Bumps != 0 {
+		t.Errorf("expected no bump of a battle that moved on, got %d", utxo.Bumps)
+	}
+}
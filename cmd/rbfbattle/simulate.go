@@ -0,0 +1,400 @@
+package main
+
+import (
+	"container/heap"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"math/rand/v2"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/btcsuite/btcd/btcec/v2"
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/jessevdk/go-flags"
+)
+
+// SimulateConfig holds the options of the simulate command
+type SimulateConfig struct {
+	Battles     int      `short:"n" long:"battles" description:"Number of battles per strategy and adversary" default:"100"`
+	Seed        uint64   `long:"seed" description:"Seed of the first battle. Battles are reproducible by seed" default:"1"`
+	Strategies  []string `short:"s" long:"strategy" description:"Fee strategy to simulate. Repeat for several (bump, minimal, double)" default:"bump" default:"minimal" default:"double"`
+	Adversaries []string `short:"a" long:"adversary" description:"Counterpart to fight: simple, input, burner or custom:... Repeat for several" default:"simple" default:"input" default:"burner"`
+
+	BlockInterval time.Duration `long:"blockinterval" description:"Mean time between blocks" default:"10m"`
+	Latency       time.Duration `long:"latency" description:"Mean propagation latency of a transaction between a party and the miners" default:"2s"`
+	Reaction      time.Duration `long:"reaction" description:"Our time to answer a counterpart transaction" default:"100ms"`
+
+	MinValue int64   `long:"minvalue" description:"Smallest contested utxo value in sats" default:"10000"`
+	MaxValue int64   `long:"maxvalue" description:"Largest contested utxo value in sats" default:"1000000"`
+	Funding  int64   `long:"funding" description:"Value of the wallet coin each party can add in sats" default:"1000000"`
+	FeeRate  float64 `long:"feerate" description:"Fee rate of the initial sweep in sat/vbyte" default:"2"`
+
+	JSON bool `long:"json" description:"Print the results as JSON"`
+}
+
+// runSimulate runs the simulate command
+func runSimulate(args []string) error {
+	config := &SimulateConfig{}
+	if _, err := flags.ParseArgs(config, args); err != nil {
+		if flagsErr, ok := err.(*flags.Error); ok && flagsErr.Type == flags.ErrHelp {
+			return nil
+		}
+		return err
+	}
+
+	var adversaries []AdversaryConfig
+	for _, spec := range config.Adversaries {
+		adversary, err := parseAdversaryConfig(spec)
+		if err != nil {
+			return err
+		}
+		adversaries = append(adversaries, adversary)
+	}
+	for _, name := range config.Strategies {
+		if _, ok := feeStrategies[name]; !ok {
+			return fmt.Errorf("unknown strategy %s, expected one of %s", name, sortedStrategies())
+		}
+	}
+
+	// The bot logs every decision
+	logger := slog.Default()
+	slog.SetDefault(slog.New(slog.DiscardHandler))
+	results := simulate(config, adversaries)
+	slog.SetDefault(logger)
+
+	if config.JSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(results)
+	}
+
+	printSimulationResults(os.Stdout, results)
+	return nil
+}
+
+// SimulationResult sums up the battles of a strategy against an adversary
+type SimulationResult struct {
+	Strategy  string `json:"strategy"`
+	Adversary string `json:"adversary"`
+	Battles   int    `json:"battles"`
+
+	Wins   int `json:"wins"`
+	Losses int `json:"losses"`
+	Burns  int `json:"burns"`
+
+	WinRate  float64 `json:"win_rate"`
+	BurnRate float64 `json:"burn_rate"`
+
+	// SatsKept is the value we swept minus the fees we paid over all battles
+	SatsKept int64 `json:"sats_kept"`
+	// FeesSpent is the fees of our confirmed transactions over all battles
+	FeesSpent    int64   `json:"fees_spent"`
+	Replacements float64 `json:"replacements_per_battle"`
+}
+
+// simulate runs every strategy against every adversary
+func simulate(config *SimulateConfig, adversaries []AdversaryConfig) []*SimulationResult {
+	var results []*SimulationResult
+
+	for _, name := range config.Strategies {
+		for _, adversary := range adversaries {
+			result := &SimulationResult{Strategy: name, Adversary: adversary.Name, Battles: config.Battles}
+
+			var replacements int
+			for i := 0; i < config.Battles; i++ {
+				outcome := simulateBattle(config, feeStrategies[name], adversary, config.Seed+uint64(i))
+
+				switch outcome.result {
+				case "won":
+					result.Wins++
+				case "burned":
+					result.Burns++
+				default:
+					result.Losses++
+				}
+				result.SatsKept += int64(outcome.kept)
+				result.FeesSpent += int64(outcome.fees)
+				replacements += outcome.replacements
+			}
+
+			if config.Battles > 0 {
+				result.WinRate = float64(result.Wins) / float64(config.Battles)
+				result.BurnRate = float64(result.Burns) / float64(config.Battles)
+				result.Replacements = float64(replacements) / float64(config.Battles)
+			}
+			results = append(results, result)
+		}
+	}
+
+	return results
+}
+
+func printSimulationResults(w io.Writer, results []*SimulationResult) {
+	table := tabwriter.NewWriter(w, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(table, "strategy\tadversary\tbattles\twin rate\tburn rate\tsats kept\tfees spent\treplacements\t")
+	for _, r := range results {
+		fmt.Fprintf(table, "%s\t%s\t%d\t%.1f%%\t%.1f%%\t%d\t%d\t%.1f\t\n",
+			r.Strategy, r.Adversary, r.Battles, r.WinRate*100, r.BurnRate*100, r.SatsKept, r.FeesSpent, r.Replacements)
+	}
+	table.Flush()
+}
+
+type battleOutcome struct {
+	result       string
+	kept         btcutil.Amount
+	fees         btcutil.Amount
+	replacements int
+}
+
+type simParty int
+
+const (
+	us simParty = iota
+	them
+)
+
+type simEventKind int
+
+const (
+	// A transaction reaches the miners
+	arriveEvent simEventKind = iota
+	// A party sees a transaction of the other party
+	observeEvent
+	blockEvent
+)
+
+type simEvent struct {
+	at   time.Duration
+	kind simEventKind
+	// The party that sent the transaction
+	from simParty
+	tx   *wire.MsgTx
+}
+
+type simEvents []*simEvent
+
+func (e simEvents) Len() int           { return len(e) }
+func (e simEvents) Less(i, j int) bool { return e[i].at < e[j].at }
+func (e simEvents) Swap(i, j int)      { e[i], e[j] = e[j], e[i] }
+func (e *simEvents) Push(x any)        { *e = append(*e, x.(*simEvent)) }
+func (e *simEvents) Pop() any {
+	old := *e
+	event := old[len(old)-1]
+	*e = old[:len(old)-1]
+	return event
+}
+
+// simulateBattle fights one battle over a new utxo until a block confirms a spend of it.
+// Both parties see the utxo at the same time and we sweep it first.
+func simulateBattle(config *SimulateConfig, strategy FeeStrategy, adversaryConfig AdversaryConfig, seed uint64) battleOutcome {
+	rng := rand.New(rand.NewPCG(seed, 0))
+	exp := func(mean time.Duration) time.Duration {
+		return time.Duration(rng.ExpFloat64() * float64(mean))
+	}
+
+	mempool := newPolicyMempool()
+	mempool.VerifyScripts = false
+
+	// Log-uniform so small and large utxos are equally represented
+	value := btcutil.Amount(math.Exp(math.Log(float64(config.MinValue)) + rng.Float64()*(math.Log(float64(config.MaxValue))-math.Log(float64(config.MinValue)))))
+
+	newCoin := func(value btcutil.Amount) Coin {
+		var secret [32]byte
+		for i := range secret {
+			secret[i] = byte(rng.Uint32())
+		}
+		key, _ := btcec.PrivKeyFromBytes(secret[:])
+		script, _ := txscript.NewScriptBuilder().
+			AddOp(txscript.OP_0).
+			AddData(btcutil.Hash160(key.PubKey().SerializeCompressed())).
+			Script()
+		return Coin{OutPoint: mempool.Fund(script, value), Output: wire.NewTxOut(int64(value), script), Key: key}
+	}
+
+	contested := newCoin(value)
+	bot := &simBot{
+		strategy:    strategy,
+		contested:   contested,
+		funding:     newCoin(btcutil.Amount(config.Funding)),
+		destination: newCoin(0).Output.PkScript,
+	}
+	bot.burnTo, _ = txscript.NullDataScript([]byte("rbfbattle"))
+
+	adversary := newAdversary(adversaryConfig, contested, []Coin{newCoin(btcutil.Amount(config.Funding))}, newCoin(0).Output.PkScript)
+
+	events := &simEvents{}
+	heap.Push(events, &simEvent{at: exp(config.BlockInterval), kind: blockEvent})
+	if sweep := bot.sweep(config.FeeRate); sweep != nil {
+		heap.Push(events, &simEvent{at: config.Reaction + exp(config.Latency), kind: arriveEvent, from: us, tx: sweep})
+	}
+
+	outcome := battleOutcome{result: "lost"}
+	for events.Len() > 0 {
+		event := heap.Pop(events).(*simEvent)
+
+		switch event.kind {
+		case arriveEvent:
+			if err := mempool.Submit(event.tx); err != nil {
+				continue
+			}
+			if event.from == us && bot.sent > 0 {
+				outcome.replacements++
+			}
+			if event.from == us {
+				bot.sent++
+			}
+			heap.Push(events, &simEvent{at: event.at + exp(config.Latency), kind: observeEvent, from: event.from, tx: event.tx})
+
+		case observeEvent:
+			fee, ok := mempool.MempoolFee(event.tx.TxHash())
+			if !ok {
+				// Replaced before it was seen
+				continue
+			}
+
+			var answer *wire.MsgTx
+			var delay time.Duration
+			if event.from == us {
+				answer, _ = adversary.Respond(event.tx, fee)
+				delay = adversary.Delay
+			} else {
+				answer = bot.respond(event.tx, fee)
+				delay = config.Reaction
+			}
+			if answer != nil {
+				heap.Push(events, &simEvent{at: event.at + delay + exp(config.Latency), kind: arriveEvent, from: 1 - event.from, tx: answer})
+			}
+
+		case blockEvent:
+			for _, tx := range mempool.MineBlock() {
+				if !msgTxSpends(tx, contested.OutPoint) {
+					continue
+				}
+
+				switch {
+				case txscript.IsUnspendable(tx.TxOut[0].PkScript):
+					outcome.result = "burned"
+				case string(tx.TxOut[0].PkScript) == string(bot.destination):
+					outcome.result = "won"
+				}
+
+				if bot.sentTx[tx.TxHash()] {
+					var in btcutil.Amount
+					for _, txIn := range tx.TxIn {
+						if txIn.PreviousOutPoint == bot.funding.OutPoint {
+							in += btcutil.Amount(bot.funding.Output.Value)
+						} else {
+							in += value
+						}
+					}
+					var out btcutil.Amount
+					for _, txOut := range tx.TxOut {
+						out += btcutil.Amount(txOut.Value)
+					}
+					outcome.fees = in - out
+					outcome.kept = value - outcome.fees
+					if outcome.result == "burned" {
+						outcome.kept = 0
+					}
+				}
+				return outcome
+			}
+			if events.Len() == 0 {
+				// Nobody is going to spend it
+				return outcome
+			}
+			heap.Push(events, &simEvent{at: event.at + exp(config.BlockInterval), kind: blockEvent})
+		}
+	}
+
+	return outcome
+}
+
+// simBot answers counterpart transactions with the same decisions as TryReplacingAttacker
+type simBot struct {
+	strategy    FeeStrategy
+	contested   Coin
+	funding     Coin
+	destination []byte
+	burnTo      []byte
+
+	sent   int
+	sentTx map[chainhash.Hash]bool
+}
+
+func (b *simBot) track(tx *wire.MsgTx) *wire.MsgTx {
+	if b.sentTx == nil {
+		b.sentTx = make(map[chainhash.Hash]bool)
+	}
+	b.sentTx[tx.TxHash()] = true
+	return tx
+}
+
+// sweep spends the contested utxo at feeRate like broadcastSweep
+func (b *simBot) sweep(feeRate float64) *wire.MsgTx {
+	value := btcutil.Amount(b.contested.Output.Value)
+	vsize := estimateTransactionSize(b.destination, value, fmt.Sprintf("%x", b.contested.Output.PkScript))
+
+	output := value - btcutil.Amount(math.Ceil(feeRate*float64(vsize)))
+	if output < dustThreshold(b.destination) {
+		return nil
+	}
+	return b.spend([]Coin{b.contested}, wire.NewTxOut(int64(output), b.destination))
+}
+
+// respond answers a counterpart transaction paying fee
+func (b *simBot) respond(counterpart *wire.MsgTx, fee btcutil.Amount) *wire.MsgTx {
+	utxo := &TrackedUTXO{Amount: btcutil.Amount(b.contested.Output.Value)}
+	if fee >= utxo.Amount {
+		// Burned or overpaid, giving up
+		return nil
+	}
+
+	conflict := &Conflict{Fee: fee, VSize: int32(txVirtualSize(counterpart))}
+	funding := btcutil.Amount(b.funding.Output.Value)
+	vsize := int32(estimateTransactionSize(b.destination, utxo.Amount+funding,
+		fmt.Sprintf("%x", b.contested.Output.PkScript), fmt.Sprintf("%x", b.funding.Output.PkScript)))
+
+	conflict.MinFee, _ = bip125Policy{}.MinReplacementFee(conflict, utxo, vsize)
+
+	action, newFee := decideReplacement(b.strategy, conflict, utxo, funding, vsize, b.destination)
+	switch action {
+	case burnAction:
+		return b.spend([]Coin{b.contested}, wire.NewTxOut(0, b.burnTo))
+	case giveUpAction:
+		return nil
+	}
+	return b.spend([]Coin{b.contested, b.funding}, wire.NewTxOut(int64(utxo.Amount+funding-newFee), b.destination))
+}
+
+func (b *simBot) spend(coins []Coin, output *wire.TxOut) *wire.MsgTx {
+	tx := wire.NewMsgTx(2)
+	for _, coin := range coins {
+		tx.AddTxIn(wire.NewTxIn(&coin.OutPoint, nil, nil))
+	}
+	tx.AddTxOut(output)
+
+	if err := signCoins(tx, coins); err != nil {
+		return nil
+	}
+	return b.track(tx)
+}
+
+// sortedStrategies returns the names of the fee strategies
+func sortedStrategies() string {
+	var names []string
+	for name := range feeStrategies {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestSimulate(t *testing.T) {
+	config := &SimulateConfig{
+		Battles:       10,
+		Seed:          7,
+		Strategies:    []string{"bump", "minimal"},
+		BlockInterval: 10 * time.Minute,
+		Latency:       2 * time.Second,
+		Reaction:      100 * time.Millisecond,
+		MinValue:      10_000,
+		MaxValue:      1_000_000,
+		Funding:       1_000_000,
+		FeeRate:       2,
+	}
+	adversaries := []AdversaryConfig{simpleBumper(), burner()}
+
+	results := simulate(config, adversaries)
+	if len(results) != 4 {
+		t.Fatalf("expected 4 results, got %d", len(results))
+	}
+
+	for _, r := range results {
+		if r.Wins+r.Losses+r.Burns != r.Battles {
+			t.Errorf("%s against %s: outcomes don't add up: %+v", r.Strategy, r.Adversary, r)
+		}
+		if r.Adversary == "burner" && r.BurnRate != 1 {
+			t.Errorf("%s against the burner: expected every battle burned, got %+v", r.Strategy, r)
+		}
+	}
+
+	if again := simulate(config, adversaries); !reflect.DeepEqual(results, again) {
+		t.Errorf("battles are not reproducible by seed")
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"github.com/btcsuite/btcd/btcjson"
+	"github.com/btcsuite/btcd/btcutil"
+)
+
+// FeeStrategy decides how much we pay to replace a counterpart transaction
+type FeeStrategy interface {
+	// ReplacementFee returns the absolute fee for our replacement of ourVSize vbytes
+	// and whether we should rather burn the utxo.
+	ReplacementFee(conflict *Conflict, ourVSize int32, utxo *TrackedUTXO) (fee btcutil.Amount, burn bool)
+}
+
+// feeStrategy is the strategy we fight our battles with
+var feeStrategy FeeStrategy = bumpStrategy{}
+
+// feeStrategies are the strategies selectable by name
+var feeStrategies = map[string]FeeStrategy{
+	"bump":    bumpStrategy{},
+	"minimal": minimalStrategy{},
+	"double":  doubleStrategy{},
+}
+
+type replacementAction int
+
+const (
+	replaceAction replacementAction = iota
+	burnAction
+	giveUpAction
+)
+
+// decideReplacement decides how to answer a conflict with a replacement of vsize vbytes spending
+// the utxo and a funding coin to destScript, and returns the fee the replacement pays
+func decideReplacement(strategy FeeStrategy, conflict *Conflict, utxo *TrackedUTXO, funding btcutil.Amount, vsize int32, destScript []byte) (replacementAction, btcutil.Amount) {
+	fee, overpaying := strategy.ReplacementFee(conflict, vsize, utxo)
+	if overpaying {
+		return burnAction, fee
+	}
+	if utxo.Amount+funding-fee < dustThreshold(destScript) {
+		return giveUpAction, fee
+	}
+	return replaceAction, fee
+}
+
+// Conflict is a mempool transaction our replacement has to evict
+type Conflict struct {
+	TxID    string
+	Version int32
+	// Fee includes the fees of all descendants as they are evicted along with the transaction
+	Fee   btcutil.Amount
+	VSize int32
+	// Sibling is set when the transaction doesn't spend our utxo but another output of the same
+	// unconfirmed TRUC parent. A TRUC transaction may only have one unconfirmed child, so the
+	// sibling has to be evicted, which follows the same fee rules as a replacement.
+	Sibling bool
+
+	// MinFee is the smallest fee our replacement must pay under the replacement policy of the node
+	MinFee btcutil.Amount
+}
+
+// FeeRate returns the fee rate of the conflict in sat/vbyte
+func (c *Conflict) FeeRate() float64 {
+	return float64(c.Fee) / float64(c.VSize)
+}
+
+// getConflict looks up a counterpart transaction in our mempool
+func getConflict(backend ChainBackend, peers peerSet, counterpart *btcjson.TxRawResult, utxo *TrackedUTXO) (*Conflict, error) {
+	mempool, err := backend.MempoolEntry(counterpart.Txid)
+	return newConflict(peers, counterpart, utxo, mempool, err)
+}
+
+// newConflict describes a counterpart from the outcome of looking it up in our mempool
+func newConflict(peers peerSet, counterpart *btcjson.TxRawResult, utxo *TrackedUTXO, mempool *mempoolSummary, err error) (*Conflict, error) {
+	if err != nil {
+		// Our node may not have the counterpart when another node announced it
+		entry, ok := peers.mempoolEntry(counterpart.Txid)
+		if !ok {
+			return nil, err
+		}
+		mempool = entry
+	}
+
+	return &Conflict{
+		TxID:    counterpart.Txid,
+		Version: int32(counterpart.Version),
+		Fee:     mempool.Fee,
+		VSize:   mempool.VSize,
+		Sibling: !spendsOutpoint(counterpart, utxo),
+	}, nil
+}
+
+// spendsOutpoint checks if a transaction spends the tracked utxo
+func spendsOutpoint(tx *btcjson.TxRawResult, utxo *TrackedUTXO) bool {
+	for _, vin := range tx.Vin {
+		if vin.Txid == utxo.TxID && vin.Vout == utxo.N {
+			return true
+		}
+	}
+	return false
+}
+
+// bumpStrategy outbids the counterpart fee rate by 1 sat/vbyte + 10%
+type bumpStrategy struct{}
+
+func (bumpStrategy) ReplacementFee(conflict *Conflict, ourVSize int32, utxo *TrackedUTXO) (btcutil.Amount, bool) {
+	fee, burn := newFee(conflict.Fee, conflict.VSize, ourVSize, utxo)
+
+	// The fee rate bump may not be enough to pay for everything we evict
+	if fee < conflict.MinFee {
+		fee = conflict.MinFee
+		burn = fee >= utxo.Amount
+	}
+
+	return fee, burn
+}
+
+// minimalStrategy pays the least the node accepts, barely outbidding the counterpart fee rate
+type minimalStrategy struct{}
+
+func (minimalStrategy) ReplacementFee(conflict *Conflict, ourVSize int32, utxo *TrackedUTXO) (btcutil.Amount, bool) {
+	fee := max(conflict.MinFee, btcutil.Amount(conflict.FeeRate()*float64(ourVSize))+1)
+	return fee, fee >= utxo.Amount
+}
+
+// doubleStrategy doubles the counterpart fee rate to end battles in few rounds
+type doubleStrategy struct{}
+
+func (doubleStrategy) ReplacementFee(conflict *Conflict, ourVSize int32, utxo *TrackedUTXO) (btcutil.Amount, bool) {
+	fee := max(conflict.MinFee, btcutil.Amount(2*conflict.FeeRate()*float64(ourVSize)))
+	return fee, fee >= utxo.Amount
+}
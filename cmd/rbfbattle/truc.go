@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/btcsuite/btcd/btcjson"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/rpcclient"
+	"github.com/btcsuite/btcd/wire"
+)
+
+// TRUC (version 3) transaction policy
+// https://github.com/bitcoin/bitcoin/blob/master/doc/policy/version3_transactions.md
+const (
+	trucVersion = 3
+	// Maximum virtual size of a TRUC transaction
+	trucMaxVSize = 10_000
+	// Maximum virtual size of a TRUC transaction with an unconfirmed TRUC parent
+	trucChildMaxVSize = 1_000
+)
+
+// txVersionFor returns the version of a transaction spending utxo.
+// A TRUC transaction can't spend an unconfirmed non-TRUC output and the other way around,
+// so we must match the version of the parent until it confirms.
+func txVersionFor(config *Config, utxo *TrackedUTXO) int32 {
+	if hasUnconfirmedParent(utxo) {
+		if utxo.Tx.Version == trucVersion {
+			return trucVersion
+		}
+		return 2
+	}
+
+	if config.TRUC {
+		return trucVersion
+	}
+	return 2
+}
+
+func hasUnconfirmedParent(utxo *TrackedUTXO) bool {
+	return utxo.Tx != nil && utxo.Tx.Confirmations == 0
+}
+
+// trucSiblingOf returns the monitored utxo a transaction blocks by spending another
+// output of the same unconfirmed TRUC parent.
+func trucSiblingOf(tx *btcjson.TxRawResult) (*TrackedUTXO, bool) {
+	for _, vin := range tx.Vin {
+		hash, err := chainhash.NewHashFromStr(vin.Txid)
+		if err != nil {
+			continue
+		}
+		if utxo, ok := trucSiblingAt(wire.OutPoint{Hash: *hash, Index: vin.Vout}); ok {
+			return utxo, true
+		}
+	}
+	return nil, false
+}
+
+// trucSiblingAt returns the monitored utxo blocked by spending outpoint, when that is
+// another output of its unconfirmed TRUC parent
+func trucSiblingAt(outpoint wire.OutPoint) (*TrackedUTXO, bool) {
+	monitoredUtxosMu.RLock()
+	defer monitoredUtxosMu.RUnlock()
+
+	for monitored, utxo := range monitoredUtxos {
+		if monitored.Hash != outpoint.Hash || monitored.Index == outpoint.Index {
+			continue
+		}
+		if hasUnconfirmedParent(utxo) && utxo.Tx.Version == trucVersion {
+			return utxo, true
+		}
+	}
+	return nil, false
+}
+
+// checkTRUCTopology checks our transaction against the TRUC size limits before broadcasting
+func checkTRUCTopology(tx *wire.MsgTx, utxo *TrackedUTXO) error {
+	if tx.Version != trucVersion {
+		return nil
+	}
+
+	vsize := txVirtualSize(tx)
+	if vsize > trucMaxVSize {
+		return fmt.Errorf("TRUC transaction is %d vbytes, more than %d", vsize, trucMaxVSize)
+	}
+	if hasUnconfirmedParent(utxo) && vsize > trucChildMaxVSize {
+		return fmt.Errorf("TRUC child transaction is %d vbytes, more than %d", vsize, trucChildMaxVSize)
+	}
+	return nil
+}
+
+// txVirtualSize returns the virtual size of a transaction in vbytes
+func txVirtualSize(tx *wire.MsgTx) int64 {
+	weight := tx.SerializeSizeStripped()*3 + tx.SerializeSize()
+	return int64((weight + 3) / 4)
+}
+
+// broadcastTransaction sends our transaction spending utxo. If the node doesn't have the
+// parent of the utxo we submit both as a package, which also gets a TRUC parent paying
+// less than the minimum relay fee in.
+func broadcastTransaction(client *rpcclient.Client, backend ChainBackend, peers peerSet, tx *wire.MsgTx, utxo *TrackedUTXO) (*chainhash.Hash, error) {
+	if err := checkTRUCTopology(tx, utxo); err != nil {
+		return nil, err
+	}
+
+	txHash, err := backend.Broadcast(tx)
+	if err == nil {
+		observeReaction(utxo)
+		utxo.recordView(primaryNode, txHash.String())
+		go peers.broadcast(tx, utxo)
+		go announceP2P(tx)
+		return txHash, nil
+	}
+	if !hasUnconfirmedParent(utxo) || !errors.Is(err, errMissingInputs) {
+		// Other nodes may accept what our node refused under its own policy
+		if len(peers) > 0 && peers.broadcast(tx, utxo) > 0 {
+			utxo.logger().Warn("Our node refused transaction but other nodes accepted it", "txid", tx.TxHash(), "err", err)
+			observeReaction(utxo)
+			hash := tx.TxHash()
+			return &hash, nil
+		}
+		return nil, err
+	}
+
+	parentBytes, decodeErr := hex.DecodeString(utxo.Tx.Hex)
+	if decodeErr != nil {
+		return nil, err
+	}
+	parent := wire.NewMsgTx(wire.TxVersion)
+	if decodeErr := parent.Deserialize(bytes.NewReader(parentBytes)); decodeErr != nil {
+		return nil, err
+	}
+
+	if _, err := submitPackage(client, parent, tx); err != nil {
+		return nil, err
+	}
+
+	observeReaction(utxo)
+
+	hash := tx.TxHash()
+	utxo.recordView(primaryNode, hash.String())
+	return &hash, nil
+}
+
+type submitPackageTxResult struct {
+	TxID  string `json:"txid"`
+	VSize int64  `json:"vsize"`
+	Fees  *struct {
+		Base             float64 `json:"base"`
+		EffectiveFeeRate float64 `json:"effective-feerate"`
+	} `json:"fees"`
+	Error string `json:"error"`
+}
+
+type submitPackageResult struct {
+	PackageMsg           string                           `json:"package_msg"`
+	TxResults            map[string]submitPackageTxResult `json:"tx-results"`
+	ReplacedTransactions []string                         `json:"replaced-transactions"`
+}
+
+// submitPackage submits a child with its unconfirmed parents to the node.
+// Transactions must be topologically sorted with the child last.
+func submitPackage(client *rpcclient.Client, txs ...*wire.MsgTx) (*submitPackageResult, error) {
+	var rawTxs []string
+	for _, tx := range txs {
+		var buf bytes.Buffer
+		if err := tx.Serialize(&buf); err != nil {
+			return nil, fmt.Errorf("error serializing transaction: %v", err)
+		}
+		rawTxs = append(rawTxs, hex.EncodeToString(buf.Bytes()))
+	}
+
+	param, err := json.Marshal(rawTxs)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := client.RawRequest("submitpackage", []json.RawMessage{param})
+	if err != nil {
+		return nil, fmt.Errorf("error submitting package: %v", err)
+	}
+
+	var result submitPackageResult
+	if err := json.Unmarshal(res, &result); err != nil {
+		return nil, fmt.Errorf("error parsing submitpackage result: %v", err)
+	}
+
+	if result.PackageMsg != "success" {
+		for _, txResult := range result.TxResults {
+			if txResult.Error != "" {
+				return &result, &btcjson.RPCError{
+					Code:    btcjson.ErrRPCVerifyRejected,
+					Message: fmt.Sprintf("%s: %s", result.PackageMsg, txResult.Error),
+				}
+			}
+		}
+		return &result, fmt.Errorf("package rejected: %s", result.PackageMsg)
+	}
+
+	return &result, nil
+}
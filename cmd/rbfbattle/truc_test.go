@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/btcsuite/btcd/btcjson"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+)
+
+func testTx(version int32, outputs int) *wire.MsgTx {
+	tx := wire.NewMsgTx(version)
+	tx.AddTxIn(wire.NewTxIn(wire.NewOutPoint(&chainhash.Hash{1}, 0), nil, nil))
+	for i := 0; i < outputs; i++ {
+		tx.AddTxOut(wire.NewTxOut(1000, bytes.Repeat([]byte{0x51}, 22)))
+	}
+	return tx
+}
+
+func txHex(tx *wire.MsgTx) string {
+	var buf bytes.Buffer
+	tx.Serialize(&buf)
+	return hex.EncodeToString(buf.Bytes())
+}
+
+func TestTxVersionFor(t *testing.T) {
+	config := &Config{TRUC: true}
+
+	unconfirmedTRUC := &TrackedUTXO{Tx: &btcjson.TxRawResult{Version: 3}}
+	if v := txVersionFor(&Config{}, unconfirmedTRUC); v != 3 {
+		t.Errorf("spending an unconfirmed TRUC parent must be TRUC. received version %d", v)
+	}
+
+	unconfirmed := &TrackedUTXO{Tx: &btcjson.TxRawResult{Version: 2}}
+	if v := txVersionFor(config, unconfirmed); v != 2 {
+		t.Errorf("spending an unconfirmed non-TRUC parent must not be TRUC. received version %d", v)
+	}
+
+	confirmed := &TrackedUTXO{Tx: &btcjson.TxRawResult{Version: 2, Confirmations: 1}}
+	if v := txVersionFor(config, confirmed); v != 3 {
+		t.Errorf("spending a confirmed parent should follow the config. received version %d", v)
+	}
+}
+
+func TestCheckTRUCTopology(t *testing.T) {
+	child := &TrackedUTXO{Tx: &btcjson.TxRawResult{Version: 3}}
+
+	if err := checkTRUCTopology(testTx(3, 2), child); err != nil {
+		t.Errorf("small TRUC child was rejected: %v", err)
+	}
+	if err := checkTRUCTopology(testTx(3, 40), child); err == nil {
+		t.Errorf("TRUC child larger than %d vbytes was accepted", trucChildMaxVSize)
+	}
+	if err := checkTRUCTopology(testTx(3, 40), &TrackedUTXO{}); err != nil {
+		t.Errorf("TRUC transaction with confirmed inputs was rejected: %v", err)
+	}
+}
+
+func TestBroadcastTransactionSubmitsPackage(t *testing.T) {
+	parent := testTx(3, 1)
+	child := testTx(3, 1)
+	child.TxIn[0].PreviousOutPoint = *wire.NewOutPoint(&chainhash.Hash{}, 0)
+
+	standIn, client := newRPCStandIn(t, map[string]rpcHandler{
+		"sendrawtransaction": func([]json.RawMessage) (any, *btcjson.RPCError) {
+			return nil, btcjson.NewRPCError(btcjson.ErrRPCVerify, "bad-txns-inputs-missingorspent")
+		},
+		"submitpackage": func([]json.RawMessage) (any, *btcjson.RPCError) {
+			return map[string]any{"package_msg": "success", "tx-results": map[string]any{}}, nil
+		},
+	})
+
+	utxo := &TrackedUTXO{Tx: &btcjson.TxRawResult{Version: 3, Hex: txHex(parent)}}
+
+	txHash, err := broadcastTransaction(client, &bitcoindBackend{client: client}, nil, child, utxo)
+	if err != nil {
+		t.Fatalf("error broadcasting package: %v", err)
+	}
+	if *txHash != child.TxHash() {
+		t.Errorf("expected the child txid %s, received %s", child.TxHash(), txHash)
+	}
+
+	calls := standIn.Calls("submitpackage")
+	if len(calls) != 1 {
+		t.Fatalf("expected one submitpackage call, received %d", len(calls))
+	}
+	var rawTxs []string
+	json.Unmarshal(calls[0][0], &rawTxs)
+	if len(rawTxs) != 2 || rawTxs[0] != txHex(parent) || rawTxs[1] != txHex(child) {
+		t.Errorf("package should be parent then child. received %v", rawTxs)
+	}
+}
+
+func TestSubmitPackageRejected(t *testing.T) {
+	_, client := newRPCStandIn(t, map[string]rpcHandler{
+		"submitpackage": func([]json.RawMessage) (any, *btcjson.RPCError) {
+			return map[string]any{
+				"package_msg": "transaction failed",
+				"tx-results": map[string]any{
+					"wtxid": map[string]any{"txid": "txid", "error": "insufficient fee"},
+				},
+			}, nil
+		},
+	})
+
+	_, err := submitPackage(client, testTx(3, 1), testTx(3, 1))
+
+	var rpcErr *btcjson.RPCError
+	if !errors.As(err, &rpcErr) || rpcErr.Code != btcjson.ErrRPCVerifyRejected {
+		t.Fatalf("expected a rejection error, received %v", err)
+	}
+}
+
+func TestTRUCSibling(t *testing.T) {
+	parent := strings.Repeat("11", 32)
+	utxo := &TrackedUTXO{
+		TxID:   parent,
+		N:      0,
+		Amount: btc(0.001),
+		Tx:     &btcjson.TxRawResult{Version: 3},
+	}
+	monitor(utxo)
+	defer cleanup(utxo)
+
+	sibling := &btcjson.TxRawResult{Txid: "sibling", Vin: []btcjson.Vin{{Txid: parent, Vout: 1}}}
+	if found, ok := trucSiblingOf(sibling); !ok || found != utxo {
+		t.Fatalf("sibling was not detected")
+	}
+
+	direct := &btcjson.TxRawResult{Txid: "direct", Vin: []btcjson.Vin{{Txid: parent, Vout: 0}}}
+	if _, ok := trucSiblingOf(direct); ok {
+		t.Fatalf("direct conflict was detected as a sibling")
+	}
+
+	_, client := newRPCStandIn(t, map[string]rpcHandler{
+		"getmempoolentry": func([]json.RawMessage) (any, *btcjson.RPCError) {
+			return map[string]any{"vsize": 150, "fees": map[string]any{"base": 0.00001, "descendant": 0.00003}}, nil
+		},
+	})
+
+	conflict, err := getConflict(&bitcoindBackend{client: client}, nil, sibling, utxo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !conflict.Sibling {
+		t.Errorf("conflict should be a sibling")
+	}
+
+	// The sibling and its descendants have to be outbid
+	conflict.MinFee, _ = bip125Policy{}.MinReplacementFee(conflict, utxo, 200)
+	if fee, _ := feeStrategy.ReplacementFee(conflict, 200, utxo); fee < 3200 {
+		t.Errorf("replacement fee %d does not evict the sibling", fee)
+	}
+}
@@ -4,23 +4,18 @@ import (
 	"bytes"
 	"encoding/hex"
 	"fmt"
-	"log"
 
 	"github.com/btcsuite/btcd/btcec/v2"
 	"github.com/btcsuite/btcd/btcutil"
 	"github.com/btcsuite/btcd/chaincfg/chainhash"
-	"github.com/btcsuite/btcd/rpcclient"
 	"github.com/btcsuite/btcd/txscript"
 	"github.com/btcsuite/btcd/wire"
 	"github.com/btcsuite/btcwallet/wallet/txsizes"
 )
 
 // estimateTransactionSize roughly estimates the size of a transaction
-// we're sending that spends our watched utxos
-func estimateTransactionSize(config *Config, outputValue btcutil.Amount, inputScripts ...string) int {
-	// Create destination script
-	destScript, _ := txscript.PayToAddrScript(config.decodedDestinationAddress)
-
+// we're sending that spends our watched utxos to destScript
+func estimateTransactionSize(destScript []byte, outputValue btcutil.Amount, inputScripts ...string) int {
 	// Count input types
 	var numP2PKHIns, numP2TRIns, numP2WPKHIns, numNestedP2WPKHIns int
 
@@ -30,7 +25,8 @@ func estimateTransactionSize(config *Config, outputValue btcutil.Amount, inputSc
 		inputScriptClass := txscript.GetScriptClass(inputScriptBytes)
 
 		switch inputScriptClass {
-		case txscript.PubKeyHashTy:
+		case txscript.PubKeyHashTy, txscript.PubKeyTy:
+			// A pay-to-pubkey input is a P2PKH one without the public key, so this overestimates it
 			numP2PKHIns++
 		case txscript.WitnessV0PubKeyHashTy:
 			numP2WPKHIns++
@@ -39,7 +35,7 @@ func estimateTransactionSize(config *Config, outputValue btcutil.Amount, inputSc
 		case txscript.ScriptHashTy:
 			numNestedP2WPKHIns++
 		default:
-			log.Fatalf("unsupported script type: %v", inputScriptClass)
+			fatal("Unsupported script type", "class", inputScriptClass)
 		}
 	}
 
@@ -53,13 +49,15 @@ func estimateTransactionSize(config *Config, outputValue btcutil.Amount, inputSc
 	)
 }
 
-func formatTxId(txid string) string {
-	return txid[:6] + "..." + txid[len(txid)-6:]
-}
-
 // SignInput signs a transaction input based on its script type.
 // It handles P2PKH, P2SH, P2WPKH, P2WSH, and P2TR inputs.
-func SignInput(client *rpcclient.Client, tx *wire.MsgTx, idx int, privateKey string, trackedUtxo *TrackedUTXO) error {
+func SignInput(backend ChainBackend, batch *rpcBatch, tx *wire.MsgTx, idx int, privateKey string, trackedUtxo *TrackedUTXO) error {
+	return signInputWithPrevOuts(backend, batch, tx, idx, privateKey, trackedUtxo, nil)
+}
+
+// signInputWithPrevOuts signs like SignInput. A taproot signature commits to the outputs spent
+// by every input, and only those missing from known are looked up.
+func signInputWithPrevOuts(backend ChainBackend, batch *rpcBatch, tx *wire.MsgTx, idx int, privateKey string, trackedUtxo *TrackedUTXO, known map[wire.OutPoint]*wire.TxOut) error {
 	scriptBytes, err := hex.DecodeString(trackedUtxo.Script.Hex)
 	if err != nil {
 		return fmt.Errorf("error decoding script hex: %v", err)
@@ -100,6 +98,16 @@ func SignInput(client *rpcclient.Client, tx *wire.MsgTx, idx int, privateKey str
 	// Determine the script type and sign accordingly
 	scriptClass := txscript.GetScriptClass(scriptBytes)
 
+	// Segwit v0 signatures only commit to our own input, but NewTxSigHashes looks up
+	// every input. Taproot fetches the real outputs below.
+	if scriptClass != txscript.WitnessV1TaprootTy {
+		for i, txIn := range tx.TxIn {
+			if i != idx {
+				prevOutFetcher.AddPrevOut(txIn.PreviousOutPoint, &wire.TxOut{})
+			}
+		}
+	}
+
 	switch scriptClass {
 	case txscript.PubKeyHashTy:
 		// For P2PKH, we need to check if it's uncompressed
@@ -121,8 +129,6 @@ func SignInput(client *rpcclient.Client, tx *wire.MsgTx, idx int, privateKey str
 			return fmt.Errorf("public key hash does not match either compressed or uncompressed key")
 		}
 
-		fmt.Println("compress", compress)
-
 		// P2PKH
 		sigScript, err := txscript.SignatureScript(tx, idx, scriptBytes, txscript.SigHashAll, pk, compress)
 		if err != nil {
@@ -130,6 +136,18 @@ func SignInput(client *rpcclient.Client, tx *wire.MsgTx, idx int, privateKey str
 		}
 		tx.TxIn[idx].SignatureScript = sigScript
 
+	case txscript.PubKeyTy:
+		// P2PK only needs the signature, the public key is in the script
+		sig, err := txscript.RawTxInSignature(tx, idx, scriptBytes, txscript.SigHashAll, pk)
+		if err != nil {
+			return fmt.Errorf("error creating signature for P2PK: %v", err)
+		}
+		sigScript, err := txscript.NewScriptBuilder().AddData(sig).Script()
+		if err != nil {
+			return fmt.Errorf("error creating signature script for P2PK: %v", err)
+		}
+		tx.TxIn[idx].SignatureScript = sigScript
+
 	case txscript.ScriptHashTy:
 		// P2SH
 
@@ -173,24 +191,25 @@ func SignInput(client *rpcclient.Client, tx *wire.MsgTx, idx int, privateKey str
 		// P2TR
 
 		// Add all other inputs from the transaction
+		var missing []wire.OutPoint
 		for i, txIn := range tx.TxIn {
-			if i != idx { // Skip our current input as we already added it
-				// Get the previous transaction to get the actual output value and script
-				prevTx, err := client.GetRawTransactionVerbose(&txIn.PreviousOutPoint.Hash)
-				if err != nil {
-					return fmt.Errorf("error getting previous transaction: %v", err)
-				}
-
-				// Get the output we're spending
-				prevOut := prevTx.Vout[txIn.PreviousOutPoint.Index]
-				prevAmount, _ := btcutil.NewAmount(prevOut.Value)
-				prevScript, _ := hex.DecodeString(prevOut.ScriptPubKey.Hex)
-
-				prevOutFetcher.AddPrevOut(txIn.PreviousOutPoint, &wire.TxOut{
-					Value:    int64(prevAmount),
-					PkScript: prevScript,
-				})
+			if i == idx { // Skip our current input as we already added it
+				continue
 			}
+			if prevOut, ok := known[txIn.PreviousOutPoint]; ok {
+				prevOutFetcher.AddPrevOut(txIn.PreviousOutPoint, prevOut)
+			} else {
+				missing = append(missing, txIn.PreviousOutPoint)
+			}
+		}
+
+		// Get the previous transactions to get the actual output values and scripts
+		prevOuts, err := fetchPrevOuts(backend, batch, missing)
+		if err != nil {
+			return fmt.Errorf("error getting previous transaction: %v", err)
+		}
+		for i, prevOut := range prevOuts {
+			prevOutFetcher.AddPrevOut(missing[i], prevOut)
 		}
 
 		sigHashes := txscript.NewTxSigHashes(tx, prevOutFetcher)
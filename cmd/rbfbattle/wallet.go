@@ -3,8 +3,8 @@ package main
 import (
 	"encoding/hex"
 	"fmt"
-	"log"
 	"sort"
+	"sync"
 
 	"github.com/btcsuite/btcd/btcjson"
 	"github.com/btcsuite/btcd/rpcclient"
@@ -12,7 +12,10 @@ import (
 )
 
 var (
-	unspentUtxo *btcjson.ListUnspentResult
+	// fundingReservations maps the wallet coins funding our replacements to their battle,
+	// so concurrent battles never spend the same coin
+	fundingReservations   = make(map[string]*TrackedUTXO)
+	fundingReservationsMu sync.Mutex
 
 	errNoUsableUtxo = fmt.Errorf("no usable utxo in wallet. make sure that the correct wallet is loaded and that you have at least one confirmed utxo with value between %f BTC and %f BTC", lowestValueUtxo, highestValueUtxo)
 )
@@ -22,51 +25,119 @@ const (
 	lowestValueUtxo  = 0.00001000
 )
 
-// selectUnspentUtxo selects the smallest spendable utxo.
+// selectUnspentUtxo selects the smallest spendable utxo that no battle has reserved.
 //
 // We need to select a confirmed utxo because of RBF rule #2
 // > The replacement transaction only include an unconfirmed input if that input was included in one of the directly conflicting transactions.
 //
 // https://github.com/bitcoin/bitcoin/blob/master/doc/policy/mempool-replacements.md
 func selectUnspentUtxo(client *rpcclient.Client) (btcjson.ListUnspentResult, error) {
-	if unspentUtxo != nil {
-		return *unspentUtxo, nil
-	}
-
 	unspent, err := client.ListUnspentMin(1)
-
-	if len(unspent) == 0 {
-		return btcjson.ListUnspentResult{}, errNoUsableUtxo
-	}
-
 	if err != nil {
 		return btcjson.ListUnspentResult{}, err
 	}
+	return pickUnspentUtxo(unspent)
+}
 
+// pickUnspentUtxo picks the smallest spendable utxo of the wallet coins that no battle has reserved
+func pickUnspentUtxo(unspent []btcjson.ListUnspentResult) (btcjson.ListUnspentResult, error) {
 	// Pick the lowest value utxo first
 	sort.Slice(unspent, func(i, j int) bool {
 		return unspent[i].Amount < unspent[j].Amount
 	})
 
+	fundingReservationsMu.Lock()
+	defer fundingReservationsMu.Unlock()
+
 	for _, utxo := range unspent {
+		if _, reserved := fundingReservations[fundingID(utxo)]; reserved {
+			continue
+		}
 		if utxo.Spendable && utxo.Amount < highestValueUtxo && utxo.Amount > lowestValueUtxo {
-			unspentUtxo = &utxo
-			break
+			return utxo, nil
 		}
 	}
 
-	if unspentUtxo == nil {
-		return btcjson.ListUnspentResult{}, errNoUsableUtxo
+	return btcjson.ListUnspentResult{}, errNoUsableUtxo
+}
+
+// reserveFunding returns the wallet coin funding the replacements of a battle,
+// reserving one on the first call
+func reserveFunding(client *rpcclient.Client, battle *TrackedUTXO) (btcjson.ListUnspentResult, error) {
+	return reserveFundingFrom(client, battle, nil)
+}
+
+// reserveFundingFrom reserves like reserveFunding, picking from unspent when the wallet coins
+// were listed already
+func reserveFundingFrom(client *rpcclient.Client, battle *TrackedUTXO, unspent []btcjson.ListUnspentResult) (btcjson.ListUnspentResult, error) {
+	battle.mu.Lock()
+	funding := battle.Funding
+	battle.mu.Unlock()
+	if funding != nil {
+		return *funding, nil
+	}
+
+	var utxo btcjson.ListUnspentResult
+	var err error
+	if unspent != nil {
+		utxo, err = pickUnspentUtxo(unspent)
+	} else {
+		utxo, err = selectUnspentUtxo(client)
 	}
+	if err != nil {
+		return btcjson.ListUnspentResult{}, err
+	}
+
+	fundingReservationsMu.Lock()
+	battle.mu.Lock()
+	if battle.Funding != nil {
+		// A concurrent call reserved a coin for the battle first
+		funding := *battle.Funding
+		battle.mu.Unlock()
+		fundingReservationsMu.Unlock()
+		return funding, nil
+	}
+	if _, reserved := fundingReservations[fundingID(utxo)]; reserved {
+		// Another battle took it in the meantime
+		battle.mu.Unlock()
+		fundingReservationsMu.Unlock()
+		return reserveFunding(client, battle)
+	}
+	fundingReservations[fundingID(utxo)] = battle
+	battle.Funding = &utxo
+	battle.mu.Unlock()
+	fundingReservationsMu.Unlock()
+
+	bus.Publish(FundingCoinChanged{Battle: battle, Coin: &utxo})
 
-	script, err := hex.DecodeString(unspentUtxo.ScriptPubKey)
+	script, err := hex.DecodeString(utxo.ScriptPubKey)
 	if err != nil {
 		return btcjson.ListUnspentResult{}, err
 	}
 
-	scriptClass := txscript.GetScriptClass(script)
+	battle.logger().Info("Reserved wallet utxo", "funding", fundingID(utxo), "amount", utxo.Amount, "class", txscript.GetScriptClass(script))
 
-	log.Printf("Selected utxo: %s:%d, %f BTC (%s)", unspentUtxo.TxID, unspentUtxo.Vout, unspentUtxo.Amount, scriptClass.String())
+	return utxo, nil
+}
+
+// releaseFunding frees the wallet coin reserved by a battle
+func releaseFunding(battle *TrackedUTXO) {
+	battle.mu.Lock()
+	funding := battle.Funding
+	battle.Funding = nil
+	battle.mu.Unlock()
+
+	if funding == nil {
+		return
+	}
+
+	fundingReservationsMu.Lock()
+	delete(fundingReservations, fundingID(*funding))
+	fundingReservationsMu.Unlock()
+
+	bus.Publish(FundingCoinChanged{Battle: battle})
+}
 
-	return *unspentUtxo, nil
+func fundingID(utxo btcjson.ListUnspentResult) string {
+	return fmt.Sprintf("%s:%d", utxo.TxID, utxo.Vout)
 }
@@ -1,96 +1,128 @@
 package main
 
 import (
+	"bytes"
 	"encoding/hex"
 	"fmt"
-	"log"
+	"log/slog"
+	"time"
 
-	"github.com/btcsuite/btcd/chaincfg/chainhash"
 	"github.com/btcsuite/btcd/rpcclient"
-	"github.com/pebbe/zmq4"
+	"github.com/btcsuite/btcd/wire"
 )
 
+// zmqSubscriber is a ZMQ SUB socket. The default build uses libzmq through cgo,
+// the zmqpure build tag a ZMTP implementation in Go.
+type zmqSubscriber interface {
+	// Subscribe receives the messages whose first part starts with topic
+	Subscribe(topic string) error
+	// SetRecvTimeout makes Recv fail after waiting timeout for a message
+	SetRecvTimeout(timeout time.Duration) error
+	// Recv returns the parts of the next message
+	Recv() ([][]byte, error)
+	Close() error
+}
+
+// zmqPublisher is a ZMQ PUB socket, used by the mock and replay nodes
+type zmqPublisher interface {
+	// Endpoint is the address the publisher is bound to, with the actual port
+	Endpoint() string
+	Publish(parts ...[]byte) error
+	Close() error
+}
+
 // monitorMempoolWithZMQ subscribes to ZeroMQ notifications for new transactions
 func monitorMempoolWithZMQ(client *rpcclient.Client, config *Config) {
-	log.Println("Starting ZeroMQ mempool monitoring...")
+	slog.Info("Starting ZeroMQ mempool monitoring")
 
-	// Initialize ZMQ context and subscriber
-	context, err := zmq4.NewContext()
-	if err != nil {
-		log.Fatalf("Failed to create ZMQ context: %v", err)
+	if err := watchMempool(client, config.ZMQ, primaryNode, rawTransactionQueue); err != nil {
+		fatal("Failed to monitor mempool", "endpoint", config.ZMQ, "err", err)
 	}
-	defer context.Term()
+}
 
-	subscriber, err := context.NewSocket(zmq4.SUB)
+// watchMempool queues the transactions and blocks announced over ZMQ by a node, whose
+// client describes the transactions the pipeline can't tell from their raw form
+func watchMempool(client *rpcclient.Client, endpoint string, node string, queue chan<- queuedTx) error {
+	// Connect to the ZMQ endpoint
+	subscriber, err := newZMQSubscriber(endpoint)
 	if err != nil {
-		log.Fatalf("Failed to create ZMQ subscriber socket: %v", err)
+		return fmt.Errorf("error connecting to ZMQ endpoint: %v", err)
 	}
 	defer subscriber.Close()
 
-	// Connect to the ZMQ endpoint
-	if err := subscriber.Connect(config.ZMQ); err != nil {
-		log.Fatalf("Failed to connect to ZMQ endpoint %s: %v", config.ZMQ, err)
-	}
-
-	// Subscribe to transaction topics
-	// "hashtx" for transaction hashes
-	// if err := subscriber.SetSubscribe("rawtx"); err != nil {
-	// 	log.Fatalf("Failed to subscribe to rawtx topic: %v", err)
-	// }
-
-	if err := subscriber.SetSubscribe("hashtx"); err != nil {
-		log.Fatalf("Failed to subscribe to hashtx topic: %v", err)
+	// Transactions come raw so the filter stage can drop the ones that don't concern us
+	// without asking the node. Blocks come raw too and confirm the transactions in them.
+	for _, topic := range []string{"rawtx", "rawblock"} {
+		if err := subscriber.Subscribe(topic); err != nil {
+			return fmt.Errorf("error subscribing to %s topic: %v", topic, err)
+		}
 	}
 
-	log.Printf("Successfully subscribed to ZMQ endpoint %s", config.ZMQ)
+	slog.Info("Successfully subscribed to ZMQ endpoint", "endpoint", endpoint, "node", node)
 
 	// Process incoming messages
 	for {
 		// Receive multipart message (topic, body, ...)
-		msgs, err := subscriber.RecvMessageBytes(0)
+		msgs, err := subscriber.Recv()
+		seenAt := time.Now()
 		if err != nil {
-			log.Printf("Error receiving ZMQ message: %v", err)
+			slog.Error("Error receiving ZMQ message", "err", err)
 			continue
 		}
 
 		if len(msgs) < 2 {
-			log.Printf("Received incomplete ZMQ message")
+			slog.Warn("Received incomplete ZMQ message")
 			continue
 		}
 
-		topic := string(msgs[0])
-		body := msgs[1]
-
-		// Process based on topic
-		switch topic {
-		case "rawtx":
-			decoded, err := client.DecodeRawTransaction(body)
-			fmt.Println("rawtx", decoded)
-			if err != nil {
-				log.Printf("Error decoding raw transaction: %v", err)
-				continue
-			}
-			rawTransactionQueue <- decoded
-		case "hashtx":
-			// For hashtx, we receive the transaction hash and need to fetch the full transaction
-			txid := hex.EncodeToString(body)
-			txHash, err := chainhash.NewHashFromStr(txid)
-			if err != nil {
-				log.Printf("Error parsing transaction hash from hashtx: %v", err)
-				continue
+		// Sequence numbers and captures are for the primary node only
+		if node == primaryNode {
+			if capture != nil {
+				capture.recordZMQ(msgs)
 			}
+			observeZMQ(msgs)
+		}
 
-			// Get the full transaction details
-			tx, err := client.GetRawTransactionVerbose(txHash)
-			if err != nil {
-				// For our own transactions this is gonna fail as zmq sends the hashtx event before it's available in our local mempool
-				log.Printf("Error getting transaction %s: %v", txid, err)
-				continue
-			}
+		for _, queued := range zmqQueuedTxs(msgs, seenAt, node, client) {
+			queue <- queued
+		}
+	}
+}
+
+// zmqQueuedTxs makes the transactions announced by a ZMQ message ready for the pipeline
+func zmqQueuedTxs(msgs [][]byte, seenAt time.Time, node string, client *rpcclient.Client) []queuedTx {
+	topic := string(msgs[0])
+	body := msgs[1]
 
-			rawTransactionQueue <- tx
-		default:
-			log.Printf("Received unknown ZMQ topic: %s", topic)
+	// Process based on topic
+	switch topic {
+	case "rawtx":
+		// Decoded here, the filter stage matches it without asking the node. The transactions
+		// of a block are announced again before the block, so client can tell payments to
+		// us that are confirmed already.
+		tx := wire.NewMsgTx(wire.TxVersion)
+		if err := tx.Deserialize(bytes.NewReader(body)); err != nil {
+			slog.Error("Error decoding raw transaction", "err", err)
+			return nil
+		}
+		return []queuedTx{{msg: tx, seenAt: seenAt, node: node, client: client}}
+	case "rawblock":
+		var block wire.MsgBlock
+		if err := block.Deserialize(bytes.NewReader(body)); err != nil {
+			slog.Error("Error decoding raw block", "err", err)
+			return nil
+		}
+		blockHash := block.BlockHash().String()
+		queued := make([]queuedTx, 0, len(block.Transactions))
+		for _, tx := range block.Transactions {
+			queued = append(queued, queuedTx{msg: tx, seenAt: seenAt, node: node, confirmations: 1, blockHash: blockHash})
 		}
+		return queued
+	case "hashtx":
+		// Captures from before rawtx was used announce by txid, and the enrich stage fetches the full transaction
+		return []queuedTx{{txid: hex.EncodeToString(body), seenAt: seenAt, node: node, client: client}}
+	default:
+		slog.Warn("Received unknown ZMQ topic", "topic", topic)
+		return nil
 	}
 }
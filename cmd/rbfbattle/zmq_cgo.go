@@ -0,0 +1,92 @@
+//go:build !zmqpure
+
+package main
+
+import (
+	"time"
+
+	"github.com/pebbe/zmq4"
+)
+
+// cgoSubscriber is a SUB socket of libzmq
+type cgoSubscriber struct {
+	context *zmq4.Context
+	socket  *zmq4.Socket
+}
+
+// newZMQSubscriber connects a libzmq SUB socket to endpoint
+func newZMQSubscriber(endpoint string) (zmqSubscriber, error) {
+	context, err := zmq4.NewContext()
+	if err != nil {
+		return nil, err
+	}
+	socket, err := context.NewSocket(zmq4.SUB)
+	if err != nil {
+		context.Term()
+		return nil, err
+	}
+	if err := socket.Connect(endpoint); err != nil {
+		socket.Close()
+		context.Term()
+		return nil, err
+	}
+	return &cgoSubscriber{context: context, socket: socket}, nil
+}
+
+func (s *cgoSubscriber) Subscribe(topic string) error {
+	return s.socket.SetSubscribe(topic)
+}
+
+func (s *cgoSubscriber) SetRecvTimeout(timeout time.Duration) error {
+	return s.socket.SetRcvtimeo(timeout)
+}
+
+func (s *cgoSubscriber) Recv() ([][]byte, error) {
+	return s.socket.RecvMessageBytes(0)
+}
+
+func (s *cgoSubscriber) Close() error {
+	s.socket.Close()
+	return s.context.Term()
+}
+
+// cgoPublisher is a PUB socket of libzmq
+type cgoPublisher struct {
+	socket   *zmq4.Socket
+	endpoint string
+}
+
+// newZMQPublisher binds a libzmq PUB socket to endpoint
+func newZMQPublisher(endpoint string) (zmqPublisher, error) {
+	socket, err := zmq4.NewSocket(zmq4.PUB)
+	if err != nil {
+		return nil, err
+	}
+	if err := socket.Bind(endpoint); err != nil {
+		socket.Close()
+		return nil, err
+	}
+	bound, err := socket.GetLastEndpoint()
+	if err != nil {
+		socket.Close()
+		return nil, err
+	}
+	return &cgoPublisher{socket: socket, endpoint: bound}, nil
+}
+
+func (p *cgoPublisher) Endpoint() string {
+	return p.endpoint
+}
+
+func (p *cgoPublisher) Publish(parts ...[]byte) error {
+	message := make([]interface{}, len(parts))
+	for i, part := range parts {
+		message[i] = part
+	}
+	_, err := p.socket.SendMessage(message...)
+	return err
+}
+
+func (p *cgoPublisher) Close() error {
+	return p.socket.Close()
+}
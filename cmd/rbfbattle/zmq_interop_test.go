@@ -0,0 +1,103 @@
+//go:build zmqpure && libzmq
+
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/pebbe/zmq4"
+)
+
+// These tests need libzmq, so they only run with -tags 'zmqpure libzmq'. A libzmq socket talks
+// to a ZMTP one of the zmqpure build on each side.
+
+func TestInteropSubscriberWithLibzmq(t *testing.T) {
+	publisher, err := zmq4.NewSocket(zmq4.PUB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer publisher.Close()
+	if err := publisher.Bind("tcp://127.0.0.1:*"); err != nil {
+		t.Fatal(err)
+	}
+	endpoint, err := publisher.GetLastEndpoint()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	subscriber, err := newZMQSubscriber(endpoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer subscriber.Close()
+	if err := subscriber.Subscribe("hashtx"); err != nil {
+		t.Fatal(err)
+	}
+	subscriber.SetRecvTimeout(100 * time.Millisecond)
+
+	// Messages published before the subscription reached the publisher are lost, so keep publishing
+	want := [][]byte{[]byte("hashtx"), bytes.Repeat([]byte{0xab}, 32), {1, 0, 0, 0}}
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if _, err := publisher.SendMessage("rawtx", []byte{1}, []byte{0, 0, 0, 0}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := publisher.SendMessage(want); err != nil {
+			t.Fatal(err)
+		}
+
+		msg, err := subscriber.Recv()
+		if err != nil {
+			continue
+		}
+		if len(msg) != len(want) || !bytes.Equal(msg[0], want[0]) || !bytes.Equal(msg[1], want[1]) || !bytes.Equal(msg[2], want[2]) {
+			t.Fatalf("expected %x, got %x", want, msg)
+		}
+		return
+	}
+	t.Fatal("timed out waiting for a message from libzmq")
+}
+
+func TestInteropPublisherWithLibzmq(t *testing.T) {
+	publisher, err := newZMQPublisher("tcp://127.0.0.1:*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer publisher.Close()
+
+	subscriber, err := zmq4.NewSocket(zmq4.SUB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer subscriber.Close()
+	if err := subscriber.Connect(publisher.Endpoint()); err != nil {
+		t.Fatal(err)
+	}
+	if err := subscriber.SetSubscribe("hashtx"); err != nil {
+		t.Fatal(err)
+	}
+	subscriber.SetRcvtimeo(100 * time.Millisecond)
+
+	want := [][]byte{[]byte("hashtx"), bytes.Repeat([]byte{0xcd}, 32), {2, 0, 0, 0}}
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if err := publisher.Publish([]byte("rawtx"), []byte{1}, []byte{0, 0, 0, 0}); err != nil {
+			t.Fatal(err)
+		}
+		if err := publisher.Publish(want...); err != nil {
+			t.Fatal(err)
+		}
+
+		msg, err := subscriber.RecvMessageBytes(0)
+		if err != nil {
+			continue
+		}
+		if len(msg) != len(want) || !bytes.Equal(msg[0], want[0]) || !bytes.Equal(msg[1], want[1]) || !bytes.Equal(msg[2], want[2]) {
+			t.Fatalf("expected %x, got %x", want, msg)
+		}
+		return
+	}
+	t.Fatal("timed out waiting for a message from the ZMTP publisher")
+}
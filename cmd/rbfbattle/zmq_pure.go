@@ -0,0 +1,482 @@
+//go:build zmqpure
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// This file implements the PUB and SUB sockets over ZMTP 3 with the NULL mechanism, which is
+// all bitcoind's notifications need, so the zmqpure build doesn't link libzmq.
+// See https://rfc.zeromq.org/spec/23/ and https://rfc.zeromq.org/spec/37/
+
+const (
+	zmtpFlagMore    = 0x01
+	zmtpFlagLong    = 0x02
+	zmtpFlagCommand = 0x04
+
+	// zmtpMaxFrameSize bounds the frames we accept, rawblock notifications being the largest
+	zmtpMaxFrameSize = 32 << 20
+	// zmtpQueueSize is the number of received messages buffered, like libzmq's default high water mark
+	zmtpQueueSize     = 1000
+	zmtpRetryInterval = 100 * time.Millisecond
+)
+
+var (
+	errZMQTimeout = errors.New("resource temporarily unavailable")
+	errZMQClosed  = errors.New("socket closed")
+)
+
+// zmtpGreeting returns our greeting. We speak ZMTP 3.0, where subscriptions are messages,
+// which ZMTP 3.1 peers accept too.
+func zmtpGreeting() []byte {
+	greeting := make([]byte, 64)
+	greeting[0] = 0xff
+	greeting[9] = 0x7f
+	greeting[10] = 3
+	greeting[11] = 0
+	copy(greeting[12:32], "NULL")
+	return greeting
+}
+
+// zmtpHandshake exchanges greetings and READY commands with a peer
+func zmtpHandshake(conn net.Conn, reader *bufio.Reader, socketType string) error {
+	if _, err := conn.Write(zmtpGreeting()); err != nil {
+		return err
+	}
+
+	greeting := make([]byte, 64)
+	if _, err := io.ReadFull(reader, greeting); err != nil {
+		return err
+	}
+	if greeting[0] != 0xff || greeting[9] != 0x7f {
+		return fmt.Errorf("peer is not speaking ZMTP")
+	}
+	if greeting[10] < 3 {
+		return fmt.Errorf("unsupported ZMTP version %d.%d", greeting[10], greeting[11])
+	}
+	if mechanism := string(bytes.TrimRight(greeting[12:32], "\x00")); mechanism != "NULL" {
+		return fmt.Errorf("unsupported ZMTP mechanism %s", mechanism)
+	}
+
+	ready := []byte("\x05READY\x0bSocket-Type")
+	ready = binary.BigEndian.AppendUint32(ready, uint32(len(socketType)))
+	ready = append(ready, socketType...)
+	if err := writeZMTPFrames(conn, zmtpFlagCommand, ready); err != nil {
+		return err
+	}
+
+	flags, body, err := readZMTPFrame(reader)
+	if err != nil {
+		return err
+	}
+	if flags&zmtpFlagCommand == 0 || !bytes.HasPrefix(body, []byte("\x05READY")) {
+		return fmt.Errorf("expected READY from ZMTP peer")
+	}
+	return nil
+}
+
+// writeZMTPFrames writes the parts of a message, or a command, in a single write
+func writeZMTPFrames(w io.Writer, flags byte, parts ...[]byte) error {
+	var buf bytes.Buffer
+	for i, part := range parts {
+		frameFlags := flags
+		if i < len(parts)-1 {
+			frameFlags |= zmtpFlagMore
+		}
+		if len(part) > 255 {
+			buf.WriteByte(frameFlags | zmtpFlagLong)
+			buf.Write(binary.BigEndian.AppendUint64(nil, uint64(len(part))))
+		} else {
+			buf.WriteByte(frameFlags)
+			buf.WriteByte(byte(len(part)))
+		}
+		buf.Write(part)
+	}
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+func readZMTPFrame(r *bufio.Reader) (byte, []byte, error) {
+	flags, err := r.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+
+	var size uint64
+	if flags&zmtpFlagLong != 0 {
+		var long [8]byte
+		if _, err := io.ReadFull(r, long[:]); err != nil {
+			return 0, nil, err
+		}
+		size = binary.BigEndian.Uint64(long[:])
+	} else {
+		short, err := r.ReadByte()
+		if err != nil {
+			return 0, nil, err
+		}
+		size = uint64(short)
+	}
+	if size > zmtpMaxFrameSize {
+		return 0, nil, fmt.Errorf("ZMTP frame of %d bytes is too large", size)
+	}
+
+	body := make([]byte, size)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return 0, nil, err
+	}
+	return flags, body, nil
+}
+
+// readZMTPMessage returns the parts of the next message, or the next command
+func readZMTPMessage(r *bufio.Reader) (parts [][]byte, command []byte, err error) {
+	for {
+		flags, body, err := readZMTPFrame(r)
+		if err != nil {
+			return nil, nil, err
+		}
+		if flags&zmtpFlagCommand != 0 {
+			return nil, body, nil
+		}
+		parts = append(parts, body)
+		if flags&zmtpFlagMore == 0 {
+			return parts, nil, nil
+		}
+	}
+}
+
+// answerZMTPCommand answers heartbeats, which libzmq sends when configured to
+func answerZMTPCommand(conn net.Conn, command []byte) error {
+	if !bytes.HasPrefix(command, []byte("\x04PING")) || len(command) < 7 {
+		return nil
+	}
+	pong := append([]byte("\x04PONG"), command[7:]...)
+	return writeZMTPFrames(conn, zmtpFlagCommand, pong)
+}
+
+// tcpEndpoint returns the host:port of a tcp:// endpoint
+func tcpEndpoint(endpoint string) (string, error) {
+	addr, ok := strings.CutPrefix(endpoint, "tcp://")
+	if !ok {
+		return "", fmt.Errorf("unsupported ZMQ endpoint %s, only tcp:// is supported", endpoint)
+	}
+	return addr, nil
+}
+
+// zmtpSubscriber is a SUB socket. Like libzmq it connects in the background and
+// reconnects when the publisher goes away.
+type zmtpSubscriber struct {
+	endpoint string
+	messages chan [][]byte
+	closed   chan struct{}
+
+	mu      sync.Mutex
+	conn    net.Conn
+	topics  []string
+	timeout time.Duration
+}
+
+// newZMQSubscriber connects a SUB socket to endpoint
+func newZMQSubscriber(endpoint string) (zmqSubscriber, error) {
+	addr, err := tcpEndpoint(endpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &zmtpSubscriber{
+		endpoint: endpoint,
+		messages: make(chan [][]byte, zmtpQueueSize),
+		closed:   make(chan struct{}),
+		timeout:  -1,
+	}
+	go s.run(addr)
+	return s, nil
+}
+
+func (s *zmtpSubscriber) run(addr string) {
+	for {
+		err := s.receive(addr)
+
+		select {
+		case <-s.closed:
+			return
+		case <-time.After(zmtpRetryInterval):
+			slog.Debug("Reconnecting to ZMQ endpoint", "endpoint", s.endpoint, "err", err)
+		}
+	}
+}
+
+// receive queues the messages of a single connection to the publisher
+func (s *zmtpSubscriber) receive(addr string) error {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	reader := bufio.NewReader(conn)
+	if err := zmtpHandshake(conn, reader, "SUB"); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	select {
+	case <-s.closed:
+		s.mu.Unlock()
+		return errZMQClosed
+	default:
+	}
+	for _, topic := range s.topics {
+		if err := writeZMTPFrames(conn, 0, append([]byte{1}, topic...)); err != nil {
+			s.mu.Unlock()
+			return err
+		}
+	}
+	s.conn = conn
+	s.mu.Unlock()
+
+	defer func() {
+		s.mu.Lock()
+		s.conn = nil
+		s.mu.Unlock()
+	}()
+
+	for {
+		parts, command, err := readZMTPMessage(reader)
+		if err != nil {
+			return err
+		}
+		if command != nil {
+			s.mu.Lock()
+			err := answerZMTPCommand(conn, command)
+			s.mu.Unlock()
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		select {
+		case s.messages <- parts:
+		case <-s.closed:
+			return errZMQClosed
+		}
+	}
+}
+
+func (s *zmtpSubscriber) Subscribe(topic string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.topics = append(s.topics, topic)
+	if s.conn == nil {
+		// Sent once connected
+		return nil
+	}
+	return writeZMTPFrames(s.conn, 0, append([]byte{1}, topic...))
+}
+
+func (s *zmtpSubscriber) SetRecvTimeout(timeout time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.timeout = timeout
+	return nil
+}
+
+func (s *zmtpSubscriber) Recv() ([][]byte, error) {
+	s.mu.Lock()
+	timeout := s.timeout
+	s.mu.Unlock()
+
+	var expired <-chan time.Time
+	if timeout >= 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+
+	select {
+	case parts := <-s.messages:
+		return parts, nil
+	case <-expired:
+		return nil, errZMQTimeout
+	case <-s.closed:
+		return nil, errZMQClosed
+	}
+}
+
+func (s *zmtpSubscriber) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	select {
+	case <-s.closed:
+		return nil
+	default:
+	}
+	close(s.closed)
+	if s.conn != nil {
+		s.conn.Close()
+	}
+	return nil
+}
+
+// zmtpPublisher is a PUB socket sending every message to the subscribers of its topic
+type zmtpPublisher struct {
+	listener net.Listener
+
+	mu          sync.Mutex
+	subscribers map[*zmtpPeer]struct{}
+}
+
+// zmtpPeer is a subscriber connected to a zmtpPublisher
+type zmtpPeer struct {
+	conn net.Conn
+
+	mu     sync.Mutex
+	topics map[string]int
+}
+
+// newZMQPublisher binds a PUB socket to endpoint. As with libzmq, a * port binds a random port.
+func newZMQPublisher(endpoint string) (zmqPublisher, error) {
+	addr, err := tcpEndpoint(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if host, port, err := net.SplitHostPort(addr); err == nil && port == "*" {
+		addr = net.JoinHostPort(host, "0")
+	}
+
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &zmtpPublisher{listener: listener, subscribers: make(map[*zmtpPeer]struct{})}
+	go p.accept()
+	return p, nil
+}
+
+func (p *zmtpPublisher) accept() {
+	for {
+		conn, err := p.listener.Accept()
+		if err != nil {
+			return
+		}
+		go p.serve(conn)
+	}
+}
+
+// serve tracks the subscriptions of a subscriber until it disconnects
+func (p *zmtpPublisher) serve(conn net.Conn) {
+	defer conn.Close()
+
+	reader := bufio.NewReader(conn)
+	if err := zmtpHandshake(conn, reader, "PUB"); err != nil {
+		return
+	}
+
+	peer := &zmtpPeer{conn: conn, topics: make(map[string]int)}
+	p.mu.Lock()
+	p.subscribers[peer] = struct{}{}
+	p.mu.Unlock()
+
+	defer func() {
+		p.mu.Lock()
+		delete(p.subscribers, peer)
+		p.mu.Unlock()
+	}()
+
+	for {
+		parts, command, err := readZMTPMessage(reader)
+		if err != nil {
+			return
+		}
+
+		switch {
+		// ZMTP 3.0 subscriptions are messages starting with 1, cancellations with 0
+		case len(parts) == 1 && len(parts[0]) > 0:
+			peer.subscribe(string(parts[0][1:]), parts[0][0] == 1)
+		// ZMTP 3.1 has commands for them
+		case bytes.HasPrefix(command, []byte("\x09SUBSCRIBE")):
+			peer.subscribe(string(command[10:]), true)
+		case bytes.HasPrefix(command, []byte("\x06CANCEL")):
+			peer.subscribe(string(command[7:]), false)
+		case command != nil:
+			peer.mu.Lock()
+			err := answerZMTPCommand(conn, command)
+			peer.mu.Unlock()
+			if err != nil {
+				return
+			}
+		}
+	}
+}
+
+func (peer *zmtpPeer) subscribe(topic string, subscribe bool) {
+	peer.mu.Lock()
+	defer peer.mu.Unlock()
+
+	if subscribe {
+		peer.topics[topic]++
+	} else if peer.topics[topic] > 1 {
+		peer.topics[topic]--
+	} else {
+		delete(peer.topics, topic)
+	}
+}
+
+// send writes the message if the peer subscribed to its topic
+func (peer *zmtpPeer) send(parts [][]byte) {
+	peer.mu.Lock()
+	defer peer.mu.Unlock()
+
+	for topic := range peer.topics {
+		if bytes.HasPrefix(parts[0], []byte(topic)) {
+			if err := writeZMTPFrames(peer.conn, 0, parts...); err != nil {
+				peer.conn.Close()
+			}
+			return
+		}
+	}
+}
+
+func (p *zmtpPublisher) Endpoint() string {
+	return "tcp://" + p.listener.Addr().String()
+}
+
+func (p *zmtpPublisher) Publish(parts ...[]byte) error {
+	if len(parts) == 0 {
+		return fmt.Errorf("empty message")
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for peer := range p.subscribers {
+		peer.send(parts)
+	}
+	return nil
+}
+
+func (p *zmtpPublisher) Close() error {
+	err := p.listener.Close()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for peer := range p.subscribers {
+		peer.conn.Close()
+	}
+	return err
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+// Run with -tags zmqpure to test the ZMTP implementation instead of libzmq
+
+func TestZMQSubscriber(t *testing.T) {
+	publisher, err := newZMQPublisher("tcp://127.0.0.1:*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer publisher.Close()
+
+	subscriber, err := newZMQSubscriber(publisher.Endpoint())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer subscriber.Close()
+
+	if err := subscriber.Subscribe("hashtx"); err != nil {
+		t.Fatal(err)
+	}
+	if err := subscriber.SetRecvTimeout(50 * time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+
+	// Long enough for a frame with a 64-bit size
+	body := bytes.Repeat([]byte{0xab}, 1000)
+	seq := []byte{1, 0, 0, 0}
+
+	// Subscriptions reach the publisher asynchronously, so publish until one arrives
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for a message")
+		}
+		publisher.Publish([]byte("rawtx"), []byte{0x01})
+		publisher.Publish([]byte("hashtx"), body, seq)
+
+		msgs, err := subscriber.Recv()
+		if err != nil {
+			continue
+		}
+		if len(msgs) != 3 || string(msgs[0]) != "hashtx" || !bytes.Equal(msgs[1], body) || !bytes.Equal(msgs[2], seq) {
+			t.Fatalf("unexpected message %x", msgs)
+		}
+		break
+	}
+}
+
+func TestZMQSubscriberTimeout(t *testing.T) {
+	publisher, err := newZMQPublisher("tcp://127.0.0.1:*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer publisher.Close()
+
+	subscriber, err := newZMQSubscriber(publisher.Endpoint())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer subscriber.Close()
+
+	subscriber.Subscribe("hashtx")
+	subscriber.SetRecvTimeout(50 * time.Millisecond)
+
+	start := time.Now()
+	if _, err := subscriber.Recv(); err == nil {
+		t.Fatal("expected a timeout without messages")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("expected Recv to give up after the timeout, waited %v", elapsed)
+	}
+}